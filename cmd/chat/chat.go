@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 
-	"github.com/ollama/ollama/api"
-	"github.com/webbben/mail-assistant/internal/llama"
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llm"
 	"github.com/webbben/mail-assistant/internal/util"
 )
 
@@ -14,22 +16,30 @@ func main() {
 	system := flag.String("system", "", "provide a system prompt to define the context of the chat. e.g. -system=\"You are an old timey detective investigating a murder case, and you are subtly suspicious of me\"")
 	flag.Parse()
 
-	cmd, err := llama.StartServer()
+	config, err := config.LoadConfig()
 	if err != nil {
-		fmt.Println("Failed to start ollama server:", err)
+		fmt.Println("failed to load configuration:", err)
 		os.Exit(1)
 	}
-	defer llama.StopServer(cmd)
 
-	client, err := llama.GetClient()
+	if config.LLM.Provider == "" || config.LLM.Provider == llm.OLLAMA {
+		server, err := llm.StartOllama(context.Background(), config.LLM)
+		if err != nil {
+			fmt.Println("Failed to start ollama server:", err)
+			os.Exit(1)
+		}
+		defer server.Stop()
+	}
+
+	provider, err := llm.NewProvider(config)
 	if err != nil {
-		fmt.Println("Failed to get ollama client:", err)
+		fmt.Println("Failed to get llm provider:", err)
 		os.Exit(1)
 	}
 
-	messages := []api.Message{}
+	messages := []llm.Message{}
 	if *system != "" {
-		messages = append(messages, api.Message{
+		messages = append(messages, llm.Message{
 			Role:    "system",
 			Content: *system,
 		})
@@ -40,15 +50,26 @@ func main() {
 		if util.IsQuit(input) {
 			return
 		}
-		messages = append(messages, api.Message{
+		messages = append(messages, llm.Message{
 			Role:    "user",
 			Content: input,
 		})
-		messages, err = llama.ChatCompletion(client, messages)
+		// Ctrl-C while the bot is talking only cancels that reply
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		talk := util.NewTalkStream("Bot", util.Hi_blue)
+		out, err := provider.ChatStream(ctx, messages, talk.Write)
+		talk.End()
+		interrupted := ctx.Err() != nil
+		stop()
+		if interrupted {
+			messages = messages[:len(messages)-1]
+			util.SomeoneTalks("SYS", "(interrupted)", util.Gray)
+			continue
+		}
 		if err != nil {
 			fmt.Println("error doing chat completion:", err)
 			return
 		}
-		util.SomeoneTalks("Bot", messages[len(messages)-1].Content, util.Hi_blue)
+		messages = out
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/assistant"
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	"github.com/webbben/mail-assistant/internal/personality"
+)
+
+func main() {
+	request := flag.String("m", "", "describe the email to write. e.g. -m=\"write to Tim that I'll be late Thursday\" (default: the assistant asks)")
+	flag.Parse()
+
+	config, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("failed to load configuration:", err)
+		os.Exit(1)
+	}
+
+	if config.LLM.Provider == "" || config.LLM.Provider == llm.OLLAMA {
+		server, err := llm.StartOllama(context.Background(), config.LLM)
+		if err != nil {
+			fmt.Println("Failed to start ollama server:", err)
+			os.Exit(1)
+		}
+		defer server.Stop()
+	}
+
+	provider, err := llm.NewProvider(config)
+	if err != nil {
+		fmt.Println("Failed to get llm provider:", err)
+		os.Exit(1)
+	}
+
+	mb, err := mailbox.New(config)
+	if err != nil {
+		fmt.Println("failed to set up mailbox:", err)
+		os.Exit(1)
+	}
+
+	p, err := personality.Load(config.PersonalityID)
+	if err != nil {
+		fmt.Println("failed to load personality file:", err)
+		os.Exit(1)
+	}
+	bytes, err := os.ReadFile("prompts/" + p.Prompts.Compose + ".txt")
+	if err != nil {
+		fmt.Println("error reading prompt file:", err)
+		os.Exit(1)
+	}
+
+	// past correspondents are loaded with the cache, to find who the email is for
+	if err := emailcache.LoadCacheFromDisk(); err != nil {
+		fmt.Println("failed to load cache; recipients will need to be entered by address:", err)
+	}
+
+	if err := assistant.Compose(context.Background(), mb, provider, config, p, strings.TrimSpace(string(bytes)), *request); err != nil {
+		fmt.Println("failed to compose email:", err)
+		os.Exit(1)
+	}
+}
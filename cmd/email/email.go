@@ -1,45 +1,57 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 
-	"github.com/webbben/mail-assistant/internal/auth"
 	"github.com/webbben/mail-assistant/internal/config"
 	"github.com/webbben/mail-assistant/internal/gmail"
+	"github.com/webbben/mail-assistant/internal/mailbox"
 	"github.com/webbben/mail-assistant/internal/util"
 )
 
 func main() {
 	list := flag.Bool("list", false, "list the email IDs found in the inbox")
 	id := flag.String("id", "", "specify a specific email ID to analyze the email")
+	query := flag.String("q", "", "gmail search query for the emails to list (default: the assistant's query, based on the config). gmail only")
+	limit := flag.Int("limit", 0, "limit on the number of emails to list (default: the configured list limit)")
 	flag.Parse()
 
-	srv := auth.GetGmailService()
 	config, err := config.LoadConfig()
 	if err != nil {
 		fmt.Println("failed to load configuration:", err)
 		os.Exit(1)
 	}
+	mb, err := mailbox.New(config)
+	if err != nil {
+		fmt.Println("failed to set up mailbox:", err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
 
 	if *list == true {
 		if *id != "" {
 			fmt.Println("Can't specify id flag if using list flag")
 			os.Exit(1)
 		}
-		messages, err := gmail.ListMessages(srv, config.GmailAddr)
+		listCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+		messages, err := listMessages(listCtx, mb, config, *query, *limit)
+		cancel()
 		if err != nil {
-			fmt.Println("failed to list mail from gmail inbox:", err)
+			fmt.Println("failed to list mail from inbox:", err)
 			os.Exit(1)
 		}
-		for i, msg := range messages {
-			fmt.Printf("%v: %s\n", i+1, msg.Id)
+		for i, msgID := range messages {
+			fmt.Printf("%v: %s\n", i+1, msgID)
 		}
 		return
 	}
 	if *id != "" {
-		email, err := gmail.ProcessEmail(srv, *id, config.GmailAddr)
+		msgCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+		email, err := mb.GetEmail(msgCtx, *id)
+		cancel()
 		if err != nil {
 			fmt.Println("failed to process email:", err)
 			os.Exit(1)
@@ -57,17 +69,23 @@ func main() {
 		fmt.Println("~~~")
 		return
 	}
-	messages, err := gmail.ListMessages(srv, config.GmailAddr)
+	listCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+	messages, err := listMessages(listCtx, mb, config, *query, *limit)
+	cancel()
 	if err != nil {
-		fmt.Println("failed to list mail from gmail inbox:", err)
+		fmt.Println("failed to list mail from inbox:", err)
 		os.Exit(1)
 	}
-	for _, msg := range messages {
-		email, err := gmail.ProcessEmail(srv, msg.Id, config.GmailAddr)
+	for _, msgID := range messages {
+		msgCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+		email, err := mb.GetEmail(msgCtx, msgID)
+		cancel()
 		if err != nil {
 			fmt.Println("failed to process email:", err)
-			raw, err := gmail.GetRaw(srv, config.GmailAddr, msg.Id)
-			fmt.Println("=====", msg.Id, "=====")
+			rawCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+			raw, err := mb.GetRaw(rawCtx, msgID)
+			cancel()
+			fmt.Println("=====", msgID, "=====")
 			if err != nil {
 				fmt.Println("failed to load message:", err)
 			} else {
@@ -80,7 +98,7 @@ func main() {
 		if email.SenderName != "" {
 			from += fmt.Sprintf(" (%s)", email.SenderName)
 		}
-		fmt.Println("ID:", msg.Id)
+		fmt.Println("ID:", msgID)
 		fmt.Println("From:", from)
 		fmt.Println("Subject:", email.Subject)
 		fmt.Println("\nContent:")
@@ -92,3 +110,29 @@ func main() {
 		}
 	}
 }
+
+// Lists the IDs of the emails in the inbox, up to the limit (if set).
+// A search query can only be used with gmail; other mailboxes list what the assistant would look at.
+func listMessages(ctx context.Context, mb mailbox.Mailbox, config config.Config, query string, limit int) ([]string, error) {
+	if gmailMB, ok := mb.(*mailbox.GmailMailbox); ok {
+		listOpts := gmail.DefaultListOptions(config)
+		if query != "" {
+			listOpts.Query = query
+		}
+		if limit > 0 {
+			listOpts.Limit = limit
+		}
+		return gmailMB.ListMatching(ctx, listOpts)
+	}
+	if query != "" {
+		return nil, fmt.Errorf("search queries are only supported with gmail")
+	}
+	messages, err := mb.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
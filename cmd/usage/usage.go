@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/usage"
+)
+
+func main() {
+	days := flag.Int("days", 7, "number of days (including today) to report on")
+	emails := flag.Bool("emails", false, "also show the totals for each email")
+	flag.Parse()
+
+	if *days < 1 {
+		fmt.Println("days must be at least 1")
+		os.Exit(1)
+	}
+	since := usage.StartOfToday().AddDate(0, 0, -(*days - 1))
+	records, err := usage.AppLedger().Records(since)
+	if err != nil {
+		fmt.Println("failed to load usage ledger:", err)
+		os.Exit(1)
+	}
+	if len(records) == 0 {
+		fmt.Printf("No model calls recorded in the last %v day(s).\n", *days)
+		return
+	}
+
+	fmt.Printf("Usage for the last %v day(s)\n\n", *days)
+	fmt.Println("Per day:")
+	printGroups("DAY", usage.GroupBy(records, usage.ByDay), nil)
+	fmt.Println("\nPer task:")
+	printGroups("TASK", usage.GroupBy(records, usage.ByTask), nil)
+
+	if *emails {
+		// show who each email was from, if it's in the email cache
+		if err := emailcache.LoadCacheFromDisk(); err != nil {
+			fmt.Println("(failed to load email cache:", err, ")")
+		}
+		fmt.Println("\nPer email:")
+		printGroups("EMAIL", usage.GroupBy(records, usage.ByEmail), func(id string) string {
+			if datum, ok := emailcache.IsCached(id); ok {
+				return datum.From
+			}
+			return ""
+		})
+	}
+
+	appConfig, err := config.LoadConfig()
+	if err != nil {
+		return
+	}
+	printBudget(appConfig.Budget)
+}
+
+// prints a table of the groups' totals, with a total row at the end. describe gives extra info to show for each key, if set.
+func printGroups(keyName string, groups []usage.Group, describe func(string) string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tCALLS\tPROMPT\tCOMPLETION\tLATENCY\tCOST\t\n", keyName)
+	total := usage.Totals{}
+	for _, g := range groups {
+		key := g.Key
+		if describe != nil {
+			if desc := describe(key); desc != "" {
+				key += " (" + desc + ")"
+			}
+		}
+		printRow(w, key, g.Totals)
+		total.Merge(g.Totals)
+	}
+	printRow(w, "total", total)
+	w.Flush()
+}
+
+func printRow(w *tabwriter.Writer, key string, t usage.Totals) {
+	fmt.Fprintf(w, "%s\t%v\t%v\t%v\t%v\t$%.4f\t\n", key, t.Calls, t.PromptTokens, t.CompletionTokens, t.Latency.Round(time.Second), t.Cost)
+}
+
+// prints how much of today's budget is used up, if a budget is set
+func printBudget(b config.Budget) {
+	if b.DailyTokens <= 0 && b.DailyCost <= 0 {
+		return
+	}
+	fmt.Println()
+	over, reason, err := usage.AppLedger().OverBudget(b)
+	if err != nil {
+		fmt.Println("failed to check budget:", err)
+		return
+	}
+	if over {
+		fmt.Println("Daily budget reached, auto-reply is paused:", reason)
+	} else {
+		fmt.Println("Daily budget not reached yet.")
+	}
+}
@@ -5,8 +5,12 @@ go 1.22.0
 toolchain go1.22.4
 
 require (
+	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-message v0.18.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
+	github.com/emersion/go-smtp v0.15.0
 	github.com/fatih/color v1.17.0
+	github.com/inancgumus/screen v0.0.0-20190314163918-06e984b86ed3
 	github.com/ollama/ollama v0.1.43
 	golang.org/x/oauth2 v0.20.0
 	golang.org/x/text v0.15.0
@@ -26,7 +30,6 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.2 // indirect
 	github.com/googleapis/gax-go/v2 v2.12.4 // indirect
-	github.com/inancgumus/screen v0.0.0-20190314163918-06e984b86ed3 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	go.opencensus.io v0.24.0 // indirect
@@ -2,71 +2,142 @@ package assistant
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
 	"time"
 
-	"github.com/ollama/ollama/api"
 	"github.com/webbben/mail-assistant/internal/config"
 	"github.com/webbben/mail-assistant/internal/debug"
 	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
-	"github.com/webbben/mail-assistant/internal/gmail"
-	"github.com/webbben/mail-assistant/internal/llama"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	"github.com/webbben/mail-assistant/internal/message"
 	"github.com/webbben/mail-assistant/internal/personality"
+	"github.com/webbben/mail-assistant/internal/spamfilter"
 	"github.com/webbben/mail-assistant/internal/types"
 	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/usage"
 	"github.com/webbben/mail-assistant/internal/util"
-	g "google.golang.org/api/gmail/v1"
 )
 
-func GetResponseInteractive(message t.Email, basePrompt string, ollamaClient *api.Client, appConfig config.Config, p *personality.Personality) string {
-	prompt := p.FormatPrompt(appConfig.UserName, basePrompt, message)
+// Runs the interactive dialog for replying to an email, and returns the confirmed reply, whether the user chose to save it as a draft instead of sending it,
+// and whether they chose to reply to everyone on the email.
+// While the AI is talking, Ctrl-C cancels just that generation and returns to the prompt.
+//
+// Long emails are abridged before they are given to the AI, and it offers to show the full text instead.
+// If the prompt has the thread placeholder, the earlier messages in the conversation are given to the AI too.
+// The AI is told about the email's attachments (with summaries of the text ones), and can save them for the user.
+// If the user asks, the email is forwarded to one of their delegates with a cover note from the AI, and "<<FORWARDED>>" is returned.
+func GetResponseInteractive(ctx context.Context, mb mailbox.Mailbox, message t.Email, basePrompt string, provider llm.Provider, appConfig config.Config, p *personality.Personality) (string, bool, bool) {
+	ctx = usage.WithEmail(ctx, message.ID)
+	condensed, abridged := condenseEmail(ctx, provider, message, appConfig)
+	thread := ""
+	if strings.Contains(basePrompt, personality.ThreadPlaceholder) {
+		// the rest of the drafting model's context is left for the conversation
+		budget := llm.ContextChars(appConfig.LLM, llm.DRAFT) - len(basePrompt) - len(condensed.Body)
+		thread = threadTranscript(ctx, mb, message, budget, appConfig)
+	}
+	prompt := p.FormatPrompt(appConfig.UserName, basePrompt, condensed, thread)
 	if prompt == "" {
 		debug.Println("no prompt data.")
-		return ""
+		return "", false, false
+	}
+	if abridged {
+		prompt += abridgedNote
+	}
+	attachments := listedAttachments(message)
+	getAttachment := mailboxAttachments(mb, message, appConfig)
+	if len(attachments) > 0 {
+		prompt += attachmentPromptNote(ctx, provider, attachments, getAttachment, llm.ContextChars(appConfig.LLM, llm.SUMMARIZE))
 	}
-	messages := []api.Message{
+	prompt += delegatesPromptNote(appConfig.Forward.Delegates)
+	drafter := provider.ForTask(llm.DRAFT)
+	messages := []llm.Message{
 		{
 			Role:    "system",
 			Content: prompt,
 		},
 	}
-	messages, err := llama.ChatCompletion(ollamaClient, messages)
-	if err != nil {
+	out, err := streamChat(ctx, drafter, p.Name, messages)
+	if errors.Is(err, errInterrupted) {
+		util.SomeoneTalks("SYS", "(interrupted)", util.Gray)
+	} else if err != nil {
 		log.Println("failed to generate chat completion:", err)
-		return ""
-	}
-	if len(messages) == 0 {
+		return "", false, false
+	} else if len(out) == 0 {
 		debug.Println("unexpected empty output from AI API")
-		return ""
+		return "", false, false
+	} else {
+		messages = out
 	}
-	util.SomeoneTalks(p.Name, messages[len(messages)-1].Content, util.Hi_blue)
 
 	reply := ""
 	for {
 		response := util.GetUserInput()
 		if util.IsQuit(response) {
-			return "<<QUIT>>"
+			return "<<QUIT>>", false, false
 		}
-		messages = append(messages, api.Message{
+		messages = append(messages, llm.Message{
 			Role:    "user",
 			Content: response,
 		})
-		messages, err = llama.ChatCompletion(ollamaClient, messages)
+		out, err := streamChat(ctx, drafter, p.Name, messages)
+		if errors.Is(err, errInterrupted) {
+			// forget the last input, so the user can try again
+			messages = messages[:len(messages)-1]
+			util.SomeoneTalks("SYS", "(interrupted)", util.Gray)
+			continue
+		}
 		if err != nil {
 			log.Println("failed to generate chat completion:", err)
-			return ""
+			return "", false, false
 		}
+		messages = out
 		content := messages[len(messages)-1].Content
 
-		if strings.Contains(content, "<<<IGNORE>>>") {
-			util.SomeoneTalks(p.Name, p.GenPhrase(ollamaClient, "ignore"), util.Hi_blue)
-			return "<<SKIP>>"
+		if strings.Contains(content, ignoreToken) {
+			p.SayPhrase(ctx, provider, "ignore")
+			return "<<SKIP>>", false, false
+		}
+
+		if abridged && strings.Contains(content, fullTextToken) {
+			util.SomeoneTalks("SYS", "Full text of the letter:", util.Gray)
+			fmt.Println(message.Body)
+			messages[len(messages)-1].Content = "(I have shown you the full text of the letter.)"
+			continue
+		}
+
+		if len(attachments) > 0 && strings.Contains(content, saveAttachmentsToken) {
+			paths, err := saveAttachments(ctx, attachments, getAttachment, appConfig)
+			for _, path := range paths {
+				util.SomeoneTalks("SYS", "Saved "+path, util.Gray)
+			}
+			messages[len(messages)-1].Content = "(I have saved the attachments for you.)"
+			if err != nil {
+				log.Println("failed to save attachments:", err)
+				messages[len(messages)-1].Content = "(I tried to save the attachments for you, but it failed.)"
+			}
+			continue
+		}
+
+		if len(appConfig.Forward.Delegates) > 0 && strings.Contains(content, forwardToken) {
+			forwarded, err := forwardInteractive(ctx, mb, provider, message, condensed, response, appConfig, p)
+			if err != nil {
+				log.Println("failed to forward email:", err)
+				messages[len(messages)-1].Content = "(I tried to forward the letter, but it failed.)"
+				continue
+			}
+			if forwarded {
+				return "<<FORWARDED>>", false, false
+			}
+			messages[len(messages)-1].Content = "(I didn't forward the letter after all.)"
+			continue
 		}
-		util.SomeoneTalks(p.Name, content, util.Hi_blue)
 
 		if strings.Contains(content, "~~~") {
 			// A reply draft is in the output
@@ -75,13 +146,157 @@ func GetResponseInteractive(message t.Email, basePrompt string, ollamaClient *ap
 				log.Println("No response parsed; exiting dialog.")
 				break
 			}
-			if util.PromptYN("Confirm reply?") {
-				return reply
+			if confirmed, draft, replyAll := confirmReply(message, appConfig); confirmed {
+				return reply, draft, replyAll
 			}
 			util.SomeoneTalks(p.Name, "Ah, how should I reply then, Monsieur?", util.Hi_blue)
 		}
 	}
-	return reply
+	return reply, false, false
+}
+
+// Shows who the reply will go to, and asks the user to confirm it. By default, it's sent (or saved as a draft, in draft mode),
+// but the user can choose the other for just this email. If others were on the email, the user can also choose to reply to everyone.
+// Returns whether the reply was confirmed, whether it should be saved as a draft, and whether it should go to everyone.
+func confirmReply(email t.Email, appConfig config.Config) (bool, bool, bool) {
+	own := appConfig.OwnAddresses()
+	util.SomeoneTalks("SYS", formatRecipients(message.NewReply(email, "", false, own)), util.Gray)
+	if !message.HasOtherRecipients(email, own) {
+		confirmed, draft := confirmSend("reply", appConfig.DraftMode)
+		return confirmed, draft, false
+	}
+	util.SomeoneTalks("SYS", "Reply to everyone (A):\n"+formatRecipients(message.NewReply(email, "", true, own)), util.Gray)
+	prompt := "Confirm reply? [Y/N, A to reply to everyone, or D/AD to save it as a draft]:"
+	if appConfig.DraftMode {
+		prompt = "Confirm reply? It will be saved as a draft. [Y/N, A to reply to everyone, or S/AS to send it now]:"
+	}
+	fmt.Print(prompt)
+	answer := strings.ToLower(util.GetUserInput())
+	replyAll := strings.HasPrefix(answer, "a")
+	if replyAll {
+		answer = strings.TrimPrefix(answer, "a")
+		if answer == "" {
+			answer = "y"
+		}
+	}
+	confirmed, draft := parseSendAnswer(answer, appConfig.DraftMode)
+	return confirmed, draft, confirmed && replyAll
+}
+
+// same as confirmReply, but for any kind of email, e.g. "forward"
+func confirmSend(what string, draftMode bool) (bool, bool) {
+	prompt := fmt.Sprintf("Confirm %s? [Y/N, or D to save it as a draft]:", what)
+	if draftMode {
+		prompt = fmt.Sprintf("Confirm %s? It will be saved as a draft. [Y/N, or S to send it now]:", what)
+	}
+	fmt.Print(prompt)
+	return parseSendAnswer(strings.ToLower(util.GetUserInput()), draftMode)
+}
+
+// reads the user's answer to a confirm prompt: whether they confirmed, and whether to save a draft instead of sending
+func parseSendAnswer(answer string, draftMode bool) (bool, bool) {
+	switch {
+	case util.IsYes(answer):
+		return true, draftMode
+	case answer == "d" || answer == "draft":
+		return true, true
+	case answer == "s" || answer == "send":
+		return true, false
+	}
+	return false, false
+}
+
+const (
+	ignoreToken          = "<<<IGNORE>>>"
+	fullTextToken        = "<<<FULL-TEXT>>>"
+	saveAttachmentsToken = "<<<SAVE-ATTACHMENTS>>>"
+	forwardToken         = "<<<FORWARD>>>"
+)
+
+// replies that are only meant for parsing, and shouldn't be shown to the user
+var controlTokens = []string{ignoreToken, fullTextToken, saveAttachmentsToken, forwardToken}
+
+// added to the drafting prompt when the email given to it is abridged
+const abridgedNote = `
+
+Note: the message above is a long letter that has been abridged for you - it is a summary, not the original text.
+* When you describe the message to me, mention that the letter was long and that you have abridged it, and offer to read me the full text.
+* If I ask to read or see the full letter, respond with exactly "<<<FULL-TEXT>>>"
+`
+
+// if the email is long, returns a copy of it with the body condensed, and true to mark it as abridged.
+// If the summary fails, the body is cut short instead.
+func condenseEmail(ctx context.Context, provider llm.Provider, email t.Email, appConfig config.Config) (t.Email, bool) {
+	if len(email.Body) <= LongEmailLength {
+		return email, false
+	}
+	util.SomeoneTalks("SYS", fmt.Sprintf("This letter is long (%v characters); condensing it first...", len(email.Body)), util.Gray)
+	summary, err := SummarizeLong(ctx, provider, email.Body, llm.ContextChars(appConfig.LLM, llm.SUMMARIZE))
+	if err != nil {
+		log.Println("failed to summarize long email:", err)
+		summary = email.Body[:runeCut(email.Body, LongEmailLength)] + "..."
+	}
+	email.Body = summary
+	return email, true
+}
+
+var errInterrupted = errors.New("generation interrupted")
+
+// streams the chat completion to the terminal as it's generated, and returns the messages with the reply appended.
+// A reply that is just a control token (like the ignore token) is not shown, since it's only meant for parsing.
+//
+// If the user presses Ctrl-C while the reply is generating, the generation is cancelled and errInterrupted is returned.
+func streamChat(ctx context.Context, provider llm.Provider, name string, messages []llm.Message) ([]llm.Message, error) {
+	interruptCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	talk := util.NewTalkStream(name, util.Hi_blue)
+	buf := ""
+	printing := false
+	messages, err := provider.ChatStream(interruptCtx, messages, func(token string) {
+		if printing {
+			talk.Write(token)
+			return
+		}
+		buf += token
+		// hold off on printing while the reply could still be a control token
+		if isControlPrefix(buf) {
+			return
+		}
+		printing = true
+		talk.Write(buf)
+	})
+	if !printing && err == nil && !containsControlToken(buf) {
+		talk.Write(buf)
+		printing = true
+	}
+	if printing {
+		talk.End()
+	}
+	if err != nil && interruptCtx.Err() != nil && ctx.Err() == nil {
+		return messages, errInterrupted
+	}
+	return messages, err
+}
+
+// returns true if the text could be the start of a control token
+func isControlPrefix(text string) bool {
+	text = strings.TrimSpace(text)
+	for _, token := range controlTokens {
+		if strings.HasPrefix(token, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsControlToken(text string) bool {
+	for _, token := range controlTokens {
+		if strings.Contains(text, token) {
+			return true
+		}
+	}
+	return false
 }
 
 func parseReplyMessage(content string) string {
@@ -110,100 +325,198 @@ func parseReplyMessage(content string) string {
 	return reply
 }
 
-// waits for the user to summon the assistant, and checks for new mail while waiting
-func WaitForNextSummon(srv *g.Service, client *api.Client, config config.Config, p personality.Personality) {
+// what the user summoned the assistant for
+const (
+	CHECK_MAIL = "CHECK_MAIL" // go through the new emails
+	COMPOSE    = "COMPOSE"    // write a new email
+)
+
+// minutes between inbox checks while waiting to be summoned, if inbox_check_freq isn't set
+const defaultInboxCheckFreq = 5
+
+// waits for the user to summon the assistant, and checks for new mail every inbox_check_freq minutes while waiting.
+// returns what the user summoned the assistant for: CHECK_MAIL, or COMPOSE if they entered 'c'.
+//
+// Each mailbox or model call made while waiting is limited by its configured timeout, so a hung call can't block the loop forever.
+func WaitForNextSummon(ctx context.Context, mb mailbox.Mailbox, provider llm.Provider, config config.Config, p personality.Personality) string {
 	input := make(chan string)
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(inboxCheckInterval(config))
+	defer ticker.Stop()
 
 	go func() {
 		reader := bufio.NewReader(os.Stdin)
-		util.SomeoneTalks("SYS", "Press the enter key to summon", util.Gray)
+		util.SomeoneTalks("SYS", "Press the enter key to summon, or enter 'c' to write a new letter", util.Gray)
 		s, _ := reader.ReadString('\n')
 		input <- s
 	}()
 
+	newMail := []t.Email{}
 	newMailCount := 0
+	budgetPaused := false
 
 	util.ClearScreen()
 
 	for {
 		select {
 		case <-ticker.C:
-			// check for new emails
-			newMail, err := checkForNewMail(srv, config.GmailAddr)
-			if err != nil {
-				log.Println("error checking for new mail:", err)
-				continue
-			}
+			// check for emails that arrived since the last check. the same checks are done as when the user is summoned, so emails that are too old, junk, etc are left out
+			newMail = append(newMail, mailbox.GetNewEmails(ctx, mb, config)...)
 			// use auto-reply if enabled and applicable to the new emails
-			if len(newMail) > 0 && config.AutoReply.Enabled {
+			if email, ok := nextAutoReply(newMail); ok && config.AutoReply.Enabled && !overBudget(config, &budgetPaused) {
 				// only auto reply one email every tick, just so not too many emails are sent out at once
 				// just a random mitigation measure against unexpected bugs or bad behavior, since one bad auto-reply email is better than 100.
-				msgID := newMail[0]
-				err := autoReplyMessage(client, srv, msgID, config, p)
+				autoReplyChecked[email.ID] = true
+				err := autoReplyMessage(ctx, provider, mb, email, config, p)
 				if err != nil {
 					log.Println("failed to autoreply:", err)
 				}
 			}
-			if len(newMail) > newMailCount {
-				newMailCount = len(newMail)
-				util.SomeoneTalks("SYS", fmt.Sprintf("%v new email(s) waiting to be received.", len(newMail)), util.Gray)
+			if waiting := countUncached(newMail); waiting > newMailCount {
+				newMailCount = waiting
+				util.SomeoneTalks("SYS", fmt.Sprintf("%v new email(s) waiting to be received.", waiting), util.Gray)
 			}
-		case <-input:
-			return
+		case s := <-input:
+			if strings.ToLower(strings.TrimSpace(s)) == "c" {
+				return COMPOSE
+			}
+			return CHECK_MAIL
+		case <-ctx.Done():
+			return CHECK_MAIL
+		}
+	}
+}
+
+// IDs of the emails auto-reply has already looked at, so an email it decided not to reply to isn't categorized again on every inbox check
+var autoReplyChecked = make(map[string]bool)
+
+// gets the first email auto-reply hasn't looked at yet, that the user hasn't dealt with
+func nextAutoReply(emails []t.Email) (t.Email, bool) {
+	for _, email := range emails {
+		if autoReplyChecked[email.ID] {
+			continue
 		}
+		if _, isCached := emailcache.IsCached(email.ID); isCached {
+			continue
+		}
+		return email, true
 	}
+	return t.Email{}, false
 }
 
-func autoReplyMessage(client *api.Client, srv *g.Service, msgID string, config config.Config, p personality.Personality) error {
-	// load the email content
-	email, err := gmail.ProcessEmail(srv, msgID, config.GmailAddr)
+// counts the emails that haven't been dealt with yet, e.g. by auto-reply
+func countUncached(emails []t.Email) int {
+	count := 0
+	for _, email := range emails {
+		if _, isCached := emailcache.IsCached(email.ID); !isCached {
+			count++
+		}
+	}
+	return count
+}
+
+// gets how long to wait between inbox checks
+func inboxCheckInterval(config config.Config) time.Duration {
+	if config.InboxCheckFreq <= 0 {
+		return defaultInboxCheckFreq * time.Minute
+	}
+	return time.Duration(config.InboxCheckFreq) * time.Minute
+}
+
+// Checks if today's model usage has reached the daily budget, which pauses auto-reply until the next day.
+// paused tracks whether the user was already told, so the notice is only shown once.
+func overBudget(config config.Config, paused *bool) bool {
+	over, reason, err := usage.AppLedger().OverBudget(config.Budget)
 	if err != nil {
-		return err
+		log.Println("failed to check usage budget:", err)
+	}
+	if over && !*paused {
+		util.SomeoneTalks("SYS", fmt.Sprintf("Auto-reply paused for today (%s).", reason), util.Gray)
 	}
-	reply, err, _ := AutoReply(client, email, config.UserName, p, config.AutoReply.Categories, config.AutoReply.Instructions)
+	*paused = over
+	return over
+}
+
+func autoReplyMessage(ctx context.Context, provider llm.Provider, mb mailbox.Mailbox, email t.Email, config config.Config, p personality.Personality) error {
+	ctx = usage.WithEmail(ctx, email.ID)
+	// the AI only sees the condensed email; the reply and forward are still made from the original
+	condensed, _ := condenseEmail(ctx, provider, email, config)
+	body, err, cats := AutoReply(ctx, provider, condensed, config.UserName, p, config.AutoReply.Categories, config.AutoReply.Instructions)
 	if err != nil {
 		return err
 	}
-	if reply == "" {
+	draft := config.DraftMode || anyCategory(cats, config.AutoReply.Draft)
+	if delegate, ok := categoryDelegate(cats, config); ok {
+		if err := autoForwardMessage(ctx, provider, mb, email, condensed, delegate, draft, config, p); err != nil {
+			return err
+		}
+	}
+	if body == "" {
 		return nil
 	}
-	if !util.PromptYN("Do you want to autoreply to " + email.From + "?") {
+	reply := message.NewReply(email, body, anyCategory(cats, config.AutoReply.ReplyAll), config.OwnAddresses())
+	reply.Style = p.ReplyStyle
+	// drafts are for the user to review later, so they don't need confirming now
+	if draft {
+		return autoReplyDraft(ctx, mb, email, reply, config)
+	}
+	if !ConfirmRecipients(reply, "Do you want to autoreply to "+email.From+"?") {
 		return nil
 	}
-	emailcache.AddToCache(email, emailcache.REPLY)
+	mailCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+	err = mb.SendReply(mailCtx, email, reply)
+	cancel()
+	if err != nil {
+		return err
+	}
+	emailcache.AddToCache(email, emailcache.REPLY, t.AUTO_REPLIED)
+	spamfilter.Learn(email, false)
 	util.SomeoneTalks("SYS", fmt.Sprintf("(%s) Auto reply sent to %s", util.CurrentTime(), email.From), util.Gray)
-	return gmail.SendReply(srv, config.GmailAddr, email, reply)
+	mailCtx, cancel = util.WithTimeout(ctx, config.MailTimeout())
+	defer cancel()
+	if err := mb.MarkHandled(mailCtx, email.ID, t.AUTO_REPLIED); err != nil {
+		log.Println("failed to label email:", err)
+	}
+	return nil
 }
 
-// checks if new, unprocessed emails are waiting, and returns their message IDs. If an error occurs while checking gmail API, the error is returned.
-func checkForNewMail(srv *g.Service, addr string) ([]string, error) {
-	newMail := make([]string, 0)
-	list, err := gmail.ListMessages(srv, addr)
+// saves an auto-reply as a draft, for the user to review and send later
+func autoReplyDraft(ctx context.Context, mb mailbox.Mailbox, email t.Email, reply t.Reply, config config.Config) error {
+	mailCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+	draftID, err := mb.CreateDraft(mailCtx, email, reply)
+	cancel()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for _, msg := range list {
-		if _, cached := emailcache.IsCached(msg.Id); !cached {
-			newMail = append(newMail, msg.Id)
-		}
+	emailcache.AddDraftToCache(email, draftID, t.AUTO_REPLIED)
+	spamfilter.Learn(email, false)
+	util.SomeoneTalks("SYS", fmt.Sprintf("(%s) Auto reply to %s saved as a draft", util.CurrentTime(), email.From), util.Gray)
+	mailCtx, cancel = util.WithTimeout(ctx, config.MailTimeout())
+	defer cancel()
+	if err := mb.MarkHandled(mailCtx, email.ID, t.DRAFTED); err != nil {
+		log.Println("failed to label email:", err)
 	}
-	return newMail, nil
+	return nil
 }
 
-func AutoReply(client *api.Client, email types.Email, username string, p personality.Personality, categories []string, instructions [][]string) (string, error, []int) {
+func AutoReply(ctx context.Context, provider llm.Provider, email types.Email, username string, p personality.Personality, categories []string, instructions [][]string) (string, error, []int) {
 	// first, detect if the given email is related to the auto reply categories, and output which one it is related to.
-	cats := getEmailCategories(client, email, categories)
+	cats := getEmailCategories(ctx, provider, email, categories)
 	if cats[0] == 0 {
 		return "", nil, cats
 	}
 	instr := make([]string, 0)
 	for _, cat := range cats {
-		instr = append(instr, instructions[cat-1]...)
+		if cat <= len(instructions) {
+			instr = append(instr, instructions[cat-1]...)
+		}
+	}
+	// e.g. categories that are only forwarded to a delegate
+	if len(instr) == 0 {
+		return "", nil, cats
 	}
 	// prompt for a response based on the related categories and their instructions
 	prompt := formatARReplyPrompt(p.BasePersonality, username, p.Name, instr)
-	s, err := llama.GenerateCompletion(client, prompt, email.String())
+	s, err := provider.ForTask(llm.DRAFT).Generate(ctx, prompt, email.String())
 	if err != nil {
 		return "", err, cats
 	}
@@ -233,15 +546,14 @@ func formatARReplyPrompt(basePersonality string, username string, aiName string,
 }
 
 const ARCategoryPrompt = `
-You are a robot that only outputs numbers from 0 to <<N>>.
-You will be given a message, and you will determine if it falls into any of the following categories. Output the number of the category it falls into, or 0 if none apply.
-If more than one apply, you can output more than one number, separated by commas. Only choose a category if you are 100 percent sure about it.
+You are a robot that only outputs JSON.
+You will be given a message, and you will determine if it falls into any of the following categories, numbered from 1 to <<N>>.
+If more than one apply, you can output more than one category. Only choose a category if you are 100 percent sure about it. If none apply, output an empty list of categories.
 
 Sample outputs:
-0
-1
-2
-1,2
+{"categories": [], "confidence": 0.95, "reason": "The message doesn't relate to any of the categories."}
+{"categories": [2], "confidence": 0.9, "reason": "The message is about category 2."}
+{"categories": [1, 2], "confidence": 0.8, "reason": "The message mentions both category 1 and category 2."}
 
 Categories:
 
@@ -260,26 +572,60 @@ func formatARCategoryPrompt(categories []string) string {
 	return util.InsertMappedValues(ARCategoryPrompt, d)
 }
 
-func getEmailCategories(client *api.Client, email types.Email, categories []string) []int {
+// output of the category detection prompt
+type categoryResult struct {
+	Categories []int    `json:"categories"`
+	Confidence *float64 `json:"confidence"`
+	Reason     string   `json:"reason"`
+}
+
+var categorySchema = llm.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"categories": map[string]any{"type": "array", "items": map[string]any{"type": "integer", "minimum": 1}, "uniqueItems": true},
+		"confidence": map[string]any{"type": "number", "minimum": 0, "maximum": 1},
+		"reason":     map[string]any{"type": "string"},
+	},
+	"required": []string{"categories", "confidence", "reason"},
+}
+
+func (r *categoryResult) validate(n int) error {
+	if r.Categories == nil {
+		return errors.New(`missing "categories" list`)
+	}
+	seen := make(map[int]bool)
+	for _, c := range r.Categories {
+		if c < 1 || c > n {
+			return fmt.Errorf("category %v doesn't exist; categories must be from 1 to %v, or an empty list if none apply", c, n)
+		}
+		if seen[c] {
+			return fmt.Errorf("category %v is listed more than once", c)
+		}
+		seen[c] = true
+	}
+	if r.Confidence == nil {
+		return errors.New(`missing "confidence"`)
+	}
+	if *r.Confidence < 0 || *r.Confidence > 1 {
+		return fmt.Errorf(`"confidence" must be between 0 and 1, but was %v`, *r.Confidence)
+	}
+	return nil
+}
+
+// detects which of the given categories the email falls into, and returns their numbers (starting from 1). If none apply, or detection fails, returns [0].
+func getEmailCategories(ctx context.Context, provider llm.Provider, email types.Email, categories []string) []int {
 	prompt := formatARCategoryPrompt(categories)
-	out, err := llama.GenerateCompletionWithOpts(client, prompt, email.String(), map[string]interface{}{"temperature": 0.0})
+	var result categoryResult
+	validate := func() error { return result.validate(len(categories)) }
+	out, err := llm.GenerateStructured(ctx, provider.ForTask(llm.CATEGORIZE), prompt, email.String(), categorySchema, map[string]interface{}{"temperature": 0.0}, llm.DefaultJSONRetries, &result, validate)
 	if err != nil {
 		log.Println("failed to get email categories:", err)
+		debug.Println("category detection output:", out)
 		return []int{0}
 	}
-	nums := strings.Split(out, ",")
-	if len(nums) == 0 {
-		log.Println("invalid output for email category detection:", out)
+	debug.Printf("detected categories %v (confidence: %v): %s\n", result.Categories, *result.Confidence, result.Reason)
+	if len(result.Categories) == 0 {
 		return []int{0}
 	}
-	parsedInts := make([]int, 0)
-	for _, num := range nums {
-		v, err := strconv.Atoi(strings.TrimSpace(num))
-		if err != nil {
-			log.Println("error parsing int:", err)
-			return []int{0}
-		}
-		parsedInts = append(parsedInts, v)
-	}
-	return parsedInts
+	return result.Categories
 }
@@ -2,6 +2,7 @@ package assistant
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -10,12 +11,25 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
 	"github.com/webbben/mail-assistant/internal/llama"
+	"github.com/webbben/mail-assistant/internal/llama/llamatest"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
 	"github.com/webbben/mail-assistant/internal/personality"
 	"github.com/webbben/mail-assistant/internal/types"
 )
 
+// gets the LLM provider for a test: ollama, live or with recorded fixtures (see llamatest.Client).
+//
+// go test -run ^TestAutoReply$ github.com/webbben/mail-assistant/internal/assistant -args -record
+func getTestProvider(t *testing.T) llm.Provider {
+	return llm.NewOllamaWithClient(llamatest.Client(t, llama.DefaultModel), config.LLM{})
+}
+
 type AutoReplyTestCase struct {
 	email       types.Email
 	shouldReply bool
@@ -66,17 +80,8 @@ var test_p personality.Personality = personality.Personality{
 
 // go test -run ^TestAutoReply$ github.com/webbben/mail-assistant/internal/assistant
 func TestAutoReply(t *testing.T) {
-	// ollama
-	cmd, err := llama.StartServer()
-	if err != nil {
-		log.Fatal("failed to start ollama server:", err)
-	}
-	defer llama.StopServer(cmd)
-
-	client, err := llama.GetClient()
-	if err != nil {
-		log.Fatal("failed to get ollama client:", err)
-	}
+	tests := loadTestCases()
+	provider := getTestProvider(t)
 
 	categories := []string{
 		"The company Epic, and software engineering.",
@@ -98,7 +103,6 @@ func TestAutoReply(t *testing.T) {
 		},
 	}
 
-	tests := loadTestCases()
 	pass := 0
 	falsePositive := 0
 	invalid := 0
@@ -106,7 +110,7 @@ func TestAutoReply(t *testing.T) {
 
 	for i, test := range tests {
 		logString := fmt.Sprintf("==========\n   CASE %v\n==========\nEMAIL:\n%s", i, test.email)
-		out, err, cats := AutoReply(client, test.email, "Ben Webb", test_p, categories, instructions)
+		out, err, cats := AutoReply(context.Background(), provider, test.email, "Ben Webb", test_p, categories, instructions)
 		if err != nil {
 			t.Errorf("case: %v, error occurred: %s", i, err)
 		}
@@ -251,20 +255,11 @@ func TestGetEmailCategories(t *testing.T) {
 		},
 	}
 
-	// ollama
-	cmd, err := llama.StartServer()
-	if err != nil {
-		log.Fatal("failed to start ollama server:", err)
-	}
-	defer llama.StopServer(cmd)
+	provider := getTestProvider(t)
 
-	client, err := llama.GetClient()
-	if err != nil {
-		log.Fatal("failed to get ollama client:", err)
-	}
 	pass := 0
 	for i, test := range tests {
-		cats := getEmailCategories(client, test.email, test.categories)
+		cats := getEmailCategories(context.Background(), provider, test.email, test.categories)
 		if len(cats) != len(test.expCategories) {
 			t.Errorf("case %v, output: %v, exp: %v", i, cats, test.expCategories)
 			continue
@@ -283,3 +278,220 @@ func TestGetEmailCategories(t *testing.T) {
 	}
 	t.Logf("Pass: %v/%v (%v%%)", pass, len(tests), math.Round(float64(pass)/float64(len(tests))*100))
 }
+
+func TestGetEmailCategoriesRetry(t *testing.T) {
+	categories := []string{"Software engineering", "Mapo tofu", "Debts"}
+	email := types.Email{
+		From:    "somedude@gmail.com",
+		Subject: "Mapo Tofu",
+		Body:    "Do you like mapo tofu?",
+	}
+	tests := []struct {
+		responses     []string
+		expCategories []int
+	}{
+		{[]string{`2`, `{"categories": [2], "confidence": 0.9, "reason": "tofu"}`}, []int{2}},
+		{[]string{`{"categories": [0], "confidence": 0.9, "reason": "none"}`, `{"categories": [], "confidence": 0.9, "reason": "none"}`}, []int{0}},
+		{[]string{`{"categories": [4], "confidence": 0.9, "reason": "?"}`, `{"categories": [2, 2], "confidence": 0.9}`, `{"categories": [2]}`}, []int{0}},
+	}
+
+	for i, test := range tests {
+		fake := llm.NewFake(test.responses...)
+		cats := getEmailCategories(context.Background(), fake, email, categories)
+		if fmt.Sprint(cats) != fmt.Sprint(test.expCategories) {
+			t.Errorf("case %v, output: %v, exp: %v", i, cats, test.expCategories)
+		}
+		for _, call := range fake.Calls {
+			if call.Task != llm.CATEGORIZE {
+				t.Errorf("case %v, expected task %q, got %q", i, llm.CATEGORIZE, call.Task)
+			}
+		}
+	}
+}
+
+func TestAnyCategory(t *testing.T) {
+	tests := []struct {
+		cats  []int
+		flags []bool
+		want  bool
+	}{
+		{[]int{0}, []bool{true}, false},
+		{[]int{1}, []bool{false, true}, false},
+		{[]int{2}, []bool{false, true}, true},
+		{[]int{1, 2}, []bool{false, true}, true},
+		{[]int{3}, []bool{false, true}, false}, // the setting doesn't have to list every category
+	}
+	for _, test := range tests {
+		if got := anyCategory(test.cats, test.flags); got != test.want {
+			t.Errorf("cats %v, flags %v: expected %v, got %v", test.cats, test.flags, test.want, got)
+		}
+	}
+}
+
+// a mailbox that only saves drafts, for auto-replies in draft mode
+type draftMailbox struct {
+	mailbox.Mailbox
+	replies  []types.Reply
+	forwards []types.Forward
+}
+
+func (m *draftMailbox) CreateDraft(ctx context.Context, email types.Email, reply types.Reply) (string, error) {
+	m.replies = append(m.replies, reply)
+	return "draft", nil
+}
+
+func (m *draftMailbox) CreateForwardDraft(ctx context.Context, email types.Email, fwd types.Forward) (string, error) {
+	m.forwards = append(m.forwards, fwd)
+	return "draft", nil
+}
+
+func (m *draftMailbox) MarkHandled(ctx context.Context, id string, action string) error {
+	return nil
+}
+
+// checks that AutoReply drafts with the instructions of the detected categories, using canned model output
+func TestAutoReplyUsesCategoryInstructions(t *testing.T) {
+	email := types.Email{
+		From:    "somedude@gmail.com",
+		Subject: "Lunch on Saturday",
+		Body:    "Wanna get mapo tofu on Saturday?",
+	}
+	categories := []string{"Software engineering", "Mapo tofu"}
+	instructions := [][]string{
+		{"Respond that I'm out of office"},
+		{"Tell them I accept"},
+	}
+	tests := []struct {
+		responses []string
+		expOut    string
+		expCats   []int
+		expCalls  int
+	}{
+		{[]string{`{"categories": [2], "confidence": 0.9, "reason": "tofu"}`, "~~~\nI accept.\n~~~"}, "~~~\nI accept.\n~~~", []int{2}, 2},
+		{[]string{`{"categories": [], "confidence": 0.9, "reason": "none"}`}, "", []int{0}, 1},
+	}
+
+	for i, test := range tests {
+		fake := llm.NewFake(test.responses...)
+		out, err, cats := AutoReply(context.Background(), fake, email, "Ben Webb", test_p, categories, instructions)
+		if err != nil {
+			t.Errorf("case %v, error occurred: %s", i, err)
+		}
+		if out != test.expOut {
+			t.Errorf("case %v, output: %q, exp: %q", i, out, test.expOut)
+		}
+		if fmt.Sprint(cats) != fmt.Sprint(test.expCats) {
+			t.Errorf("case %v, categories: %v, exp: %v", i, cats, test.expCats)
+		}
+		if len(fake.Calls) != test.expCalls {
+			t.Errorf("case %v, expected %v model calls, got %v", i, test.expCalls, len(fake.Calls))
+			continue
+		}
+		if !fake.Calls[0].JSON || !strings.Contains(fake.Calls[0].SystemPrompt, "2) Mapo tofu") {
+			t.Errorf("case %v, unexpected category call: %+v", i, fake.Calls[0])
+		}
+		if test.expCalls < 2 {
+			continue
+		}
+		draft := fake.Calls[1]
+		if draft.Task != llm.DRAFT || draft.Prompt != email.String() {
+			t.Errorf("case %v, unexpected draft call: %+v", i, draft)
+		}
+		if !strings.Contains(draft.SystemPrompt, "Tell them I accept") || strings.Contains(draft.SystemPrompt, "out of office") {
+			t.Errorf("case %v, draft prompt has the wrong instructions:\n%s", i, draft.SystemPrompt)
+		}
+	}
+}
+
+func TestNextAutoReply(t *testing.T) {
+	t.Cleanup(func() { autoReplyChecked = make(map[string]bool) })
+	emails := []types.Email{
+		{ID: "next-auto-reply-1", From: "alice@example.com", Date: time.Now()},
+		{ID: "next-auto-reply-2", From: "bob@example.com", Date: time.Now()},
+		{ID: "next-auto-reply-3", From: "carol@example.com", Date: time.Now()},
+	}
+	// already looked at and declined, and already replied to
+	autoReplyChecked["next-auto-reply-1"] = true
+	emailcache.AddToCache(emails[1], emailcache.REPLY)
+
+	email, ok := nextAutoReply(emails)
+	if !ok || email.ID != "next-auto-reply-3" {
+		t.Errorf("expected carol's email, got %+v (%v)", email, ok)
+	}
+	if count := countUncached(emails); count != 2 {
+		t.Errorf("expected 2 uncached emails, got %v", count)
+	}
+	autoReplyChecked["next-auto-reply-3"] = true
+	if email, ok := nextAutoReply(emails); ok {
+		t.Errorf("expected no email left to auto-reply to, got %+v", email)
+	}
+}
+
+func TestAutoReplyMessageCondensesLongEmails(t *testing.T) {
+	email := types.Email{ID: "long-auto", From: "bard@village.fr", Subject: "Many words", Body: strings.Repeat("word ", LongEmailLength)}
+	fake := &llm.Fake{Handler: func(call llm.FakeCall) (string, error) {
+		switch call.Task {
+		case llm.SUMMARIZE:
+			return "Just many words.", nil
+		case llm.CATEGORIZE:
+			return `{"categories": [1], "confidence": 0.9, "reason": "words"}`, nil
+		}
+		return "~~~\nThank you for the words.\n~~~", nil
+	}}
+	c := config.Config{
+		DraftMode: true,
+		Forward:   config.Forward{Delegates: delegates},
+		AutoReply: config.AutoReply{Categories: []string{"Words"}, Instructions: [][]string{{"Thank them"}}, Forward: []string{"Anna"}},
+	}
+	mb := &draftMailbox{}
+	if err := autoReplyMessage(context.Background(), fake, mb, email, c, personality.Personality{Name: "Planchet"}); err != nil {
+		t.Fatal("failed to auto-reply:", err)
+	}
+	if len(mb.replies) != 1 || len(mb.forwards) != 1 {
+		t.Fatalf("expected a reply and a forward draft, got %v and %v", len(mb.replies), len(mb.forwards))
+	}
+	for _, call := range fake.Calls {
+		if call.Task != llm.SUMMARIZE && strings.Contains(call.SystemPrompt+call.Prompt, email.Body) {
+			t.Errorf("the %s call was given the full email instead of the condensed one", call.Task)
+		}
+	}
+}
+
+func TestParseSendAnswer(t *testing.T) {
+	tests := []struct {
+		answer    string
+		draftMode bool
+		confirmed bool
+		draft     bool
+	}{
+		{"y", false, true, false},
+		{"y", true, true, true},
+		{"d", false, true, true},
+		{"s", true, true, false},
+		{"n", false, false, false},
+		{"", true, false, false},
+	}
+	for _, test := range tests {
+		confirmed, draft := parseSendAnswer(test.answer, test.draftMode)
+		if confirmed != test.confirmed || draft != test.draft {
+			t.Errorf("%q (draft mode %v): expected %v %v, got %v %v", test.answer, test.draftMode, test.confirmed, test.draft, confirmed, draft)
+		}
+	}
+}
+
+func TestInboxCheckInterval(t *testing.T) {
+	tests := []struct {
+		freq int
+		want time.Duration
+	}{
+		{0, 5 * time.Minute},
+		{-1, 5 * time.Minute},
+		{1, time.Minute},
+		{60, time.Hour},
+	}
+	for _, test := range tests {
+		if got := inboxCheckInterval(config.Config{InboxCheckFreq: test.freq}); got != test.want {
+			t.Errorf("inbox_check_freq %v: expected %v, got %v", test.freq, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package assistant
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// directory attachments are saved in, if it isn't set in the config
+const defaultAttachmentDir = "attachments"
+
+// text attachments up to this long are given to the AI as they are; longer ones are summarized first
+const shortAttachmentLength = 800
+
+// limit on the size of a text attachment that is read for the prompt, so a huge log file doesn't take forever to summarize
+const maxTextAttachmentSize = 200 * 1024
+
+// extensions and types of the attachments that are read as text, and summarized for the AI
+var textAttachmentExts = []string{".txt", ".csv", ".md", ".ics"}
+var textAttachmentTypes = []string{"text/plain", "text/csv", "text/markdown", "text/calendar"}
+
+const attachmentSummaryPrompt = `
+You summarize files attached to letters, so they can be described quickly.
+You will be given the name and contents of one file. Summarize it in one or two sentences, keeping any dates, names, amounts and requests it mentions.
+For a calendar invite, give the event, its date and time, and where it is.
+Don't add anything that isn't in the file - just output the summary.
+`
+
+// added to the drafting prompt when the email has attachments
+const attachmentsNote = `
+
+Note: the letter came with these attachments:
+%s
+* When you describe the message to me, mention the attachments.
+* If I ask to save or download the attachments, respond with exactly "<<<SAVE-ATTACHMENTS>>>"
+`
+
+// downloads the content of an attachment
+type attachmentGetter func(ctx context.Context, attachment t.Attachment) ([]byte, error)
+
+// returns a getter for the email's attachments, which downloads them from the mailbox
+func mailboxAttachments(mb mailbox.Mailbox, email t.Email, appConfig config.Config) attachmentGetter {
+	return func(ctx context.Context, attachment t.Attachment) ([]byte, error) {
+		ctx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+		defer cancel()
+		return mb.GetAttachment(ctx, email, attachment)
+	}
+}
+
+// gets the attachments worth mentioning: the ones attached to the email, not the images and such shown inside it
+func listedAttachments(email t.Email) []t.Attachment {
+	attachments := make([]t.Attachment, 0)
+	for _, a := range email.Attachments {
+		if !a.Inline {
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments
+}
+
+// returns true if the attachment can be read as text, like a .txt, .csv, .md or .ics file
+func isTextAttachment(a t.Attachment) bool {
+	ext := strings.ToLower(filepath.Ext(a.Filename))
+	for _, textExt := range textAttachmentExts {
+		if ext == textExt {
+			return true
+		}
+	}
+	for _, textType := range textAttachmentTypes {
+		if a.MimeType == textType {
+			return true
+		}
+	}
+	return false
+}
+
+// formats a size in bytes for people to read, e.g. "512 B", "12 KB" or "1.5 MB"
+func formatSize(size int) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%v B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%v KB", (size+512)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	}
+}
+
+// describes an attachment, e.g. "invoice.pdf (application/pdf, 120 KB)"
+func describeAttachment(a t.Attachment) string {
+	return fmt.Sprintf("%s (%s, %s)", a.Filename, a.MimeType, formatSize(a.Size))
+}
+
+// Builds the note about the email's attachments for the drafting prompt. Text attachments are downloaded, and
+// summarized if they're long, so the AI can tell the user what's in them. If one can't be read, it's just listed.
+func attachmentPromptNote(ctx context.Context, provider llm.Provider, attachments []t.Attachment, get attachmentGetter, chunkSize int) string {
+	if len(attachments) == 0 {
+		return ""
+	}
+	lines := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		line := "* " + describeAttachment(a)
+		if isTextAttachment(a) && a.Size <= maxTextAttachmentSize {
+			summary, err := summarizeAttachment(ctx, provider, a, get, chunkSize)
+			if err != nil {
+				log.Println("failed to read attachment:", err)
+			} else if summary != "" {
+				line += ", which says: " + summary
+			}
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Sprintf(attachmentsNote, strings.Join(lines, "\n"))
+}
+
+// downloads a text attachment, and summarizes it if it's long
+func summarizeAttachment(ctx context.Context, provider llm.Provider, a t.Attachment, get attachmentGetter, chunkSize int) (string, error) {
+	data, err := get(ctx, a)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(strings.ReplaceAll(string(data), "\r\n", "\n"))
+	if len(text) <= shortAttachmentLength {
+		return text, nil
+	}
+	if len(text) > chunkSize {
+		return SummarizeLong(ctx, provider, text, chunkSize)
+	}
+	return summarize(ctx, provider.ForTask(llm.SUMMARIZE), attachmentSummaryPrompt, a.Filename+":\n\n"+text)
+}
+
+// Saves the attachments to the configured directory, and returns the paths they were saved to.
+// Files already in the directory aren't overwritten; the new file gets a number added to its name instead.
+func saveAttachments(ctx context.Context, attachments []t.Attachment, get attachmentGetter, appConfig config.Config) ([]string, error) {
+	dir := appConfig.AttachmentDir
+	if dir == "" {
+		dir = defaultAttachmentDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		data, err := get(ctx, a)
+		if err != nil {
+			return paths, fmt.Errorf("failed to download %s: %w", a.Filename, err)
+		}
+		path, err := saveFile(dir, a.Filename, data)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// writes the data to a new file in the directory. the filename comes from the email, so anything that would put the file elsewhere is removed.
+func saveFile(dir string, filename string, data []byte) (string, error) {
+	filename = strings.NewReplacer("/", "_", "\\", "_").Replace(filename)
+	if filename == "" || filename == "." || filename == ".." {
+		filename = "attachment"
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 1; ; i++ {
+		path := filepath.Join(dir, filename)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			filename = fmt.Sprintf("%s (%v)%s", base, i, ext)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return "", err
+		}
+		return path, file.Close()
+	}
+}
@@ -0,0 +1,121 @@
+package assistant
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int
+		want string
+	}{
+		{0, "0 B"},
+		{512, "512 B"},
+		{1024, "1 KB"},
+		{120 * 1024, "120 KB"},
+		{3 * 1024 * 1024 / 2, "1.5 MB"},
+	}
+	for _, test := range tests {
+		if got := formatSize(test.size); got != test.want {
+			t.Errorf("%v bytes: expected %q, got %q", test.size, test.want, got)
+		}
+	}
+}
+
+func TestIsTextAttachment(t *testing.T) {
+	tests := []struct {
+		attachment types.Attachment
+		want       bool
+	}{
+		{types.Attachment{Filename: "notes.txt", MimeType: "text/plain"}, true},
+		{types.Attachment{Filename: "report.CSV", MimeType: "application/octet-stream"}, true},
+		{types.Attachment{Filename: "invite.ics", MimeType: "application/ics"}, true},
+		{types.Attachment{Filename: "readme", MimeType: "text/markdown"}, true},
+		{types.Attachment{Filename: "invoice.pdf", MimeType: "application/pdf"}, false},
+		{types.Attachment{Filename: "photo.jpg", MimeType: "image/jpeg"}, false},
+	}
+	for _, test := range tests {
+		if got := isTextAttachment(test.attachment); got != test.want {
+			t.Errorf("%+v: expected %v", test.attachment, test.want)
+		}
+	}
+}
+
+func TestAttachmentPromptNote(t *testing.T) {
+	contents := map[string]string{
+		"notes.txt":  "Launch moved to August.",
+		"report.csv": strings.Repeat("region,sales\nnorth,100\n", 100),
+	}
+	get := func(ctx context.Context, a types.Attachment) ([]byte, error) {
+		content, ok := contents[a.Filename]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return []byte(content), nil
+	}
+	attachments := []types.Attachment{
+		{Filename: "invoice.pdf", MimeType: "application/pdf", Size: 120 * 1024},
+		{Filename: "notes.txt", MimeType: "text/plain", Size: 23},
+		{Filename: "report.csv", MimeType: "text/csv", Size: 2300},
+		{Filename: "missing.txt", MimeType: "text/plain", Size: 10},
+	}
+	fake := llm.NewFake("Sales by region.")
+	note := attachmentPromptNote(context.Background(), fake, attachments, get, 4000)
+	for _, want := range []string{
+		"* invoice.pdf (application/pdf, 120 KB)\n",
+		"* notes.txt (text/plain, 23 B), which says: Launch moved to August.\n",
+		"* report.csv (text/csv, 2 KB), which says: Sales by region.\n",
+		"* missing.txt (text/plain, 10 B)\n",
+		saveAttachmentsToken,
+	} {
+		if !strings.Contains(note, want) {
+			t.Errorf("expected the note to contain %q, got:\n%s", want, note)
+		}
+	}
+	// only the long text attachment is summarized
+	if len(fake.Calls) != 1 || fake.Calls[0].Task != llm.SUMMARIZE || fake.Calls[0].SystemPrompt != attachmentSummaryPrompt {
+		t.Errorf("expected one summary call, got %+v", fake.Calls)
+	}
+
+	if note := attachmentPromptNote(context.Background(), fake, nil, get, 4000); note != "" {
+		t.Errorf("expected no note without attachments, got %q", note)
+	}
+}
+
+func TestSaveAttachments(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "saved")
+	get := func(ctx context.Context, a types.Attachment) ([]byte, error) {
+		return []byte("content of " + a.Filename), nil
+	}
+	attachments := []types.Attachment{
+		{Filename: "notes.txt"},
+		{Filename: "notes.txt"},
+		{Filename: "../../escape.txt"},
+	}
+	paths, err := saveAttachments(context.Background(), attachments, get, config.Config{AttachmentDir: dir})
+	if err != nil {
+		t.Fatal("failed to save attachments:", err)
+	}
+	want := []string{"notes.txt", "notes (1).txt", ".._.._escape.txt"}
+	if len(paths) != len(want) {
+		t.Fatalf("expected %v files, got %v", len(want), paths)
+	}
+	for i, path := range paths {
+		if path != filepath.Join(dir, want[i]) {
+			t.Errorf("expected %s, got %s", filepath.Join(dir, want[i]), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != "content of "+attachments[i].Filename {
+			t.Errorf("%s: unexpected content %q (%v)", path, data, err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package assistant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	"github.com/webbben/mail-assistant/internal/personality"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// limit on how many matching correspondents the user is asked to choose from
+const maxRecipientChoices = 5
+
+// Runs the interactive dialog for writing a new email: the user describes the email, and the AI drafts it, until the user confirms the draft.
+// The recipients the AI was told about are looked up among the user's past correspondents. Then the email is sent, or saved as a draft.
+//
+// request is the user's first message, e.g. "write to Tim that I'll be late Thursday". If it's empty, the AI asks for it instead.
+func Compose(ctx context.Context, mb mailbox.Mailbox, provider llm.Provider, appConfig config.Config, p *personality.Personality, basePrompt string, request string) error {
+	prompt := p.FormatPrompt(appConfig.UserName, basePrompt, t.Email{}, "")
+	if prompt == "" {
+		return errors.New("no prompt for composing emails")
+	}
+	drafter := provider.ForTask(llm.DRAFT)
+	messages := []llm.Message{{Role: "system", Content: prompt}}
+	if request == "" {
+		out, err := streamChat(ctx, drafter, p.Name, messages)
+		if errors.Is(err, errInterrupted) {
+			util.SomeoneTalks("SYS", "(interrupted)", util.Gray)
+		} else if err != nil {
+			return err
+		} else {
+			messages = out
+		}
+	}
+
+	for {
+		response := request
+		request = ""
+		if response == "" {
+			response = util.GetUserInput()
+		}
+		if util.IsQuit(response) {
+			return nil
+		}
+		messages = append(messages, llm.Message{Role: "user", Content: response})
+		out, err := streamChat(ctx, drafter, p.Name, messages)
+		if errors.Is(err, errInterrupted) {
+			messages = messages[:len(messages)-1]
+			util.SomeoneTalks("SYS", "(interrupted)", util.Gray)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		messages = out
+		content := messages[len(messages)-1].Content
+		if !strings.Contains(content, "~~~") {
+			continue
+		}
+
+		names, subject, body, err := parseComposed(parseReplyMessage(content))
+		if err != nil {
+			debug.Println("failed to parse composed email:", err)
+			util.SomeoneTalks("SYS", "The draft couldn't be read; ask for it again.", util.Gray)
+			continue
+		}
+		newEmail := t.NewEmail{Subject: subject, Body: body, Style: p.ReplyStyle}
+		resolved := true
+		for _, name := range names {
+			address, ok := chooseRecipient(name, emailcache.Correspondents())
+			if !ok {
+				resolved = false
+				break
+			}
+			newEmail.To = append(newEmail.To, address)
+		}
+		if !resolved {
+			util.SomeoneTalks(p.Name, "Ah, to whom shall I write then, Monsieur?", util.Hi_blue)
+			continue
+		}
+		util.SomeoneTalks("SYS", formatRecipients(t.Reply{To: newEmail.To})+"\nSubject: "+newEmail.Subject, util.Gray)
+		confirmed, draft := confirmSend("email", appConfig.DraftMode)
+		if !confirmed {
+			util.SomeoneTalks(p.Name, "Ah, what should I change then, Monsieur?", util.Hi_blue)
+			continue
+		}
+		return sendComposed(ctx, mb, appConfig, newEmail, draft)
+	}
+}
+
+// sends the new email, or saves it as a draft
+func sendComposed(ctx context.Context, mb mailbox.Mailbox, appConfig config.Config, email t.NewEmail, draft bool) error {
+	ctx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+	defer cancel()
+	to := joinAddresses(email.To)
+	if draft {
+		if _, err := mb.CreateEmailDraft(ctx, email); err != nil {
+			return err
+		}
+		util.SomeoneTalks("SYS", "email to "+to+" saved as a draft", util.Gray)
+		return nil
+	}
+	if err := mb.SendEmail(ctx, email); err != nil {
+		return err
+	}
+	util.SomeoneTalks("SYS", "email successfully sent to "+to, util.Gray)
+	return nil
+}
+
+// Parses a composed draft: a "To:" line with whom the email is for, a "Subject:" line, then a blank line and the body.
+// Returns the recipients as the AI named them, the subject and the body.
+func parseComposed(draft string) ([]string, string, string, error) {
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(draft, "\r\n", "\n")), "\n")
+	names, subject := []string{}, ""
+	i := 0
+	for ; i < len(lines); i++ {
+		key, value, found := strings.Cut(lines[i], ":")
+		if !found {
+			break
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "to":
+			for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			continue
+		case "subject":
+			subject = strings.TrimSpace(value)
+			continue
+		}
+		break
+	}
+	if len(names) == 0 {
+		return nil, "", "", errors.New("no recipient in draft")
+	}
+	body := strings.TrimSpace(strings.Join(lines[i:], "\n"))
+	if body == "" {
+		return nil, "", "", errors.New("no body in draft")
+	}
+	return names, subject, body, nil
+}
+
+// Finds the addresses of the correspondents the name could refer to, most frequent correspondents first.
+// An address (like "tim@example.com" or "Tim <tim@example.com>") is used as it is; otherwise each word of the name
+// must be in the correspondent's address or display name.
+func resolveRecipient(name string, correspondents []emailcache.Correspondent) []*mail.Address {
+	if addr, err := mail.ParseAddress(name); err == nil {
+		return []*mail.Address{addr}
+	}
+	words := strings.Fields(strings.ToLower(name))
+	matches := make([]*mail.Address, 0)
+	if len(words) == 0 {
+		return matches
+	}
+	for _, c := range correspondents {
+		displayName := strings.ToLower(c.Name)
+		match := true
+		for _, word := range words {
+			match = match && (strings.Contains(c.Address, word) || strings.Contains(displayName, word))
+		}
+		if match {
+			matches = append(matches, &mail.Address{Name: c.Name, Address: c.Address})
+		}
+	}
+	return matches
+}
+
+// Gets the address of the named recipient. If the name matches more than one correspondent, or none, the user is asked to
+// choose one or enter an address. Returns false if the user gives up.
+func chooseRecipient(name string, correspondents []emailcache.Correspondent) (*mail.Address, bool) {
+	matches := resolveRecipient(name, correspondents)
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	if len(matches) > maxRecipientChoices {
+		matches = matches[:maxRecipientChoices]
+	}
+	if len(matches) == 0 {
+		util.SomeoneTalks("SYS", fmt.Sprintf("No one called %q found among your correspondents. Enter their address (or q to cancel):", name), util.Gray)
+	} else {
+		choices := make([]string, 0, len(matches))
+		for i, address := range matches {
+			choices = append(choices, fmt.Sprintf("%v. %s", i+1, formatAddress(address)))
+		}
+		util.SomeoneTalks("SYS", fmt.Sprintf("Who is %q?\n%s\nEnter a number or an address (or q to cancel):", name, strings.Join(choices, "\n")), util.Gray)
+	}
+	for {
+		input := util.GetUserInput()
+		if util.IsQuit(input) {
+			return nil, false
+		}
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(matches) {
+			return matches[n-1], true
+		}
+		if addr, err := mail.ParseAddress(input); err == nil {
+			return addr, true
+		}
+		util.SomeoneTalks("SYS", "That's not one of the choices, or an email address. Try again (or q to cancel):", util.Gray)
+	}
+}
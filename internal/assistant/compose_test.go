@@ -0,0 +1,85 @@
+package assistant
+
+import (
+	"reflect"
+	"testing"
+
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+)
+
+func TestParseComposed(t *testing.T) {
+	tests := []struct {
+		draft   string
+		names   []string
+		subject string
+		body    string
+		err     bool
+	}{
+		{
+			draft:   "\nTo: Tim\nSubject: A delay on Thursday\n\nMonsieur Tim,\n\nMy lord shall be late.\n",
+			names:   []string{"Tim"},
+			subject: "A delay on Thursday",
+			body:    "Monsieur Tim,\n\nMy lord shall be late.",
+		},
+		{
+			draft:   "to: Anna Smith, bob@example.com; Claire\nsubject: Supper\n\nNote: supper is at eight.",
+			names:   []string{"Anna Smith", "bob@example.com", "Claire"},
+			subject: "Supper",
+			body:    "Note: supper is at eight.",
+		},
+		{
+			draft: "To: Tim\nMonsieur Tim,\nNo subject, and no blank line.",
+			names: []string{"Tim"},
+			body:  "Monsieur Tim,\nNo subject, and no blank line.",
+		},
+		{draft: "Subject: Nobody\n\nA letter to no one.", err: true},
+		{draft: "To: Tim\nSubject: Nothing", err: true},
+	}
+	for i, test := range tests {
+		names, subject, body, err := parseComposed(test.draft)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %v: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %v: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, test.names) || subject != test.subject || body != test.body {
+			t.Errorf("case %v: got names %q, subject %q, body %q", i, names, subject, body)
+		}
+	}
+}
+
+func TestResolveRecipient(t *testing.T) {
+	correspondents := []emailcache.Correspondent{
+		{Address: "tim.berg@example.com", Count: 5},
+		{Address: "anna.smith@example.com", Name: "Anna Smith", Count: 3},
+		{Address: "timothy@blacsand.com", Count: 1},
+		{Address: "ts@blacsand.com", Name: "Tim Squeaks", Count: 1},
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"Tim", []string{"tim.berg@example.com", "timothy@blacsand.com", "Tim Squeaks <ts@blacsand.com>"}},
+		{"Tim Berg", []string{"tim.berg@example.com"}},
+		{"anna", []string{"Anna Smith <anna.smith@example.com>"}},
+		{"Anna Smith", []string{"Anna Smith <anna.smith@example.com>"}},
+		{"Mr Squeaks", []string{}},
+		{"Tim Squeaks", []string{"Tim Squeaks <ts@blacsand.com>"}},
+		{"squeaks@blacsand.com", []string{"squeaks@blacsand.com"}},
+		{"Squeaks <squeaks@blacsand.com>", []string{"Squeaks <squeaks@blacsand.com>"}},
+	}
+	for _, test := range tests {
+		got := make([]string, 0)
+		for _, addr := range resolveRecipient(test.name, correspondents) {
+			got = append(got, formatAddress(addr))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package assistant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	"github.com/webbben/mail-assistant/internal/personality"
+	"github.com/webbben/mail-assistant/internal/spamfilter"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// added to the drafting prompt when the user has delegates to forward emails to
+const delegatesNote = `
+
+Note: these people take care of letters for me:
+%s
+* If I ask to forward the letter, or pass it on to one of them, respond with exactly "<<<FORWARD>>>"
+`
+
+const forwardNotePrompt = `
+<<BASE-PERSONALITY>>
+Your name is <<AI-NAME>> and your duty is to write letters on behalf of your lord <<USER-NAME>>.
+Your lord is forwarding the letter below to <<DELEGATE>><<ROLE>>. Write a short note to go with it, telling <<DELEGATE>> why it's being passed on to them.
+Keep it to a few sentences - the letter itself is attached, so don't repeat it. Surround the note in "~~~" so it is easily parsed.
+<<INSTRUCTIONS>>`
+
+// lists the delegates for the drafting prompt, e.g. "* Mr Squeaks: head engineer"
+func delegatesPromptNote(delegates []config.Delegate) string {
+	if len(delegates) == 0 {
+		return ""
+	}
+	lines := make([]string, 0, len(delegates))
+	for _, d := range delegates {
+		line := "* " + d.Name
+		if d.Role != "" {
+			line += ": " + d.Role
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Sprintf(delegatesNote, strings.Join(lines, "\n"))
+}
+
+// Has the AI write the cover note for forwarding the email to the delegate. instructions are what the user asked for, if anything.
+// Long emails should be condensed first (see condenseEmail), so they fit in the drafting model's context.
+func writeForwardNote(ctx context.Context, provider llm.Provider, p personality.Personality, username string, delegate config.Delegate, email t.Email, instructions string) (string, error) {
+	d := map[string]string{
+		"base-personality": p.BasePersonality,
+		"ai-name":          p.Name,
+		"user-name":        username,
+		"delegate":         delegate.Name,
+		"role":             "",
+		"instructions":     "",
+	}
+	if delegate.Role != "" {
+		d["role"] = " (" + delegate.Role + ")"
+	}
+	if instructions != "" {
+		d["instructions"] = "\nHere is what your lord told you about it: " + instructions + "\n"
+	}
+	s, err := provider.ForTask(llm.DRAFT).Generate(ctx, util.InsertMappedValues(forwardNotePrompt, d), email.String())
+	if err != nil {
+		return "", err
+	}
+	note := strings.TrimSpace(s)
+	if strings.Contains(note, "~~~") {
+		note = strings.TrimSpace(parseReplyMessage(note))
+	}
+	if note == "" {
+		return "", errors.New("no forward note generated")
+	}
+	return note, nil
+}
+
+// makes the forward of an email to the delegate
+func newForward(delegate config.Delegate, note string, appConfig config.Config, style t.ReplyStyle) t.Forward {
+	return t.Forward{
+		To:     []*mail.Address{{Name: delegate.Name, Address: delegate.Address}},
+		Note:   note,
+		Inline: appConfig.Forward.Inline,
+		Style:  style,
+	}
+}
+
+// Sends the forward, or saves it as a draft, and records that the email was handled in the cache and with a label.
+func sendForward(ctx context.Context, mb mailbox.Mailbox, email t.Email, fwd t.Forward, draft bool, appConfig config.Config) error {
+	mailCtx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+	action := t.FORWARDED
+	if draft {
+		draftID, err := mb.CreateForwardDraft(mailCtx, email, fwd)
+		cancel()
+		if err != nil {
+			return err
+		}
+		emailcache.AddDraftToCache(email, draftID, t.FORWARDED)
+		action = t.DRAFTED
+		util.SomeoneTalks("SYS", fmt.Sprintf("(%s) Forward of the email from %s saved as a draft", util.CurrentTime(), email.From), util.Gray)
+	} else {
+		err := mb.Forward(mailCtx, email, fwd)
+		cancel()
+		if err != nil {
+			return err
+		}
+		emailcache.AddToCache(email, emailcache.FORWARD)
+		util.SomeoneTalks("SYS", fmt.Sprintf("(%s) Email from %s forwarded to %s", util.CurrentTime(), email.From, joinAddresses(fwd.To)), util.Gray)
+	}
+	spamfilter.Learn(email, false)
+	mailCtx, cancel = util.WithTimeout(ctx, appConfig.MailTimeout())
+	defer cancel()
+	if err := mb.MarkHandled(mailCtx, email.ID, action); err != nil {
+		log.Println("failed to label email:", err)
+	}
+	return nil
+}
+
+// Runs the forward the user asked for in the dialog: picks the delegate, has the AI write the cover note, and asks the user to confirm it.
+// request is the user's message asking for the forward, and condensed is the email as the AI was shown it.
+// Returns true if the email was forwarded (or the forward was saved as a draft).
+func forwardInteractive(ctx context.Context, mb mailbox.Mailbox, provider llm.Provider, email t.Email, condensed t.Email, request string, appConfig config.Config, p *personality.Personality) (bool, error) {
+	delegate, ok := chooseDelegate(request, appConfig.Forward.Delegates)
+	if !ok {
+		return false, nil
+	}
+	note, err := writeForwardNote(ctx, provider, *p, appConfig.UserName, delegate, condensed, request)
+	if err != nil {
+		return false, err
+	}
+	fwd := newForward(delegate, note, appConfig, p.ReplyStyle)
+	util.SomeoneTalks(p.Name, "~~~\n"+note+"\n~~~", util.Hi_blue)
+	util.SomeoneTalks("SYS", formatRecipients(t.Reply{To: fwd.To}), util.Gray)
+	confirmed, draft := confirmSend("forward", appConfig.DraftMode)
+	if !confirmed {
+		return false, nil
+	}
+	return true, sendForward(ctx, mb, email, fwd, draft, appConfig)
+}
+
+// Works out which delegate the user wants the email forwarded to, from the names in their request. If there's only one delegate,
+// it's them; otherwise, if the request doesn't name exactly one, the user is asked to choose. Returns false if they give up.
+func chooseDelegate(request string, delegates []config.Delegate) (config.Delegate, bool) {
+	if len(delegates) == 1 {
+		return delegates[0], true
+	}
+	if matches := matchDelegates(request, delegates); len(matches) == 1 {
+		return matches[0], true
+	}
+	choices := make([]string, 0, len(delegates))
+	for i, d := range delegates {
+		choices = append(choices, fmt.Sprintf("%v. %s <%s>", i+1, d.Name, d.Address))
+	}
+	util.SomeoneTalks("SYS", "Forward it to who?\n"+strings.Join(choices, "\n")+"\nEnter a number (or q to cancel):", util.Gray)
+	for {
+		input := util.GetUserInput()
+		if util.IsQuit(input) {
+			return config.Delegate{}, false
+		}
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(delegates) {
+			return delegates[n-1], true
+		}
+		util.SomeoneTalks("SYS", "That's not one of the choices. Try again (or q to cancel):", util.Gray)
+	}
+}
+
+// finds the delegates whose name or address is in the text
+func matchDelegates(text string, delegates []config.Delegate) []config.Delegate {
+	text = strings.ToLower(text)
+	matches := make([]config.Delegate, 0)
+	for _, d := range delegates {
+		if (d.Name != "" && strings.Contains(text, strings.ToLower(d.Name))) || (d.Address != "" && strings.Contains(text, strings.ToLower(d.Address))) {
+			matches = append(matches, d)
+		}
+	}
+	return matches
+}
+
+// Gets the delegate an auto-reply category forwards its emails to. If the email matched more than one such category, the first one is used.
+func categoryDelegate(cats []int, appConfig config.Config) (config.Delegate, bool) {
+	names := appConfig.AutoReply.Forward
+	for _, cat := range cats {
+		if cat <= 0 || cat > len(names) || names[cat-1] == "" {
+			continue
+		}
+		if delegate, ok := appConfig.Forward.Delegate(names[cat-1]); ok {
+			return delegate, true
+		}
+		log.Printf("auto-reply category %v forwards to %q, who isn't one of the delegates", cat, names[cat-1])
+	}
+	return config.Delegate{}, false
+}
+
+// forwards an email that matched an auto-reply category, to the category's delegate. condensed is the email as the AI is shown it.
+func autoForwardMessage(ctx context.Context, provider llm.Provider, mb mailbox.Mailbox, email t.Email, condensed t.Email, delegate config.Delegate, draft bool, appConfig config.Config, p personality.Personality) error {
+	note, err := writeForwardNote(ctx, provider, p, appConfig.UserName, delegate, condensed, "")
+	if err != nil {
+		return err
+	}
+	fwd := newForward(delegate, note, appConfig, p.ReplyStyle)
+	// drafts are for the user to review later, so they don't need confirming now
+	if !draft && !ConfirmRecipients(t.Reply{To: fwd.To}, "Do you want to forward the email from "+email.From+"?") {
+		return nil
+	}
+	return sendForward(ctx, mb, email, fwd, draft, appConfig)
+}
@@ -0,0 +1,93 @@
+package assistant
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/personality"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+var delegates = []config.Delegate{
+	{Name: "Mr Squeaks", Address: "squeaks@blacsand.com", Role: "head engineer, in charge of the Hamu project"},
+	{Name: "Anna", Address: "anna.smith@example.com"},
+}
+
+func TestMatchDelegates(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"forward this to mr squeaks please", []string{"Mr Squeaks"}},
+		{"send it on to anna.smith@example.com", []string{"Anna"}},
+		{"pass it to Anna and Mr Squeaks", []string{"Mr Squeaks", "Anna"}},
+		{"forward it", []string{}},
+	}
+	for _, test := range tests {
+		matches := matchDelegates(test.text, delegates)
+		names := make([]string, 0, len(matches))
+		for _, d := range matches {
+			names = append(names, d.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%q: expected %v, got %v", test.text, test.want, names)
+		}
+	}
+}
+
+func TestCategoryDelegate(t *testing.T) {
+	c := config.Config{
+		Forward:   config.Forward{Delegates: delegates},
+		AutoReply: config.AutoReply{Forward: []string{"", "mr squeaks", "Nobody"}},
+	}
+	tests := []struct {
+		cats []int
+		want string
+		ok   bool
+	}{
+		{[]int{0}, "", false},
+		{[]int{1}, "", false},
+		{[]int{2}, "Mr Squeaks", true},
+		{[]int{1, 2}, "Mr Squeaks", true},
+		{[]int{3}, "", false},
+		{[]int{4}, "", false},
+	}
+	for _, test := range tests {
+		delegate, ok := categoryDelegate(test.cats, c)
+		if ok != test.ok || delegate.Name != test.want {
+			t.Errorf("%v: expected %q %v, got %q %v", test.cats, test.want, test.ok, delegate.Name, ok)
+		}
+	}
+}
+
+func TestWriteForwardNote(t *testing.T) {
+	fake := llm.NewFake("Here is the note:\n~~~\nMr Squeaks, a question about Hamu for you.\n~~~")
+	p := personality.Personality{Name: "Planchet", BasePersonality: "You are a valet."}
+	email := types.Email{From: "bob@example.com", Subject: "Hamu", Body: "When is Hamu shipping?"}
+	note, err := writeForwardNote(context.Background(), fake, p, "Ben", delegates[0], email, "tell him it's urgent")
+	if err != nil {
+		t.Fatal("failed to write note:", err)
+	}
+	if note != "Mr Squeaks, a question about Hamu for you." {
+		t.Errorf("unexpected note %q", note)
+	}
+	if len(fake.Calls) != 1 || fake.Calls[0].Task != llm.DRAFT {
+		t.Fatalf("expected one draft call, got %+v", fake.Calls)
+	}
+	prompt := fake.Calls[0].SystemPrompt
+	for _, want := range []string{"Planchet", "Ben", "Mr Squeaks (head engineer, in charge of the Hamu project)", "tell him it's urgent"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("expected the prompt to contain %q, got:\n%s", want, prompt)
+		}
+	}
+	if strings.Contains(prompt, "<<") {
+		t.Errorf("expected every placeholder to be filled in, got:\n%s", prompt)
+	}
+
+	if _, err := writeForwardNote(context.Background(), llm.NewFake("~~~\n~~~"), p, "Ben", delegates[1], email, ""); err == nil {
+		t.Error("expected an error for an empty note")
+	}
+}
@@ -0,0 +1,52 @@
+package assistant
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// Shows who the reply will go to, and asks the user the given question to confirm sending it.
+func ConfirmRecipients(reply types.Reply, question string) bool {
+	util.SomeoneTalks("SYS", formatRecipients(reply), util.Gray)
+	return util.PromptYN(question)
+}
+
+// formats the recipients of a reply, like "To: a@example.com, b@example.com"
+func formatRecipients(reply types.Reply) string {
+	s := "To: " + joinAddresses(reply.To)
+	if len(reply.Cc) > 0 {
+		s += fmt.Sprintf("\nCc: %s", joinAddresses(reply.Cc))
+	}
+	return s
+}
+
+// shows the address with the person's name, if it's known
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return fmt.Sprintf("%s <%s>", addr.Name, addr.Address)
+}
+
+func joinAddresses(addrs []*mail.Address) string {
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, formatAddress(addr))
+	}
+	return strings.Join(list, ", ")
+}
+
+// Checks if an auto-reply setting (like reply_all) is set for any of the matched categories.
+// cats are the 1-based category indexes from getEmailCategories, and flags has the setting for each category.
+func anyCategory(cats []int, flags []bool) bool {
+	for _, cat := range cats {
+		if cat > 0 && cat <= len(flags) && flags[cat-1] {
+			return true
+		}
+	}
+	return false
+}
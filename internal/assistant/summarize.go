@@ -0,0 +1,147 @@
+package assistant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/webbben/mail-assistant/internal/debug"
+	"github.com/webbben/mail-assistant/internal/llm"
+)
+
+// emails with bodies longer than this are summarized before they are given to the drafting prompt
+const LongEmailLength = 3000
+
+// limit on how many times the chunk summaries are themselves summarized, in case the model doesn't actually condense the text
+const maxReduceRounds = 3
+
+const chunkSummaryPrompt = `
+You condense parts of long letters so they can be read quickly.
+You will be given one part of a longer letter. Summarize it in a few sentences, keeping every request, question, date, name, number and decision it mentions.
+Don't add anything that isn't in the text, and don't comment on the letter - just output the summary.
+`
+
+const combineSummaryPrompt = `
+You condense long letters so they can be read quickly.
+You will be given summaries of consecutive parts of one letter, in order. Combine them into a single summary of the whole letter, keeping every request, question, date, name, number and decision they mention.
+Don't add anything that isn't in the summaries, and don't comment on the letter - just output the summary.
+`
+
+// Condenses a long email body with a map-reduce pass: the body is split into chunks of at most chunkSize characters,
+// each chunk is summarized on its own, and then the chunk summaries are combined into one summary.
+// If the combined summaries still don't fit in one chunk, they are summarized again in the same way.
+func SummarizeLong(ctx context.Context, provider llm.Provider, body string, chunkSize int) (string, error) {
+	if chunkSize <= 0 {
+		return "", errors.New("chunk size must be positive")
+	}
+	summarizer := provider.ForTask(llm.SUMMARIZE)
+	text := body
+	for round := 0; round < maxReduceRounds; round++ {
+		chunks := splitChunks(text, chunkSize)
+		// map: summarize each chunk
+		summaries := make([]string, 0, len(chunks))
+		for i, chunk := range chunks {
+			debug.Printf("summarizing chunk %v of %v (%v chars)\n", i+1, len(chunks), len(chunk))
+			summary, err := summarize(ctx, summarizer, chunkSummaryPrompt, chunk)
+			if err != nil {
+				return "", err
+			}
+			summaries = append(summaries, summary)
+		}
+		if len(summaries) == 1 {
+			return summaries[0], nil
+		}
+		// reduce: combine the summaries, once they fit together
+		text = strings.Join(summaries, "\n\n")
+		if len(text) <= chunkSize {
+			return summarize(ctx, summarizer, combineSummaryPrompt, text)
+		}
+	}
+	debug.Println("summaries still too long after", maxReduceRounds, "rounds; truncating")
+	return text[:runeCut(text, chunkSize)], nil
+}
+
+func summarize(ctx context.Context, provider llm.Provider, system string, text string) (string, error) {
+	out, err := provider.Generate(ctx, system, text)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize: %w", err)
+	}
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return "", errors.New("failed to summarize: empty output")
+	}
+	return out, nil
+}
+
+// splits the text into chunks of at most size characters, breaking between paragraphs where possible.
+// Paragraphs too long to fit in a chunk are broken between lines, then words, and finally wherever they need to be.
+func splitChunks(text string, size int) []string {
+	text = strings.TrimSpace(text)
+	if len(text) <= size {
+		return []string{text}
+	}
+	chunks := []string{}
+	current := ""
+	add := func(piece string) {
+		if current == "" {
+			current = piece
+			return
+		}
+		if len(current)+2+len(piece) <= size {
+			current += "\n\n" + piece
+			return
+		}
+		chunks = append(chunks, current)
+		current = piece
+	}
+	for _, para := range strings.Split(text, "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		if len(para) <= size {
+			add(para)
+			continue
+		}
+		for _, piece := range splitLong(para, size) {
+			add(piece)
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// breaks a single paragraph that is longer than size into pieces that fit
+func splitLong(para string, size int) []string {
+	pieces := []string{}
+	for len(para) > size {
+		cut := strings.LastIndex(para[:size], "\n")
+		if cut <= 0 {
+			cut = strings.LastIndex(para[:size], " ")
+		}
+		if cut <= 0 {
+			cut = runeCut(para, size)
+		}
+		if cut <= 0 {
+			cut = size
+		}
+		pieces = append(pieces, strings.TrimSpace(para[:cut]))
+		para = strings.TrimSpace(para[cut:])
+	}
+	if para != "" {
+		pieces = append(pieces, para)
+	}
+	return pieces
+}
+
+// moves the cut index back to the start of a character, so multi-byte characters aren't split
+func runeCut(s string, i int) int {
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
@@ -0,0 +1,95 @@
+package assistant
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		text   string
+		size   int
+		expOut []string
+	}{
+		{"short letter", 100, []string{"short letter"}},
+		{"one two\n\nthree four\n\nfive six", 20, []string{"one two\n\nthree four", "five six"}},
+		{"aaaa bbbb cccc dddd", 10, []string{"aaaa bbbb", "cccc dddd"}},
+		{"line one\nline two\n\nend", 12, []string{"line one", "line two", "end"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"ééééé", 3, []string{"é", "é", "é", "é", "é"}},
+	}
+
+	for i, test := range tests {
+		out := splitChunks(test.text, test.size)
+		if fmt.Sprintf("%q", out) != fmt.Sprintf("%q", test.expOut) {
+			t.Errorf("case %v, expected: %q, output: %q", i, test.expOut, out)
+		}
+		for _, chunk := range out {
+			if len(chunk) > test.size {
+				t.Errorf("case %v, chunk longer than %v: %q", i, test.size, chunk)
+			}
+		}
+	}
+}
+
+func TestSummarizeLong(t *testing.T) {
+	paragraph := strings.Repeat("The harvest festival will be held in the village square. ", 10)
+	body := strings.TrimSpace(strings.Repeat(paragraph+"\n\n", 6))
+
+	fake := llm.NewFake()
+	fake.Handler = func(call llm.FakeCall) (string, error) {
+		if call.SystemPrompt == combineSummaryPrompt {
+			return "A festival in the square.", nil
+		}
+		return "Festival part.", nil
+	}
+
+	out, err := SummarizeLong(context.Background(), fake, body, 1200)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if out != "A festival in the square." {
+		t.Errorf("expected the combined summary, but got: %q", out)
+	}
+	chunks := splitChunks(body, 1200)
+	if len(fake.Calls) != len(chunks)+1 {
+		t.Errorf("expected %v calls (one per chunk, plus combining), but got %v", len(chunks)+1, len(fake.Calls))
+	}
+	for i, call := range fake.Calls {
+		if call.Task != llm.SUMMARIZE {
+			t.Errorf("call %v used task %q", i, call.Task)
+		}
+	}
+}
+
+func TestSummarizeLongSingleChunk(t *testing.T) {
+	fake := llm.NewFake("A short summary.")
+	out, err := SummarizeLong(context.Background(), fake, "Not so long after all.", 1000)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if out != "A short summary." || len(fake.Calls) != 1 {
+		t.Errorf("expected one summary call, but got %v calls and output %q", len(fake.Calls), out)
+	}
+}
+
+func TestCondenseEmail(t *testing.T) {
+	email := types.Email{From: "bard@village.fr", Subject: "Many words", Body: strings.Repeat("word ", LongEmailLength)}
+	fake := llm.NewFake("Just many words.")
+	condensed, abridged := condenseEmail(context.Background(), fake, email, config.Config{})
+	if !abridged || condensed.Body != "Just many words." {
+		t.Errorf("long email wasn't condensed. abridged: %v, body: %q", abridged, condensed.Body)
+	}
+
+	short := types.Email{From: "bard@village.fr", Subject: "A note", Body: "A short note."}
+	condensed, abridged = condenseEmail(context.Background(), fake, short, config.Config{})
+	if abridged || condensed.Body != short.Body {
+		t.Errorf("short email was changed. abridged: %v, body: %q", abridged, condensed.Body)
+	}
+}
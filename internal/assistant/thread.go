@@ -0,0 +1,41 @@
+package assistant
+
+import (
+	"context"
+	"log"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// put in place of the transcript when there are no other messages in the conversation, or they can't be loaded
+const noThreadNote = "(none - this is the first letter in the conversation)"
+
+// Gets the transcript of the other messages in the email's conversation, for the thread placeholder in the drafting prompt.
+// If it's longer than maxChars, the oldest messages are left out.
+func threadTranscript(ctx context.Context, mb mailbox.Mailbox, email t.Email, maxChars int, appConfig config.Config) string {
+	if email.ThreadID == "" {
+		return noThreadNote
+	}
+	ctx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+	defer cancel()
+	messages, err := mb.Thread(ctx, email)
+	if err != nil {
+		log.Println("failed to get email thread:", err)
+		return noThreadNote
+	}
+	// the email itself is already in the prompt
+	others := make([]t.ThreadMessage, 0, len(messages))
+	for _, m := range messages {
+		if m.ID != email.ID {
+			others = append(others, m)
+		}
+	}
+	if len(others) == 0 {
+		return noThreadNote
+	}
+	return message.Transcript(others, maxChars)
+}
@@ -3,24 +3,175 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"strings"
 )
 
+// limit on the number of messages listed in one inbox check, if none is configured
+const DefaultListLimit = 500
+
 // configuration for this application
 type Config struct {
 	UserName        string    `json:"user_name"`         // name of the human using this application
 	PersonalityID   string    `json:"personality_id"`    // id of the personality file for the AI to use
-	GmailAddr       string    `json:"gmail_address"`     // gmail address to use
-	InboxCheckFreq  int       `json:"inbox_check_freq"`  // frequency in minutes in which the gmail inbox is checked for mail
+	GmailAddr       string    `json:"gmail_address"`     // the user's email address. with an imap mailbox, this is the address mail is sent from
+	Aliases         []string  `json:"aliases"`           // other addresses of the user, which are left out when replying to everyone on an email
+	InboxCheckFreq  int       `json:"inbox_check_freq"`  // frequency in minutes in which the inbox is checked for mail
 	EmailBatchLimit int       `json:"email_batch_limit"` // limit to the number of emails that will be processed in a single batch
 	LookbackDays    int       `json:"lookback_days"`     // number of days to look back in the inbox (0 = no limit)
+	InboxQuery      string    `json:"inbox_query"`       // extra gmail search terms for the mail to look at, e.g. "is:unread -category:social" (gmail only)
+	ListLimit       int       `json:"list_limit"`        // limit on the number of messages listed in one inbox check (0 = default of 500)
 	Debug           bool      `json:"debug"`             // if enabled, debug statements will be printed to the console
+	GmailTimeout    int       `json:"gmail_timeout"`     // older name for mailbox.timeout, used if that isn't set
+	SpamThreshold   float64   `json:"spam_threshold"`    // emails the spam filter gives at least this probability (0 to 1) of being spam are ignored (0 = spam filter off)
+	DraftMode       bool      `json:"draft_mode"`        // if enabled, replies are saved as drafts instead of being sent
+	AttachmentDir   string    `json:"attachment_dir"`    // directory email attachments are saved to (default: attachments)
+	Mailbox         Mailbox   `json:"mailbox"`
+	Forward         Forward   `json:"forward"`
 	AutoReply       AutoReply `json:"auto_reply"`
+	LLM             LLM       `json:"llm"`
+	Budget          Budget    `json:"budget"`
+	Labels          Labels    `json:"labels"`
+}
+
+// where mail is read from and sent through
+type Mailbox struct {
+	Provider string     `json:"provider"`  // which kind of mailbox to use: "gmail" (default) or "imap", for any other provider (sending through smtp)
+	IMAP     MailServer `json:"imap"`      // the imap server mail is read from
+	SMTP     MailServer `json:"smtp"`      // the smtp server mail is sent through
+	Folders  Folders    `json:"folders"`   // imap folders
+	SaveSent bool       `json:"save_sent"` // if set, sent mail is also saved to the sent folder. most servers other than gmail don't do this themselves.
+	Timeout  int        `json:"timeout"`   // seconds a single gmail API call or imap/smtp session may take before it is aborted (0 = gmail_timeout, or no limit)
+}
+
+// how to connect to an imap or smtp server
+type MailServer struct {
+	Host     string         `json:"host"`
+	Port     int            `json:"port"`     // (default: 993 for imap and 465 for smtp with tls, otherwise 143 for imap and 587 for smtp)
+	Security string         `json:"security"` // "tls" (default), "starttls", or "none" (only for servers on the same machine)
+	Username string         `json:"username"` // (default: the gmail_address)
+	Password PasswordSource `json:"password"` // where the password is loaded from
+}
+
+// names of the imap folders the valet uses
+type Folders struct {
+	Inbox   string `json:"inbox"`   // (default: INBOX)
+	Sent    string `json:"sent"`    // (default: Sent)
+	Drafts  string `json:"drafts"`  // (default: Drafts)
+	Archive string `json:"archive"` // folder emails are moved to when they're archived (default: Archive)
+}
+
+// labels applied to emails the valet has handled, so what it did shows up in gmail. with an imap mailbox, they're set as keywords (flags) instead.
+type Labels struct {
+	Enabled     bool   `json:"enabled"`
+	Replied     string `json:"replied"`      // label for emails the user replied to (default: Valet/Replied)
+	Ignored     string `json:"ignored"`      // label for emails the user or the spam checks ignored (default: Valet/Ignored)
+	AutoReplied string `json:"auto_replied"` // label for emails that got an auto-reply (default: Valet/AutoReplied)
+	Drafted     string `json:"drafted"`      // label for emails whose reply was saved as a draft (default: Valet/Drafted)
+	Forwarded   string `json:"forwarded"`    // label for emails forwarded to a delegate (default: Valet/Forwarded)
+	MarkRead    bool   `json:"mark_read"`    // if set, emails the user or auto-reply handled are marked as read
+	Archive     bool   `json:"archive"`      // if set, emails the user or auto-reply handled are archived (removed from the inbox)
+}
+
+// people emails can be forwarded to, and how forwards are sent
+type Forward struct {
+	Delegates []Delegate `json:"delegates"`
+	Inline    bool       `json:"inline"` // if set, the email's text is put below the cover note, instead of attaching the whole email (message/rfc822)
+}
+
+// someone who takes care of emails for the user
+type Delegate struct {
+	Name    string `json:"name"` // how the user and the AI refer to them, e.g. "Mr Squeaks"
+	Address string `json:"address"`
+	Role    string `json:"role"` // what they take care of, which the AI is told about, e.g. "head engineer, in charge of the Hamu project"
+}
+
+// finds the delegate with the given name or address, ignoring case
+func (f Forward) Delegate(name string) (Delegate, bool) {
+	name = strings.TrimSpace(name)
+	for _, d := range f.Delegates {
+		if strings.EqualFold(d.Name, name) || strings.EqualFold(d.Address, name) {
+			return d, true
+		}
+	}
+	return Delegate{}, false
+}
+
+// daily limits on model usage. once a limit is reached, auto-reply is paused until the next day.
+type Budget struct {
+	DailyTokens int     `json:"daily_tokens"` // limit on prompt + completion tokens used per day (0 = no limit)
+	DailyCost   float64 `json:"daily_cost"`   // limit on the estimated cost per day, in USD (0 = no limit)
+}
+
+// configuration for the LLM backend
+type LLM struct {
+	Provider string                 `json:"provider"` // which LLM provider to use: "ollama" (default) or "openai"
+	Model    string                 `json:"model"`    // model used for all tasks, unless overridden for a task (default depends on the provider)
+	Host     string                 `json:"host"`     // address of the ollama server (default: OLLAMA_HOST env var, or localhost)
+	BaseURL  string                 `json:"base_url"` // base URL of the openai API, or a compatible server like llama.cpp or vLLM (default: https://api.openai.com/v1)
+	APIKey   APIKeySource           `json:"api_key"`  // where the openai API key is loaded from
+	Options  map[string]interface{} `json:"options"`  // generation options used for all tasks (e.g. temperature, num_ctx, top_p, seed)
+	Timeout  int                    `json:"timeout"`  // seconds a single model call may take before it is aborted (0 = no limit)
+	Tasks    map[string]LLMTask     `json:"tasks"`    // per-task overrides. tasks are "draft", "categorize", "spam", "phrase" and "summarize"
+	Cache    LLMCache               `json:"cache"`
+	Prices   map[string]Price       `json:"prices"` // prices of models by name, for estimating the cost of calls. these override the built in prices.
+}
+
+// price of a model, in USD per million tokens
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// on-disk cache of model outputs. Only deterministic calls (temperature 0) are cached.
+type LLMCache struct {
+	Enabled    bool   `json:"enabled"`
+	Dir        string `json:"dir"`         // directory the cached outputs are stored in (default: "llmcache")
+	MaxEntries int    `json:"max_entries"` // limit on the number of cached outputs; the oldest are removed first (0 = no limit)
+	MaxSizeMB  int    `json:"max_size_mb"` // limit on the total size of the cached outputs, in MB (0 = no limit)
+	TTLHours   int    `json:"ttl_hours"`   // hours a cached output can be used before it expires (0 = never expires)
+	Bypass     bool   `json:"bypass"`      // if set, cached outputs aren't used, but new outputs are still saved to the cache
+}
+
+// where to load an API key from. the environment variable is used if it's set, otherwise the file is read.
+type APIKeySource struct {
+	Env  string `json:"env"`  // environment variable holding the key (default: OPENAI_API_KEY)
+	File string `json:"file"` // file holding the key (default: cred/openai.txt)
+}
+
+// where to load a mail server password from. the environment variable is used if it's set, otherwise the file is read.
+// there are no defaults; with neither set, the password is empty.
+type PasswordSource struct {
+	Env  string `json:"env"`  // environment variable holding the password, e.g. IMAP_PASSWORD
+	File string `json:"file"` // file holding the password, e.g. cred/imap.txt. it's an error if the file doesn't exist
+}
+
+// model and generation options for a specific task, which override the general LLM settings
+type LLMTask struct {
+	Model   string                 `json:"model"`
+	Options map[string]interface{} `json:"options"`
+	Timeout int                    `json:"timeout"`
 }
 
 type AutoReply struct {
 	Enabled      bool       `json:"enabled"`
 	Categories   []string   `json:"categories"`
 	Instructions [][]string `json:"instructions"`
+	ReplyAll     []bool     `json:"reply_all"` // for each category, whether its auto-replies go to everyone on the email instead of just the sender
+	Draft        []bool     `json:"draft"`     // for each category, whether its auto-replies are saved as drafts for review instead of being sent
+	Forward      []string   `json:"forward"`   // for each category, the name of the delegate its emails are forwarded to, if any
+}
+
+// gets the user's own addresses: the gmail address and any aliases
+func (c Config) OwnAddresses() []string {
+	return append([]string{c.GmailAddr}, c.Aliases...)
+}
+
+// gets how many seconds a single mailbox call may take: mailbox.timeout, or gmail_timeout if that isn't set (0 = no limit)
+func (c Config) MailTimeout() int {
+	if c.Mailbox.Timeout > 0 {
+		return c.Mailbox.Timeout
+	}
+	return c.GmailTimeout
 }
 
 func LoadConfig() (Config, error) {
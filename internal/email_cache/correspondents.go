@@ -0,0 +1,86 @@
+package emailcache
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// file the user's correspondents are saved to
+const correspondentsPath = "correspondents.json"
+
+// someone the user has gotten email from
+type Correspondent struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name"`  // their display name, from their latest email that had one
+	Count   int       `json:"count"` // number of their emails the user handled
+	Last    time.Time `json:"last"`  // date of their latest email
+}
+
+// the user's correspondents by address. Unlike the cache, they aren't removed after the lookback period,
+// so people the user hasn't heard from in a while can still be written to.
+var correspondents = make(map[string]Correspondent)
+
+// counts the cached email towards its sender. Senders the user only ignored aren't included, since they're probably not people the user writes to.
+func addCorrespondent(datum EmailCacheDatum) {
+	if datum.Action == IGNORE || datum.From == "" {
+		return
+	}
+	address := strings.ToLower(datum.From)
+	c, ok := correspondents[address]
+	if !ok {
+		c = Correspondent{Address: address}
+	}
+	c.Count++
+	if datum.SenderName != "" && (c.Name == "" || !datum.Date.Before(c.Last)) {
+		c.Name = datum.SenderName
+	}
+	if datum.Date.After(c.Last) {
+		c.Last = datum.Date
+	}
+	correspondents[address] = c
+}
+
+// Gets the senders of the emails the user replied to (or otherwise handled), most frequent first.
+func Correspondents() []Correspondent {
+	list := make([]Correspondent, 0, len(correspondents))
+	for _, c := range correspondents {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		if !list[i].Last.Equal(list[j].Last) {
+			return list[i].Last.After(list[j].Last)
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+func writeCorrespondents() error {
+	data, err := json.Marshal(Correspondents())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(correspondentsPath, data, 0644)
+}
+
+func loadCorrespondents() error {
+	data, err := os.ReadFile(correspondentsPath)
+	if err != nil {
+		return err
+	}
+	list := []Correspondent{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	correspondents = make(map[string]Correspondent)
+	for _, c := range list {
+		correspondents[c.Address] = c
+	}
+	return nil
+}
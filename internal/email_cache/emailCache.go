@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -14,10 +15,15 @@ import (
 )
 
 const (
-	IGNORE = "IGNORE"
-	REPLY  = "REPLY"
+	IGNORE  = "IGNORE"
+	REPLY   = "REPLY"
+	DRAFT   = "DRAFT"   // a reply was saved as a gmail draft, for the user to review and send themselves
+	FORWARD = "FORWARD" // the email was forwarded to someone else to handle
 )
 
+// category for a decision the user made themselves, as opposed to one made by the app's checks (spam filter, bulk mail, etc)
+const USER = "USER"
+
 var cache map[string]EmailCacheDatum = make(map[string]EmailCacheDatum)
 var unsavedChanges int
 
@@ -27,12 +33,33 @@ type EmailCacheDatum struct {
 	From       string    // who is the email from
 	Action     string    // how was this email dealt with
 	Categories string    // different categories attributed to this email (e.g. spam, noreply, etc)
+	DraftID    string    // ID of the gmail draft of the reply, if it was saved as a draft
+	SenderName string    // display name of the sender, if they have one
 }
 
 func (datum EmailCacheDatum) String() string {
-	return fmt.Sprintf("%s %s %v %s %s", datum.MessageID, datum.From, datum.Date.Unix(), datum.Action, datum.Categories)
+	s := fmt.Sprintf("%s %s %v %s %s", datum.MessageID, datum.From, datum.Date.Unix(), datum.Action, datum.Categories)
+	if datum.DraftID == "" && datum.SenderName == "" {
+		return s
+	}
+	// optional fields can't be left empty if another one follows them, or the next field would be read in their place
+	if datum.Categories == "" {
+		s += noValue
+	}
+	if datum.DraftID == "" {
+		s += " " + noValue
+	} else {
+		s += " " + datum.DraftID
+	}
+	if datum.SenderName != "" {
+		s += " " + url.QueryEscape(datum.SenderName)
+	}
+	return s
 }
 
+// written in place of an empty field when another field follows it
+const noValue = "-"
+
 func parseCacheLine(line string) (EmailCacheDatum, error) {
 	fields := strings.Fields(line)
 	if len(fields) < 4 {
@@ -49,9 +76,19 @@ func parseCacheLine(line string) (EmailCacheDatum, error) {
 		Date:      time.Unix(int64(timestamp), 0),
 		Action:    fields[3],
 	}
-	if len(fields) > 4 {
+	if len(fields) > 4 && fields[4] != noValue {
 		datum.Categories = fields[4]
 	}
+	if len(fields) > 5 && fields[5] != noValue {
+		datum.DraftID = fields[5]
+	}
+	if len(fields) > 6 {
+		name, err := url.QueryUnescape(fields[6])
+		if err != nil {
+			return EmailCacheDatum{}, err
+		}
+		datum.SenderName = name
+	}
 	return datum, nil
 }
 
@@ -60,16 +97,31 @@ func AddToCache(email t.Email, action string, categories ...string) {
 	if err := checkInit(); err != nil {
 		log.Fatal("failed to init cache:", err)
 	}
-	cache[email.ID] = EmailCacheDatum{
+	_, cached := cache[email.ID]
+	datum := EmailCacheDatum{
 		MessageID:  email.ID,
 		From:       strings.ReplaceAll(email.From, " ", "_"), // just in case some spaces somehow snuck in
 		Date:       email.Date,
 		Action:     action,
 		Categories: strings.Join(categories, ";"),
+		SenderName: email.SenderName,
+	}
+	cache[email.ID] = datum
+	// an email that's cached again (e.g. a draft that was sent) isn't counted twice
+	if !cached {
+		addCorrespondent(datum)
 	}
 	unsavedChanges++
 }
 
+// adds an email whose reply was saved as a gmail draft, along with the ID of the draft
+func AddDraftToCache(email t.Email, draftID string, categories ...string) {
+	AddToCache(email, DRAFT, categories...)
+	datum := cache[email.ID]
+	datum.DraftID = draftID
+	cache[email.ID] = datum
+}
+
 // checks the in-memory cache for the given message ID, and also returns its cache data if found
 func IsCached(messageID string) (EmailCacheDatum, bool) {
 	if err := checkInit(); err != nil {
@@ -79,6 +131,18 @@ func IsCached(messageID string) (EmailCacheDatum, bool) {
 	return datum, isCached
 }
 
+// returns all the entries in the in-memory cache
+func Entries() []EmailCacheDatum {
+	if err := checkInit(); err != nil {
+		log.Fatal("failed to init cache:", err)
+	}
+	entries := make([]EmailCacheDatum, 0, len(cache))
+	for _, datum := range cache {
+		entries = append(entries, datum)
+	}
+	return entries
+}
+
 // writes the current data in the in-memory cache to the disk, overwriting any previous data in the file
 func WriteCacheToDisk() error {
 	if unsavedChanges == 0 {
@@ -97,12 +161,19 @@ func WriteCacheToDisk() error {
 			return err
 		}
 	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
 	unsavedChanges = 0
-	return writer.Flush()
+	return writeCorrespondents()
 }
 
-// loads the cache from its file on the disk into application memory to be accessible
+// loads the cache from its file on the disk into application memory to be accessible. The user's correspondents are loaded too,
+// even if the cache file is missing.
 func LoadCacheFromDisk() error {
+	if err := loadCorrespondents(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
 	file, err := os.Open("emailcache")
 	if err != nil {
 		return err
@@ -119,6 +190,12 @@ func LoadCacheFromDisk() error {
 		}
 		cache[datum.MessageID] = datum
 	}
+	// e.g. the correspondents file is new, and the cache was written before it existed
+	if len(correspondents) == 0 {
+		for _, datum := range cache {
+			addCorrespondent(datum)
+		}
+	}
 	unsavedChanges = 0
 	return nil
 }
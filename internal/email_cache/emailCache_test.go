@@ -0,0 +1,76 @@
+package emailcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+func TestCacheLine(t *testing.T) {
+	date := time.Unix(1719828000, 0)
+	tests := []EmailCacheDatum{
+		{MessageID: "m1", From: "alice@example.com", Date: date, Action: IGNORE},
+		{MessageID: "m2", From: "bob@example.com", Date: date, Action: REPLY, Categories: "RESTORED;AUTO_REPLIED"},
+		{MessageID: "m3", From: "carol@example.com", Date: date, Action: DRAFT, DraftID: "r-123"},
+		{MessageID: "m4", From: "dan@example.com", Date: date, Action: DRAFT, Categories: "AUTO_REPLIED", DraftID: "r-456"},
+		{MessageID: "m5", From: "tim@example.com", Date: date, Action: REPLY, SenderName: "Tim Berg"},
+		{MessageID: "m6", From: "eve@example.com", Date: date, Action: DRAFT, Categories: "USER", DraftID: "r-789", SenderName: "Ève O'Neil + Co"},
+	}
+	for _, datum := range tests {
+		parsed, err := parseCacheLine(datum.String())
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", datum.String(), err)
+		}
+		if parsed != datum {
+			t.Errorf("cache line %q didn't round trip: got %+v", datum.String(), parsed)
+		}
+	}
+}
+
+func TestCorrespondents(t *testing.T) {
+	cache = make(map[string]EmailCacheDatum)
+	correspondents = make(map[string]Correspondent)
+	t.Cleanup(func() {
+		cache = make(map[string]EmailCacheDatum)
+		correspondents = make(map[string]Correspondent)
+	})
+	day := func(d int) time.Time { return time.Date(2024, 7, d, 0, 0, 0, 0, time.UTC) }
+	for i, email := range []types.Email{
+		{From: "tim@example.com", Date: day(1), SenderName: "Tim"},
+		{From: "Tim@Example.com", Date: day(3), SenderName: "Tim Berg"},
+		{From: "anna@example.com", Date: day(2)},
+		{From: "news@shop.example.com", Date: day(4)},
+		{From: "zoe@example.com", Date: day(5), SenderName: "Zoe"},
+	} {
+		email.ID = fmt.Sprint("m", i)
+		action := REPLY
+		if email.From == "news@shop.example.com" {
+			action = IGNORE
+		}
+		AddToCache(email, action)
+	}
+	// caching an email again doesn't count it twice
+	AddToCache(types.Email{ID: "m0", From: "tim@example.com", Date: day(1)}, REPLY)
+	// correspondents are kept after their emails are removed from the cache
+	RemoveOldEntries(1)
+	if len(cache) != 0 {
+		t.Fatalf("expected the old entries to be removed, got %v", len(cache))
+	}
+
+	want := []Correspondent{
+		{Address: "tim@example.com", Name: "Tim Berg", Count: 2, Last: day(3)},
+		{Address: "zoe@example.com", Name: "Zoe", Count: 1, Last: day(5)},
+		{Address: "anna@example.com", Count: 1, Last: day(2)},
+	}
+	got := Correspondents()
+	if len(got) != len(want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%v: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	t "github.com/webbben/mail-assistant/internal/types"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Downloads the content of one of the email's attachments. Large attachments are fetched through the attachments API,
+// while small ones come with the message itself.
+// The call is aborted if the context is cancelled or times out.
+func GetAttachment(ctx context.Context, srv *gmail.Service, gmailAddr string, messageID string, attachment t.Attachment) ([]byte, error) {
+	msg, err := srv.Users.Messages.Get(gmailAddr, messageID).Format("full").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	part := findPart(msg.Payload, attachment.PartID)
+	if part == nil || part.Body == nil {
+		return nil, fmt.Errorf("attachment %s not found in message %s", attachment.Filename, messageID)
+	}
+	data := part.Body.Data
+	if part.Body.AttachmentId != "" {
+		body, err := srv.Users.Messages.Attachments.Get(gmailAddr, messageID, part.Body.AttachmentId).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		data = body.Data
+	}
+	return decodeBase64URL(data)
+}
+
+// finds the part of the message with the given part ID
+func findPart(part *gmail.MessagePart, partID string) *gmail.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.PartId == partID {
+		return part
+	}
+	for _, child := range part.Parts {
+		if found := findPart(child, partID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// decodes data from the gmail API, which is URL safe base64, with or without padding
+func decodeBase64URL(data string) ([]byte, error) {
+	if decoded, err := base64.URLEncoding.DecodeString(data); err == nil {
+		return decoded, nil
+	}
+	return base64.RawURLEncoding.DecodeString(data)
+}
@@ -0,0 +1,60 @@
+package gmail
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+var attachmentEmail = strings.ReplaceAll(`From: Alice <alice@example.com>
+To: me@example.com
+Date: Mon, 1 Jul 2024 10:00:00 +0000
+Subject: Notes
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="mixed"
+
+--mixed
+Content-Type: text/plain; charset="utf-8"
+
+Notes from the meeting are attached.
+
+--mixed
+Content-Type: text/plain; charset="utf-8"; name="notes.txt"
+Content-Disposition: attachment; filename="notes.txt"
+Content-Transfer-Encoding: base64
+
+TGF1bmNoIG1vdmVkIHRvIEF1Z3VzdC4=
+
+--mixed--
+`, "\n", "\r\n")
+
+func TestGetAttachment(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	fake.add("m1", attachmentEmail, "INBOX")
+	email, err := ProcessEmail(context.Background(), srv, "m1", "me")
+	if err != nil {
+		t.Fatal("failed to process email:", err)
+	}
+	if email.Body != "Notes from the meeting are attached." {
+		t.Errorf("unexpected body %q", email.Body)
+	}
+	if len(email.Attachments) != 1 {
+		t.Fatalf("expected one attachment, got %+v", email.Attachments)
+	}
+	attachment := email.Attachments[0]
+	if attachment.Filename != "notes.txt" || attachment.MimeType != "text/plain" || attachment.Size != 23 || attachment.PartID != "1" {
+		t.Errorf("unexpected attachment %+v", attachment)
+	}
+	data, err := GetAttachment(context.Background(), srv, "me", "m1", attachment)
+	if err != nil {
+		t.Fatal("failed to get attachment:", err)
+	}
+	if string(data) != "Launch moved to August." {
+		t.Errorf("unexpected attachment content %q", data)
+	}
+
+	attachment.PartID = "5"
+	if _, err := GetAttachment(context.Background(), srv, "me", "m1", attachment); err == nil {
+		t.Error("expected an error for a missing attachment")
+	}
+}
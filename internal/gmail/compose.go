@@ -0,0 +1,43 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Sends a new email, starting a new thread.
+// The call is aborted if the context is cancelled or times out.
+func SendEmail(ctx context.Context, srv *gmail.Service, userID string, email t.NewEmail) error {
+	msg, err := createEmail(userID, email)
+	if err != nil {
+		return err
+	}
+	_, err = srv.Users.Messages.Send(userID, msg).Context(ctx).Do()
+	return err
+}
+
+// Saves a new email as a draft instead of sending it. Returns the ID of the new draft.
+// The call is aborted if the context is cancelled or times out.
+func CreateEmailDraft(ctx context.Context, srv *gmail.Service, userID string, email t.NewEmail) (string, error) {
+	msg, err := createEmail(userID, email)
+	if err != nil {
+		return "", err
+	}
+	draft, err := srv.Users.Drafts.Create(userID, &gmail.Draft{Message: msg}).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return draft.Id, nil
+}
+
+func createEmail(userID string, email t.NewEmail) (*gmail.Message, error) {
+	raw, err := message.RawEmail(userID, email)
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw)}, nil
+}
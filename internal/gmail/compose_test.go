@@ -0,0 +1,71 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/types"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+)
+
+func TestSendEmail(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	email := types.NewEmail{
+		To:      []*mail.Address{{Name: "Tim", Address: "tim@example.com"}},
+		Cc:      []*mail.Address{{Address: "sam@example.com"}},
+		Subject: "Running late Thursday",
+		Body:    "I'll be about 20 minutes late on Thursday.",
+	}
+	if err := SendEmail(context.Background(), srv, "me@example.com", email); err != nil {
+		t.Fatal("failed to send email:", err)
+	}
+	if len(fake.sent) != 1 {
+		t.Fatalf("expected one sent message, got %v", len(fake.sent))
+	}
+	if fake.sent[0].ThreadId != "sent-1" {
+		t.Errorf("a new email should start its own thread, got thread %q", fake.sent[0].ThreadId)
+	}
+	raw, err := base64.URLEncoding.DecodeString(fake.sent[0].Raw)
+	if err != nil {
+		t.Fatal("failed to decode sent message:", err)
+	}
+	body, headers, err := emailparse.ParseEmail(string(raw))
+	if err != nil {
+		t.Fatal("failed to parse sent message:", err)
+	}
+	if body != email.Body {
+		t.Errorf("expected body %q, got %q", email.Body, body)
+	}
+	for key, want := range map[string]string{
+		"To":      `"Tim" <tim@example.com>`,
+		"Cc":      "<sam@example.com>",
+		"Subject": "Running late Thursday",
+		"From":    "me@example.com",
+	} {
+		if got := headers[key]; len(got) == 0 || got[0] != want {
+			t.Errorf("expected %s %q, got %v", key, want, got)
+		}
+	}
+	for _, key := range []string{"In-Reply-To", "References"} {
+		if _, ok := headers[key]; ok {
+			t.Errorf("a new email shouldn't have a %s header", key)
+		}
+	}
+	if strings.Contains(string(raw), "wrote:") {
+		t.Error("a new email shouldn't quote anything")
+	}
+
+	draftID, err := CreateEmailDraft(context.Background(), srv, "me@example.com", email)
+	if err != nil {
+		t.Fatal("failed to create draft:", err)
+	}
+	if draft := fake.drafts[draftID]; draft == nil || draft.Message.ThreadId != "" {
+		t.Errorf("expected a draft outside any thread, got %+v", draft)
+	}
+	if err := SendEmail(context.Background(), srv, "me@example.com", types.NewEmail{Subject: "no one"}); err == nil {
+		t.Error("expected an error for an email without recipients")
+	}
+}
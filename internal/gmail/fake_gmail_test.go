@@ -0,0 +1,516 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeGmail is an in-process stand-in for the parts of the gmail REST API the app uses, for testing without a google account.
+// Messages are kept in memory, and every change is added to the mailbox history like gmail does.
+type fakeGmail struct {
+	mu         sync.Mutex
+	messages   map[string]*fakeMessage
+	order      []string // message IDs, oldest first
+	historyID  uint64
+	history    []*gmail.History
+	minHistory uint64 // history before this ID has expired
+
+	labelNames map[string]string // user label IDs by name
+	nextLabel  int
+
+	drafts map[string]*gmail.Draft // created drafts by ID
+	sent   []*gmail.Message        // messages sent through messages.send, in order
+
+	listQueries  []string // the q parameter of each messages.list call
+	historyCalls int
+
+	now time.Time // the time "newer_than:" is judged from (default: the current time)
+}
+
+type fakeMessage struct {
+	id       string
+	threadID string
+	labels   []string
+	raw      string
+}
+
+// starts a fake gmail server, and returns it with a gmail service that talks to it
+func newFakeGmail(t *testing.T) (*fakeGmail, *gmail.Service) {
+	f := &fakeGmail{messages: make(map[string]*fakeMessage), labelNames: make(map[string]string), drafts: make(map[string]*gmail.Draft), historyID: 1000}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	service, err := gmail.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal("failed to create gmail service:", err)
+	}
+	return f, service
+}
+
+// adds a message to the mailbox, with the given raw RFC 822 content
+func (f *fakeGmail) add(id string, raw string, labels ...string) {
+	f.addToThread(id, id, raw, labels...)
+}
+
+// same as add, but the message is put in the given thread instead of starting its own
+func (f *fakeGmail) addToThread(threadID string, id string, raw string, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := &fakeMessage{id: id, threadID: threadID, labels: labels, raw: raw}
+	f.messages[id] = m
+	f.order = append(f.order, id)
+	f.record(&gmail.History{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: m.summary()}}})
+}
+
+func (f *fakeGmail) addLabels(id string, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.messages[id]
+	for _, label := range labels {
+		if !m.hasLabel(label) {
+			m.labels = append(m.labels, label)
+		}
+	}
+	f.record(&gmail.History{LabelsAdded: []*gmail.HistoryLabelAdded{{LabelIds: labels, Message: m.summary()}}})
+}
+
+func (f *fakeGmail) removeLabels(id string, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.messages[id]
+	kept := []string{}
+	for _, label := range m.labels {
+		if !contains(labels, label) {
+			kept = append(kept, label)
+		}
+	}
+	m.labels = kept
+	f.record(&gmail.History{LabelsRemoved: []*gmail.HistoryLabelRemoved{{LabelIds: labels, Message: m.summary()}}})
+}
+
+func (f *fakeGmail) delete(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.messages, id)
+	f.record(&gmail.History{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: id}}}})
+}
+
+// deletes the user label, as if the user did in gmail
+func (f *fakeGmail) deleteLabel(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.labelNames, name)
+}
+
+// checks if there's a user label with the ID
+func (f *fakeGmail) labelExists(id string) bool {
+	for _, labelID := range f.labelNames {
+		if labelID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// makes all of the history so far unavailable, like gmail does after about a week
+func (f *fakeGmail) expireHistory() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.minHistory = f.historyID + 1
+	f.history = nil
+}
+
+func (f *fakeGmail) labels(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if m, ok := f.messages[id]; ok {
+		return append([]string{}, m.labels...)
+	}
+	return nil
+}
+
+func (f *fakeGmail) record(h *gmail.History) {
+	f.historyID++
+	h.Id = f.historyID
+	f.history = append(f.history, h)
+}
+
+func (m *fakeMessage) summary() *gmail.Message {
+	return &gmail.Message{Id: m.id, ThreadId: m.threadID, LabelIds: append([]string{}, m.labels...)}
+}
+
+func (m *fakeMessage) hasLabel(label string) bool {
+	return contains(m.labels, label)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// any user ID is accepted, whether it's "me" or an address
+	_, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/"), "/")
+	switch {
+	case r.Method == http.MethodGet && path == "profile":
+		writeJSON(w, &gmail.Profile{EmailAddress: "me@example.com", HistoryId: f.historyID})
+	case r.Method == http.MethodGet && path == "messages":
+		f.listMessages(w, r)
+	case r.Method == http.MethodPost && path == "messages/send":
+		var msg gmail.Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.Raw == "" {
+			writeError(w, http.StatusBadRequest, "invalid message")
+			return
+		}
+		msg.Id = "sent-" + strconv.Itoa(len(f.sent)+1)
+		if msg.ThreadId == "" {
+			msg.ThreadId = msg.Id
+		}
+		f.sent = append(f.sent, &msg)
+		writeJSON(w, &msg)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "messages/") && strings.HasSuffix(path, "/modify"):
+		f.modifyMessage(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "messages/"), "/modify"))
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "messages/") && strings.Contains(path, "/attachments/"):
+		id, attachmentID, _ := strings.Cut(strings.TrimPrefix(path, "messages/"), "/attachments/")
+		f.getAttachment(w, id, attachmentID)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "messages/"):
+		f.getMessage(w, r, strings.TrimPrefix(path, "messages/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "threads/"):
+		f.getThread(w, strings.TrimPrefix(path, "threads/"))
+	case r.Method == http.MethodGet && path == "labels":
+		resp := &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "INBOX", Name: "INBOX", Type: "system"}, {Id: "UNREAD", Name: "UNREAD", Type: "system"}}}
+		for name, id := range f.labelNames {
+			resp.Labels = append(resp.Labels, &gmail.Label{Id: id, Name: name, Type: "user"})
+		}
+		writeJSON(w, resp)
+	case r.Method == http.MethodPost && path == "labels":
+		var label gmail.Label
+		if err := json.NewDecoder(r.Body).Decode(&label); err != nil || label.Name == "" {
+			writeError(w, http.StatusBadRequest, "invalid label")
+			return
+		}
+		if _, exists := f.labelNames[label.Name]; exists {
+			writeError(w, http.StatusConflict, "Label name exists or conflicts")
+			return
+		}
+		f.nextLabel++
+		label.Id = "Label_" + strconv.Itoa(f.nextLabel)
+		f.labelNames[label.Name] = label.Id
+		writeJSON(w, &label)
+	case r.Method == http.MethodPost && path == "drafts":
+		var draft gmail.Draft
+		if err := json.NewDecoder(r.Body).Decode(&draft); err != nil || draft.Message == nil || draft.Message.Raw == "" {
+			writeError(w, http.StatusBadRequest, "invalid draft")
+			return
+		}
+		draft.Id = "r" + strconv.Itoa(len(f.drafts)+1)
+		draft.Message.Id = "draft-message-" + strconv.Itoa(len(f.drafts)+1)
+		f.drafts[draft.Id] = &draft
+		writeJSON(w, &draft)
+	case r.Method == http.MethodGet && path == "history":
+		f.listHistory(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not supported by the fake gmail server: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// gets a message in the raw format, or just its headers in the metadata format
+func (f *fakeGmail) getMessage(w http.ResponseWriter, r *http.Request, id string) {
+	m, ok := f.messages[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	msg := m.summary()
+	parsed, err := mail.ReadMessage(strings.NewReader(m.raw))
+	msg.InternalDate = m.internalDate()
+	switch r.URL.Query().Get("format") {
+	case "metadata":
+		msg.Payload = &gmail.MessagePart{}
+		if err == nil {
+			for name, values := range parsed.Header {
+				for _, value := range values {
+					msg.Payload.Headers = append(msg.Payload.Headers, &gmail.MessagePartHeader{Name: name, Value: value})
+				}
+			}
+		}
+	case "full":
+		msg.Payload, _ = fullPayload(m.raw, false)
+	default:
+		msg.Raw = base64.URLEncoding.EncodeToString([]byte(m.raw))
+	}
+	writeJSON(w, msg)
+}
+
+// gets the messages in a thread in the full format, in the order they were added
+func (f *fakeGmail) getThread(w http.ResponseWriter, id string) {
+	thread := &gmail.Thread{Id: id}
+	for _, msgID := range f.order {
+		m, ok := f.messages[msgID]
+		if !ok || m.threadID != id {
+			continue
+		}
+		msg := m.summary()
+		msg.InternalDate = m.internalDate()
+		msg.Payload, _ = fullPayload(m.raw, false)
+		thread.Messages = append(thread.Messages, msg)
+	}
+	if len(thread.Messages) == 0 {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	writeJSON(w, thread)
+}
+
+// gets the time the message was received from its Date header, like gmail's internal date
+func (m *fakeMessage) internalDate() int64 {
+	parsed, err := mail.ReadMessage(strings.NewReader(m.raw))
+	if err != nil {
+		return 0
+	}
+	date, err := parsed.Header.Date()
+	if err != nil {
+		return 0
+	}
+	return date.UnixMilli()
+}
+
+// builds the payload of a message in the full format. Parts with a filename get an attachment ID instead of their content, like gmail does;
+// with withData set, their content is kept too, for getAttachment to find.
+func fullPayload(raw string, withData bool) (*gmail.MessagePart, error) {
+	entity, err := message.Read(strings.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return fullPart(entity, "", withData)
+}
+
+func fullPart(entity *message.Entity, partID string, withData bool) (*gmail.MessagePart, error) {
+	mediaType, params, _ := entity.Header.ContentType()
+	part := &gmail.MessagePart{PartId: partID, MimeType: mediaType, Body: &gmail.MessagePartBody{}}
+	fields := entity.Header.Fields()
+	for fields.Next() {
+		part.Headers = append(part.Headers, &gmail.MessagePartHeader{Name: fields.Key(), Value: fields.Value()})
+	}
+	if mr := entity.MultipartReader(); mr != nil {
+		for i := 0; ; i++ {
+			child, err := mr.NextPart()
+			if err == io.EOF {
+				return part, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			childID := strconv.Itoa(i)
+			if partID != "" {
+				childID = partID + "." + childID
+			}
+			childPart, err := fullPart(child, childID, withData)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, childPart)
+		}
+	}
+	data, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return nil, err
+	}
+	_, disp, _ := entity.Header.ContentDisposition()
+	part.Filename = disp["filename"]
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	part.Body.Size = int64(len(data))
+	if part.Filename == "" || withData {
+		part.Body.Data = base64.URLEncoding.EncodeToString(data)
+	}
+	if part.Filename != "" {
+		part.Body.AttachmentId = "attachment-" + partID
+	}
+	return part, nil
+}
+
+func (f *fakeGmail) getAttachment(w http.ResponseWriter, id string, attachmentID string) {
+	m, ok := f.messages[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	payload, err := fullPayload(m.raw, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var find func(part *gmail.MessagePart) *gmail.MessagePartBody
+	find = func(part *gmail.MessagePart) *gmail.MessagePartBody {
+		if part.Body.AttachmentId == attachmentID {
+			return part.Body
+		}
+		for _, child := range part.Parts {
+			if body := find(child); body != nil {
+				return body
+			}
+		}
+		return nil
+	}
+	body := find(payload)
+	if body == nil {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	writeJSON(w, &gmail.MessagePartBody{AttachmentId: attachmentID, Size: body.Size, Data: body.Data})
+}
+
+func (f *fakeGmail) modifyMessage(w http.ResponseWriter, r *http.Request, id string) {
+	m, ok := f.messages[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	var req gmail.ModifyMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	for _, label := range req.AddLabelIds {
+		if strings.HasPrefix(label, "Label_") && !f.labelExists(label) {
+			writeError(w, http.StatusNotFound, "Requested entity was not found.")
+			return
+		}
+	}
+	for _, label := range req.AddLabelIds {
+		if !m.hasLabel(label) {
+			m.labels = append(m.labels, label)
+		}
+	}
+	kept := []string{}
+	for _, label := range m.labels {
+		if !contains(req.RemoveLabelIds, label) {
+			kept = append(kept, label)
+		}
+	}
+	m.labels = kept
+	if len(req.AddLabelIds) > 0 {
+		f.record(&gmail.History{LabelsAdded: []*gmail.HistoryLabelAdded{{LabelIds: req.AddLabelIds, Message: m.summary()}}})
+	}
+	if len(req.RemoveLabelIds) > 0 {
+		f.record(&gmail.History{LabelsRemoved: []*gmail.HistoryLabelRemoved{{LabelIds: req.RemoveLabelIds, Message: m.summary()}}})
+	}
+	writeJSON(w, m.summary())
+}
+
+// matches the "newer_than:" search term, with the number of days
+var newerThanPattern = regexp.MustCompile(`(?:^|\s)newer_than:(\d+)d`)
+
+// lists messages newest first. Label IDs are applied, and "in:inbox" and "newer_than:" in the query; other search terms are ignored.
+// Pages are at most 100 messages, however many are asked for, so clients have to follow the page tokens.
+func (f *fakeGmail) listMessages(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := params.Get("q")
+	f.listQueries = append(f.listQueries, q)
+	labels := params["labelIds"]
+	if strings.Contains(q, "in:inbox") {
+		labels = append(labels, "INBOX")
+	}
+	var since int64
+	if m := newerThanPattern.FindStringSubmatch(q); m != nil {
+		days, _ := strconv.Atoi(m[1])
+		now := f.now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		since = now.AddDate(0, 0, -days).UnixMilli()
+	}
+	matches := []*gmail.Message{}
+	for i := len(f.order) - 1; i >= 0; i-- {
+		m, ok := f.messages[f.order[i]]
+		if !ok {
+			continue
+		}
+		match := since == 0 || m.internalDate() >= since
+		for _, label := range labels {
+			match = match && m.hasLabel(label)
+		}
+		if match {
+			matches = append(matches, &gmail.Message{Id: m.id, ThreadId: m.threadID})
+		}
+	}
+	start, _ := strconv.Atoi(params.Get("pageToken"))
+	size, _ := strconv.Atoi(params.Get("maxResults"))
+	if size <= 0 || size > 100 {
+		size = 100
+	}
+	resp := &gmail.ListMessagesResponse{}
+	for i := start; i < len(matches) && i < start+size; i++ {
+		resp.Messages = append(resp.Messages, matches[i])
+	}
+	if start+size < len(matches) {
+		resp.NextPageToken = strconv.Itoa(start + size)
+	}
+	writeJSON(w, resp)
+}
+
+func (f *fakeGmail) listHistory(w http.ResponseWriter, r *http.Request) {
+	f.historyCalls++
+	params := r.URL.Query()
+	startID, err := strconv.ParseUint(params.Get("startHistoryId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid startHistoryId")
+		return
+	}
+	if startID < f.minHistory {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	records := []*gmail.History{}
+	for _, h := range f.history {
+		if h.Id > startID {
+			records = append(records, h)
+		}
+	}
+	// two records per page, so paging gets tested
+	start, _ := strconv.Atoi(params.Get("pageToken"))
+	resp := &gmail.ListHistoryResponse{HistoryId: f.historyID}
+	for i := start; i < len(records) && i < start+2; i++ {
+		resp.History = append(resp.History, records[i])
+	}
+	if start+2 < len(records) {
+		resp.NextPageToken = strconv.Itoa(start + 2)
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writes an error in the format of the google APIs, so the client turns it into a googleapi.Error
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
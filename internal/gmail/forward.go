@@ -0,0 +1,59 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Forwards the email. The forward is sent in the original's thread, so it shows up in the same conversation in gmail.
+// The calls are aborted if the context is cancelled or times out.
+func ForwardEmail(ctx context.Context, srv *gmail.Service, userID string, original t.Email, fwd t.Forward) error {
+	msg, err := createForward(ctx, srv, userID, original, fwd)
+	if err != nil {
+		return err
+	}
+	_, err = srv.Users.Messages.Send(userID, msg).Context(ctx).Do()
+	return err
+}
+
+// Saves a forward of the email as a draft in the original's thread, instead of sending it. Returns the ID of the new draft.
+// The calls are aborted if the context is cancelled or times out.
+func CreateForwardDraft(ctx context.Context, srv *gmail.Service, userID string, original t.Email, fwd t.Forward) (string, error) {
+	msg, err := createForward(ctx, srv, userID, original, fwd)
+	if err != nil {
+		return "", err
+	}
+	draft, err := srv.Users.Drafts.Create(userID, &gmail.Draft{Message: msg}).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return draft.Id, nil
+}
+
+// builds the forward. unless it's inline, the original raw message is downloaded to be attached.
+func createForward(ctx context.Context, srv *gmail.Service, userID string, original t.Email, fwd t.Forward) (*gmail.Message, error) {
+	if original.ID == "" || userID == "" {
+		return nil, errors.New("failed to create forward; missing required email properties")
+	}
+	rawOriginal := ""
+	if !fwd.Inline {
+		var err error
+		rawOriginal, err = GetRaw(ctx, srv, userID, original.ID)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get the original message"), err)
+		}
+	}
+	raw, err := message.RawForward(original, rawOriginal, userID, fwd)
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(raw),
+		ThreadId: original.ThreadID,
+	}, nil
+}
@@ -0,0 +1,115 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+func TestForwardEmail(t *testing.T) {
+	tests := []struct {
+		inline bool
+	}{
+		{inline: false},
+		{inline: true},
+	}
+	for _, test := range tests {
+		fake, srv := newFakeGmail(t)
+		fake.add("m1", attachmentEmail, "INBOX")
+		original := types.Email{
+			ID:         "m1",
+			ThreadID:   "m1",
+			From:       "alice@example.com",
+			SenderName: "Alice",
+			Subject:    "Notes",
+			Body:       "Notes from the meeting are attached.",
+			MessageID:  "<notes@example.com>",
+		}
+		fwd := types.Forward{
+			To:     []*mail.Address{{Name: "Mr Squeaks", Address: "squeaks@example.com"}},
+			Note:   "Mr Squeaks, the notes from the meeting, for the Hamu project.",
+			Inline: test.inline,
+		}
+		if err := ForwardEmail(context.Background(), srv, "me@example.com", original, fwd); err != nil {
+			t.Fatal("failed to forward email:", err)
+		}
+		if len(fake.sent) != 1 {
+			t.Fatalf("expected one sent message, got %v", len(fake.sent))
+		}
+		if fake.sent[0].ThreadId != "m1" {
+			t.Errorf("expected the forward in the original's thread, got thread %q", fake.sent[0].ThreadId)
+		}
+		raw, err := base64.URLEncoding.DecodeString(fake.sent[0].Raw)
+		if err != nil {
+			t.Fatal("failed to decode sent message:", err)
+		}
+		for _, line := range strings.Split(string(raw), "\r\n") {
+			if len(line) > 78 {
+				t.Errorf("line too long (%v chars): %q", len(line), line)
+			}
+		}
+		entity, err := message.Read(strings.NewReader(string(raw)))
+		if err != nil {
+			t.Fatal("failed to read forward:", err)
+		}
+		for key, want := range map[string]string{
+			"Subject":     "Fwd: Notes",
+			"To":          `"Mr Squeaks" <squeaks@example.com>`,
+			"In-Reply-To": "<notes@example.com>",
+			"References":  "<notes@example.com>",
+		} {
+			if got := entity.Header.Get(key); got != want {
+				t.Errorf("expected %s %q, got %q", key, want, got)
+			}
+		}
+		mediaType, _, _ := entity.Header.ContentType()
+
+		if test.inline {
+			if mediaType != "multipart/alternative" {
+				t.Fatalf("expected an inline forward to be multipart/alternative, got %s", mediaType)
+			}
+			part, err := entity.MultipartReader().NextPart()
+			if err != nil {
+				t.Fatal("failed to read part:", err)
+			}
+			body, _ := io.ReadAll(part.Body)
+			text := strings.ReplaceAll(string(body), "\r\n", "\n")
+			if !strings.HasPrefix(text, fwd.Note+"\n\n---------- Forwarded message ---------") || !strings.Contains(text, original.Body) {
+				t.Errorf("expected the note, then the original message, got %q", text)
+			}
+			continue
+		}
+
+		if mediaType != "multipart/mixed" {
+			t.Fatalf("expected multipart/mixed, got %s", mediaType)
+		}
+		mr := entity.MultipartReader()
+		note, err := mr.NextPart()
+		if err != nil {
+			t.Fatal("failed to read the note:", err)
+		}
+		if noteType, _, _ := note.Header.ContentType(); noteType != "multipart/alternative" {
+			t.Errorf("expected the note to be multipart/alternative, got %s", noteType)
+		}
+		attached, err := mr.NextPart()
+		if err != nil {
+			t.Fatal("failed to read the attached message:", err)
+		}
+		if attachedType, _, _ := attached.Header.ContentType(); attachedType != "message/rfc822" {
+			t.Errorf("expected message/rfc822, got %s", attachedType)
+		}
+		if _, params, _ := attached.Header.ContentDisposition(); params["filename"] != "Notes.eml" {
+			t.Errorf("expected the attached message to be named Notes.eml, got %q", params["filename"])
+		}
+		body, _ := io.ReadAll(attached.Body)
+		if string(body) != attachmentEmail {
+			t.Errorf("expected the original message attached as it is, got:\n%s", body)
+		}
+	}
+}
@@ -1,177 +1,132 @@
 package gmail
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
-	"fmt"
-	"log"
-	"time"
 
-	"github.com/ollama/ollama/api"
-	"github.com/webbben/mail-assistant/internal/config"
 	"github.com/webbben/mail-assistant/internal/debug"
-	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/message"
 	t "github.com/webbben/mail-assistant/internal/types"
-	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
 	"google.golang.org/api/gmail/v1"
 )
 
-const (
-	SPAM     = "SPAM"
-	BAD_FORM = "BAD_FORM"
-	NOREPLY  = "NOREPLY"
-	OLD      = "OLD"
-)
-
-func ListMessages(srv *gmail.Service, gmailAddr string) ([]*gmail.Message, error) {
-	r, err := srv.Users.Messages.List(gmailAddr).Do()
-	if err != nil {
-		return nil, err
-	}
-	return r.Messages, nil
-}
-
-func GetMessage(srv *gmail.Service, gmailAddr string, messageID string) (*gmail.Message, error) {
-	return srv.Users.Messages.Get(gmailAddr, messageID).Format("raw").Do()
-}
-
-func GetRaw(srv *gmail.Service, gmailAddr string, messageID string) (string, error) {
-	msg, err := srv.Users.Messages.Get(gmailAddr, messageID).Format("raw").Do()
-	if err != nil {
-		return "", err
-	}
-	return decodeRawMessage(msg.Raw)
-}
-
-func GetEmails(srv *gmail.Service, ollamaClient *api.Client, config config.Config) []t.Email {
-	debug.Println("getting emails...")
-	emails := []t.Email{}
-	list, err := ListMessages(srv, config.GmailAddr)
-	if err != nil {
-		log.Println("failed to list emails:", err)
-		return emails
-	}
-	if len(list) == 0 {
-		debug.Println("No emails found.")
-		return emails
-	}
-	for _, msg := range list {
-		if len(emails) >= config.EmailBatchLimit {
-			break
+// Lists the messages matching the options.
+// The calls are aborted if the context is cancelled or times out.
+//
+// Messages are listed newest first, following the result pages until there are no more or the limit is reached.
+func ListMessages(ctx context.Context, srv *gmail.Service, gmailAddr string, opts ListOptions) ([]*gmail.Message, error) {
+	messages := []*gmail.Message{}
+	pageToken := ""
+	for {
+		call := srv.Users.Messages.List(gmailAddr).Context(ctx)
+		if opts.Query != "" {
+			call = call.Q(opts.Query)
 		}
-		if _, isCached := emailcache.IsCached(msg.Id); isCached {
-			continue
+		if len(opts.LabelIDs) > 0 {
+			call = call.LabelIds(opts.LabelIDs...)
 		}
-		email, err := ProcessEmail(srv, msg.Id, config.GmailAddr)
-		if err != nil {
-			debug.Println("failed to process email:", err)
-			continue
+		pageSize := maxPageSize
+		if opts.Limit > 0 && opts.Limit-len(messages) < pageSize {
+			pageSize = opts.Limit - len(messages)
 		}
-		// ignore messages that are from ourself
-		if email.From == config.GmailAddr {
-			continue
+		call = call.MaxResults(int64(pageSize))
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
 		}
-		if isEmailTooOld(email, config) {
-			debug.Println("email too old:", email.Date, email.From)
-			emailcache.AddToCache(email, emailcache.IGNORE, OLD)
-			break
+		r, err := call.Do()
+		if err != nil {
+			return nil, err
 		}
-		if junk, reason := isJunk(email, ollamaClient); junk {
-			emailcache.AddToCache(email, emailcache.IGNORE, reason)
-			continue
+		messages = append(messages, r.Messages...)
+		if opts.Limit > 0 && len(messages) >= opts.Limit {
+			return messages[:opts.Limit], nil
 		}
-		emails = append(emails, email)
+		if r.NextPageToken == "" {
+			return messages, nil
+		}
+		pageToken = r.NextPageToken
 	}
-	debug.Println("... done!")
-	return emails
 }
 
-// determines if the given email is junk or unwanted, and if so, gives a category for why it is unwanted
-func isJunk(email t.Email, ollamaClient *api.Client) (bool, string) {
-	if len(email.Body) == 0 {
-		debug.Println("empty email:", email.From)
-		return true, BAD_FORM
-	}
-	if len(email.Body) > 3000 {
-		debug.Println("email too long:", len(email.Body), email.From)
-		return true, BAD_FORM
-	}
-	if isEmailNoReply(email) {
-		debug.Println("no reply email:", email.From)
-		return true, NOREPLY
+// Gets the message with the given ID, in the raw format.
+// The call is aborted if the context is cancelled or times out.
+func GetMessage(ctx context.Context, srv *gmail.Service, gmailAddr string, messageID string) (*gmail.Message, error) {
+	return srv.Users.Messages.Get(gmailAddr, messageID).Format("raw").Context(ctx).Do()
+}
+
+// Gets the raw RFC 5322 message with the given ID.
+// The call is aborted if the context is cancelled or times out.
+func GetRaw(ctx context.Context, srv *gmail.Service, gmailAddr string, messageID string) (string, error) {
+	msg, err := GetMessage(ctx, srv, gmailAddr, messageID)
+	if err != nil {
+		return "", err
 	}
-	//if isSpam, _ := llama.IsEmailSpam(ollamaClient, email.Body); isSpam {
-	//	debug.Println("spam email:", email.From, email.Snippet)
-	//	return true, SPAM
-	//}
-	return false, ""
+	return decodeRawMessage(msg.Raw)
 }
 
-func ProcessEmail(srv *gmail.Service, messageID string, emailAddr string) (t.Email, error) {
-	msg, err := GetMessage(srv, emailAddr, messageID)
+// Gets the message with the given ID and parses it into an email, with its gmail ID, thread, labels and date filled in.
+// The call is aborted if the context is cancelled or times out.
+func ProcessEmail(ctx context.Context, srv *gmail.Service, messageID string, emailAddr string) (t.Email, error) {
+	msg, err := GetMessage(ctx, srv, emailAddr, messageID)
 	if err != nil {
 		return t.Email{}, err
 	}
-	// basic info
-	email := t.Email{
-		ID:       messageID,
-		Snippet:  msg.Snippet,
-		Date:     convInternalDateToTime(msg.InternalDate),
-		ThreadID: msg.ThreadId,
-	}
-	// get the email content
 	raw, err := decodeRawMessage(msg.Raw)
 	if err != nil {
-		return email, err
+		return t.Email{}, err
 	}
-	body, headers, err := emailparse.ParseEmail(raw)
+	email, err := message.ParseRaw(raw)
 	if err != nil {
-		return email, err
+		return t.Email{}, err
 	}
-	from, sender := extractEmailAndName(headers["From"][0])
-	email.From = from
-	email.SenderName = sender
-	email.Subject = headers["Subject"][0]
-	email.Body = body
+	email.ID = messageID
+	email.Snippet = msg.Snippet
+	email.Date = convInternalDateToTime(msg.InternalDate)
+	email.ThreadID = msg.ThreadId
+	email.LabelIDs = msg.LabelIds
 	return email, nil
 }
 
-func SendReply(srv *gmail.Service, userID string, replyToEmail t.Email, replyBody string) error {
-	replyMessage, err := createReply(replyToEmail, userID, replyBody)
+// Sends the reply in the email's thread.
+// The call is aborted if the context is cancelled or times out.
+func SendReply(ctx context.Context, srv *gmail.Service, userID string, replyToEmail t.Email, reply t.Reply) error {
+	replyMessage, err := createReply(replyToEmail, userID, reply)
 	if err != nil {
 		return err
 	}
-	_, err = srv.Users.Messages.Send(userID, replyMessage).Do()
+	_, err = srv.Users.Messages.Send(userID, replyMessage).Context(ctx).Do()
 	return err
 }
 
-func createReply(replyToEmail t.Email, userID string, replyBody string) (*gmail.Message, error) {
-	if replyToEmail.ID == "" || replyToEmail.From == "" || userID == "" {
+// Saves the reply as a draft in the email's thread instead of sending it, so the user can review it in gmail first.
+// Returns the ID of the new draft.
+// The call is aborted if the context is cancelled or times out.
+func CreateDraft(ctx context.Context, srv *gmail.Service, userID string, replyToEmail t.Email, reply t.Reply) (string, error) {
+	replyMessage, err := createReply(replyToEmail, userID, reply)
+	if err != nil {
+		return "", err
+	}
+	draft, err := srv.Users.Drafts.Create(userID, &gmail.Draft{Message: replyMessage}).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return draft.Id, nil
+}
+
+func createReply(replyToEmail t.Email, userID string, reply t.Reply) (*gmail.Message, error) {
+	if replyToEmail.ID == "" || userID == "" {
 		return nil, errors.New("failed to create reply; missing required email properties")
 	}
 	if replyToEmail.ThreadID == "" {
 		debug.Println("no thread ID present?")
 	}
-	// make the headers
-	replySubject := "Re: " + replyToEmail.Subject
-	headers := make(map[string]string)
-	headers["From"] = userID
-	headers["To"] = replyToEmail.From
-	headers["Subject"] = replySubject
-	headers["In-Reply-To"] = replyToEmail.ID
-	headers["References"] = replyToEmail.ID
-	headers["Date"] = time.Now().Format(time.RFC1123Z)
-	var messageContent string
-	for k, v := range headers {
-		messageContent += fmt.Sprintf("%s: %s\r\n", k, v)
+	raw, err := message.RawReply(replyToEmail, userID, reply)
+	if err != nil {
+		return nil, err
 	}
-	messageContent += "\r\n" + replyBody
-
-	// encode the email message
-	encodedEmail := base64.URLEncoding.EncodeToString([]byte(messageContent))
-	gMessage := &gmail.Message{
-		Raw:      encodedEmail,
+	return &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(raw),
 		ThreadId: replyToEmail.ThreadID,
-	}
-	return gMessage, nil
+	}, nil
 }
@@ -1,26 +1,38 @@
 package gmail
 
-import "testing"
+import (
+	"context"
+	"encoding/base64"
+	"testing"
 
-func TestExtractEmailAddressFromHeader(t *testing.T) {
-	tests := []struct {
-		input string
-		email string
-		name  string
-	}{
-		{"First Last <email.addr@gmail.com>", "email.addr@gmail.com", "First Last"},
-		{"email.addr@gmail.com", "email.addr@gmail.com", ""},
-		{"No email here", "", ""},
-		{"Another Name <another.email@example.com>", "another.email@example.com", "Another Name"},
-	}
+	"github.com/webbben/mail-assistant/internal/message"
+	"github.com/webbben/mail-assistant/internal/types"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+)
 
-	for _, test := range tests {
-		email, name := extractEmailAndName(test.input)
-		if email != test.email {
-			t.Errorf("expected email %q but got %q for input %q", test.email, email, test.input)
-		}
-		if name != test.name {
-			t.Errorf("expected name %s but got %s for input %s", test.name, name, test.input)
-		}
+func TestCreateDraft(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	original := types.Email{ID: "m1", ThreadID: "t1", From: "bob@example.com", Subject: "Lunch", MessageID: "<1@example.com>"}
+	draftID, err := CreateDraft(context.Background(), srv, "me@example.com", original, message.NewReply(original, "Sounds good.", false, nil))
+	if err != nil {
+		t.Fatal("failed to create draft:", err)
+	}
+	draft, ok := fake.drafts[draftID]
+	if !ok {
+		t.Fatalf("draft %q wasn't created", draftID)
+	}
+	if draft.Message.ThreadId != "t1" {
+		t.Errorf("draft should be in the email's thread, got thread %q", draft.Message.ThreadId)
+	}
+	raw, err := base64.URLEncoding.DecodeString(draft.Message.Raw)
+	if err != nil {
+		t.Fatal("failed to decode draft:", err)
+	}
+	body, headers, err := emailparse.ParseEmail(string(raw))
+	if err != nil {
+		t.Fatal("failed to parse draft:", err)
+	}
+	if body != "Sounds good." || headers["In-Reply-To"][0] != "<1@example.com>" || headers["Subject"][0] != "Re: Lunch" {
+		t.Errorf("unexpected draft: %v %q", headers, body)
 	}
 }
@@ -0,0 +1,188 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Labeler applies the valet's labels to emails in gmail, and rebuilds the cache from them. It keeps the IDs of the user's
+// labels by name, so they only need to be looked up once.
+type Labeler struct {
+	srv    *gmail.Service
+	config config.Config
+
+	mu  sync.Mutex
+	ids map[string]string // label IDs by name
+}
+
+func NewLabeler(srv *gmail.Service, c config.Config) *Labeler {
+	return &Labeler{srv: srv, config: c, ids: make(map[string]string)}
+}
+
+// Shows in gmail how the valet handled the email, by applying the configured label for the action.
+// Emails the user handled are also marked as read and/or archived, if that's enabled in the config.
+// Does nothing if labels aren't enabled.
+//
+// If the label was deleted since its ID was looked up, it's looked up again (or created again) and applied once more.
+func (l *Labeler) MarkHandled(ctx context.Context, messageID string, action string) error {
+	c := l.config.Labels
+	if !c.Enabled {
+		return nil
+	}
+	name := message.LabelName(c, action)
+	if name == "" {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	labelID, err := l.labelID(ctx, name, true)
+	if err != nil {
+		return err
+	}
+	err = l.modify(ctx, messageID, action, labelID)
+	if !isLabelNotFound(err) {
+		return err
+	}
+	l.forget(name)
+	newID, lookupErr := l.labelID(ctx, name, true)
+	if lookupErr != nil || newID == labelID {
+		// the label is still there, so it was the message that wasn't found
+		return err
+	}
+	debug.Println("label", name, "was changed in gmail; using its new ID")
+	return l.modify(ctx, messageID, action, newID)
+}
+
+// adds the label to the message, and marks it as read and/or archives it if the action and config call for it
+func (l *Labeler) modify(ctx context.Context, messageID string, action string, labelID string) error {
+	c := l.config.Labels
+	req := &gmail.ModifyMessageRequest{AddLabelIds: []string{labelID}}
+	if action != t.FILTERED && action != t.DRAFTED {
+		if c.MarkRead {
+			req.RemoveLabelIds = append(req.RemoveLabelIds, "UNREAD")
+		}
+		if c.Archive {
+			req.RemoveLabelIds = append(req.RemoveLabelIds, "INBOX")
+		}
+	}
+	_, err := l.srv.Users.Messages.Modify(l.config.GmailAddr, messageID, req).Context(ctx).Do()
+	return err
+}
+
+// gmail answers with 404 (or 400, for an invalid label) when a label ID no longer exists, e.g. the user deleted the label.
+// A 404 can also mean the message doesn't exist, which MarkHandled tells apart by looking the label up again.
+func isLabelNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusBadRequest)
+}
+
+// Gets the ID of the label with the given name. If there is no such label and create is set, the label is created;
+// otherwise an empty ID is returned.
+func (l *Labeler) labelID(ctx context.Context, name string, create bool) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id, ok := l.ids[name]; ok {
+		return id, nil
+	}
+	list, err := l.srv.Users.Labels.List(l.config.GmailAddr).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	for _, label := range list.Labels {
+		l.ids[label.Name] = label.Id
+	}
+	if id, ok := l.ids[name]; ok || !create {
+		return id, nil
+	}
+	debug.Println("creating gmail label:", name)
+	label, err := l.srv.Users.Labels.Create(l.config.GmailAddr, &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to create label %s: %w", name, err)
+	}
+	l.ids[name] = label.Id
+	return label.Id, nil
+}
+
+// drops the label's ID, so it's looked up again the next time it's needed
+func (l *Labeler) forget(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ids, name)
+}
+
+// Rebuilds the email cache from the labels applied by MarkHandled, e.g. when the cache file was lost.
+// Only emails from the lookback period are looked at. Returns how many emails were added to the cache.
+//
+// The labels don't say why an email was ignored, so restored entries get the RESTORED category instead.
+// Drafted emails are restored without their draft IDs. Each API call gets its own mailbox timeout, since a rebuild can make many.
+func (l *Labeler) RebuildCache(ctx context.Context) (int, error) {
+	count := 0
+	for _, action := range message.RestorableActions {
+		labelCtx, cancel := util.WithTimeout(ctx, l.config.MailTimeout())
+		labelID, err := l.labelID(labelCtx, message.LabelName(l.config.Labels, action), false)
+		cancel()
+		if err != nil {
+			return count, err
+		}
+		if labelID == "" {
+			continue
+		}
+		opts := ListOptions{
+			Query:    NewQuery().In("anywhere").NewerThanDays(l.config.LookbackDays).String(),
+			LabelIDs: []string{labelID},
+			Limit:    DefaultListOptions(l.config).Limit,
+		}
+		listCtx, cancel := util.WithTimeout(ctx, l.config.MailTimeout())
+		list, err := ListMessages(listCtx, l.srv, l.config.GmailAddr, opts)
+		cancel()
+		if err != nil {
+			return count, err
+		}
+		cacheAction, categories := message.RestoredCacheAction(action)
+		for _, msg := range list {
+			if _, cached := emailcache.IsCached(msg.Id); cached {
+				continue
+			}
+			msgCtx, cancel := util.WithTimeout(ctx, l.config.MailTimeout())
+			email, err := getEmailMetadata(msgCtx, l.srv, l.config.GmailAddr, msg.Id)
+			cancel()
+			if err != nil {
+				return count, err
+			}
+			emailcache.AddToCache(email, cacheAction, categories...)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// gets just the sender and date of an email, which is all the cache needs
+func getEmailMetadata(ctx context.Context, srv *gmail.Service, gmailAddr string, messageID string) (t.Email, error) {
+	msg, err := srv.Users.Messages.Get(gmailAddr, messageID).Format("metadata").MetadataHeaders("From").Context(ctx).Do()
+	if err != nil {
+		return t.Email{}, err
+	}
+	email := t.Email{ID: msg.Id, Date: convInternalDateToTime(msg.InternalDate)}
+	if msg.Payload != nil {
+		for _, header := range msg.Payload.Headers {
+			if header.Name == "From" {
+				email.From, email.SenderName = message.ExtractEmailAndName(header.Value)
+			}
+		}
+	}
+	return email, nil
+}
@@ -0,0 +1,158 @@
+package gmail
+
+import (
+	"context"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/message"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+const labeledEmail = "From: Alice <alice@example.com>\r\nDate: Mon, 1 Jul 2024 10:00:00 +0000\r\nSubject: hi\r\n\r\nhello\r\n"
+
+func TestMarkHandled(t *testing.T) {
+	tests := []struct {
+		labels  config.Labels
+		action  string
+		want    []string // labels the message should have afterwards
+		notWant []string // labels the message shouldn't have afterwards
+	}{
+		{config.Labels{}, types.REPLIED, []string{"INBOX", "UNREAD"}, []string{"Valet/Replied"}},
+		{config.Labels{Enabled: true}, types.REPLIED, []string{"INBOX", "UNREAD", "Valet/Replied"}, nil},
+		{config.Labels{Enabled: true, MarkRead: true}, types.IGNORED, []string{"INBOX", "Valet/Ignored"}, []string{"UNREAD"}},
+		{config.Labels{Enabled: true, MarkRead: true, Archive: true}, types.AUTO_REPLIED, []string{"Valet/AutoReplied"}, []string{"INBOX", "UNREAD"}},
+		{config.Labels{Enabled: true, MarkRead: true, Archive: true}, types.FILTERED, []string{"INBOX", "UNREAD", "Valet/Ignored"}, nil},
+		{config.Labels{Enabled: true, Replied: "Handled"}, types.REPLIED, []string{"Handled"}, []string{"Valet/Replied"}},
+		{config.Labels{Enabled: true, MarkRead: true, Archive: true}, types.DRAFTED, []string{"INBOX", "UNREAD", "Valet/Drafted"}, nil},
+	}
+	for _, test := range tests {
+		fake, srv := newFakeGmail(t)
+		fake.add("m1", labeledEmail, "INBOX", "UNREAD")
+		err := NewLabeler(srv, config.Config{GmailAddr: "me", Labels: test.labels}).MarkHandled(context.Background(), "m1", test.action)
+		if err != nil {
+			t.Fatalf("%s %+v: failed to mark handled: %v", test.action, test.labels, err)
+		}
+		// label names, as the fake gives user labels generated IDs
+		names := make(map[string]bool)
+		for _, id := range fake.labels("m1") {
+			names[id] = true
+			for name, labelID := range fake.labelNames {
+				if labelID == id {
+					names[name] = true
+				}
+			}
+		}
+		for _, label := range test.want {
+			if !names[label] {
+				t.Errorf("%s %+v: expected label %s, got %v", test.action, test.labels, label, fake.labels("m1"))
+			}
+		}
+		for _, label := range test.notWant {
+			if names[label] {
+				t.Errorf("%s %+v: didn't expect label %s, got %v", test.action, test.labels, label, fake.labels("m1"))
+			}
+		}
+	}
+}
+
+func TestMarkHandledReusesLabels(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	fake.add("m1", labeledEmail, "INBOX")
+	fake.add("m2", labeledEmail, "INBOX")
+	c := config.Config{GmailAddr: "me", Labels: config.Labels{Enabled: true}}
+	labeler := NewLabeler(srv, c)
+	for _, id := range []string{"m1", "m2"} {
+		if err := labeler.MarkHandled(context.Background(), id, types.REPLIED); err != nil {
+			t.Fatal("failed to mark handled:", err)
+		}
+	}
+	if len(fake.labelNames) != 1 {
+		t.Errorf("expected one label to be created, got %v", fake.labelNames)
+	}
+	// an existing label should be found, rather than created again
+	if err := NewLabeler(srv, c).MarkHandled(context.Background(), "m1", types.REPLIED); err != nil {
+		t.Fatal("failed to mark handled with an existing label:", err)
+	}
+	if len(fake.labelNames) != 1 {
+		t.Errorf("expected the existing label to be used, got %v", fake.labelNames)
+	}
+}
+
+func TestMarkHandledDeletedLabel(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	fake.add("m1", labeledEmail, "INBOX")
+	fake.add("m2", labeledEmail, "INBOX")
+	labeler := NewLabeler(srv, config.Config{GmailAddr: "me", Labels: config.Labels{Enabled: true}})
+	ctx := context.Background()
+	if err := labeler.MarkHandled(ctx, "m1", types.REPLIED); err != nil {
+		t.Fatal("failed to mark handled:", err)
+	}
+
+	// the user deletes the label, so the remembered ID is stale
+	fake.deleteLabel(message.DefaultRepliedLabel)
+	if err := labeler.MarkHandled(ctx, "m2", types.REPLIED); err != nil {
+		t.Fatal("failed to mark handled after the label was deleted:", err)
+	}
+	labelID, ok := fake.labelNames[message.DefaultRepliedLabel]
+	if !ok {
+		t.Fatal("expected the label to be created again")
+	}
+	if labels := fake.labels("m2"); !contains(labels, labelID) {
+		t.Errorf("expected the new label on the email, got %v", labels)
+	}
+
+	if err := labeler.MarkHandled(ctx, "missing", types.REPLIED); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestRebuildCache(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	labeler := NewLabeler(srv, config.Config{GmailAddr: "me", Labels: config.Labels{Enabled: true}})
+	actions := map[string]string{
+		"rebuild-replied": types.REPLIED,
+		"rebuild-auto":    types.AUTO_REPLIED,
+		"rebuild-ignored": types.IGNORED,
+		"rebuild-spam":    types.FILTERED,
+		"rebuild-drafted": types.DRAFTED,
+		"rebuild-forward": types.FORWARDED,
+	}
+	for id, action := range actions {
+		fake.add(id, labeledEmail, "INBOX")
+		if err := labeler.MarkHandled(context.Background(), id, action); err != nil {
+			t.Fatal("failed to mark handled:", err)
+		}
+	}
+	fake.add("rebuild-unhandled", labeledEmail, "INBOX")
+
+	count, err := labeler.RebuildCache(context.Background())
+	if err != nil {
+		t.Fatal("failed to rebuild cache:", err)
+	}
+	if count != len(actions) {
+		t.Errorf("expected %v emails restored, got %v", len(actions), count)
+	}
+	want := map[string]string{
+		"rebuild-replied": emailcache.REPLY,
+		"rebuild-auto":    emailcache.REPLY,
+		"rebuild-ignored": emailcache.IGNORE,
+		"rebuild-spam":    emailcache.IGNORE,
+		"rebuild-drafted": emailcache.DRAFT,
+		"rebuild-forward": emailcache.FORWARD,
+	}
+	for id, action := range want {
+		datum, ok := emailcache.IsCached(id)
+		if !ok {
+			t.Errorf("%s wasn't restored to the cache", id)
+			continue
+		}
+		if datum.Action != action || datum.From != "alice@example.com" || datum.Date.IsZero() {
+			t.Errorf("%s: unexpected cache entry %+v", id, datum)
+		}
+	}
+	if _, ok := emailcache.IsCached("rebuild-unhandled"); ok {
+		t.Error("an email without a valet label shouldn't be restored")
+	}
+}
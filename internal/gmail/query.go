@@ -0,0 +1,109 @@
+package gmail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+// the most messages the gmail API returns in one page
+const maxPageSize = 500
+
+// Query builds a gmail search query, using the same operators as the gmail search box.
+// e.g. NewQuery().In("inbox").Is("unread").NewerThanDays(10).Not("category:promotions") gives
+// "in:inbox is:unread newer_than:10d -category:promotions".
+type Query struct {
+	terms []string
+}
+
+func NewQuery() *Query {
+	return &Query{}
+}
+
+// only messages in the given label or folder (e.g. "inbox", "sent", "anywhere")
+func (q *Query) In(label string) *Query {
+	return q.add("in:" + label)
+}
+
+// only messages in the given state (e.g. "unread", "starred", "important")
+func (q *Query) Is(state string) *Query {
+	return q.add("is:" + state)
+}
+
+// only messages with the given label
+func (q *Query) Label(label string) *Query {
+	return q.add("label:" + quoteTerm(label))
+}
+
+// only messages from the given sender. "me" means the user's own address.
+func (q *Query) From(sender string) *Query {
+	return q.add("from:" + quoteTerm(sender))
+}
+
+// only messages received within the last n days. n <= 0 adds nothing.
+func (q *Query) NewerThanDays(n int) *Query {
+	if n <= 0 {
+		return q
+	}
+	return q.add(fmt.Sprintf("newer_than:%vd", n))
+}
+
+// leaves out messages matching the given term (e.g. "category:promotions")
+func (q *Query) Not(term string) *Query {
+	return q.add("-" + term)
+}
+
+// adds raw search terms as they are, e.g. from the config. empty terms are ignored.
+func (q *Query) Raw(terms string) *Query {
+	return q.add(strings.TrimSpace(terms))
+}
+
+func (q *Query) add(term string) *Query {
+	if term != "" {
+		q.terms = append(q.terms, term)
+	}
+	return q
+}
+
+func (q *Query) String() string {
+	return strings.Join(q.terms, " ")
+}
+
+// values with spaces need to be quoted to be a single search term
+func quoteTerm(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + strings.ReplaceAll(value, `"`, "") + `"`
+	}
+	return value
+}
+
+// options for listing messages
+type ListOptions struct {
+	Query    string   // gmail search query, e.g. from a Query (empty = all messages)
+	LabelIDs []string // only list messages that have all of these label IDs
+	Limit    int      // limit on the number of messages listed, across all pages (0 = no limit)
+}
+
+// Gets the query for the mail the assistant should look at: inbox mail from the lookback period, leaving out promotions
+// (which are always treated as bulk mail) and mail the user sent. The configured inbox query is added on to the end.
+func DefaultQuery(config config.Config) *Query {
+	return NewQuery().
+		In("inbox").
+		NewerThanDays(config.LookbackDays).
+		Not("category:promotions").
+		Not("from:me").
+		Raw(config.InboxQuery)
+}
+
+// gets the options for listing the mail the assistant should look at, based on the config
+func DefaultListOptions(c config.Config) ListOptions {
+	limit := c.ListLimit
+	if limit == 0 {
+		limit = config.DefaultListLimit
+	}
+	return ListOptions{
+		Query: DefaultQuery(c).String(),
+		Limit: limit,
+	}
+}
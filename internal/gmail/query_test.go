@@ -0,0 +1,88 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		query *Query
+		want  string
+	}{
+		{NewQuery(), ""},
+		{NewQuery().In("inbox").Is("unread").NewerThanDays(10).Not("category:promotions"), "in:inbox is:unread newer_than:10d -category:promotions"},
+		{NewQuery().In("inbox").NewerThanDays(0).Raw("  "), "in:inbox"},
+		{NewQuery().From("me").Label("Valet Replied"), `from:me label:"Valet Replied"`},
+		{NewQuery().Raw("is:starred has:attachment"), "is:starred has:attachment"},
+	}
+	for _, test := range tests {
+		if got := test.query.String(); got != test.want {
+			t.Errorf("expected query %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestDefaultListOptions(t *testing.T) {
+	opts := DefaultListOptions(config.Config{LookbackDays: 10, InboxQuery: "is:unread"})
+	if want := "in:inbox newer_than:10d -category:promotions -from:me is:unread"; opts.Query != want {
+		t.Errorf("expected query %q, got %q", want, opts.Query)
+	}
+	if opts.Limit != config.DefaultListLimit {
+		t.Errorf("expected default limit %v, got %v", config.DefaultListLimit, opts.Limit)
+	}
+	opts = DefaultListOptions(config.Config{ListLimit: 20})
+	if want := "in:inbox -category:promotions -from:me"; opts.Query != want {
+		t.Errorf("expected query %q without a lookback limit, got %q", want, opts.Query)
+	}
+	if opts.Limit != 20 {
+		t.Errorf("expected configured limit 20, got %v", opts.Limit)
+	}
+}
+
+func TestListMessagesPagination(t *testing.T) {
+	tests := []struct {
+		total int
+		limit int
+		want  int
+		calls int
+	}{
+		{total: 50, limit: 0, want: 50, calls: 1},
+		{total: 250, limit: 0, want: 250, calls: 3},
+		{total: 250, limit: 120, want: 120, calls: 2},
+		{total: 250, limit: 30, want: 30, calls: 1},
+		{total: 0, limit: 10, want: 0, calls: 1},
+	}
+	for _, test := range tests {
+		fake, srv := newFakeGmail(t)
+		for i := 0; i < test.total; i++ {
+			fake.add(fmt.Sprint("msg", i), "", "INBOX")
+		}
+		messages, err := ListMessages(context.Background(), srv, "me", ListOptions{Query: "in:inbox", Limit: test.limit})
+		if err != nil {
+			t.Fatalf("total %v, limit %v: failed to list messages: %v", test.total, test.limit, err)
+		}
+		if len(messages) != test.want {
+			t.Errorf("total %v, limit %v: expected %v messages, got %v", test.total, test.limit, test.want, len(messages))
+		}
+		if len(fake.listQueries) != test.calls {
+			t.Errorf("total %v, limit %v: expected %v API calls, got %v", test.total, test.limit, test.calls, len(fake.listQueries))
+		}
+		for _, q := range fake.listQueries {
+			if q != "in:inbox" {
+				t.Errorf("query wasn't passed on to the API: %q", q)
+			}
+		}
+		// no message should be listed twice
+		seen := make(map[string]bool)
+		for _, msg := range messages {
+			if seen[msg.Id] {
+				t.Errorf("message %s listed twice", msg.Id)
+			}
+			seen[msg.Id] = true
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// file the inbox sync state is saved to
+const syncStatePath = "syncstate.json"
+
+// how long the synced inbox is kept up to date from the history before it's listed in full again.
+// The history can't tell when a message has aged out of the lookback period, so the full resync is what drops old messages.
+const fullResyncInterval = 24 * time.Hour
+
+// labels that keep a message out of the synced inbox, even if it's labeled INBOX.
+// promotions are left out of the default query too, since they're always bulk mail.
+var excludedSyncLabels = []string{"SENT", "DRAFT", "SPAM", "TRASH", "CATEGORY_PROMOTIONS"}
+
+// Syncer keeps an up to date list of the messages in the inbox, without listing the whole inbox every time it checks for mail.
+//
+// The first sync lists the messages matching the list options, and remembers the mailbox's history ID.
+// After that, each sync asks the gmail History API for only what changed since then: messages added or deleted,
+// and labels added or removed (e.g. a message being archived, or moved back to the inbox).
+// If gmail no longer has the history back to the saved ID (it only keeps about a week), a full resync is done instead.
+// A full resync is also done once a day, so messages that have gotten older than the lookback period in the query are dropped.
+//
+// Changes found through the history are judged by their labels, since the History API can't apply a search query.
+// The search terms are applied on full resyncs; emails that get through are still checked by mailbox.GetEmails before the user sees them.
+type Syncer struct {
+	srv       *gmail.Service
+	gmailAddr string
+	opts      ListOptions
+	state     syncState
+	path      string
+}
+
+// sync state, as saved to disk
+type syncState struct {
+	HistoryID  uint64    `json:"history_id"`   // history ID of the mailbox as of the last sync (0 = never synced)
+	Query      string    `json:"query"`        // query the messages were listed with. if the configured query changes, a full resync is done.
+	Messages   []string  `json:"messages"`     // IDs of the messages in the synced inbox, newest first
+	FullSyncAt time.Time `json:"full_sync_at"` // when the inbox was last listed in full
+}
+
+// the changes found by a sync
+type SyncResult struct {
+	Added   []string // IDs of messages that are new to the synced inbox, newest first
+	Removed []string // IDs of messages that left the synced inbox (deleted, archived, etc)
+	Full    bool     // true if the inbox was listed in full, instead of synced from the history
+}
+
+// creates a syncer for the messages matching the given list options. Its state is saved to path; if path is empty, it isn't saved.
+func NewSyncer(srv *gmail.Service, gmailAddr string, opts ListOptions, path string) *Syncer {
+	return &Syncer{
+		srv:       srv,
+		gmailAddr: gmailAddr,
+		opts:      opts,
+		path:      path,
+	}
+}
+
+// Creates the syncer for the app's inbox, as set in the config, and loads its state from the last run.
+// If no state was saved yet, the first sync will be a full one.
+func LoadSyncer(srv *gmail.Service, config config.Config) (*Syncer, error) {
+	s := NewSyncer(srv, config.GmailAddr, DefaultListOptions(config), syncStatePath)
+	return s, s.Load()
+}
+
+// loads the saved sync state. If there is none, or the query has changed since it was saved, the state is reset.
+func (s *Syncer) Load() error {
+	s.state = syncState{}
+	if s.path == "" {
+		return nil
+	}
+	bytes, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state syncState
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return err
+	}
+	if state.Query == s.opts.Query {
+		s.state = state
+	}
+	return nil
+}
+
+// saves the sync state to disk
+func (s *Syncer) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	bytes, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, bytes, 0644)
+}
+
+// returns the IDs of the messages in the synced inbox, newest first
+func (s *Syncer) Messages() []string {
+	return append([]string{}, s.state.Messages...)
+}
+
+// returns the history ID the syncer is up to date with (0 if it hasn't synced yet)
+func (s *Syncer) HistoryID() uint64 {
+	return s.state.HistoryID
+}
+
+// Brings the synced inbox up to date, and returns what changed. The state is saved after each successful sync.
+func (s *Syncer) Sync(ctx context.Context) (SyncResult, error) {
+	var result SyncResult
+	var err error
+	if s.state.HistoryID == 0 || time.Since(s.state.FullSyncAt) > fullResyncInterval {
+		result, err = s.fullSync(ctx)
+	} else {
+		result, err = s.historySync(ctx)
+		if isHistoryExpired(err) {
+			debug.Println("gmail history expired; doing a full resync")
+			result, err = s.fullSync(ctx)
+		}
+	}
+	if err != nil {
+		return SyncResult{}, err
+	}
+	if err := s.Save(); err != nil {
+		debug.Println("failed to save sync state:", err)
+	}
+	return result, nil
+}
+
+// lists the whole inbox. The history ID is taken before listing, so changes made during the listing are picked up by the next sync.
+func (s *Syncer) fullSync(ctx context.Context) (SyncResult, error) {
+	profile, err := s.srv.Users.GetProfile(s.gmailAddr).Context(ctx).Do()
+	if err != nil {
+		return SyncResult{}, err
+	}
+	list, err := ListMessages(ctx, s.srv, s.gmailAddr, s.opts)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	old := make(map[string]bool)
+	for _, id := range s.state.Messages {
+		old[id] = true
+	}
+	result := SyncResult{Full: true}
+	messages := make([]string, 0, len(list))
+	for _, msg := range list {
+		messages = append(messages, msg.Id)
+		if old[msg.Id] {
+			delete(old, msg.Id)
+		} else {
+			result.Added = append(result.Added, msg.Id)
+		}
+	}
+	for _, id := range s.state.Messages {
+		if old[id] {
+			result.Removed = append(result.Removed, id)
+		}
+	}
+	s.state = syncState{HistoryID: profile.HistoryId, Query: s.opts.Query, Messages: messages, FullSyncAt: time.Now()}
+	return result, nil
+}
+
+// applies the changes in the mailbox history since the last sync
+func (s *Syncer) historySync(ctx context.Context) (SyncResult, error) {
+	original := make(map[string]bool)
+	inInbox := make(map[string]bool)
+	for _, id := range s.state.Messages {
+		original[id] = true
+		inInbox[id] = true
+	}
+	added := []string{} // oldest first, as they come in the history
+	update := func(msg *gmail.Message, member bool) {
+		if msg == nil || msg.Id == "" {
+			return
+		}
+		inInbox[msg.Id] = member
+		if member {
+			added = append(added, msg.Id)
+		}
+	}
+
+	historyID := s.state.HistoryID
+	pageToken := ""
+	for {
+		call := s.srv.Users.History.List(s.gmailAddr).StartHistoryId(s.state.HistoryID).
+			HistoryTypes("messageAdded", "messageDeleted", "labelAdded", "labelRemoved").
+			MaxResults(maxPageSize).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return SyncResult{}, err
+		}
+		for _, h := range r.History {
+			for _, m := range h.MessagesAdded {
+				update(m.Message, m.Message != nil && s.matchesLabels(m.Message.LabelIds))
+			}
+			for _, m := range h.LabelsAdded {
+				update(m.Message, m.Message != nil && s.matchesLabels(m.Message.LabelIds))
+			}
+			for _, m := range h.LabelsRemoved {
+				update(m.Message, m.Message != nil && s.matchesLabels(m.Message.LabelIds))
+			}
+			for _, m := range h.MessagesDeleted {
+				update(m.Message, false)
+			}
+		}
+		if r.HistoryId > historyID {
+			historyID = r.HistoryId
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+
+	// messages that were already in the inbox keep their place, even if they left it and came back
+	result := SyncResult{}
+	messages := []string{}
+	seen := make(map[string]bool)
+	for i := len(added) - 1; i >= 0; i-- {
+		id := added[i]
+		if inInbox[id] && !original[id] && !seen[id] {
+			seen[id] = true
+			result.Added = append(result.Added, id)
+			messages = append(messages, id)
+		}
+	}
+	for _, id := range s.state.Messages {
+		if inInbox[id] {
+			messages = append(messages, id)
+		} else {
+			result.Removed = append(result.Removed, id)
+		}
+	}
+	if s.opts.Limit > 0 && len(messages) > s.opts.Limit {
+		messages = messages[:s.opts.Limit]
+	}
+	s.state.Messages = messages
+	s.state.HistoryID = historyID
+	return result, nil
+}
+
+// returns true if a message with these labels belongs in the synced inbox
+func (s *Syncer) matchesLabels(labelIDs []string) bool {
+	labels := make(map[string]bool)
+	for _, label := range labelIDs {
+		labels[label] = true
+	}
+	if !labels["INBOX"] {
+		return false
+	}
+	for _, label := range excludedSyncLabels {
+		if labels[label] {
+			return false
+		}
+	}
+	for _, label := range s.opts.LabelIDs {
+		if !labels[label] {
+			return false
+		}
+	}
+	return true
+}
+
+// gmail answers with 404 when the start history ID is too old to list the history from
+func isHistoryExpired(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,166 @@
+package gmail
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncer(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	fake.add("a", "", "INBOX")
+	fake.add("b", "", "INBOX", "UNREAD")
+	fake.add("sent", "", "SENT")
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "syncstate.json")
+	syncer := NewSyncer(srv, "me", ListOptions{Query: "in:inbox"}, path)
+
+	// the first sync lists the whole inbox
+	result, err := syncer.Sync(ctx)
+	if err != nil {
+		t.Fatal("first sync failed:", err)
+	}
+	if !result.Full || !reflect.DeepEqual(result.Added, []string{"b", "a"}) {
+		t.Errorf("expected a full sync adding b and a, got %+v", result)
+	}
+
+	// later syncs only get the changes from the history
+	fake.add("c", "", "INBOX")
+	fake.add("promo", "", "INBOX", "CATEGORY_PROMOTIONS")
+	fake.add("d", "", "INBOX")
+	fake.removeLabels("a", "INBOX") // archived
+	fake.add("e", "", "INBOX")
+	fake.delete("e")
+	fake.addLabels("sent", "INBOX")
+	lists := len(fake.listQueries)
+	result, err = syncer.Sync(ctx)
+	if err != nil {
+		t.Fatal("history sync failed:", err)
+	}
+	if len(fake.listQueries) != lists {
+		t.Error("a history sync shouldn't list the inbox")
+	}
+	if result.Full {
+		t.Error("expected a history sync, but got a full sync")
+	}
+	if !reflect.DeepEqual(result.Added, []string{"d", "c"}) {
+		t.Errorf("expected d and c to be added, got %v", result.Added)
+	}
+	if !reflect.DeepEqual(result.Removed, []string{"a"}) {
+		t.Errorf("expected a to be removed, got %v", result.Removed)
+	}
+	if got := syncer.Messages(); !reflect.DeepEqual(got, []string{"d", "c", "b"}) {
+		t.Errorf("unexpected synced inbox: %v", got)
+	}
+
+	// nothing changed
+	result, err = syncer.Sync(ctx)
+	if err != nil || len(result.Added) != 0 || len(result.Removed) != 0 {
+		t.Errorf("expected no changes, got %+v, error: %v", result, err)
+	}
+
+	// moving a message back to the inbox adds it again
+	fake.addLabels("a", "INBOX")
+	result, _ = syncer.Sync(ctx)
+	if !reflect.DeepEqual(result.Added, []string{"a"}) {
+		t.Errorf("expected a to be added back, got %v", result.Added)
+	}
+
+	// the state is picked up by a new syncer, like when the app is restarted
+	fake.add("f", "", "INBOX")
+	restarted := NewSyncer(srv, "me", ListOptions{Query: "in:inbox"}, path)
+	if err := restarted.Load(); err != nil {
+		t.Fatal("failed to load sync state:", err)
+	}
+	if restarted.HistoryID() != syncer.HistoryID() {
+		t.Errorf("expected saved history ID %v, got %v", syncer.HistoryID(), restarted.HistoryID())
+	}
+	result, _ = restarted.Sync(ctx)
+	if result.Full || !reflect.DeepEqual(result.Added, []string{"f"}) {
+		t.Errorf("expected f to be added from the history after restarting, got %+v", result)
+	}
+}
+
+func TestSyncerHistoryExpired(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	fake.add("a", "", "INBOX")
+	fake.add("b", "", "INBOX")
+	ctx := context.Background()
+	syncer := NewSyncer(srv, "me", ListOptions{Query: "in:inbox"}, "")
+	if _, err := syncer.Sync(ctx); err != nil {
+		t.Fatal("first sync failed:", err)
+	}
+
+	fake.delete("a")
+	fake.add("c", "", "INBOX")
+	fake.expireHistory()
+	result, err := syncer.Sync(ctx)
+	if err != nil {
+		t.Fatal("sync after history expired failed:", err)
+	}
+	if !result.Full {
+		t.Error("expected a full resync when the history expired")
+	}
+	if !reflect.DeepEqual(result.Added, []string{"c"}) || !reflect.DeepEqual(result.Removed, []string{"a"}) {
+		t.Errorf("expected c added and a removed, got %+v", result)
+	}
+	if got := syncer.Messages(); !reflect.DeepEqual(got, []string{"c", "b"}) {
+		t.Errorf("unexpected synced inbox: %v", got)
+	}
+}
+
+func TestSyncerQueryChanged(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	fake.add("a", "", "INBOX")
+	path := filepath.Join(t.TempDir(), "syncstate.json")
+	if _, err := NewSyncer(srv, "me", ListOptions{Query: "in:inbox"}, path).Sync(context.Background()); err != nil {
+		t.Fatal("sync failed:", err)
+	}
+	changed := NewSyncer(srv, "me", ListOptions{Query: "in:inbox is:unread"}, path)
+	if err := changed.Load(); err != nil {
+		t.Fatal("failed to load sync state:", err)
+	}
+	if changed.HistoryID() != 0 {
+		t.Error("sync state should be reset when the query changes")
+	}
+}
+
+func TestSyncerDropsOldMessages(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	dated := func(daysAgo int) string {
+		return "From: bob@example.com\r\nDate: " + time.Now().AddDate(0, 0, -daysAgo).Format(time.RFC1123Z) + "\r\n\r\nHi\r\n"
+	}
+	fake.add("aging", dated(6), "INBOX")
+	fake.add("recent", dated(1), "INBOX")
+	ctx := context.Background()
+	syncer := NewSyncer(srv, "me", ListOptions{Query: "in:inbox newer_than:7d"}, "")
+	if _, err := syncer.Sync(ctx); err != nil {
+		t.Fatal("first sync failed:", err)
+	}
+	if got := syncer.Messages(); !reflect.DeepEqual(got, []string{"recent", "aging"}) {
+		t.Fatalf("unexpected synced inbox: %v", got)
+	}
+
+	// two days later, the aging message is older than the lookback period. the history doesn't show that,
+	// but it's been long enough since the last full sync to list the inbox again.
+	fake.now = time.Now().AddDate(0, 0, 2)
+	syncer.state.FullSyncAt = syncer.state.FullSyncAt.AddDate(0, 0, -2)
+	result, err := syncer.Sync(ctx)
+	if err != nil {
+		t.Fatal("sync failed:", err)
+	}
+	if !result.Full || !reflect.DeepEqual(result.Removed, []string{"aging"}) {
+		t.Errorf("expected a full resync removing the aged message, got %+v", result)
+	}
+	if got := syncer.Messages(); !reflect.DeepEqual(got, []string{"recent"}) {
+		t.Errorf("unexpected synced inbox: %v", got)
+	}
+
+	// the next sync is from the history again
+	result, err = syncer.Sync(ctx)
+	if err != nil || result.Full {
+		t.Errorf("expected a history sync after the resync, got %+v, error: %v", result, err)
+	}
+}
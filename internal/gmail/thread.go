@@ -0,0 +1,106 @@
+package gmail
+
+import (
+	"context"
+	"mime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Gets the messages in the thread, oldest first. Drafts aren't included, since they weren't sent.
+// Messages sent from one of ownAddrs (or labeled as sent) are marked as the user's own.
+// The call is aborted if the context is cancelled or times out.
+func GetThread(ctx context.Context, srv *gmail.Service, gmailAddr string, threadID string, ownAddrs []string) ([]t.ThreadMessage, error) {
+	thread, err := srv.Users.Threads.Get(gmailAddr, threadID).Format("full").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]t.ThreadMessage, 0, len(thread.Messages))
+	for _, msg := range thread.Messages {
+		if slices.Contains(msg.LabelIds, "DRAFT") {
+			continue
+		}
+		messages = append(messages, threadMessage(msg, ownAddrs))
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date.Before(messages[j].Date)
+	})
+	return messages, nil
+}
+
+// gets the sender, date and text of a message in the full format
+func threadMessage(msg *gmail.Message, ownAddrs []string) t.ThreadMessage {
+	m := t.ThreadMessage{ID: msg.Id, Date: convInternalDateToTime(msg.InternalDate)}
+	if msg.Payload != nil {
+		for _, h := range msg.Payload.Headers {
+			if strings.EqualFold(h.Name, "From") {
+				from, err := new(mime.WordDecoder).DecodeHeader(h.Value)
+				if err != nil {
+					from = h.Value
+				}
+				m.From, m.SenderName = message.ExtractEmailAndName(from)
+				m.SenderName = strings.Trim(m.SenderName, `"`)
+			}
+		}
+		m.Text = message.StripQuoted(partText(msg.Payload))
+	}
+	m.Mine = slices.Contains(msg.LabelIds, "SENT") || message.IsOwnAddress(m.From, ownAddrs)
+	return m
+}
+
+// Gets the text of a message part in the full format. The plain text version is used if there is one, otherwise the HTML version.
+// Attachments are left out.
+func partText(part *gmail.MessagePart) string {
+	plain, html := findTextParts(part)
+	text := plain
+	if text == nil {
+		text = html
+	}
+	if text == nil || text.Body == nil {
+		return ""
+	}
+	data, err := decodeBase64URL(text.Body.Data)
+	if err != nil {
+		return ""
+	}
+	contentType := text.MimeType
+	for _, h := range text.Headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			contentType = h.Value
+		}
+	}
+	s, err := emailparse.DecodeText(data, contentType)
+	if err != nil {
+		return strings.TrimSpace(string(data))
+	}
+	return s
+}
+
+// finds the first plain text and HTML parts that aren't attachments
+func findTextParts(part *gmail.MessagePart) (*gmail.MessagePart, *gmail.MessagePart) {
+	if part.Filename == "" && (part.Body == nil || part.Body.AttachmentId == "") {
+		switch part.MimeType {
+		case "text/plain":
+			return part, nil
+		case "text/html":
+			return nil, part
+		}
+	}
+	var plain, html *gmail.MessagePart
+	for _, child := range part.Parts {
+		p, h := findTextParts(child)
+		if plain == nil {
+			plain = p
+		}
+		if html == nil {
+			html = h
+		}
+	}
+	return plain, html
+}
@@ -0,0 +1,76 @@
+package gmail
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+func TestGetThread(t *testing.T) {
+	fake, srv := newFakeGmail(t)
+	crlf := func(s string) string { return strings.ReplaceAll(s, "\n", "\r\n") }
+	fake.addToThread("t1", "m1", crlf(`From: Bob <bob@example.com>
+To: me@example.com
+Date: Mon, 1 Jul 2024 09:30:00 +0000
+Subject: Lunch
+
+Lunch on Friday?
+`), "INBOX")
+	fake.addToThread("t1", "m3", crlf(`From: "Bob" <bob@example.com>
+To: me@example.com
+Date: Mon, 1 Jul 2024 11:30:00 +0000
+Subject: Re: Lunch
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="alt"
+
+--alt
+Content-Type: text/html; charset="utf-8"
+
+<p>The usual place &amp; time.</p>
+--alt--
+`), "INBOX")
+	fake.addToThread("t1", "m2", crlf(`From: Me <me@example.com>
+To: bob@example.com
+Date: Mon, 1 Jul 2024 10:30:00 +0000
+Subject: Re: Lunch
+
+Sounds good, where?
+
+On Mon, Jul 1, 2024 at 9:30 AM, Bob <bob@example.com> wrote:
+> Lunch on Friday?
+`), "SENT")
+	fake.addToThread("t1", "d1", crlf(`From: me@example.com
+To: bob@example.com
+Date: Mon, 1 Jul 2024 12:00:00 +0000
+Subject: Re: Lunch
+
+Unsent draft
+`), "DRAFT")
+	fake.add("other", labeledEmail, "INBOX")
+
+	messages, err := GetThread(context.Background(), srv, "me", "t1", []string{"me@example.com"})
+	if err != nil {
+		t.Fatal("failed to get thread:", err)
+	}
+	want := []types.ThreadMessage{
+		{ID: "m1", From: "bob@example.com", SenderName: "Bob", Text: "Lunch on Friday?"},
+		{ID: "m2", From: "me@example.com", SenderName: "Me", Text: "Sounds good, where?", Mine: true},
+		{ID: "m3", From: "bob@example.com", SenderName: "Bob", Text: "The usual place & time."},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("expected %v messages, got %+v", len(want), messages)
+	}
+	for i := range want {
+		got := messages[i]
+		got.Date = time.Time{}
+		if got != want[i] {
+			t.Errorf("message %v: expected %+v, got %+v", i, want[i], got)
+		}
+	}
+	if messages[0].Date.After(messages[1].Date) || messages[1].Date.After(messages[2].Date) {
+		t.Error("expected the messages oldest first")
+	}
+}
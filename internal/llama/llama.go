@@ -2,11 +2,11 @@ package llama
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"os/exec"
-	"strconv"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/ollama/ollama/api"
 )
@@ -19,42 +19,82 @@ API: https://github.com/ollama/ollama/blob/main/docs/api.md
 Parameters: https://github.com/ollama/ollama/blob/main/docs/modelfile.md#valid-parameters-and-values
 */
 
-const (
-	model   = "llama3"
-	baseURL = "http://localhost:11434/"
-)
+// model used when none is configured
+const DefaultModel = "llama3"
 
-// starts the ollama server, and returns its Cmd reference so the process can be managed later
-func StartServer() (*exec.Cmd, error) {
-	cmd := exec.Command("ollama", "serve")
-	err := cmd.Start()
-	if err != nil {
-		return nil, err
+// token counts and timing of ollama calls, as reported by the server
+type Stats struct {
+	PromptTokens     int
+	CompletionTokens int
+	Duration         time.Duration // total time the server spent on the calls
+}
+
+type statsKey struct{}
+
+// returns a context that adds up the stats of the ollama calls made with it into stats
+func WithStats(ctx context.Context, stats *Stats) context.Context {
+	return context.WithValue(ctx, statsKey{}, stats)
+}
+
+func addStats(ctx context.Context, m api.Metrics) {
+	stats, ok := ctx.Value(statsKey{}).(*Stats)
+	if !ok {
+		return
 	}
-	return cmd, nil
+	stats.PromptTokens += m.PromptEvalCount
+	stats.CompletionTokens += m.EvalCount
+	stats.Duration += m.TotalDuration
 }
 
-// stops the ollama server, killing the process
-func StopServer(cmd *exec.Cmd) error {
-	return cmd.Process.Kill()
+// gets a client for the ollama server at the given host (e.g. "http://192.168.1.20:11434").
+// If host is empty, the OLLAMA_HOST environment variable is used, falling back to the default local address.
+func GetClient(host string) (*api.Client, error) {
+	return NewClient(host, http.DefaultClient)
 }
 
-func GetClient() (*api.Client, error) {
-	return api.ClientFromEnvironment()
+// Same as GetClient, but the given http client is used to make the API calls.
+func NewClient(host string, httpClient *http.Client) (*api.Client, error) {
+	base, err := resolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewClient(base, httpClient), nil
+}
+
+// gets the base URL of the ollama server at the given host, following the same rules as GetClient.
+func resolveHost(host string) (*url.URL, error) {
+	if host == "" {
+		ollamaHost, err := api.GetOllamaHost()
+		if err != nil {
+			return nil, err
+		}
+		return &url.URL{
+			Scheme: ollamaHost.Scheme,
+			Host:   net.JoinHostPort(ollamaHost.Host, ollamaHost.Port),
+		}, nil
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return url.Parse(strings.TrimRight(host, "/"))
 }
 
 // Call the Chat Completion API. Meant for conversations where past message context is needed.
-func ChatCompletion(client *api.Client, messages []api.Message) ([]api.Message, error) {
+// The call is aborted if the context is cancelled or times out.
+//
+// opts may be nil; see GenerateCompletionWithOpts for more info on options.
+func ChatCompletion(ctx context.Context, client *api.Client, model string, messages []api.Message, opts map[string]interface{}) ([]api.Message, error) {
 	stream := false
-	ctx := context.Background()
 	req := &api.ChatRequest{
 		Model:    model,
 		Messages: messages,
 		Stream:   &stream,
+		Options:  opts,
 	}
 
 	err := client.Chat(ctx, req, func(cr api.ChatResponse) error {
 		messages = append(messages, cr.Message)
+		addStats(ctx, cr.Metrics)
 		return nil
 	})
 	if err != nil {
@@ -63,12 +103,48 @@ func ChatCompletion(client *api.Client, messages []api.Message) ([]api.Message,
 	return messages, nil
 }
 
+// Same as ChatCompletion, but the response is streamed; fn is called with each token of the reply as it is generated.
+func ChatCompletionStream(ctx context.Context, client *api.Client, model string, messages []api.Message, opts map[string]interface{}, fn func(string)) ([]api.Message, error) {
+	stream := true
+	req := &api.ChatRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   &stream,
+		Options:  opts,
+	}
+
+	reply := api.Message{Role: "assistant"}
+	err := client.Chat(ctx, req, func(cr api.ChatResponse) error {
+		if cr.Message.Role != "" {
+			reply.Role = cr.Message.Role
+		}
+		reply.Content += cr.Message.Content
+		if fn != nil && cr.Message.Content != "" {
+			fn(cr.Message.Content)
+		}
+		addStats(ctx, cr.Metrics)
+		return nil
+	})
+	if err != nil {
+		return []api.Message{}, err
+	}
+	return append(messages, reply), nil
+}
+
 // Generate a completion using custom options. Below are some common options, but find more information about options params here:
 //
 // https://github.com/ollama/ollama/blob/main/docs/modelfile.md#valid-parameters-and-values
 //
 // "temperature": float (default: 0.8) - increasing this will make the model answer more creatively
-func GenerateCompletionWithOpts(client *api.Client, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+//
+// "num_ctx": int (default: 2048) - size of the context window used to generate the next token
+//
+// "top_p": float (default: 0.9) - lower values make the output more focused and conservative
+//
+// "seed": int (default: 0) - setting a specific seed makes the model generate the same text for the same prompt
+//
+// The call is aborted if the context is cancelled or times out.
+func GenerateCompletionWithOpts(ctx context.Context, client *api.Client, model string, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
 	stream := false
 	req := &api.GenerateRequest{
 		Model:   model,
@@ -77,15 +153,17 @@ func GenerateCompletionWithOpts(client *api.Client, systemPrompt string, prompt
 		Stream:  &stream,
 		Options: opts,
 	}
-	return generateCompletion(client, req)
+	return generateCompletion(ctx, client, req)
 }
 
 // Generates a completion using the given system prompt to set the context and AI behavior/personality, and based on the given prompt.
 //
+// The call is aborted if the context is cancelled or times out.
+//
 // Use ChatCompletion for conversations and memory based generation.
 //
 // Use GenerateCompletionWithOpts to customize options such as temperature.
-func GenerateCompletion(client *api.Client, systemPrompt string, prompt string) (string, error) {
+func GenerateCompletion(ctx context.Context, client *api.Client, model string, systemPrompt string, prompt string) (string, error) {
 	stream := false
 	req := &api.GenerateRequest{
 		Model:  model,
@@ -93,14 +171,41 @@ func GenerateCompletion(client *api.Client, systemPrompt string, prompt string)
 		System: systemPrompt,
 		Stream: &stream,
 	}
-	return generateCompletion(client, req)
+	return generateCompletion(ctx, client, req)
+}
+
+// Same as GenerateCompletionWithOpts, but the model is forced to output a valid JSON object.
+// This version of the ollama API can't be given a schema, so the prompt should describe the JSON structure you want (see llm.GenerateStructured).
+func GenerateCompletionJSON(ctx context.Context, client *api.Client, model string, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	stream := false
+	req := &api.GenerateRequest{
+		Model:   model,
+		Prompt:  prompt,
+		System:  systemPrompt,
+		Stream:  &stream,
+		Format:  "json",
+		Options: opts,
+	}
+	return generateCompletion(ctx, client, req)
 }
 
-func generateCompletion(client *api.Client, req *api.GenerateRequest) (string, error) {
-	ctx := context.Background()
+// Same as GenerateCompletionWithOpts, but the response is streamed; fn is called with each token as it is generated.
+func GenerateCompletionStream(ctx context.Context, client *api.Client, model string, systemPrompt string, prompt string, opts map[string]interface{}, fn func(string)) (string, error) {
+	stream := true
+	req := &api.GenerateRequest{
+		Model:   model,
+		Prompt:  prompt,
+		System:  systemPrompt,
+		Stream:  &stream,
+		Options: opts,
+	}
 	output := ""
 	err := client.Generate(ctx, req, func(gr api.GenerateResponse) error {
-		output = gr.Response
+		output += gr.Response
+		if fn != nil && gr.Response != "" {
+			fn(gr.Response)
+		}
+		addStats(ctx, gr.Metrics)
 		return nil
 	})
 	if err != nil {
@@ -109,46 +214,15 @@ func generateCompletion(client *api.Client, req *api.GenerateRequest) (string, e
 	return output, nil
 }
 
-// Pass: 5/9            (56%)
-// False positives: 1/9 (11%)
-// Wrong format: 1/9    (11%)
-const spam_prompt string = `
-You are a robot that only outputs a number between 0 and 100.
-You are given an email body, and you detect if it is junk or not. 
-Output your confidence level about if the email is junk, where 0 means zero confidence (it is definitely not junk) and 100 is complete confidence (it is surely junk).
-After the confidence level, also output a semi-colon and a short reason.
-
-Sample outputs:
-15;The email doesn't look like junk because the sender seems to know the recipient personally.
-87;The email looks like junk because it's a newsletter from an online shop.
-50;It's unclear if this is junk or not, since it has traits of both junk and regular emails.
-
-An email is junk if:
-* is a newsletter.
-* it is a notification talking about inboxes, unread messages, etc.
-* is doesn't refer to the recipient by their name.
-
-An email is not junk if:
-* it's from a person who seems to know the recipient personally.
-* it includes odd, suspicious, or humorous content, since I want to see those messages personally.
-`
-
-// TODO - this doesn't work well enough so far, since it gives false positives a lot.
-// Apparently it's kind of hard to prompt Llama3 to identify junk mail.
-func IsEmailSpam(client *api.Client, email string) (bool, string) {
-	prompt := fmt.Sprintf("Email:\n\n%s", email)
-	system := strings.TrimSpace(spam_prompt)
-	out, err := GenerateCompletionWithOpts(client, system, prompt, map[string]interface{}{"temperature": 0.0})
-	if err != nil {
-		log.Println("failed to do spam detection completion:", err)
-		return false, ""
-	}
-	split := strings.Split(out, ";")
-	confidence, err := strconv.Atoi(split[0])
+func generateCompletion(ctx context.Context, client *api.Client, req *api.GenerateRequest) (string, error) {
+	output := ""
+	err := client.Generate(ctx, req, func(gr api.GenerateResponse) error {
+		output = gr.Response
+		addStats(ctx, gr.Metrics)
+		return nil
+	})
 	if err != nil {
-		log.Println("failed to parse number from completion output:", err)
-		return false, ""
+		return "", err
 	}
-
-	return confidence > 50, out
+	return output, nil
 }
@@ -0,0 +1,72 @@
+package llamatest
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/webbben/mail-assistant/internal/llama"
+)
+
+// test flags for how tests that call a model reach it. only test binaries import this package, so the app doesn't get these flags.
+var (
+	live   = flag.Bool("live", false, "run the tests against a live ollama server, instead of replaying recorded fixtures")
+	record = flag.Bool("record", false, "run the tests against a live ollama server, and record its responses as fixtures under tests/fixtures to replay in later runs")
+)
+
+// Gets the ollama client for a test's model calls, depending on the test flags:
+//
+// -record: a live ollama server, recording its responses to tests/fixtures/<test name>. The test's old fixtures are removed first,
+// so fixtures for outdated prompts don't pile up.
+//
+// -live: a live ollama server
+//
+// otherwise, the recorded fixtures for the test are replayed. If the test has none, it's skipped, since there's no model
+// output to check.
+//
+// With -record or -live, the server is started if it isn't running already, and the given models are pulled. It's stopped when the test is done.
+//
+// go test ./internal/assistant ./internal/llm -args -record
+func Client(t *testing.T, models ...string) *api.Client {
+	t.Helper()
+	fixtures := filepath.Join("tests", "fixtures", t.Name())
+	if !*record && !*live {
+		if !llama.HasFixtures(fixtures) {
+			t.Skip("no recorded fixtures in", fixtures, "- record them with -args -record")
+		}
+		return recordingClient(t, fixtures, llama.Replay)
+	}
+
+	server, err := llama.NewServer("")
+	if err != nil {
+		t.Fatal("failed to get ollama server:", err)
+	}
+	ctx := context.Background()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal("failed to start ollama server:", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	for _, model := range models {
+		if err := server.EnsureModel(ctx, model, llama.PrintPullProgress(model)); err != nil {
+			t.Fatalf("failed to get model %s: %v", model, err)
+		}
+	}
+	if *live {
+		return server.Client
+	}
+	if err := os.RemoveAll(fixtures); err != nil {
+		t.Fatal("failed to remove old fixtures:", err)
+	}
+	return recordingClient(t, fixtures, llama.Record)
+}
+
+func recordingClient(t *testing.T, fixtures string, mode llama.RecordMode) *api.Client {
+	client, err := llama.NewRecordingClient("", &llama.Recorder{Dir: fixtures, Mode: mode})
+	if err != nil {
+		t.Fatal("failed to get ollama client:", err)
+	}
+	return client
+}
@@ -0,0 +1,177 @@
+package llama
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// modes for a Recorder
+type RecordMode int
+
+const (
+	Replay RecordMode = iota // serve responses from the fixture files, without a server
+	Record                   // pass requests on to the server, and save each response to a fixture file
+)
+
+// Recorder is an http.RoundTripper for the ollama API client, which records real requests and responses to fixture files,
+// or replays them back from those files. This lets tests run against real model outputs without an ollama server.
+//
+// Each request is matched to its fixture by a hash of its method, path and body, so replays are deterministic
+// as long as the prompts and options don't change. When they do, record the fixtures again.
+type Recorder struct {
+	Dir       string            // directory holding the fixture files
+	Mode      RecordMode        // whether to record or replay
+	Transport http.RoundTripper // used to reach the server when recording (default: http.DefaultTransport)
+}
+
+// a recorded request and its response, as saved to a fixture file
+type fixture struct {
+	Request  fixtureRequest  `json:"request"`
+	Response fixtureResponse `json:"response"`
+}
+
+type fixtureRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type fixtureResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"` // streamed responses are saved whole, as newline separated JSON objects
+}
+
+// gets a client for the ollama server at the given host, which records or replays its calls with the given recorder.
+// When replaying, the host doesn't need to be running (or exist).
+func NewRecordingClient(host string, r *Recorder) (*api.Client, error) {
+	return NewClient(host, &http.Client{Transport: r})
+}
+
+// returns true if the directory has any recorded fixtures in it
+func HasFixtures(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	return len(matches) > 0
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	recorded := fixtureRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Body:   normalizeJSON(body),
+	}
+	path := filepath.Join(r.Dir, recorded.key()+".json")
+
+	if r.Mode == Replay {
+		return r.replay(req, recorded, path)
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	f := fixture{
+		Request: recorded,
+		Response: fixtureResponse{
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        string(respBody),
+		},
+	}
+	if err := writeFixture(path, f); err != nil {
+		return nil, fmt.Errorf("failed to record fixture: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, recorded fixtureRequest, path string) (*http.Response, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no recorded response for %s %s in %s (prompts or options may have changed; record the fixtures again)", recorded.Method, recorded.Path, r.Dir)
+	}
+	var f fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to read fixture %s: %w", path, err)
+	}
+	header := make(http.Header)
+	if f.Response.ContentType != "" {
+		header.Set("Content-Type", f.Response.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Response.Status, http.StatusText(f.Response.Status)),
+		StatusCode:    f.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(f.Response.Body)),
+		ContentLength: int64(len(f.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+func writeFixture(path string, f fixture) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(bytes, '\n'), 0644)
+}
+
+// hashes the request into the name of its fixture file
+func (fr fixtureRequest) key() string {
+	sum := sha256.Sum256([]byte(fr.Method + " " + fr.Path + "\n" + string(fr.Body)))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// re-encodes a JSON body so the same content always gives the same bytes (map keys are sorted when encoding).
+// Bodies that aren't JSON are left out, since ollama API requests are always JSON.
+func normalizeJSON(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return out
+}
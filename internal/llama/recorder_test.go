@@ -0,0 +1,100 @@
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+// a stand-in for the ollama generate API, which echoes the prompt back, one word at a time if streaming
+func echoGenerate(calls *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		var req api.GenerateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		if req.Stream != nil && !*req.Stream {
+			enc.Encode(api.GenerateResponse{Response: "echo: " + req.Prompt, Done: true})
+			return
+		}
+		for _, word := range strings.SplitAfter("echo: "+req.Prompt, " ") {
+			enc.Encode(api.GenerateResponse{Response: word})
+		}
+		enc.Encode(api.GenerateResponse{Done: true})
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(echoGenerate(&calls))
+	dir := t.TempDir()
+	opts := map[string]interface{}{"temperature": 0.0, "seed": 42}
+
+	// record
+	client, err := NewRecordingClient(srv.URL, &Recorder{Dir: dir, Mode: Record})
+	if err != nil {
+		t.Fatal("failed to create client:", err)
+	}
+	recorded, err := GenerateCompletionWithOpts(context.Background(), client, "llama3", "system", "hello there", opts)
+	if err != nil {
+		t.Fatal("failed to record:", err)
+	}
+	tokens := []string{}
+	recordedStream, err := GenerateCompletionStream(context.Background(), client, "llama3", "system", "stream me", opts, func(s string) { tokens = append(tokens, s) })
+	if err != nil {
+		t.Fatal("failed to record stream:", err)
+	}
+	srv.Close()
+	if calls != 2 || !HasFixtures(dir) {
+		t.Fatalf("expected 2 recorded calls, but the server got %v calls", calls)
+	}
+
+	// replay, with the server gone
+	client, err = NewRecordingClient(srv.URL, &Recorder{Dir: dir, Mode: Replay})
+	if err != nil {
+		t.Fatal("failed to create client:", err)
+	}
+	replayed, err := GenerateCompletionWithOpts(context.Background(), client, "llama3", "system", "hello there", map[string]interface{}{"seed": 42, "temperature": 0})
+	if err != nil {
+		t.Fatal("failed to replay:", err)
+	}
+	if replayed != recorded || replayed != "echo: hello there" {
+		t.Errorf("replayed output %q doesn't match the recorded output %q", replayed, recorded)
+	}
+	replayedTokens := []string{}
+	replayedStream, err := GenerateCompletionStream(context.Background(), client, "llama3", "system", "stream me", opts, func(s string) { replayedTokens = append(replayedTokens, s) })
+	if err != nil {
+		t.Fatal("failed to replay stream:", err)
+	}
+	if replayedStream != recordedStream || strings.Join(replayedTokens, "|") != strings.Join(tokens, "|") {
+		t.Errorf("replayed stream %q doesn't match the recorded stream %q", replayedTokens, tokens)
+	}
+
+	// a request that wasn't recorded fails
+	if _, err := GenerateCompletionWithOpts(context.Background(), client, "llama3", "system", "new prompt", opts); err == nil {
+		t.Error("expected an error for a request with no fixture")
+	}
+}
+
+func TestNormalizeJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		exp   string
+	}{
+		{`{"b": 1, "a": {"d": 2.0, "c": "x"}}`, `{"a":{"c":"x","d":2},"b":1}`},
+		{"", ""},
+		{"not json", ""},
+	}
+
+	for i, test := range tests {
+		if out := string(normalizeJSON([]byte(test.input))); out != test.exp {
+			t.Errorf("case %v, expected: %s, output: %s", i, test.exp, out)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package llama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/webbben/mail-assistant/internal/debug"
+)
+
+// Server manages the ollama server used by the app. It uses an existing server if one is already running,
+// and only starts (and later stops) a server itself when needed.
+type Server struct {
+	Client       *api.Client
+	ReadyTimeout time.Duration // how long to wait for a started server to become ready
+	PollInterval time.Duration // how often to check if a started server is ready
+
+	base    *url.URL
+	command func() *exec.Cmd // builds the command that starts the server
+	cmd     *exec.Cmd        // the server process, if we started it ourselves
+	exited  chan struct{}    // closed once the server process we started exits
+}
+
+// creates a manager for the ollama server at the given host. See GetClient for how host is used.
+func NewServer(host string) (*Server, error) {
+	base, err := resolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Client:       api.NewClient(base, http.DefaultClient),
+		ReadyTimeout: 30 * time.Second,
+		PollInterval: 250 * time.Millisecond,
+		base:         base,
+	}
+	s.command = func() *exec.Cmd {
+		cmd := exec.Command("ollama", "serve")
+		cmd.Env = append(os.Environ(), "OLLAMA_HOST="+s.base.Host)
+		return cmd
+	}
+	return s, nil
+}
+
+// makes sure an ollama server is running and ready to take requests.
+// If one is already running, it is used as is. Otherwise, a server is started and this waits until it is ready.
+// Servers on remote hosts are never started, since we can't do that from here.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.Client.Heartbeat(ctx); err == nil {
+		debug.Println("using existing ollama server at", s.base.String())
+		return nil
+	}
+	if !isLocalHost(s.base.Hostname()) {
+		return fmt.Errorf("ollama server at %s is not reachable", s.base.String())
+	}
+
+	debug.Println("starting ollama server at", s.base.String())
+	cmd := s.command()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.cmd = cmd
+	s.exited = make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(s.exited)
+	}()
+	if err := s.waitReady(ctx); err != nil {
+		s.Stop()
+		return err
+	}
+	return nil
+}
+
+// polls the server until it responds, it exits, or the ready timeout is reached.
+func (s *Server) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.ReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Client.Heartbeat(ctx); err == nil {
+			debug.Println("ollama server is ready")
+			return nil
+		}
+		select {
+		case <-s.exited:
+			return errors.New("ollama server exited before it was ready")
+		case <-ctx.Done():
+			return fmt.Errorf("ollama server not ready: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// stops the ollama server, but only if it was started by this manager.
+func (s *Server) Stop() error {
+	if s.cmd == nil {
+		return nil
+	}
+	cmd := s.cmd
+	s.cmd = nil
+	select {
+	case <-s.exited:
+		// already gone
+		return nil
+	default:
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-s.exited
+	return nil
+}
+
+// returns true if the server process was started by this manager
+func (s *Server) Started() bool {
+	return s.cmd != nil
+}
+
+// makes sure the given model has been downloaded to the server, pulling it if not.
+// progress is called as the download progresses, and may be nil.
+func (s *Server) EnsureModel(ctx context.Context, model string, progress func(api.ProgressResponse)) error {
+	list, err := s.Client.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range list.Models {
+		if modelNamesMatch(m.Name, model) || modelNamesMatch(m.Model, model) {
+			return nil
+		}
+	}
+	debug.Println("model not found; pulling", model)
+	return s.Client.Pull(ctx, &api.PullRequest{Model: model}, func(pr api.ProgressResponse) error {
+		if progress != nil {
+			progress(pr)
+		}
+		return nil
+	})
+}
+
+// model names without a tag refer to the "latest" tag
+func modelNamesMatch(a string, b string) bool {
+	if !strings.Contains(a, ":") {
+		a += ":latest"
+	}
+	if !strings.Contains(b, ":") {
+		b += ":latest"
+	}
+	return a == b
+}
+
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// returns a progress function for EnsureModel which prints the download progress to the terminal
+func PrintPullProgress(model string) func(api.ProgressResponse) {
+	return func(pr api.ProgressResponse) {
+		if pr.Total > 0 {
+			fmt.Printf("\rpulling %s: %s %3.0f%% (%.1f / %.1f GB)   ", model, pr.Status, float64(pr.Completed)/float64(pr.Total)*100, float64(pr.Completed)/1e9, float64(pr.Total)/1e9)
+			return
+		}
+		fmt.Printf("\rpulling %s: %s%s\n", model, pr.Status, strings.Repeat(" ", 30))
+	}
+}
@@ -0,0 +1,145 @@
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// a stand-in for the ollama API. The server reports as unavailable for the first downHeartbeats heartbeats.
+type fakeOllama struct {
+	downHeartbeats int32
+	heartbeats     atomic.Int32
+	models         []string
+	pulled         []string
+}
+
+func (f *fakeOllama) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodHead && r.URL.Path == "/":
+		if f.heartbeats.Add(1) <= f.downHeartbeats {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Path == "/api/tags":
+		list := api.ListResponse{}
+		for _, m := range f.models {
+			list.Models = append(list.Models, api.ListModelResponse{Name: m, Model: m})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.URL.Path == "/api/pull":
+		var req api.PullRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.pulled = append(f.pulled, req.Model)
+		enc := json.NewEncoder(w)
+		enc.Encode(api.ProgressResponse{Status: "pulling manifest"})
+		enc.Encode(api.ProgressResponse{Status: "downloading", Total: 100, Completed: 50})
+		enc.Encode(api.ProgressResponse{Status: "success"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestServer(t *testing.T, f *fakeOllama) (*Server, *int) {
+	httpSrv := httptest.NewServer(f)
+	t.Cleanup(httpSrv.Close)
+	s, err := NewServer(httpSrv.URL)
+	if err != nil {
+		t.Fatal("failed to create server manager:", err)
+	}
+	s.PollInterval = 10 * time.Millisecond
+	s.ReadyTimeout = 2 * time.Second
+	starts := 0
+	s.command = func() *exec.Cmd {
+		starts++
+		return exec.Command("sleep", "30")
+	}
+	return s, &starts
+}
+
+func TestServerUsesExisting(t *testing.T) {
+	s, starts := newTestServer(t, &fakeOllama{})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal("failed to start:", err)
+	}
+	if *starts != 0 || s.Started() {
+		t.Error("started a server even though one was already running")
+	}
+	if err := s.Stop(); err != nil {
+		t.Error("failed to stop:", err)
+	}
+}
+
+func TestServerStartsWhenNeeded(t *testing.T) {
+	f := &fakeOllama{downHeartbeats: 3}
+	s, starts := newTestServer(t, f)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal("failed to start:", err)
+	}
+	if *starts != 1 || !s.Started() {
+		t.Errorf("expected the server to be started once, but was started %v times", *starts)
+	}
+	if f.heartbeats.Load() <= f.downHeartbeats {
+		t.Error("server wasn't polled until ready")
+	}
+	proc := s.cmd.Process
+	if err := s.Stop(); err != nil {
+		t.Error("failed to stop:", err)
+	}
+	if s.Started() {
+		t.Error("server still marked as started after stopping")
+	}
+	if err := proc.Signal(nil); err == nil {
+		t.Error("server process still running after stopping")
+	}
+}
+
+func TestServerReadyTimeout(t *testing.T) {
+	s, _ := newTestServer(t, &fakeOllama{downHeartbeats: 1000})
+	s.ReadyTimeout = 100 * time.Millisecond
+	if err := s.Start(context.Background()); err == nil {
+		t.Error("expected an error for a server that never becomes ready")
+	}
+	if s.Started() {
+		t.Error("server that never became ready was left running")
+	}
+}
+
+func TestEnsureModel(t *testing.T) {
+	tests := []struct {
+		models    []string
+		model     string
+		expPulled bool
+	}{
+		{[]string{"llama3:latest"}, "llama3", false},
+		{[]string{"llama3:latest", "mistral:7b"}, "mistral:7b", false},
+		{[]string{"llama3:latest"}, "mistral", true},
+		{[]string{"llama3:8b"}, "llama3", true},
+	}
+
+	for i, test := range tests {
+		f := &fakeOllama{models: test.models}
+		s, _ := newTestServer(t, f)
+		progressCalls := 0
+		err := s.EnsureModel(context.Background(), test.model, func(api.ProgressResponse) { progressCalls++ })
+		if err != nil {
+			t.Errorf("case %v, error: %s", i, err)
+			continue
+		}
+		pulled := len(f.pulled) > 0
+		if pulled != test.expPulled {
+			t.Errorf("case %v, expected pull: %v, got: %v", i, test.expPulled, pulled)
+		}
+		if pulled && progressCalls != 3 {
+			t.Errorf("case %v, expected 3 progress updates, got %v", i, progressCalls)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+)
+
+const defaultCacheDir = "llmcache"
+
+// Cache is an on-disk cache of model outputs, so the same deterministic call doesn't need to be generated twice.
+// Each output is stored in its own file, named by the hash of everything that went into the call.
+//
+// A nil Cache is valid, and just doesn't cache anything.
+type Cache struct {
+	dir        string
+	maxEntries int
+	maxBytes   int64
+	ttl        time.Duration
+	bypass     bool
+
+	mu sync.Mutex
+}
+
+// a cached model output, as stored on disk
+type cacheEntry struct {
+	Created time.Time `json:"created"`
+	Model   string    `json:"model"`
+	Output  string    `json:"output"`
+}
+
+// the inputs of a call, which make up the cache key
+type cacheKeyData struct {
+	Provider     string                 `json:"provider"`
+	Model        string                 `json:"model"`
+	SystemPrompt string                 `json:"system"`
+	Prompt       string                 `json:"prompt"`
+	Opts         map[string]interface{} `json:"opts"`
+	JSON         bool                   `json:"json"`
+}
+
+// creates the cache set in the config. Returns nil if caching isn't enabled.
+func NewCache(c config.LLMCache) *Cache {
+	if !c.Enabled {
+		return nil
+	}
+	dir := c.Dir
+	if dir == "" {
+		dir = defaultCacheDir
+	}
+	return &Cache{
+		dir:        dir,
+		maxEntries: c.MaxEntries,
+		maxBytes:   int64(c.MaxSizeMB) * 1024 * 1024,
+		ttl:        time.Duration(c.TTLHours) * time.Hour,
+		bypass:     c.Bypass,
+	}
+}
+
+// returns the output of gen, using the cached output instead if there is one.
+// Only deterministic calls (temperature 0) are cached; anything else is always generated.
+func (c *Cache) generate(key cacheKeyData, gen func() (string, error)) (string, error) {
+	if c == nil || !isDeterministic(key.Opts) {
+		return gen()
+	}
+	hash := key.hash()
+	if !c.bypass {
+		if out, ok := c.Get(hash); ok {
+			debug.Println("using cached model output", hash[:12])
+			return out, nil
+		}
+	}
+	out, err := gen()
+	if err != nil {
+		return out, err
+	}
+	if err := c.Put(hash, key.Model, out); err != nil {
+		debug.Println("failed to cache model output:", err)
+	}
+	return out, nil
+}
+
+// gets the cached output for the given key hash, if it exists and hasn't expired
+func (c *Cache) Get(hash string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, err := readCacheEntry(c.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false
+	}
+	if err != nil {
+		debug.Println("removing corrupted cache entry:", hash)
+		os.Remove(c.path(hash))
+		return "", false
+	}
+	if c.expired(entry) {
+		os.Remove(c.path(hash))
+		return "", false
+	}
+	return entry.Output, true
+}
+
+// saves the output for the given key hash, then removes the oldest entries if the cache is over its limits
+func (c *Cache) Put(hash string, model string, output string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(cacheEntry{Created: time.Now(), Model: model, Output: output})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path(hash), bytes, 0644); err != nil {
+		return err
+	}
+	return c.prune()
+}
+
+// removes the cached output for the given key hash, if there is one
+func (c *Cache) Delete(hash string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Remove(c.path(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removes the cached output of the call with the given inputs, e.g. when the caller found it was invalid
+func (c *Cache) forget(key cacheKeyData) {
+	if c == nil || !isDeterministic(key.Opts) {
+		return
+	}
+	if err := c.Delete(key.hash()); err != nil {
+		debug.Println("failed to remove cached model output:", err)
+	}
+}
+
+// removes every entry from the cache
+func (c *Cache) Clear() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return os.RemoveAll(c.dir)
+}
+
+// removes expired entries, and then the oldest entries until the cache is within its size limits.
+// Entries are only written once, in Put, so they're aged by their file's modified time instead of reading every entry.
+func (c *Cache) prune() error {
+	if c.maxEntries <= 0 && c.maxBytes <= 0 && c.ttl <= 0 {
+		return nil
+	}
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	files := []file{}
+	var total int64
+	for _, de := range dirEntries {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		if c.ttl > 0 && time.Since(info.ModTime()) > c.ttl {
+			os.Remove(filepath.Join(c.dir, de.Name()))
+			continue
+		}
+		files = append(files, file{de.Name(), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for len(files) > 0 && ((c.maxEntries > 0 && len(files) > c.maxEntries) || (c.maxBytes > 0 && total > c.maxBytes)) {
+		if err := os.Remove(filepath.Join(c.dir, files[0].name)); err != nil {
+			return err
+		}
+		total -= files[0].size
+		files = files[1:]
+	}
+	return nil
+}
+
+// checks if the entry is older than the cache's TTL
+func (c *Cache) expired(entry cacheEntry) bool {
+	return c.ttl > 0 && time.Since(entry.Created) > c.ttl
+}
+
+func readCacheEntry(path string) (cacheEntry, error) {
+	var entry cacheEntry
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(bytes, &entry)
+	return entry, err
+}
+
+func (c *Cache) path(hash string) string {
+	return filepath.Join(c.dir, hash+".json")
+}
+
+// hashes the call inputs into a cache key. map keys are sorted when encoded to JSON, so the same options always give the same hash.
+func (k cacheKeyData) hash() string {
+	bytes, _ := json.Marshal(k)
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// a call is deterministic if its temperature is set to 0
+func isDeterministic(opts map[string]interface{}) bool {
+	switch t := opts["temperature"].(type) {
+	case float64:
+		return t == 0
+	case int:
+		return t == 0
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+// returns a function that generates a new output each time, and counts how many times it was called
+func countingGen(calls *int) func() (string, error) {
+	return func() (string, error) {
+		*calls++
+		return fmt.Sprint("output ", *calls), nil
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache(config.LLMCache{Enabled: true, Dir: t.TempDir()})
+	calls := 0
+	gen := countingGen(&calls)
+	key := cacheKeyData{Model: "llama3", SystemPrompt: "system", Prompt: "prompt", Opts: map[string]interface{}{"temperature": 0.0, "seed": 42}}
+
+	first, _ := cache.generate(key, gen)
+	second, _ := cache.generate(key, gen)
+	if calls != 1 || first != second {
+		t.Errorf("expected the second call to be cached. calls: %v, outputs: %q, %q", calls, first, second)
+	}
+
+	// options are part of the key, regardless of how the numbers were decoded
+	sameOpts := key
+	sameOpts.Opts = map[string]interface{}{"seed": 42.0, "temperature": 0}
+	if cache.generate(sameOpts, gen); calls != 1 {
+		t.Error("equal options gave a different cache key")
+	}
+	otherPrompt := key
+	otherPrompt.Prompt = "another prompt"
+	if cache.generate(otherPrompt, gen); calls != 2 {
+		t.Error("different prompt used the cached output")
+	}
+
+	// non-deterministic calls aren't cached
+	random := key
+	random.Opts = map[string]interface{}{"temperature": 0.8}
+	cache.generate(random, gen)
+	cache.generate(random, gen)
+	if calls != 4 {
+		t.Errorf("non-deterministic call was cached. calls: %v", calls)
+	}
+
+	// a nil cache always generates
+	var none *Cache
+	none.generate(key, gen)
+	if calls != 5 {
+		t.Error("nil cache didn't generate")
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	dir := t.TempDir()
+	key := cacheKeyData{Model: "llama3", Prompt: "prompt", Opts: map[string]interface{}{"temperature": 0}}
+	calls := 0
+	gen := countingGen(&calls)
+
+	NewCache(config.LLMCache{Enabled: true, Dir: dir}).generate(key, gen)
+	bypass := NewCache(config.LLMCache{Enabled: true, Dir: dir, Bypass: true})
+	out, _ := bypass.generate(key, gen)
+	if calls != 2 {
+		t.Error("bypassed cache used the cached output")
+	}
+	// the new output should still be saved
+	if cached, _ := NewCache(config.LLMCache{Enabled: true, Dir: dir}).Get(key.hash()); cached != out {
+		t.Errorf("bypassed output wasn't saved. expected: %q, cached: %q", out, cached)
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewCache(config.LLMCache{Enabled: true, Dir: dir, MaxEntries: 2})
+	for i, hash := range []string{"a", "b", "c"} {
+		if err := cache.Put(hash, "llama3", "output"); err != nil {
+			t.Fatal("failed to put:", err)
+		}
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(cache.path(hash), modTime, modTime)
+	}
+	if err := cache.prune(); err != nil {
+		t.Fatal("failed to prune:", err)
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Error("oldest entry wasn't removed when over the entry limit")
+	}
+	for _, hash := range []string{"b", "c"} {
+		if _, ok := cache.Get(hash); !ok {
+			t.Errorf("entry %s was removed", hash)
+		}
+	}
+
+	// expired entries aren't used
+	expiring := NewCache(config.LLMCache{Enabled: true, Dir: t.TempDir(), TTLHours: 1})
+	expiring.Put("old", "llama3", "output")
+	data, _ := json.Marshal(cacheEntry{Created: time.Now().Add(-2 * time.Hour), Model: "llama3", Output: "output"})
+	os.WriteFile(expiring.path("old"), data, 0644)
+	if _, ok := expiring.Get("old"); ok {
+		t.Error("expired entry was used")
+	}
+
+	// expired entries are removed when the cache is pruned
+	expiring.Put("old", "llama3", "output")
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(expiring.path("old"), old, old)
+	if err := expiring.Put("new", "llama3", "output"); err != nil {
+		t.Fatal("failed to put:", err)
+	}
+	if _, err := os.Stat(expiring.path("old")); !os.IsNotExist(err) {
+		t.Error("expired entry wasn't pruned")
+	}
+	if _, ok := expiring.Get("new"); !ok {
+		t.Error("new entry was pruned")
+	}
+}
+
+func TestOllamaCache(t *testing.T) {
+	generates := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		generates++
+		json.NewEncoder(w).Encode(api.GenerateResponse{Response: `{"confidence": 10, "reason": "a real person"}`, Done: true})
+	}))
+	defer srv.Close()
+
+	c := config.LLM{Host: srv.URL, Cache: config.LLMCache{Enabled: true, Dir: t.TempDir()}}
+	for i := 0; i < 2; i++ {
+		provider, err := NewOllama(c)
+		if err != nil {
+			t.Fatal("failed to create provider:", err)
+		}
+		if isSpam, _ := IsEmailSpam(context.Background(), provider, "Hi Ben, lunch tomorrow?"); isSpam {
+			t.Error("expected email not to be spam")
+		}
+	}
+	if generates != 1 {
+		t.Errorf("expected the repeated spam check to be cached, but the model was called %v times", generates)
+	}
+}
+
+func TestOllamaCacheSkipsInvalidOutput(t *testing.T) {
+	generates := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		generates++
+		out := `{"categories": [1]}`
+		if generates == 1 {
+			out = `{"categories": [9]}`
+		}
+		json.NewEncoder(w).Encode(api.GenerateResponse{Response: out, Done: true})
+	}))
+	defer srv.Close()
+
+	c := config.LLM{Host: srv.URL, Cache: config.LLMCache{Enabled: true, Dir: t.TempDir()}}
+	for i := 0; i < 3; i++ {
+		provider, err := NewOllama(c)
+		if err != nil {
+			t.Fatal("failed to create provider:", err)
+		}
+		var result testResult
+		validate := func() error {
+			if len(result.Categories) != 1 || result.Categories[0] != 1 {
+				return errors.New("category out of range")
+			}
+			return nil
+		}
+		if _, err := GenerateStructured(context.Background(), provider, "system", "prompt", nil, map[string]interface{}{"temperature": 0.0}, 1, &result, validate); err != nil {
+			t.Fatalf("run %v: unexpected error: %v", i, err)
+		}
+	}
+	// the invalid first output isn't kept, so the second run generates it again, and the third uses the valid cached output
+	if generates != 3 {
+		t.Errorf("expected 3 calls to the model, got %v", generates)
+	}
+}
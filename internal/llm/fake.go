@@ -0,0 +1,143 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Fake is an in-memory Provider for tests of the code around the model - provider wiring, prompt building, and parsing
+// and validating output - so they can run without a live model. It only gives canned output, so tests of the model's
+// answers themselves should replay recorded fixtures instead (see llamatest.Client).
+//
+// If Handler is set, it decides the output of each call. Otherwise, Responses are returned in order, repeating the last one once they run out.
+type Fake struct {
+	Responses []string
+	Handler   func(call FakeCall) (string, error)
+	Calls     []FakeCall // every call made to this provider, in order
+
+	mu   sync.Mutex
+	next int
+}
+
+// a call made to a Fake provider. For Chat calls, Messages is set; for Generate calls, SystemPrompt and Prompt are set.
+// Streamed calls pass their output to the onToken callback one word at a time.
+type FakeCall struct {
+	Task         string // task set with ForTask, if any
+	Messages     []Message
+	SystemPrompt string
+	Prompt       string
+	Opts         map[string]interface{}
+	JSON         bool // if the call asked for JSON output
+}
+
+// creates a fake provider which returns the given responses in order
+func NewFake(responses ...string) *Fake {
+	return &Fake{Responses: responses}
+}
+
+func (f *Fake) Chat(ctx context.Context, messages []Message) ([]Message, error) {
+	return f.ForTask("").Chat(ctx, messages)
+}
+
+func (f *Fake) ChatStream(ctx context.Context, messages []Message, onToken func(string)) ([]Message, error) {
+	return f.ForTask("").ChatStream(ctx, messages, onToken)
+}
+
+func (f *Fake) Generate(ctx context.Context, systemPrompt string, prompt string) (string, error) {
+	return f.ForTask("").Generate(ctx, systemPrompt, prompt)
+}
+
+func (f *Fake) GenerateWithOpts(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	return f.ForTask("").GenerateWithOpts(ctx, systemPrompt, prompt, opts)
+}
+
+func (f *Fake) GenerateJSON(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	return f.ForTask("").GenerateJSON(ctx, systemPrompt, prompt, opts)
+}
+
+func (f *Fake) GenerateStream(ctx context.Context, systemPrompt string, prompt string, onToken func(string)) (string, error) {
+	return f.ForTask("").GenerateStream(ctx, systemPrompt, prompt, onToken)
+}
+
+// returns a provider that shares this fake's responses and recorded calls, marking each call with the given task
+func (f *Fake) ForTask(task string) Provider {
+	return &fakeTask{fake: f, task: task}
+}
+
+func (f *Fake) respond(ctx context.Context, call FakeCall) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, call)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if f.Handler != nil {
+		return f.Handler(call)
+	}
+	if len(f.Responses) == 0 {
+		return "", nil
+	}
+	out := f.Responses[min(f.next, len(f.Responses)-1)]
+	f.next++
+	return out, nil
+}
+
+type fakeTask struct {
+	fake *Fake
+	task string
+}
+
+func (ft *fakeTask) Chat(ctx context.Context, messages []Message) ([]Message, error) {
+	out, err := ft.fake.respond(ctx, FakeCall{Task: ft.task, Messages: messages})
+	if err != nil {
+		return []Message{}, err
+	}
+	return append(messages, Message{Role: "assistant", Content: out}), nil
+}
+
+func (ft *fakeTask) ChatStream(ctx context.Context, messages []Message, onToken func(string)) ([]Message, error) {
+	out, err := ft.Chat(ctx, messages)
+	if err != nil {
+		return out, err
+	}
+	fakeStream(LastContent(out), onToken)
+	return out, nil
+}
+
+func (ft *fakeTask) Generate(ctx context.Context, systemPrompt string, prompt string) (string, error) {
+	return ft.fake.respond(ctx, FakeCall{Task: ft.task, SystemPrompt: systemPrompt, Prompt: prompt})
+}
+
+func (ft *fakeTask) GenerateWithOpts(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	return ft.fake.respond(ctx, FakeCall{Task: ft.task, SystemPrompt: systemPrompt, Prompt: prompt, Opts: opts})
+}
+
+func (ft *fakeTask) GenerateJSON(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	return ft.fake.respond(ctx, FakeCall{Task: ft.task, SystemPrompt: systemPrompt, Prompt: prompt, Opts: opts, JSON: true})
+}
+
+func (ft *fakeTask) GenerateStream(ctx context.Context, systemPrompt string, prompt string, onToken func(string)) (string, error) {
+	out, err := ft.Generate(ctx, systemPrompt, prompt)
+	if err != nil {
+		return "", err
+	}
+	fakeStream(out, onToken)
+	return out, nil
+}
+
+func (ft *fakeTask) ForTask(task string) Provider {
+	return ft.fake.ForTask(task)
+}
+
+// passes the output to onToken one word at a time, to imitate a streamed response
+func fakeStream(out string, onToken func(string)) {
+	if onToken == nil {
+		return
+	}
+	for _, token := range strings.SplitAfter(out, " ") {
+		if token != "" {
+			onToken(token)
+		}
+	}
+}
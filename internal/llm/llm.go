@@ -0,0 +1,128 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+// supported LLM providers, as set in the "llm" section of the config json
+const (
+	OLLAMA = "ollama"
+	OPENAI = "openai"
+)
+
+// tasks that the LLM is used for. each task can have its own model and options in the config.
+const (
+	DRAFT      = "draft"      // drafting replies and conversing with the user
+	CATEGORIZE = "categorize" // categorizing emails for auto-reply
+	SPAM       = "spam"       // spam detection
+	PHRASE     = "phrase"     // generating personality phrases
+	SUMMARIZE  = "summarize"  // condensing long emails
+)
+
+// rough number of characters per token, for estimating how much text fits in a model's context window
+const charsPerToken = 4
+
+// a single message in a chat conversation. Role is one of "system", "user" or "assistant".
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Provider is a backend that can generate completions from an LLM.
+// All of the assistant's model calls go through this, so the backend can be swapped out in the config without code changes.
+//
+// Each call is aborted if ctx is cancelled, or if it takes longer than the timeout configured for the provider's task.
+type Provider interface {
+	// Call the chat completion API. The returned messages are the given messages, with the model's reply appended to the end.
+	Chat(ctx context.Context, messages []Message) ([]Message, error)
+	// Generates a completion for the given prompt, using the system prompt to set the context and AI behavior/personality.
+	Generate(ctx context.Context, systemPrompt string, prompt string) (string, error)
+	// Same as Generate, but with custom model options (e.g. "temperature").
+	GenerateWithOpts(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error)
+	// Same as GenerateWithOpts, but the model is forced to output a valid JSON object. The prompt should describe the JSON structure to output.
+	GenerateJSON(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error)
+	// Same as Chat, but onToken is called with each piece of the reply as it is generated.
+	ChatStream(ctx context.Context, messages []Message, onToken func(string)) ([]Message, error)
+	// Same as Generate, but onToken is called with each piece of the output as it is generated.
+	GenerateStream(ctx context.Context, systemPrompt string, prompt string, onToken func(string)) (string, error)
+	// Returns a provider that uses the model and options configured for the given task.
+	ForTask(task string) Provider
+}
+
+// creates the provider selected in the app config. If no provider is set, ollama is used.
+func NewProvider(c config.Config) (Provider, error) {
+	switch c.LLM.Provider {
+	case "", OLLAMA:
+		return NewOllama(c.LLM)
+	case OPENAI:
+		return NewOpenAI(c.LLM)
+	}
+	return nil, fmt.Errorf("unknown llm provider: %q", c.LLM.Provider)
+}
+
+// returns the content of the last message in the conversation, or an empty string if there are no messages.
+func LastContent(messages []Message) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[len(messages)-1].Content
+}
+
+// estimates how many characters of text can be given to the model for the given task, while leaving room in its context window
+// for the prompt instructions and the output. The "num_ctx" option is used as the context size, if it is set.
+func ContextChars(c config.LLM, task string) int {
+	numCtx := 2048 // ollama's default context size
+	if c.Provider == OPENAI {
+		numCtx = 16385
+	}
+	_, opts := taskSettings(c, task, "")
+	switch n := opts["num_ctx"].(type) {
+	case float64:
+		numCtx = int(n)
+	case int:
+		numCtx = n
+	}
+	return numCtx * charsPerToken / 2
+}
+
+// gets the model and options for the given task. task settings take priority over the general settings, and defaultModel is used if no model is configured.
+func taskSettings(c config.LLM, task string, defaultModel string) (string, map[string]interface{}) {
+	model := c.Model
+	opts := mergeOpts(nil, c.Options)
+	if t, ok := c.Tasks[task]; ok {
+		if t.Model != "" {
+			model = t.Model
+		}
+		opts = mergeOpts(opts, t.Options)
+	}
+	if model == "" {
+		model = defaultModel
+	}
+	return model, opts
+}
+
+// gets the timeout in seconds for calls made for the given task. the task timeout takes priority over the general timeout.
+func taskTimeout(c config.LLM, task string) int {
+	if t, ok := c.Tasks[task]; ok && t.Timeout != 0 {
+		return t.Timeout
+	}
+	return c.Timeout
+}
+
+// returns a new map with the options in overrides applied on top of base
+func mergeOpts(base map[string]interface{}, overrides map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := make(map[string]interface{})
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,65 @@
+package llm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+func TestTaskSettings(t *testing.T) {
+	c := config.LLM{
+		Model:   "mistral",
+		Options: map[string]interface{}{"temperature": 0.7, "num_ctx": 4096},
+		Tasks: map[string]config.LLMTask{
+			CATEGORIZE: {
+				Model:   "qwen2:0.5b",
+				Options: map[string]interface{}{"temperature": 0.0, "seed": 42},
+			},
+			DRAFT: {
+				Options: map[string]interface{}{"num_ctx": 8192},
+			},
+		},
+	}
+	tests := []struct {
+		config   config.LLM
+		task     string
+		expModel string
+		expOpts  map[string]interface{}
+	}{
+		{c, CATEGORIZE, "qwen2:0.5b", map[string]interface{}{"temperature": 0.0, "num_ctx": 4096, "seed": 42}},
+		{c, DRAFT, "mistral", map[string]interface{}{"temperature": 0.7, "num_ctx": 8192}},
+		{c, PHRASE, "mistral", map[string]interface{}{"temperature": 0.7, "num_ctx": 4096}},
+		{config.LLM{}, SPAM, "llama3", nil},
+	}
+
+	for i, test := range tests {
+		model, opts := taskSettings(test.config, test.task, "llama3")
+		if model != test.expModel {
+			t.Errorf("case %v, wrong model. expected: %s, output: %s", i, test.expModel, model)
+		}
+		if fmt.Sprint(opts) != fmt.Sprint(test.expOpts) {
+			t.Errorf("case %v, wrong options. expected: %v, output: %v", i, test.expOpts, opts)
+		}
+	}
+}
+
+func TestContextChars(t *testing.T) {
+	tests := []struct {
+		config config.LLM
+		task   string
+		exp    int
+	}{
+		{config.LLM{}, SUMMARIZE, 4096},
+		{config.LLM{Provider: OPENAI}, SUMMARIZE, 32770},
+		{config.LLM{Options: map[string]interface{}{"num_ctx": 4096.0}}, SUMMARIZE, 8192},
+		{config.LLM{Tasks: map[string]config.LLMTask{SUMMARIZE: {Options: map[string]interface{}{"num_ctx": 8192}}}}, SUMMARIZE, 16384},
+		{config.LLM{Tasks: map[string]config.LLMTask{SUMMARIZE: {Options: map[string]interface{}{"num_ctx": 8192}}}}, DRAFT, 4096},
+	}
+
+	for i, test := range tests {
+		if out := ContextChars(test.config, test.task); out != test.exp {
+			t.Errorf("case %v, expected: %v, output: %v", i, test.exp, out)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llama"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// Provider implementation for a local (or remote) ollama server
+type Ollama struct {
+	client  *api.Client
+	config  config.LLM
+	model   string
+	opts    map[string]interface{}
+	timeout int
+	cache   *Cache
+	task    string
+}
+
+func NewOllama(c config.LLM) (*Ollama, error) {
+	client, err := llama.GetClient(c.Host)
+	if err != nil {
+		return nil, err
+	}
+	return newOllamaForTask(client, c, NewCache(c.Cache), ""), nil
+}
+
+// creates an ollama provider that makes its API calls through the given client, e.g. one that records or replays them (see llama.Recorder).
+// The cache is never used here, since cached calls wouldn't reach the server to be recorded.
+func NewOllamaWithClient(client *api.Client, c config.LLM) *Ollama {
+	return newOllamaForTask(client, c, nil, "")
+}
+
+// makes sure the ollama server for the given config is running, and that every model it uses (for all tasks) is downloaded.
+// Call Stop on the returned server when done; it only stops the server if it was started here.
+func StartOllama(ctx context.Context, c config.LLM) (*llama.Server, error) {
+	server, err := llama.NewServer(c.Host)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Start(ctx); err != nil {
+		return nil, err
+	}
+	for _, model := range ollamaModels(c) {
+		if err := server.EnsureModel(ctx, model, llama.PrintPullProgress(model)); err != nil {
+			server.Stop()
+			return nil, fmt.Errorf("failed to get model %s: %w", model, err)
+		}
+	}
+	return server, nil
+}
+
+// gets the distinct models used across the general settings and all tasks
+func ollamaModels(c config.LLM) []string {
+	models := []string{}
+	seen := make(map[string]bool)
+	for _, task := range []string{"", DRAFT, CATEGORIZE, SPAM, PHRASE, SUMMARIZE} {
+		model, _ := taskSettings(c, task, llama.DefaultModel)
+		if !seen[model] {
+			seen[model] = true
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+func newOllamaForTask(client *api.Client, c config.LLM, cache *Cache, task string) *Ollama {
+	model, opts := taskSettings(c, task, llama.DefaultModel)
+	return &Ollama{
+		client:  client,
+		config:  c,
+		model:   model,
+		opts:    opts,
+		timeout: taskTimeout(c, task),
+		cache:   cache,
+		task:    task,
+	}
+}
+
+// returns the underlying ollama client, for ollama specific functionality
+func (o *Ollama) Client() *api.Client {
+	return o.client
+}
+
+// returns the model this provider generates with
+func (o *Ollama) Model() string {
+	return o.model
+}
+
+func (o *Ollama) ForTask(task string) Provider {
+	return newOllamaForTask(o.client, o.config, o.cache, task)
+}
+
+func (o *Ollama) Chat(ctx context.Context, messages []Message) ([]Message, error) {
+	ctx, done := o.track(ctx)
+	defer done()
+	ctx, cancel := util.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	out, err := llama.ChatCompletion(ctx, o.client, o.model, toOllamaMessages(messages), o.opts)
+	if err != nil {
+		return []Message{}, err
+	}
+	return fromOllamaMessages(out), nil
+}
+
+func (o *Ollama) ChatStream(ctx context.Context, messages []Message, onToken func(string)) ([]Message, error) {
+	ctx, done := o.track(ctx)
+	defer done()
+	ctx, cancel := util.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	out, err := llama.ChatCompletionStream(ctx, o.client, o.model, toOllamaMessages(messages), o.opts, onToken)
+	if err != nil {
+		return []Message{}, err
+	}
+	return fromOllamaMessages(out), nil
+}
+
+func (o *Ollama) GenerateStream(ctx context.Context, systemPrompt string, prompt string, onToken func(string)) (string, error) {
+	ctx, done := o.track(ctx)
+	defer done()
+	ctx, cancel := util.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	return llama.GenerateCompletionStream(ctx, o.client, o.model, systemPrompt, prompt, o.opts, onToken)
+}
+
+func (o *Ollama) Generate(ctx context.Context, systemPrompt string, prompt string) (string, error) {
+	return o.GenerateWithOpts(ctx, systemPrompt, prompt, nil)
+}
+
+// the given options take priority over the configured options
+func (o *Ollama) GenerateWithOpts(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	opts = mergeOpts(o.opts, opts)
+	key := cacheKeyData{Provider: OLLAMA, Model: o.model, SystemPrompt: systemPrompt, Prompt: prompt, Opts: opts}
+	return o.cache.generate(key, func() (string, error) {
+		ctx, done := o.track(ctx)
+		defer done()
+		ctx, cancel := util.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		return llama.GenerateCompletionWithOpts(ctx, o.client, o.model, systemPrompt, prompt, opts)
+	})
+}
+
+// Same as GenerateWithOpts, but uses ollama's JSON format mode so the output is always a valid JSON object.
+func (o *Ollama) GenerateJSON(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	opts = mergeOpts(o.opts, opts)
+	key := cacheKeyData{Provider: OLLAMA, Model: o.model, SystemPrompt: systemPrompt, Prompt: prompt, Opts: opts, JSON: true}
+	return o.cache.generate(key, func() (string, error) {
+		ctx, done := o.track(ctx)
+		defer done()
+		ctx, cancel := util.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		return llama.GenerateCompletionJSON(ctx, o.client, o.model, systemPrompt, prompt, opts)
+	})
+}
+
+func (o *Ollama) forgetJSON(systemPrompt string, prompt string, opts map[string]interface{}) {
+	o.cache.forget(cacheKeyData{Provider: OLLAMA, Model: o.model, SystemPrompt: systemPrompt, Prompt: prompt, Opts: mergeOpts(o.opts, opts), JSON: true})
+}
+
+// starts tracking the token counts of the ollama calls made with the returned context.
+// Call done when the calls are finished to record them to the usage ledger.
+func (o *Ollama) track(ctx context.Context) (context.Context, func()) {
+	stats := &llama.Stats{}
+	start := time.Now()
+	return llama.WithStats(ctx, stats), func() {
+		recordUsage(ctx, o.config, OLLAMA, o.model, o.task, stats.PromptTokens, stats.CompletionTokens, start)
+	}
+}
+
+func toOllamaMessages(messages []Message) []api.Message {
+	out := make([]api.Message, 0, len(messages))
+	for _, m := range messages {
+		out = append(out, api.Message{Role: m.Role, Content: m.Content})
+	}
+	return out
+}
+
+func fromOllamaMessages(messages []api.Message) []Message {
+	out := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		out = append(out, Message{Role: m.Role, Content: m.Content})
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+func TestOllamaTimeout(t *testing.T) {
+	// an ollama server that never answers
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hung)
+
+	provider, err := NewOllama(config.LLM{
+		Host:  srv.URL,
+		Tasks: map[string]config.LLMTask{CATEGORIZE: {Timeout: 1}},
+	})
+	if err != nil {
+		t.Fatal("failed to create provider:", err)
+	}
+
+	start := time.Now()
+	_, err = provider.ForTask(CATEGORIZE).Generate(context.Background(), "system", "prompt")
+	if err == nil {
+		t.Error("expected timeout error, but got none")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("call took %v; timeout was not applied", elapsed)
+	}
+
+	// cancelling the context should also abort the call
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = provider.Chat(ctx, []Message{{Role: "user", Content: "hello"}})
+	if err == nil {
+		t.Error("expected cancellation error, but got none")
+	}
+}
@@ -0,0 +1,178 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	"github.com/webbben/mail-assistant/internal/openai"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+const (
+	defaultOpenAITemperature = 0.2
+	defaultOpenAIKeyEnv      = "OPENAI_API_KEY"
+)
+
+// Provider implementation for the OpenAI chat completions API, or a compatible server
+type OpenAI struct {
+	client  *openai.Client
+	config  config.LLM
+	model   string
+	opts    map[string]interface{}
+	timeout int
+	cache   *Cache
+	task    string
+}
+
+// Creates an OpenAI provider for the configured base URL. The API key is loaded from the configured environment variable or file
+// (OPENAI_API_KEY or cred/openai.txt by default). A key is only required for the OpenAI API itself, since local servers usually don't need one.
+func NewOpenAI(c config.LLM) (*OpenAI, error) {
+	env, file := c.APIKey.Env, c.APIKey.File
+	if env == "" {
+		env = defaultOpenAIKeyEnv
+	}
+	if file == "" {
+		file = openai.DefaultAPIKeyFile
+	}
+	apiKey, err := openai.LoadAPIKeyFrom(env, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read openai api key: %w", err)
+	}
+	client := openai.NewClient(c.BaseURL, apiKey)
+	if apiKey == "" && client.BaseURL == openai.DefaultBaseURL {
+		return nil, errors.New("no openai api key found")
+	}
+	return newOpenAIForTask(client, c, NewCache(c.Cache), ""), nil
+}
+
+func newOpenAIForTask(client *openai.Client, c config.LLM, cache *Cache, task string) *OpenAI {
+	model, opts := taskSettings(c, task, openai.DefaultModel)
+	return &OpenAI{
+		client:  client,
+		config:  c,
+		model:   model,
+		opts:    opts,
+		timeout: taskTimeout(c, task),
+		cache:   cache,
+		task:    task,
+	}
+}
+
+func (o *OpenAI) ForTask(task string) Provider {
+	return newOpenAIForTask(o.client, o.config, o.cache, task)
+}
+
+func (o *OpenAI) Chat(ctx context.Context, messages []Message) ([]Message, error) {
+	return o.chat(ctx, messages, o.opts, nil)
+}
+
+// Streaming isn't supported for OpenAI yet, so the whole reply is passed to onToken once it's done.
+func (o *OpenAI) ChatStream(ctx context.Context, messages []Message, onToken func(string)) ([]Message, error) {
+	out, err := o.Chat(ctx, messages)
+	if err != nil {
+		return out, err
+	}
+	if onToken != nil {
+		onToken(LastContent(out))
+	}
+	return out, nil
+}
+
+// Streaming isn't supported for OpenAI yet, so the whole output is passed to onToken once it's done.
+func (o *OpenAI) GenerateStream(ctx context.Context, systemPrompt string, prompt string, onToken func(string)) (string, error) {
+	out, err := o.Generate(ctx, systemPrompt, prompt)
+	if err != nil {
+		return "", err
+	}
+	if onToken != nil {
+		onToken(out)
+	}
+	return out, nil
+}
+
+func (o *OpenAI) Generate(ctx context.Context, systemPrompt string, prompt string) (string, error) {
+	return o.GenerateWithOpts(ctx, systemPrompt, prompt, nil)
+}
+
+// Only the "temperature" option is supported by OpenAI; other options are ignored.
+func (o *OpenAI) GenerateWithOpts(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: prompt,
+		},
+	}
+	opts = mergeOpts(o.opts, opts)
+	key := cacheKeyData{Provider: OPENAI, Model: o.model, SystemPrompt: systemPrompt, Prompt: prompt, Opts: opts}
+	return o.cache.generate(key, func() (string, error) {
+		out, err := o.chat(ctx, messages, opts, nil)
+		if err != nil {
+			return "", err
+		}
+		return LastContent(out), nil
+	})
+}
+
+// Same as GenerateWithOpts, but uses OpenAI's JSON mode so the output is always a valid JSON object.
+func (o *OpenAI) GenerateJSON(ctx context.Context, systemPrompt string, prompt string, opts map[string]interface{}) (string, error) {
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: prompt,
+		},
+	}
+	opts = mergeOpts(o.opts, opts)
+	key := cacheKeyData{Provider: OPENAI, Model: o.model, SystemPrompt: systemPrompt, Prompt: prompt, Opts: opts, JSON: true}
+	return o.cache.generate(key, func() (string, error) {
+		out, err := o.chat(ctx, messages, opts, &openai.ResponseFormat{Type: "json_object"})
+		if err != nil {
+			return "", err
+		}
+		return LastContent(out), nil
+	})
+}
+
+func (o *OpenAI) forgetJSON(systemPrompt string, prompt string, opts map[string]interface{}) {
+	o.cache.forget(cacheKeyData{Provider: OPENAI, Model: o.model, SystemPrompt: systemPrompt, Prompt: prompt, Opts: mergeOpts(o.opts, opts), JSON: true})
+}
+
+func (o *OpenAI) chat(ctx context.Context, messages []Message, opts map[string]interface{}, format *openai.ResponseFormat) ([]Message, error) {
+	ctx, cancel := util.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	temperature := defaultOpenAITemperature
+	if t, ok := opts["temperature"].(float64); ok {
+		temperature = t
+	}
+	in := make([]openai.Message, 0, len(messages))
+	for _, m := range messages {
+		in = append(in, openai.Message{Role: m.Role, Content: m.Content})
+	}
+	start := time.Now()
+	resp, err := o.client.CreateChatCompletion(ctx, openai.Request{
+		Model:          o.model,
+		Messages:       in,
+		Temperature:    temperature,
+		FreqPenalty:    1,
+		ResponseFormat: format,
+	})
+	if err != nil {
+		return []Message{}, err
+	}
+	debug.Printf("openai usage (%s): %v prompt + %v completion tokens\n", o.model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	recordUsage(ctx, o.config, OPENAI, o.model, o.task, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, start)
+	reply := resp.Choices[0].Message
+	out := append([]Message{}, messages...)
+	return append(out, Message{Role: reply.Role, Content: reply.Content}), nil
+}
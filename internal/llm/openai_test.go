@@ -0,0 +1,89 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/openai"
+)
+
+func TestOpenAICompatibleServer(t *testing.T) {
+	var got openai.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(openai.APIResponse{
+			Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: "Bonjour"}}},
+		})
+	}))
+	defer srv.Close()
+
+	noKey := config.APIKeySource{Env: "MAIL_ASSISTANT_TEST_NO_KEY", File: filepath.Join(t.TempDir(), "none.txt")}
+	provider, err := NewOpenAI(config.LLM{Provider: OPENAI, BaseURL: srv.URL, Model: "local-model", APIKey: noKey})
+	if err != nil {
+		t.Fatal("a local server shouldn't need an api key, but got error:", err)
+	}
+	out, err := provider.Generate(context.Background(), "system", "hello")
+	if err != nil || out != "Bonjour" {
+		t.Errorf("unexpected output %q, error: %v", out, err)
+	}
+	if got.Model != "local-model" {
+		t.Errorf("configured model wasn't used: %q", got.Model)
+	}
+
+	if _, err := NewOpenAI(config.LLM{Provider: OPENAI, APIKey: noKey}); err == nil {
+		t.Error("expected an error for the openai api without a key")
+	}
+}
+
+func TestOpenAIOptionPriority(t *testing.T) {
+	var got openai.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(openai.APIResponse{
+			Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: "{}"}}},
+		})
+	}))
+	defer srv.Close()
+
+	noKey := config.APIKeySource{Env: "MAIL_ASSISTANT_TEST_NO_KEY", File: filepath.Join(t.TempDir(), "none.txt")}
+	provider, err := NewOpenAI(config.LLM{
+		Provider: OPENAI,
+		BaseURL:  srv.URL,
+		APIKey:   noKey,
+		Options:  map[string]interface{}{"temperature": 0.8},
+	})
+	if err != nil {
+		t.Fatal("failed to create provider:", err)
+	}
+
+	tests := []struct {
+		name string
+		opts map[string]interface{}
+		json bool
+		want float64
+	}{
+		{"configured", nil, false, 0.8},
+		{"per call", map[string]interface{}{"temperature": 0.0}, false, 0},
+		{"per call json", map[string]interface{}{"temperature": 0.1}, true, 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.json {
+				_, err = provider.GenerateJSON(context.Background(), "system", tt.name, tt.opts)
+			} else {
+				_, err = provider.GenerateWithOpts(context.Background(), "system", tt.name, tt.opts)
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if got.Temperature != tt.want {
+				t.Errorf("got temperature %v, want %v", got.Temperature, tt.want)
+			}
+		})
+	}
+}
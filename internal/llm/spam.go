@@ -0,0 +1,70 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const spam_prompt string = `
+You are a robot that only outputs JSON.
+You are given an email body, and you detect if it is junk or not.
+Output your confidence level about if the email is junk, where 0 means zero confidence (it is definitely not junk) and 100 is complete confidence (it is surely junk), along with a short reason.
+
+Sample outputs:
+{"confidence": 15, "reason": "The email doesn't look like junk because the sender seems to know the recipient personally."}
+{"confidence": 87, "reason": "The email looks like junk because it's a newsletter from an online shop."}
+{"confidence": 50, "reason": "It's unclear if this is junk or not, since it has traits of both junk and regular emails."}
+
+An email is junk if:
+* is a newsletter.
+* it is a notification talking about inboxes, unread messages, etc.
+* is doesn't refer to the recipient by their name.
+
+An email is not junk if:
+* it's from a person who seems to know the recipient personally.
+* it includes odd, suspicious, or humorous content, since I want to see those messages personally.
+`
+
+// output of the spam detection prompt
+type spamResult struct {
+	Confidence *int   `json:"confidence"`
+	Reason     string `json:"reason"`
+}
+
+var spamSchema = Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"confidence": map[string]any{"type": "integer", "minimum": 0, "maximum": 100},
+		"reason":     map[string]any{"type": "string"},
+	},
+	"required": []string{"confidence", "reason"},
+}
+
+func (r *spamResult) validate() error {
+	if r.Confidence == nil {
+		return errors.New(`missing "confidence"`)
+	}
+	if *r.Confidence < 0 || *r.Confidence > 100 {
+		return fmt.Errorf(`"confidence" must be between 0 and 100, but was %v`, *r.Confidence)
+	}
+	return nil
+}
+
+// TODO - this doesn't work well enough so far, since it gives false positives a lot.
+// Apparently it's kind of hard to prompt Llama3 to identify junk mail.
+//
+// Returns if the email is spam, and the raw model output.
+func IsEmailSpam(ctx context.Context, provider Provider, email string) (bool, string) {
+	prompt := fmt.Sprintf("Email:\n\n%s", email)
+	system := strings.TrimSpace(spam_prompt)
+	var result spamResult
+	out, err := GenerateStructured(ctx, provider.ForTask(SPAM), system, prompt, spamSchema, map[string]interface{}{"temperature": 0.0}, DefaultJSONRetries, &result, result.validate)
+	if err != nil {
+		log.Println("failed to do spam detection completion:", err)
+		return false, out
+	}
+	return *result.Confidence > 50, out
+}
@@ -1,12 +1,17 @@
-package llama
+package llm
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/llama"
+	"github.com/webbben/mail-assistant/internal/llama/llamatest"
 )
 
 type IsSpamTestCase struct {
@@ -35,35 +40,33 @@ func loadTestCases() []*IsSpamTestCase {
 	return testCases
 }
 
+// gets the provider to run spam tests against: ollama, live or with recorded fixtures (see llamatest.Client).
+//
+// go test -run ^TestIsEmailSpam$ github.com/webbben/mail-assistant/internal/llm -args -record
+func getSpamTestProvider(t *testing.T) Provider {
+	return NewOllamaWithClient(llamatest.Client(t, llama.DefaultModel), config.LLM{})
+}
+
 // run in terminal:
-// go test -run ^TestIsEmailSpam$ github.com/webbben/mail-assistant/internal/llama
+// go test -run ^TestIsEmailSpam$ github.com/webbben/mail-assistant/internal/llm -args -live
 // by default VS code uses a timeout of 30s, but I removed it since the LLM startup takes a bit, and each call to the LLM takes a few seconds on average
 func TestIsEmailSpam(t *testing.T) {
-	// ollama
-	cmd, err := StartServer()
-	if err != nil {
-		log.Fatal("failed to start ollama server:", err)
-	}
-	defer StopServer(cmd)
-
-	client, err := GetClient()
-	if err != nil {
-		log.Fatal("failed to get ollama client:", err)
-	}
-
 	tests := loadTestCases()
+	provider := getSpamTestProvider(t)
+
 	pass := 0
 	falsePositive := 0
 	invalid := 0
 
 	for i, test := range tests {
-		isSpam, raw := IsEmailSpam(client, test.email)
+		isSpam, raw := IsEmailSpam(context.Background(), provider, test.email)
 		if isSpam != test.isSpam {
 			if isSpam {
 				falsePositive++
 			} else {
 				// wrong format?
-				if !strings.Contains(raw, ";") {
+				var result spamResult
+				if decodeAndValidate(raw, &result, result.validate) != nil {
 					invalid++
 				}
 			}
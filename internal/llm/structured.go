@@ -0,0 +1,79 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// default number of times a structured output call is retried after invalid output
+const DefaultJSONRetries = 2
+
+// Asks the model for a JSON object matching the given schema, and decodes it into v, which must be a pointer.
+// The schema is added to the end of the system prompt, so prompts don't need to describe the structure themselves.
+// If the output can't be decoded or validate returns an error, the model is asked again with the error, up to maxRetries times.
+// validate may be nil, if decoding is enough.
+//
+// Invalid output is removed from the provider's cache, so later runs don't get it again and have to retry.
+//
+// Returns the raw output of the last attempt, so it can be logged if something went wrong.
+func GenerateStructured(ctx context.Context, provider Provider, systemPrompt string, prompt string, schema Schema, opts map[string]interface{}, maxRetries int, v any, validate func() error) (string, error) {
+	systemPrompt = schema.addTo(systemPrompt)
+	attemptPrompt := prompt
+	out := ""
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		out, err = provider.GenerateJSON(ctx, systemPrompt, attemptPrompt, opts)
+		if err != nil {
+			// not a format problem, so don't bother retrying
+			return out, err
+		}
+		err = decodeAndValidate(out, v, validate)
+		if err == nil {
+			return out, nil
+		}
+		if c, ok := provider.(jsonCacher); ok {
+			c.forgetJSON(systemPrompt, attemptPrompt, opts)
+		}
+		attemptPrompt = fmt.Sprintf("%s\n\nYour previous output was:\n%s\n\nThat output is invalid: %s\nRespond again with only a valid JSON object.", prompt, out, err)
+	}
+	return out, fmt.Errorf("invalid output after %v attempts: %w", maxRetries+1, err)
+}
+
+// Schema is a JSON schema for the output of a structured call, e.g.
+//
+//	Schema{"type": "object", "properties": map[string]any{"reason": map[string]any{"type": "string"}}, "required": []string{"reason"}}
+//
+// The pinned ollama API (v0.1.43) only has a plain JSON mode, and can't be given a schema, so it's given to the model in the prompt instead.
+type Schema map[string]any
+
+// adds the schema to the end of the system prompt. a nil schema adds nothing.
+func (s Schema) addTo(systemPrompt string) string {
+	if s == nil {
+		return systemPrompt
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		panic(fmt.Sprintf("invalid output schema: %s", err))
+	}
+	return fmt.Sprintf("%s\n\nOutput a JSON object matching this JSON schema:\n%s", systemPrompt, bytes)
+}
+
+// implemented by providers that cache GenerateJSON outputs
+type jsonCacher interface {
+	// removes the cached output of the GenerateJSON call with the given inputs, if there is one
+	forgetJSON(systemPrompt string, prompt string, opts map[string]interface{})
+}
+
+func decodeAndValidate(out string, v any, validate func() error) error {
+	// clear out anything left over from a previous attempt
+	reflect.ValueOf(v).Elem().SetZero()
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		return fmt.Errorf("not valid JSON for the requested structure (%w)", err)
+	}
+	if validate != nil {
+		return validate()
+	}
+	return nil
+}
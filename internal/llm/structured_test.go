@@ -0,0 +1,87 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testResult struct {
+	Categories []int `json:"categories"`
+}
+
+func TestGenerateStructured(t *testing.T) {
+	tests := []struct {
+		responses []string
+		expErr    bool
+		expCalls  int
+		expCats   []int
+	}{
+		{[]string{`{"categories": [1, 2]}`}, false, 1, []int{1, 2}},
+		{[]string{`1, 2`, `{"categories": [3]}`}, false, 2, []int{3}},
+		{[]string{`{"categories": [9]}`, `{"categories": []}`}, false, 2, []int{}},
+		{[]string{`{"categories": [9]}`, `oops`, `{"categories": [7]}`}, true, 3, nil},
+	}
+
+	for i, test := range tests {
+		fake := NewFake(test.responses...)
+		var result testResult
+		validate := func() error {
+			for _, c := range result.Categories {
+				if c > 3 {
+					return errors.New("category out of range")
+				}
+			}
+			return nil
+		}
+		_, err := GenerateStructured(context.Background(), fake, "system", "prompt", nil, nil, 2, &result, validate)
+		if (err != nil) != test.expErr {
+			t.Errorf("case %v, expected error: %v, got: %v", i, test.expErr, err)
+		}
+		if len(fake.Calls) != test.expCalls {
+			t.Errorf("case %v, expected %v calls, got %v", i, test.expCalls, len(fake.Calls))
+		}
+		for j, call := range fake.Calls {
+			if !call.JSON {
+				t.Errorf("case %v, call %v did not ask for JSON output", i, j)
+			}
+			// retries should tell the model what was wrong
+			if j > 0 && !strings.Contains(call.Prompt, "invalid") {
+				t.Errorf("case %v, call %v prompt is missing the validation error: %q", i, j, call.Prompt)
+			}
+		}
+		if !test.expErr && len(result.Categories) != len(test.expCats) {
+			t.Errorf("case %v, expected categories %v, got %v", i, test.expCats, result.Categories)
+		}
+	}
+}
+
+func TestGenerateStructuredSchema(t *testing.T) {
+	schema := Schema{
+		"type":       "object",
+		"properties": map[string]any{"categories": map[string]any{"type": "array", "items": map[string]any{"type": "integer"}}},
+		"required":   []string{"categories"},
+	}
+	fake := NewFake(`{}`, `{"categories": [1]}`)
+	var result testResult
+	validate := func() error {
+		if result.Categories == nil {
+			return errors.New(`missing "categories"`)
+		}
+		return nil
+	}
+	if _, err := GenerateStructured(context.Background(), fake, "system", "prompt", schema, nil, 2, &result, validate); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	exp := `system
+
+Output a JSON object matching this JSON schema:
+{"properties":{"categories":{"items":{"type":"integer"},"type":"array"}},"required":["categories"],"type":"object"}`
+	// retries should be given the schema too
+	for i, call := range fake.Calls {
+		if call.SystemPrompt != exp {
+			t.Errorf("call %v, unexpected system prompt:\n%s", i, call.SystemPrompt)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/usage"
+)
+
+// known prices of openai models, in USD per million tokens. models run on ollama are free.
+// a model name only needs to start with one of these to use its price, so dated versions (e.g. gpt-4o-2024-05-13) are covered.
+var defaultPrices = map[string]config.Price{
+	"gpt-3.5-turbo": {Prompt: 0.5, Completion: 1.5},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.6},
+	"gpt-4o":        {Prompt: 5, Completion: 15},
+	"gpt-4-turbo":   {Prompt: 10, Completion: 30},
+	"gpt-4":         {Prompt: 30, Completion: 60},
+}
+
+// estimates the cost of a call in USD. Prices set in the config take priority over the built in ones.
+// Ollama calls are free, unless a price is configured for the model.
+func estimateCost(c config.LLM, provider string, model string, promptTokens int, completionTokens int) float64 {
+	price, ok := c.Prices[model]
+	if !ok && provider == OPENAI {
+		price, ok = defaultPrice(model)
+	}
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1e6
+}
+
+// finds the built in price with the longest name that the model starts with
+func defaultPrice(model string) (config.Price, bool) {
+	best := ""
+	for name := range defaultPrices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return config.Price{}, false
+	}
+	return defaultPrices[best], true
+}
+
+// records a finished model call to the usage ledger
+func recordUsage(ctx context.Context, c config.LLM, provider string, model string, task string, promptTokens int, completionTokens int, start time.Time) {
+	usage.Add(usage.Record{
+		Time:             start,
+		Task:             task,
+		Provider:         provider,
+		Model:            model,
+		EmailID:          usage.EmailFromContext(ctx),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		LatencyMs:        time.Since(start).Milliseconds(),
+		Cost:             estimateCost(c, provider, model, promptTokens, completionTokens),
+	})
+}
@@ -0,0 +1,115 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/openai"
+	"github.com/webbben/mail-assistant/internal/usage"
+)
+
+func TestEstimateCost(t *testing.T) {
+	custom := config.LLM{Prices: map[string]config.Price{"llama3": {Prompt: 1, Completion: 2}}}
+	tests := []struct {
+		c        config.LLM
+		provider string
+		model    string
+		cost     float64
+	}{
+		{config.LLM{}, OPENAI, "gpt-3.5-turbo", 0.5 + 1.5},
+		{config.LLM{}, OPENAI, "gpt-4o-2024-05-13", 5 + 15},
+		{config.LLM{}, OPENAI, "gpt-4o-mini", 0.15 + 0.6},
+		{config.LLM{}, OPENAI, "unknown-model", 0},
+		{config.LLM{}, OLLAMA, "llama3", 0},
+		{custom, OLLAMA, "llama3", 1 + 2},
+	}
+	for _, test := range tests {
+		// a million tokens each, so the cost is the sum of the prices
+		cost := estimateCost(test.c, test.provider, test.model, 1e6, 1e6)
+		if math.Abs(cost-test.cost) > 1e-9 {
+			t.Errorf("%s %s: expected cost %v, got %v", test.provider, test.model, test.cost, cost)
+		}
+	}
+}
+
+// reads back the usage recorded while running fn
+func recordedUsage(t *testing.T, fn func()) []usage.Record {
+	l := usage.NewLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+	usage.SetLedger(l)
+	defer usage.SetLedger(nil)
+	fn()
+	records, err := l.Records(time.Time{})
+	if err != nil {
+		t.Fatal("failed to read usage ledger:", err)
+	}
+	return records
+}
+
+func TestOllamaUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"model":             "llama3",
+			"response":          "hello",
+			"done":              true,
+			"prompt_eval_count": 42,
+			"eval_count":        7,
+		})
+	}))
+	defer srv.Close()
+
+	provider, err := NewOllama(config.LLM{Host: srv.URL})
+	if err != nil {
+		t.Fatal("failed to create provider:", err)
+	}
+	records := recordedUsage(t, func() {
+		ctx := usage.WithEmail(context.Background(), "msg1")
+		if _, err := provider.ForTask(SPAM).Generate(ctx, "system", "prompt"); err != nil {
+			t.Fatal("generate failed:", err)
+		}
+	})
+	if len(records) != 1 {
+		t.Fatalf("expected 1 recorded call, got %v", len(records))
+	}
+	r := records[0]
+	if r.Task != SPAM || r.Provider != OLLAMA || r.Model != "llama3" || r.EmailID != "msg1" || r.PromptTokens != 42 || r.CompletionTokens != 7 || r.Cost != 0 {
+		t.Errorf("unexpected record: %+v", r)
+	}
+}
+
+func TestOpenAIUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(openai.APIResponse{
+			Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: "hi"}}},
+			Usage:   openai.Usage{PromptTokens: 1000, CompletionTokens: 500},
+		})
+	}))
+	defer srv.Close()
+
+	noKey := config.APIKeySource{Env: "MAIL_ASSISTANT_TEST_NO_KEY", File: filepath.Join(t.TempDir(), "none.txt")}
+	provider, err := NewOpenAI(config.LLM{Provider: OPENAI, BaseURL: srv.URL, Model: "gpt-3.5-turbo", APIKey: noKey})
+	if err != nil {
+		t.Fatal("failed to create provider:", err)
+	}
+	records := recordedUsage(t, func() {
+		if _, err := provider.ForTask(DRAFT).Chat(context.Background(), []Message{{Role: "user", Content: "hello"}}); err != nil {
+			t.Fatal("chat failed:", err)
+		}
+	})
+	if len(records) != 1 {
+		t.Fatalf("expected 1 recorded call, got %v", len(records))
+	}
+	r := records[0]
+	if r.Task != DRAFT || r.Provider != OPENAI || r.PromptTokens != 1000 || r.CompletionTokens != 500 {
+		t.Errorf("unexpected record: %+v", r)
+	}
+	if want := (1000*0.5 + 500*1.5) / 1e6; math.Abs(r.Cost-want) > 1e-12 {
+		t.Errorf("expected cost %v, got %v", want, r.Cost)
+	}
+}
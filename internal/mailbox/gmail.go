@@ -0,0 +1,107 @@
+package mailbox
+
+import (
+	"context"
+	"log"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/gmail"
+	t "github.com/webbben/mail-assistant/internal/types"
+	g "google.golang.org/api/gmail/v1"
+)
+
+// GmailMailbox reads and sends mail through the gmail API. The inbox is kept up to date with a gmail.Syncer,
+// and emails are labeled with a gmail.Labeler.
+type GmailMailbox struct {
+	srv     *g.Service
+	syncer  *gmail.Syncer
+	labeler *gmail.Labeler
+	config  config.Config
+}
+
+// Creates the gmail mailbox, picking up the inbox sync where the last run left off.
+func NewGmail(srv *g.Service, c config.Config) *GmailMailbox {
+	syncer, err := gmail.LoadSyncer(srv, c)
+	if err != nil {
+		log.Println("failed to load inbox sync state; doing a full sync:", err)
+	}
+	return &GmailMailbox{srv: srv, syncer: syncer, labeler: gmail.NewLabeler(srv, c), config: c}
+}
+
+// Syncs the inbox, and lists the messages in it.
+func (m *GmailMailbox) List(ctx context.Context) ([]string, error) {
+	if _, err := m.syncer.Sync(ctx); err != nil {
+		return nil, err
+	}
+	return m.syncer.Messages(), nil
+}
+
+// Syncs the inbox, and lists the messages the sync added.
+func (m *GmailMailbox) ListNew(ctx context.Context) ([]string, error) {
+	result, err := m.syncer.Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return result.Added, nil
+}
+
+// Lists the messages matching the list options, instead of the synced inbox. e.g. for a gmail search query.
+func (m *GmailMailbox) ListMatching(ctx context.Context, opts gmail.ListOptions) ([]string, error) {
+	messages, err := gmail.ListMessages(ctx, m.srv, m.config.GmailAddr, opts)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.Id)
+	}
+	return ids, nil
+}
+
+func (m *GmailMailbox) GetEmail(ctx context.Context, id string) (t.Email, error) {
+	return gmail.ProcessEmail(ctx, m.srv, id, m.config.GmailAddr)
+}
+
+func (m *GmailMailbox) GetRaw(ctx context.Context, id string) (string, error) {
+	return gmail.GetRaw(ctx, m.srv, m.config.GmailAddr, id)
+}
+
+func (m *GmailMailbox) GetAttachment(ctx context.Context, email t.Email, attachment t.Attachment) ([]byte, error) {
+	return gmail.GetAttachment(ctx, m.srv, m.config.GmailAddr, email.ID, attachment)
+}
+
+func (m *GmailMailbox) Thread(ctx context.Context, email t.Email) ([]t.ThreadMessage, error) {
+	return gmail.GetThread(ctx, m.srv, m.config.GmailAddr, email.ThreadID, m.config.OwnAddresses())
+}
+
+func (m *GmailMailbox) SendReply(ctx context.Context, email t.Email, reply t.Reply) error {
+	return gmail.SendReply(ctx, m.srv, m.config.GmailAddr, email, reply)
+}
+
+func (m *GmailMailbox) CreateDraft(ctx context.Context, email t.Email, reply t.Reply) (string, error) {
+	return gmail.CreateDraft(ctx, m.srv, m.config.GmailAddr, email, reply)
+}
+
+func (m *GmailMailbox) SendEmail(ctx context.Context, email t.NewEmail) error {
+	return gmail.SendEmail(ctx, m.srv, m.config.GmailAddr, email)
+}
+
+func (m *GmailMailbox) CreateEmailDraft(ctx context.Context, email t.NewEmail) (string, error) {
+	return gmail.CreateEmailDraft(ctx, m.srv, m.config.GmailAddr, email)
+}
+
+func (m *GmailMailbox) Forward(ctx context.Context, email t.Email, fwd t.Forward) error {
+	return gmail.ForwardEmail(ctx, m.srv, m.config.GmailAddr, email, fwd)
+}
+
+func (m *GmailMailbox) CreateForwardDraft(ctx context.Context, email t.Email, fwd t.Forward) (string, error) {
+	return gmail.CreateForwardDraft(ctx, m.srv, m.config.GmailAddr, email, fwd)
+}
+
+func (m *GmailMailbox) MarkHandled(ctx context.Context, id string, action string) error {
+	return m.labeler.MarkHandled(ctx, id, action)
+}
+
+func (m *GmailMailbox) RebuildCache(ctx context.Context) (int, error) {
+	return m.labeler.RebuildCache(ctx)
+}
@@ -0,0 +1,868 @@
+package mailbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+)
+
+// ways of securing the connection to a mail server
+const (
+	SECURITY_TLS      = "tls"      // tls from the start (imaps, smtps)
+	SECURITY_STARTTLS = "starttls" // a plain connection, upgraded to tls before logging in
+	SECURITY_NONE     = "none"     // no tls at all. only for servers on the same machine, like a local bridge
+)
+
+// default names of the imap folders
+const (
+	DefaultInboxFolder   = "INBOX"
+	DefaultSentFolder    = "Sent"
+	DefaultDraftsFolder  = "Drafts"
+	DefaultArchiveFolder = "Archive"
+)
+
+// length of the snippets made for imap emails, which gmail would otherwise give
+const snippetLength = 200
+
+// matches the characters that can't be in an imap keyword
+var keywordSpecialsPattern = regexp.MustCompile(`[\x00-\x20\x7f(){%*"\\\]]`)
+
+// IMAPMailbox reads mail from an imap server and sends it through an smtp server, for mail providers other than gmail.
+//
+// Messages are identified by their UID in the inbox folder, along with the inbox's UIDVALIDITY. imap has no threads, so an email's conversation is found
+// by the Message-ID and References headers, and its thread ID is the Message-ID of the conversation's first email.
+// The labels MarkHandled applies are set as keywords (custom flags). The connection to the imap server is kept between calls,
+// since providers limit how often you can log in; mail is sent with a new connection to the smtp server each time.
+type IMAPMailbox struct {
+	config  config.Config
+	imap    server
+	smtp    server
+	folders config.Folders
+
+	mu   sync.Mutex     // held while a call is using conn
+	conn *client.Client // the logged in imap connection, if there is one
+
+	listedMu sync.Mutex
+	listed   map[string]bool // IDs from the last List or ListNew call, so ListNew can tell which messages are new
+}
+
+// a mail server to connect to, with the defaults filled in and the password loaded
+type server struct {
+	host     string
+	port     int
+	security string
+	username string
+	password string
+}
+
+func (s server) addr() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+// creates the imap mailbox from the servers and folders in the config
+func NewIMAP(c config.Config) (*IMAPMailbox, error) {
+	imapServer, err := newServer("imap", c.Mailbox.IMAP, c.GmailAddr, 993, 143)
+	if err != nil {
+		return nil, err
+	}
+	smtpServer, err := newServer("smtp", c.Mailbox.SMTP, c.GmailAddr, 465, 587)
+	if err != nil {
+		return nil, err
+	}
+	if c.GmailAddr == "" {
+		return nil, errors.New("no email address configured to send mail from")
+	}
+	folders := c.Mailbox.Folders
+	folders.Inbox = withDefault(folders.Inbox, DefaultInboxFolder)
+	folders.Sent = withDefault(folders.Sent, DefaultSentFolder)
+	folders.Drafts = withDefault(folders.Drafts, DefaultDraftsFolder)
+	folders.Archive = withDefault(folders.Archive, DefaultArchiveFolder)
+	return &IMAPMailbox{config: c, imap: imapServer, smtp: smtpServer, folders: folders}, nil
+}
+
+// Fills in the defaults for a server in the config, and loads its password. tlsPort is the default port with tls,
+// and plainPort is the default with starttls or no security (for smtp, starttls uses the submission port).
+func newServer(kind string, s config.MailServer, defaultUser string, tlsPort int, plainPort int) (server, error) {
+	if s.Host == "" {
+		return server{}, fmt.Errorf("no %s host configured", kind)
+	}
+	security := withDefault(s.Security, SECURITY_TLS)
+	port := s.Port
+	switch security {
+	case SECURITY_TLS:
+		if port == 0 {
+			port = tlsPort
+		}
+	case SECURITY_STARTTLS, SECURITY_NONE:
+		if port == 0 {
+			port = plainPort
+		}
+	default:
+		return server{}, fmt.Errorf("unknown %s security: %q", kind, security)
+	}
+	password, err := loadPassword(s.Password)
+	if err != nil {
+		return server{}, fmt.Errorf("failed to load %s password: %w", kind, err)
+	}
+	return server{
+		host:     s.Host,
+		port:     port,
+		security: security,
+		username: withDefault(s.Username, defaultUser),
+		password: password,
+	}, nil
+}
+
+// Loads a password from the environment variable or file it's configured in. It's empty if neither is set.
+// Unlike an API key, a configured password file that's missing is an error, since the login would fail without it.
+func loadPassword(src config.PasswordSource) (string, error) {
+	if src.Env != "" {
+		if password := os.Getenv(src.Env); password != "" {
+			return password, nil
+		}
+	}
+	if src.File == "" {
+		return "", nil
+	}
+	bytes, err := os.ReadFile(src.File)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func withDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// Connects to the server, over tls if its security is "tls". The connection is closed once ctx is done;
+// the returned function stops that, and should be called when the connection is finished with.
+func dial(ctx context.Context, s server) (net.Conn, func() bool, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr())
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.security == SECURITY_TLS {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: s.host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return conn, stop, nil
+}
+
+// Gets the connection to the imap server, logging in if there isn't one yet or the last one was lost.
+// Only one call uses the connection at a time; the returned function lets the next call have it, and must be called when done.
+// The connection is closed if ctx is done while it's in use, and the next call logs in again.
+func (m *IMAPMailbox) connect(ctx context.Context) (*client.Client, func(), error) {
+	m.mu.Lock()
+	if m.conn != nil && !alive(ctx, m.conn) {
+		m.conn = nil
+	}
+	if m.conn == nil {
+		c, err := m.login(ctx)
+		if err != nil {
+			m.mu.Unlock()
+			return nil, nil, err
+		}
+		m.conn = c
+	}
+	c := m.conn
+	stop := context.AfterFunc(ctx, func() { c.Terminate() })
+	done := func() {
+		stop()
+		m.mu.Unlock()
+	}
+	return c, done, nil
+}
+
+// checks that a kept connection still works, e.g. that the server hasn't closed it for being idle. If not, it's closed.
+func alive(ctx context.Context, c *client.Client) bool {
+	if c.State() == imap.LogoutState {
+		return false
+	}
+	stop := context.AfterFunc(ctx, func() { c.Terminate() })
+	defer stop()
+	if err := c.Noop(); err != nil {
+		debug.Println("lost the imap connection:", err)
+		c.Terminate()
+		return false
+	}
+	return true
+}
+
+// connects and logs in to the imap server. The connection stays open after ctx is done.
+func (m *IMAPMailbox) login(ctx context.Context) (*client.Client, error) {
+	conn, stop, err := dial(ctx, m.imap)
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(conn)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	c.ErrorLog = debugLogger{}
+	fail := func(err error) (*client.Client, error) {
+		stop()
+		c.Terminate()
+		return nil, err
+	}
+	if m.imap.security == SECURITY_STARTTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.imap.host}); err != nil {
+			return fail(err)
+		}
+	}
+	if err := c.Login(m.imap.username, m.imap.password); err != nil {
+		return fail(err)
+	}
+	if !stop() {
+		// ctx was done just as the login finished, and the connection was closed
+		return nil, ctx.Err()
+	}
+	return c, nil
+}
+
+// prints the imap client's errors as debug messages. They're mostly about the connection being closed, which connect already handles.
+type debugLogger struct{}
+
+func (debugLogger) Printf(format string, v ...interface{}) { debug.Printf(format+"\n", v...) }
+func (debugLogger) Println(v ...interface{})               { debug.Println(v...) }
+
+// Logs out of the imap server, if logged in.
+func (m *IMAPMailbox) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	err := m.conn.Logout()
+	m.conn = nil
+	return err
+}
+
+// a message fetched from the imap server
+type fetchedMessage struct {
+	uid   uint32
+	raw   string
+	flags []string
+	date  time.Time // when the server received it
+}
+
+// fetches the whole messages with the given UIDs from the selected folder, without marking them as read
+func fetch(c *client.Client, uids []uint32) ([]fetchedMessage, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, ch)
+	}()
+	messages := make([]fetchedMessage, 0, len(uids))
+	for msg := range ch {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			debug.Println("failed to read message", msg.Uid, err)
+			continue
+		}
+		messages = append(messages, fetchedMessage{uid: msg.Uid, raw: string(raw), flags: msg.Flags, date: msg.InternalDate})
+	}
+	return messages, <-done
+}
+
+// gets the ID of a message in the inbox, like "1700000000:42": the inbox's UIDVALIDITY and the message's UID.
+// A UID only means the same message while the UIDVALIDITY stays the same. The server changes it when the inbox
+// is recreated (e.g. the account is moved) and the UIDs start over, so the IDs of new messages don't match old ones.
+func inboxID(validity uint32, uid uint32) string {
+	return fmt.Sprintf("%d:%d", validity, uid)
+}
+
+// splits an ID from inboxID back into the UIDVALIDITY and the UID
+func parseInboxID(id string) (uint32, uint32, error) {
+	validityStr, uidStr, ok := strings.Cut(id, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid imap message ID: %q", id)
+	}
+	validity, err := strconv.ParseUint(validityStr, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid imap message ID: %q", id)
+	}
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid imap message ID: %q", id)
+	}
+	return uint32(validity), uint32(uid), nil
+}
+
+// Selects the inbox and gets the UID of the message with the ID. Fails if the inbox's UIDVALIDITY has changed
+// since the ID was made, since the UID may now belong to a different message.
+func (m *IMAPMailbox) selectMessage(c *client.Client, id string, readOnly bool) (uint32, error) {
+	validity, uid, err := parseInboxID(id)
+	if err != nil {
+		return 0, err
+	}
+	status, err := c.Select(m.folders.Inbox, readOnly)
+	if err != nil {
+		return 0, err
+	}
+	if status.UidValidity != validity {
+		return 0, fmt.Errorf("message %s is from before the inbox was recreated (its UIDVALIDITY is now %d)", id, status.UidValidity)
+	}
+	return uid, nil
+}
+
+// fetches one message from the inbox
+func (m *IMAPMailbox) fetchOne(ctx context.Context, id string) (fetchedMessage, error) {
+	if _, _, err := parseInboxID(id); err != nil {
+		return fetchedMessage{}, err
+	}
+	c, done, err := m.connect(ctx)
+	if err != nil {
+		return fetchedMessage{}, err
+	}
+	defer done()
+	uid, err := m.selectMessage(c, id, true)
+	if err != nil {
+		return fetchedMessage{}, err
+	}
+	messages, err := fetch(c, []uint32{uid})
+	if err != nil {
+		return fetchedMessage{}, err
+	}
+	if len(messages) == 0 {
+		return fetchedMessage{}, fmt.Errorf("message %s not found", id)
+	}
+	return messages[0], nil
+}
+
+// Lists the messages in the inbox from the lookback period, up to the list limit. Deleted messages and drafts are left out.
+// UIDs go up as messages arrive, so the highest are the newest.
+func (m *IMAPMailbox) List(ctx context.Context) ([]string, error) {
+	ids, err := m.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.setListed(ids)
+	return ids, nil
+}
+
+// Lists the inbox like List, but only returns the messages that weren't in the last list.
+func (m *IMAPMailbox) ListNew(ctx context.Context) ([]string, error) {
+	ids, err := m.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.setListed(ids), nil
+}
+
+// saves the latest list of the inbox, and returns the IDs that weren't in the one before
+func (m *IMAPMailbox) setListed(ids []string) []string {
+	m.listedMu.Lock()
+	defer m.listedMu.Unlock()
+	added := make([]string, 0)
+	listed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !m.listed[id] {
+			added = append(added, id)
+		}
+		listed[id] = true
+	}
+	m.listed = listed
+	return added
+}
+
+func (m *IMAPMailbox) list(ctx context.Context) ([]string, error) {
+	c, done, err := m.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	status, err := c.Select(m.folders.Inbox, true)
+	if err != nil {
+		return nil, err
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.DeletedFlag, imap.DraftFlag}
+	if m.config.LookbackDays > 0 {
+		criteria.Since = time.Now().AddDate(0, 0, -m.config.LookbackDays)
+	}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+	limit := m.config.ListLimit
+	if limit == 0 {
+		limit = config.DefaultListLimit
+	}
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+	ids := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		ids = append(ids, inboxID(status.UidValidity, uid))
+	}
+	return ids, nil
+}
+
+// Gets the email from the inbox. Its date is when the server received it, and its thread ID is the Message-ID
+// of the first email in the conversation.
+func (m *IMAPMailbox) GetEmail(ctx context.Context, id string) (t.Email, error) {
+	msg, err := m.fetchOne(ctx, id)
+	if err != nil {
+		return t.Email{}, err
+	}
+	email, err := message.ParseRaw(msg.raw)
+	if err != nil {
+		return t.Email{}, err
+	}
+	email.ID = id
+	email.Date = msg.date
+	email.ThreadID = threadID(email)
+	email.Snippet = snippet(email.Body)
+	return email, nil
+}
+
+// gets the ID of the email's conversation: the Message-ID of the first email in it
+func threadID(email t.Email) string {
+	if len(email.References) > 0 {
+		return email.References[0]
+	}
+	return email.MessageID
+}
+
+// makes a short preview of the email's text, like the snippets gmail gives
+func snippet(body string) string {
+	s := strings.Join(strings.Fields(body), " ")
+	if len(s) <= snippetLength {
+		return s
+	}
+	s = strings.ToValidUTF8(s[:snippetLength], "")
+	return s + "..."
+}
+
+func (m *IMAPMailbox) GetRaw(ctx context.Context, id string) (string, error) {
+	msg, err := m.fetchOne(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return msg.raw, nil
+}
+
+// Downloads the attachment, by fetching the whole message and taking the attachment's part out of it.
+func (m *IMAPMailbox) GetAttachment(ctx context.Context, email t.Email, attachment t.Attachment) ([]byte, error) {
+	raw, err := m.GetRaw(ctx, email.ID)
+	if err != nil {
+		return nil, err
+	}
+	return emailparse.ReadAttachment(raw, attachment.PartID)
+}
+
+// Finds the messages in the email's conversation in the inbox, sent and archive folders: the emails it references,
+// and the other replies in the conversation. Messages outside the inbox get IDs like "Sent/12", since their UIDs are only
+// unique within their folder. Messages in the sent folder are the user's own.
+func (m *IMAPMailbox) Thread(ctx context.Context, email t.Email) ([]t.ThreadMessage, error) {
+	root := threadID(email)
+	if root == "" {
+		return nil, nil
+	}
+	ids := append([]string{}, email.References...)
+	if email.MessageID != "" {
+		ids = append(ids, email.MessageID)
+	}
+	c, done, err := m.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	messages := []t.ThreadMessage{}
+	seen := make(map[string]bool)
+	for _, folder := range []string{m.folders.Inbox, m.folders.Sent, m.folders.Archive} {
+		status, err := c.Select(folder, true)
+		if err != nil {
+			// e.g. there's no archive folder yet
+			debug.Println("can't look for the thread in folder", folder, err)
+			continue
+		}
+		uids, err := c.UidSearch(threadCriteria(ids, root))
+		if err != nil {
+			return nil, err
+		}
+		if len(uids) == 0 {
+			continue
+		}
+		fetched, err := fetch(c, uids)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range fetched {
+			if slices.Contains(msg.flags, imap.DraftFlag) || slices.Contains(msg.flags, imap.DeletedFlag) {
+				continue
+			}
+			// the same email can be in more than one folder, e.g. one the user sent to themselves
+			if msgID := messageID([]byte(msg.raw)); msgID != "" {
+				if seen[msgID] {
+					continue
+				}
+				seen[msgID] = true
+			}
+			id := inboxID(status.UidValidity, msg.uid)
+			if folder != m.folders.Inbox {
+				id = folder + "/" + fmt.Sprint(msg.uid)
+			}
+			tm, err := message.ParseThreadMessage(id, msg.raw, m.config.OwnAddresses())
+			if err != nil {
+				debug.Println("failed to parse thread message", id, err)
+				continue
+			}
+			tm.Mine = tm.Mine || folder == m.folders.Sent
+			if tm.Date.IsZero() {
+				tm.Date = msg.date
+			}
+			messages = append(messages, tm)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date.Before(messages[j].Date)
+	})
+	return messages, nil
+}
+
+// matches the messages with one of the given Message-IDs, and the replies in the conversation started by root
+func threadCriteria(ids []string, root string) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("References", root)
+	for _, id := range ids {
+		byID := imap.NewSearchCriteria()
+		byID.Header.Add("Message-Id", id)
+		criteria = &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{criteria, byID}}}
+	}
+	return criteria
+}
+
+// gets the Message-ID of a raw message, or an empty string if it doesn't have one
+func messageID(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-Id"))
+}
+
+func (m *IMAPMailbox) SendReply(ctx context.Context, email t.Email, reply t.Reply) error {
+	raw, err := message.RawReply(email, m.config.GmailAddr, reply)
+	if err != nil {
+		return err
+	}
+	return m.send(ctx, raw)
+}
+
+func (m *IMAPMailbox) CreateDraft(ctx context.Context, email t.Email, reply t.Reply) (string, error) {
+	raw, err := message.RawReply(email, m.config.GmailAddr, reply)
+	if err != nil {
+		return "", err
+	}
+	return m.saveDraft(ctx, raw)
+}
+
+func (m *IMAPMailbox) SendEmail(ctx context.Context, email t.NewEmail) error {
+	raw, err := message.RawEmail(m.config.GmailAddr, email)
+	if err != nil {
+		return err
+	}
+	return m.send(ctx, raw)
+}
+
+func (m *IMAPMailbox) CreateEmailDraft(ctx context.Context, email t.NewEmail) (string, error) {
+	raw, err := message.RawEmail(m.config.GmailAddr, email)
+	if err != nil {
+		return "", err
+	}
+	return m.saveDraft(ctx, raw)
+}
+
+func (m *IMAPMailbox) Forward(ctx context.Context, email t.Email, fwd t.Forward) error {
+	raw, err := m.rawForward(ctx, email, fwd)
+	if err != nil {
+		return err
+	}
+	return m.send(ctx, raw)
+}
+
+func (m *IMAPMailbox) CreateForwardDraft(ctx context.Context, email t.Email, fwd t.Forward) (string, error) {
+	raw, err := m.rawForward(ctx, email, fwd)
+	if err != nil {
+		return "", err
+	}
+	return m.saveDraft(ctx, raw)
+}
+
+// builds the forward. unless it's inline, the original raw message is downloaded to be attached.
+func (m *IMAPMailbox) rawForward(ctx context.Context, email t.Email, fwd t.Forward) ([]byte, error) {
+	rawOriginal := ""
+	if !fwd.Inline {
+		var err error
+		rawOriginal, err = m.GetRaw(ctx, email.ID)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get the original message"), err)
+		}
+	}
+	return message.RawForward(email, rawOriginal, m.config.GmailAddr, fwd)
+}
+
+// Sends the raw message through the smtp server, to everyone in its To and Cc headers.
+// If it's enabled, the message is then saved to the sent folder.
+func (m *IMAPMailbox) send(ctx context.Context, raw []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	recipients := []string{}
+	for _, key := range []string{"To", "Cc"} {
+		list, err := msg.Header.AddressList(key)
+		if err != nil && !errors.Is(err, mail.ErrHeaderNotPresent) {
+			return fmt.Errorf("failed to read %s addresses: %w", key, err)
+		}
+		for _, addr := range list {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipients to send the email to")
+	}
+	if err := m.sendMail(ctx, recipients, raw); err != nil {
+		return err
+	}
+	if m.config.Mailbox.SaveSent {
+		// the email was already sent, so this isn't worth failing over
+		if err := m.appendMessage(ctx, m.folders.Sent, []string{imap.SeenFlag}, raw); err != nil {
+			log.Println("failed to save sent email:", err)
+		}
+	}
+	return nil
+}
+
+// sends the raw message to the recipients through the smtp server, logging in first if there's a password
+func (m *IMAPMailbox) sendMail(ctx context.Context, recipients []string, raw []byte) error {
+	conn, stop, err := dial(ctx, m.smtp)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	c, err := smtp.NewClient(conn, m.smtp.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if m.smtp.security == SECURITY_STARTTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.smtp.host}); err != nil {
+			return err
+		}
+	}
+	if m.smtp.password != "" {
+		if err := c.Auth(sasl.NewPlainClient("", m.smtp.username, m.smtp.password)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.config.GmailAddr, nil); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("failed to send to %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Saves the raw message to the drafts folder. imap drafts don't have IDs of their own, so the message's Message-ID is returned.
+func (m *IMAPMailbox) saveDraft(ctx context.Context, raw []byte) (string, error) {
+	if err := m.appendMessage(ctx, m.folders.Drafts, []string{imap.DraftFlag, imap.SeenFlag}, raw); err != nil {
+		return "", err
+	}
+	return messageID(raw), nil
+}
+
+// adds the raw message to the folder, creating the folder if it doesn't exist yet
+func (m *IMAPMailbox) appendMessage(ctx context.Context, folder string, flags []string, raw []byte) error {
+	c, done, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return intoFolder(c, folder, func() error {
+		return c.Append(folder, flags, time.Now(), bytes.NewBuffer(raw))
+	})
+}
+
+// Runs f, which puts messages into the folder. If it fails, the folder may not exist yet, so it's created and f is tried again.
+func intoFolder(c *client.Client, folder string, f func() error) error {
+	err := f()
+	if err == nil {
+		return nil
+	}
+	if createErr := c.Create(folder); createErr != nil {
+		return err
+	}
+	debug.Println("created imap folder:", folder)
+	return f()
+}
+
+// gets the imap keyword for a label, e.g. "Valet/Replied". characters keywords can't have are replaced with "_".
+func keyword(label string) string {
+	return keywordSpecialsPattern.ReplaceAllString(label, "_")
+}
+
+// Sets the configured label on the email as a keyword. Emails the user handled are also marked as read (\Seen)
+// and/or archived (moved to the archive folder), if that's enabled in the config. Does nothing if labels aren't enabled.
+// Emails are only archived if the server supports MOVE.
+func (m *IMAPMailbox) MarkHandled(ctx context.Context, id string, action string) error {
+	labels := m.config.Labels
+	if !labels.Enabled {
+		return nil
+	}
+	name := message.LabelName(labels, action)
+	if name == "" {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	if _, _, err := parseInboxID(id); err != nil {
+		return err
+	}
+	c, done, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	uid, err := m.selectMessage(c, id, false)
+	if err != nil {
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	handled := action != t.FILTERED && action != t.DRAFTED
+	flags := []interface{}{keyword(name)}
+	if handled && labels.MarkRead {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+		return err
+	}
+	if handled && labels.Archive {
+		// without MOVE, the client falls back to an EXPUNGE, which would also remove any other deleted messages in the inbox
+		if ok, err := c.Support("MOVE"); err != nil || !ok {
+			log.Println("imap server doesn't support MOVE; not archiving email", id)
+			return nil
+		}
+		return intoFolder(c, m.folders.Archive, func() error {
+			return c.UidMove(seqset, m.folders.Archive)
+		})
+	}
+	return nil
+}
+
+// Rebuilds the email cache from the keywords set by MarkHandled, like gmail.Labeler does from labels. Only the inbox is looked at,
+// since archived emails aren't listed again anyway. The whole session gets one mailbox timeout.
+func (m *IMAPMailbox) RebuildCache(ctx context.Context) (int, error) {
+	ctx, cancel := util.WithTimeout(ctx, m.config.MailTimeout())
+	defer cancel()
+	c, done, err := m.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	status, err := c.Select(m.folders.Inbox, true)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, action := range message.RestorableActions {
+		criteria := imap.NewSearchCriteria()
+		criteria.WithFlags = []string{keyword(message.LabelName(m.config.Labels, action))}
+		if m.config.LookbackDays > 0 {
+			criteria.Since = time.Now().AddDate(0, 0, -m.config.LookbackDays)
+		}
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			return count, err
+		}
+		uncached := []uint32{}
+		for _, uid := range uids {
+			if _, cached := emailcache.IsCached(inboxID(status.UidValidity, uid)); !cached {
+				uncached = append(uncached, uid)
+			}
+		}
+		if len(uncached) == 0 {
+			continue
+		}
+		messages, err := fetch(c, uncached)
+		if err != nil {
+			return count, err
+		}
+		cacheAction, categories := message.RestoredCacheAction(action)
+		for _, msg := range messages {
+			email, err := message.ParseRaw(msg.raw)
+			if err != nil {
+				debug.Println("failed to parse message", msg.uid, err)
+				continue
+			}
+			email.ID = inboxID(status.UidValidity, msg.uid)
+			email.Date = msg.date
+			emailcache.AddToCache(email, cacheAction, categories...)
+			count++
+		}
+	}
+	return count, nil
+}
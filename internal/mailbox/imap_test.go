@@ -0,0 +1,801 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-smtp"
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+// fakeSMTP is an in-process stand-in for an smtp server, which records the mail sent through it instead of delivering it
+type fakeSMTP struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+type sentMail struct {
+	from string
+	to   []string
+	data string
+}
+
+func (f *fakeSMTP) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if username != "me@example.com" || password != "smtp-secret" {
+		return nil, errors.New("invalid username or password")
+	}
+	return &fakeSMTPSession{f: f}, nil
+}
+
+func (f *fakeSMTP) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return nil, smtp.ErrAuthRequired
+}
+
+func (f *fakeSMTP) messages() []sentMail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentMail{}, f.sent...)
+}
+
+type fakeSMTPSession struct {
+	f    *fakeSMTP
+	mail sentMail
+}
+
+func (s *fakeSMTPSession) Reset()        { s.mail = sentMail{} }
+func (s *fakeSMTPSession) Logout() error { return nil }
+
+func (s *fakeSMTPSession) Mail(from string, opts smtp.MailOptions) error {
+	s.mail.from = from
+	return nil
+}
+
+func (s *fakeSMTPSession) Rcpt(to string) error {
+	s.mail.to = append(s.mail.to, to)
+	return nil
+}
+
+func (s *fakeSMTPSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mail.data = string(data)
+	s.f.mu.Lock()
+	s.f.sent = append(s.f.sent, s.mail)
+	s.f.mu.Unlock()
+	return nil
+}
+
+// movingBackend adds MOVE support to go-imap's in-memory backend, which the server advertises to clients either way.
+// It also reports uidValidity as the UIDVALIDITY of every folder, which the in-memory backend always has as 1,
+// and counts the logins.
+type movingBackend struct {
+	*memory.Backend
+	uidValidity *atomic.Uint32
+	logins      *atomic.Int32
+}
+
+type movingUser struct {
+	backend.User
+	uidValidity *atomic.Uint32
+}
+
+type movingMailbox struct {
+	backend.Mailbox
+	uidValidity *atomic.Uint32
+}
+
+func (be movingBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	be.logins.Add(1)
+	return movingUser{user, be.uidValidity}, nil
+}
+
+func (u movingUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return movingMailbox{mbox, u.uidValidity}, nil
+}
+
+func (mbox movingMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mbox.Mailbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+	if status.UidValidity != 0 {
+		status.UidValidity = mbox.uidValidity.Load()
+	}
+	return status, nil
+}
+
+func (mbox movingMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := mbox.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	if err := mbox.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return mbox.Expunge()
+}
+
+// a mailbox connected to in-process imap and smtp servers
+type testMailbox struct {
+	mb          *IMAPMailbox
+	user        backend.User
+	smtp        *fakeSMTP
+	uidValidity *atomic.Uint32
+	logins      *atomic.Int32
+}
+
+// starts the imap server (with go-imap's in-memory backend) and the smtp server, and creates an imap mailbox connected to them.
+// The inbox starts out empty.
+func newTestMailbox(t *testing.T, c config.Config) *testMailbox {
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("failed to log in to imap backend:", err)
+	}
+	tm := &testMailbox{user: user, smtp: &fakeSMTP{}, uidValidity: new(atomic.Uint32), logins: new(atomic.Int32)}
+	tm.inbox(t).Messages = nil
+	tm.uidValidity.Store(1)
+
+	imapListener := listen(t)
+	imapSrv := imapserver.New(movingBackend{be, tm.uidValidity, tm.logins})
+	imapSrv.AllowInsecureAuth = true
+	go imapSrv.Serve(imapListener)
+	t.Cleanup(func() { imapSrv.Close() })
+
+	smtpListener := listen(t)
+	smtpSrv := smtp.NewServer(tm.smtp)
+	smtpSrv.Domain = "localhost"
+	smtpSrv.AllowInsecureAuth = true
+	go smtpSrv.Serve(smtpListener)
+	// closing the listener stops the server; smtp.Server.Close races with Serve starting up
+	t.Cleanup(func() { smtpListener.Close() })
+
+	t.Setenv("TEST_IMAP_PASSWORD", "password")
+	t.Setenv("TEST_SMTP_PASSWORD", "smtp-secret")
+	c.GmailAddr = "me@example.com"
+	c.Mailbox.Provider = IMAP
+	c.Mailbox.IMAP = testServer(t, imapListener, "username", "TEST_IMAP_PASSWORD")
+	c.Mailbox.SMTP = testServer(t, smtpListener, "", "TEST_SMTP_PASSWORD")
+	mb, err := NewIMAP(c)
+	if err != nil {
+		t.Fatal("failed to create imap mailbox:", err)
+	}
+	tm.mb = mb
+	t.Cleanup(func() { mb.Close() })
+	return tm
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	return l
+}
+
+func testServer(t *testing.T, l net.Listener, username string, passwordEnv string) config.MailServer {
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return config.MailServer{Host: host, Port: p, Security: SECURITY_NONE, Username: username, Password: config.PasswordSource{Env: passwordEnv}}
+}
+
+func (tm *testMailbox) folder(t *testing.T, name string) *memory.Mailbox {
+	mbox, err := tm.user.GetMailbox(name)
+	if err != nil {
+		t.Fatalf("failed to get folder %s: %v", name, err)
+	}
+	return mbox.(*memory.Mailbox)
+}
+
+func (tm *testMailbox) inbox(t *testing.T) *memory.Mailbox {
+	return tm.folder(t, "INBOX")
+}
+
+// empties the inbox and gives it a new UIDVALIDITY, like a server does when the inbox is recreated. UIDs start over after this.
+func (tm *testMailbox) resetInbox(t *testing.T) {
+	tm.inbox(t).Messages = nil
+	tm.uidValidity.Add(1)
+}
+
+// adds a message to the folder with the given UID, received at the given time
+func addMessage(folder *memory.Mailbox, uid uint32, date time.Time, raw string, flags ...string) {
+	body := []byte(crlf(raw))
+	folder.Messages = append(folder.Messages, &memory.Message{Uid: uid, Date: date, Size: uint32(len(body)), Flags: flags, Body: body})
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func hasFlag(flags []string, flag string) bool {
+	return slices.ContainsFunc(flags, func(f string) bool { return strings.EqualFold(f, flag) })
+}
+
+const simpleEmail = `From: Alice <alice@example.com>
+To: me@example.com
+Subject: Hello
+Message-ID: <hello@example.com>
+Date: Mon, 1 Jul 2024 09:30:00 +0000
+
+Just saying hi.
+`
+
+func TestNewIMAP(t *testing.T) {
+	server := config.MailServer{Host: "mail.example.com"}
+	tests := []struct {
+		name    string
+		mailbox config.Mailbox
+		addr    string
+		wantErr bool
+		imap    string
+		smtp    string
+	}{
+		{"defaults", config.Mailbox{IMAP: server, SMTP: server}, "me@example.com", false, "mail.example.com:993", "mail.example.com:465"},
+		{"starttls", config.Mailbox{IMAP: config.MailServer{Host: "imap.example.com", Security: SECURITY_STARTTLS}, SMTP: config.MailServer{Host: "smtp.example.com", Security: SECURITY_STARTTLS}}, "me@example.com", false, "imap.example.com:143", "smtp.example.com:587"},
+		{"custom port", config.Mailbox{IMAP: config.MailServer{Host: "localhost", Port: 1143, Security: SECURITY_NONE}, SMTP: config.MailServer{Host: "localhost", Port: 1025, Security: SECURITY_NONE}}, "me@example.com", false, "localhost:1143", "localhost:1025"},
+		{"no imap host", config.Mailbox{SMTP: server}, "me@example.com", true, "", ""},
+		{"no smtp host", config.Mailbox{IMAP: server}, "me@example.com", true, "", ""},
+		{"unknown security", config.Mailbox{IMAP: config.MailServer{Host: "mail.example.com", Security: "ssl"}, SMTP: server}, "me@example.com", true, "", ""},
+		{"no address", config.Mailbox{IMAP: server, SMTP: server}, "", true, "", ""},
+		{"missing password file", config.Mailbox{IMAP: config.MailServer{Host: "mail.example.com", Password: config.PasswordSource{File: "cred/no-such-password.txt"}}, SMTP: server}, "me@example.com", true, "", ""},
+	}
+	for _, test := range tests {
+		mb, err := NewIMAP(config.Config{GmailAddr: test.addr, Mailbox: test.mailbox})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if mb.imap.addr() != test.imap || mb.smtp.addr() != test.smtp {
+			t.Errorf("%s: expected servers %s and %s, got %s and %s", test.name, test.imap, test.smtp, mb.imap.addr(), mb.smtp.addr())
+		}
+		if mb.imap.username != test.addr || mb.folders.Sent != DefaultSentFolder {
+			t.Errorf("%s: expected the defaults to be filled in, got %+v %+v", test.name, mb.imap, mb.folders)
+		}
+	}
+
+	if _, err := New(config.Config{Mailbox: config.Mailbox{Provider: "pop3"}}); err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+}
+
+func TestIMAPList(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{LookbackDays: 7})
+	now := time.Now()
+	inbox := tm.inbox(t)
+	addMessage(inbox, 101, now.Add(-2*time.Hour), simpleEmail)
+	addMessage(inbox, 102, now.AddDate(0, 0, -10), simpleEmail, imap.SeenFlag)
+	addMessage(inbox, 103, now.Add(-time.Hour), simpleEmail, imap.DeletedFlag)
+	addMessage(inbox, 104, now.Add(-time.Hour), simpleEmail, imap.DraftFlag)
+	addMessage(inbox, 105, now.Add(-time.Minute), simpleEmail, imap.SeenFlag)
+
+	ids, err := tm.mb.List(context.Background())
+	if err != nil {
+		t.Fatal("failed to list inbox:", err)
+	}
+	if want := []string{"1:105", "1:101"}; !slices.Equal(ids, want) {
+		t.Errorf("expected %v, got %v", want, ids)
+	}
+
+	tm.mb.config.ListLimit = 1
+	ids, err = tm.mb.List(context.Background())
+	if err != nil {
+		t.Fatal("failed to list inbox:", err)
+	}
+	if want := []string{"1:105"}; !slices.Equal(ids, want) {
+		t.Errorf("expected the list limit to keep the newest, got %v", ids)
+	}
+}
+
+func TestIMAPGetEmail(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{})
+	received := time.Date(2024, 7, 1, 9, 31, 0, 0, time.UTC)
+	addMessage(tm.inbox(t), 7, received, `From: Bob Smith <bob@example.com>
+To: me@example.com
+Subject: Re: Lunch notes
+Message-ID: <notes-2@example.com>
+In-Reply-To: <notes-1@example.com>
+References: <notes-0@example.com> <notes-1@example.com>
+Date: Mon, 1 Jul 2024 09:30:00 +0000
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="mixed"
+
+--mixed
+Content-Type: text/plain; charset="utf-8"
+
+Notes from lunch are attached.
+--mixed
+Content-Type: text/plain; name="notes.txt"
+Content-Disposition: attachment; filename="notes.txt"
+Content-Transfer-Encoding: base64
+
+VGFjb3Mgb24gRnJpZGF5Lg==
+--mixed--
+`)
+	ctx := context.Background()
+	email, err := tm.mb.GetEmail(ctx, "1:7")
+	if err != nil {
+		t.Fatal("failed to get email:", err)
+	}
+	if email.ID != "1:7" || email.From != "bob@example.com" || email.SenderName != "Bob Smith" || email.Subject != "Re: Lunch notes" {
+		t.Errorf("unexpected email: %+v", email)
+	}
+	if email.Body != "Notes from lunch are attached." || email.Snippet != email.Body {
+		t.Errorf("unexpected body %q, snippet %q", email.Body, email.Snippet)
+	}
+	if !email.Date.Equal(received) {
+		t.Errorf("expected the date the server received it (%v), got %v", received, email.Date)
+	}
+	if email.MessageID != "<notes-2@example.com>" || email.ThreadID != "<notes-0@example.com>" {
+		t.Errorf("expected the thread ID to be the first reference, got message ID %q, thread ID %q", email.MessageID, email.ThreadID)
+	}
+	if len(email.Attachments) != 1 || email.Attachments[0].Filename != "notes.txt" {
+		t.Fatalf("expected the notes attachment, got %+v", email.Attachments)
+	}
+	data, err := tm.mb.GetAttachment(ctx, email, email.Attachments[0])
+	if err != nil {
+		t.Fatal("failed to get attachment:", err)
+	}
+	if string(data) != "Tacos on Friday." {
+		t.Errorf("unexpected attachment content %q", data)
+	}
+
+	raw, err := tm.mb.GetRaw(ctx, "1:7")
+	if err != nil || !strings.Contains(raw, "Subject: Re: Lunch notes\r\n") {
+		t.Errorf("expected the raw message, got %q, %v", raw, err)
+	}
+	if flags := tm.inbox(t).Messages[0].Flags; hasFlag(flags, imap.SeenFlag) {
+		t.Error("getting an email shouldn't mark it as read")
+	}
+
+	if _, err := tm.mb.GetEmail(ctx, "1:8"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+	for _, id := range []string{"abc", "7", "1:abc"} {
+		if _, err := tm.mb.GetEmail(ctx, id); err == nil {
+			t.Errorf("expected an error for the invalid message ID %q", id)
+		}
+	}
+}
+
+func TestIMAPSendReply(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{Mailbox: config.Mailbox{SaveSent: true}})
+	addMessage(tm.inbox(t), 1, time.Now(), simpleEmail)
+	ctx := context.Background()
+	email, err := tm.mb.GetEmail(ctx, "1:1")
+	if err != nil {
+		t.Fatal("failed to get email:", err)
+	}
+	reply := types.Reply{
+		To:   []*mail.Address{{Name: "Alice", Address: "alice@example.com"}},
+		Cc:   []*mail.Address{{Address: "carol@example.com"}},
+		Body: "Hi Alice!",
+	}
+	if err := tm.mb.SendReply(ctx, email, reply); err != nil {
+		t.Fatal("failed to send reply:", err)
+	}
+
+	sent := tm.smtp.messages()
+	if len(sent) != 1 {
+		t.Fatalf("expected one email sent, got %v", len(sent))
+	}
+	if sent[0].from != "me@example.com" || !slices.Equal(sent[0].to, []string{"alice@example.com", "carol@example.com"}) {
+		t.Errorf("unexpected envelope: from %s to %v", sent[0].from, sent[0].to)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(sent[0].data))
+	if err != nil {
+		t.Fatal("failed to read sent email:", err)
+	}
+	if msg.Header.Get("In-Reply-To") != "<hello@example.com>" || msg.Header.Get("Subject") != "Re: Hello" {
+		t.Errorf("expected a reply to the email, got headers %v", msg.Header)
+	}
+
+	saved := tm.folder(t, DefaultSentFolder).Messages
+	if len(saved) != 1 || !hasFlag(saved[0].Flags, imap.SeenFlag) {
+		t.Fatalf("expected the reply saved to the sent folder as read, got %+v", saved)
+	}
+	if !strings.Contains(string(saved[0].Body), "Hi Alice!") {
+		t.Errorf("unexpected sent folder copy: %q", saved[0].Body)
+	}
+}
+
+func TestIMAPSendEmailWrongPassword(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{})
+	tm.mb.smtp.password = "wrong"
+	err := tm.mb.SendEmail(context.Background(), types.NewEmail{To: []*mail.Address{{Address: "bob@example.com"}}, Subject: "Hi", Body: "Hi Bob"})
+	if err == nil {
+		t.Error("expected the smtp login to fail")
+	}
+	if len(tm.smtp.messages()) != 0 {
+		t.Error("nothing should be sent without logging in")
+	}
+}
+
+func TestIMAPCreateDraft(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{})
+	ctx := context.Background()
+	draftID, err := tm.mb.CreateEmailDraft(ctx, types.NewEmail{To: []*mail.Address{{Address: "bob@example.com"}}, Subject: "Lunch", Body: "Lunch on Friday?"})
+	if err != nil {
+		t.Fatal("failed to create draft:", err)
+	}
+	drafts := tm.folder(t, DefaultDraftsFolder).Messages
+	if len(drafts) != 1 || !hasFlag(drafts[0].Flags, imap.DraftFlag) {
+		t.Fatalf("expected the draft in the (new) drafts folder, got %+v", drafts)
+	}
+	if draftID == "" || messageID(drafts[0].Body) != draftID {
+		t.Errorf("expected the draft ID to be its Message-ID, got %q", draftID)
+	}
+	if len(tm.smtp.messages()) != 0 {
+		t.Error("a draft shouldn't be sent")
+	}
+}
+
+func TestIMAPForward(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{})
+	addMessage(tm.inbox(t), 1, time.Now(), simpleEmail)
+	ctx := context.Background()
+	email, err := tm.mb.GetEmail(ctx, "1:1")
+	if err != nil {
+		t.Fatal("failed to get email:", err)
+	}
+	fwd := types.Forward{To: []*mail.Address{{Name: "Mr Squeaks", Address: "squeaks@example.com"}}, Note: "Can you handle this?"}
+	if err := tm.mb.Forward(ctx, email, fwd); err != nil {
+		t.Fatal("failed to forward:", err)
+	}
+	sent := tm.smtp.messages()
+	if len(sent) != 1 || !slices.Equal(sent[0].to, []string{"squeaks@example.com"}) {
+		t.Fatalf("expected the forward sent to the delegate, got %+v", sent)
+	}
+	if !strings.Contains(sent[0].data, "message/rfc822") || !strings.Contains(sent[0].data, "Just saying hi.") {
+		t.Errorf("expected the original attached to the forward, got %q", sent[0].data)
+	}
+}
+
+func TestIMAPMarkHandled(t *testing.T) {
+	labels := config.Labels{Enabled: true, MarkRead: true, Archive: true}
+	tm := newTestMailbox(t, config.Config{Labels: labels})
+	inbox := tm.inbox(t)
+	addMessage(inbox, 11, time.Now(), simpleEmail)
+	addMessage(inbox, 12, time.Now(), simpleEmail)
+	ctx := context.Background()
+
+	if err := tm.mb.MarkHandled(ctx, "1:11", types.REPLIED); err != nil {
+		t.Fatal("failed to mark replied:", err)
+	}
+	if err := tm.mb.MarkHandled(ctx, "1:12", types.FILTERED); err != nil {
+		t.Fatal("failed to mark filtered:", err)
+	}
+	if err := tm.mb.MarkHandled(ctx, "1:12", "???"); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+
+	inbox = tm.inbox(t)
+	if len(inbox.Messages) != 1 || inbox.Messages[0].Uid != 12 {
+		t.Fatalf("expected only the filtered email left in the inbox, got %+v", inbox.Messages)
+	}
+	if flags := inbox.Messages[0].Flags; !hasFlag(flags, "Valet/Ignored") || hasFlag(flags, imap.SeenFlag) {
+		t.Errorf("expected the filtered email labeled ignored and left unread, got %v", flags)
+	}
+	archived := tm.folder(t, DefaultArchiveFolder).Messages
+	if len(archived) != 1 {
+		t.Fatalf("expected the replied email in the archive, got %+v", archived)
+	}
+	if flags := archived[0].Flags; !hasFlag(flags, "Valet/Replied") || !hasFlag(flags, imap.SeenFlag) {
+		t.Errorf("expected the archived email labeled replied and read, got %v", flags)
+	}
+
+	// nothing happens with labels turned off
+	tm.mb.config.Labels.Enabled = false
+	addMessage(tm.inbox(t), 13, time.Now(), simpleEmail)
+	if err := tm.mb.MarkHandled(ctx, "1:13", types.REPLIED); err != nil {
+		t.Fatal("failed to mark replied:", err)
+	}
+	if flags := tm.inbox(t).Messages[1].Flags; len(flags) != 0 {
+		t.Errorf("expected no flags with labels disabled, got %v", flags)
+	}
+}
+
+func TestIMAPThread(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{})
+	inbox := tm.inbox(t)
+	received := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	addMessage(inbox, 21, received, `From: Bob <bob@example.com>
+To: me@example.com
+Subject: Lunch
+Message-ID: <lunch-1@example.com>
+Date: Mon, 1 Jul 2024 09:30:00 +0000
+
+Lunch on Friday?
+`)
+	addMessage(inbox, 22, received, `From: "Bob" <bob@example.com>
+To: me@example.com
+Subject: Re: Lunch
+Message-ID: <lunch-3@example.com>
+In-Reply-To: <lunch-2@example.com>
+References: <lunch-1@example.com> <lunch-2@example.com>
+Date: Mon, 1 Jul 2024 11:30:00 +0000
+
+The usual place.
+
+On Mon, Jul 1, 2024 at 10:30 AM, Me <me@example.com> wrote:
+> Sounds good, where?
+`)
+	addMessage(inbox, 23, received, simpleEmail)
+	addMessage(inbox, 24, received, `From: me@example.com
+To: bob@example.com
+Subject: Re: Lunch
+Message-ID: <lunch-draft@example.com>
+References: <lunch-1@example.com> <lunch-2@example.com> <lunch-3@example.com>
+Date: Mon, 1 Jul 2024 12:00:00 +0000
+
+Unsent draft
+`, imap.DraftFlag)
+	if err := tm.user.CreateMailbox(DefaultSentFolder); err != nil {
+		t.Fatal(err)
+	}
+	addMessage(tm.folder(t, DefaultSentFolder), 3, received, `From: Me <me@example.com>
+To: bob@example.com
+Subject: Re: Lunch
+Message-ID: <lunch-2@example.com>
+In-Reply-To: <lunch-1@example.com>
+References: <lunch-1@example.com>
+Date: Mon, 1 Jul 2024 10:30:00 +0000
+
+Sounds good, where?
+`)
+
+	ctx := context.Background()
+	email, err := tm.mb.GetEmail(ctx, "1:22")
+	if err != nil {
+		t.Fatal("failed to get email:", err)
+	}
+	messages, err := tm.mb.Thread(ctx, email)
+	if err != nil {
+		t.Fatal("failed to get thread:", err)
+	}
+	want := []types.ThreadMessage{
+		{ID: "1:21", From: "bob@example.com", SenderName: "Bob", Date: time.Date(2024, 7, 1, 9, 30, 0, 0, time.UTC), Text: "Lunch on Friday?"},
+		{ID: "Sent/3", From: "me@example.com", SenderName: "Me", Date: time.Date(2024, 7, 1, 10, 30, 0, 0, time.UTC), Text: "Sounds good, where?", Mine: true},
+		{ID: "1:22", From: "bob@example.com", SenderName: "Bob", Date: time.Date(2024, 7, 1, 11, 30, 0, 0, time.UTC), Text: "The usual place."},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("expected %v messages, got %+v", len(want), messages)
+	}
+	for i := range want {
+		got := messages[i]
+		if !got.Date.Equal(want[i].Date) {
+			t.Errorf("message %v: expected date %v, got %v", i, want[i].Date, got.Date)
+		}
+		got.Date = want[i].Date
+		if got != want[i] {
+			t.Errorf("message %v: expected %+v, got %+v", i, want[i], got)
+		}
+	}
+}
+
+func TestIMAPRebuildCache(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{Labels: config.Labels{Enabled: true}, LookbackDays: 7})
+	actions := map[uint32]string{
+		301: types.REPLIED,
+		302: types.IGNORED,
+		303: types.FILTERED,
+		304: types.DRAFTED,
+		305: types.FORWARDED,
+	}
+	ctx := context.Background()
+	for uid, action := range actions {
+		addMessage(tm.inbox(t), uid, time.Now(), simpleEmail)
+		if err := tm.mb.MarkHandled(ctx, fmt.Sprintf("1:%d", uid), action); err != nil {
+			t.Fatal("failed to mark handled:", err)
+		}
+	}
+	addMessage(tm.inbox(t), 306, time.Now(), simpleEmail)
+
+	count, err := tm.mb.RebuildCache(ctx)
+	if err != nil {
+		t.Fatal("failed to rebuild cache:", err)
+	}
+	if count != len(actions) {
+		t.Errorf("expected %v emails restored, got %v", len(actions), count)
+	}
+	want := map[string]string{
+		"1:301": emailcache.REPLY,
+		"1:302": emailcache.IGNORE,
+		"1:303": emailcache.IGNORE,
+		"1:304": emailcache.DRAFT,
+		"1:305": emailcache.FORWARD,
+	}
+	for id, action := range want {
+		datum, ok := emailcache.IsCached(id)
+		if !ok {
+			t.Errorf("%s wasn't restored to the cache", id)
+			continue
+		}
+		if datum.Action != action || datum.From != "alice@example.com" || datum.Date.IsZero() {
+			t.Errorf("%s: unexpected cache entry %+v", id, datum)
+		}
+	}
+	if _, ok := emailcache.IsCached("1:306"); ok {
+		t.Error("an email without a valet keyword shouldn't be restored")
+	}
+
+	// already cached emails aren't counted again
+	if count, err := tm.mb.RebuildCache(ctx); err != nil || count != 0 {
+		t.Errorf("expected nothing more to restore, got %v, %v", count, err)
+	}
+}
+
+func TestGetEmails(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{Labels: config.Labels{Enabled: true}, LookbackDays: 7, EmailBatchLimit: 10, Aliases: []string{"Me@Alias.example.com"}})
+	inbox := tm.inbox(t)
+	now := time.Now()
+	addMessage(inbox, 401, now.Add(-4*time.Hour), simpleEmail)
+	addMessage(inbox, 402, now.Add(-3*time.Hour), `From: Me@Example.com
+To: alice@example.com
+Subject: Note to self
+
+Buy milk.
+`)
+	addMessage(inbox, 405, now.Add(-3*time.Hour), `From: me@alias.example.com
+To: alice@example.com
+Subject: Note to self
+
+Buy eggs.
+`)
+	addMessage(inbox, 403, now.Add(-2*time.Hour), `From: No Reply <noreply@shop.example.com>
+To: me@example.com
+Subject: Your order has shipped
+
+It's on the way.
+`)
+	addMessage(inbox, 404, now.Add(-time.Hour), `From: Bob <bob@example.com>
+To: me@example.com
+Subject: Lunch
+
+Lunch on Friday?
+`)
+	emailcache.AddToCache(types.Email{ID: "1:404", From: "bob@example.com", Date: now}, emailcache.REPLY)
+
+	emails := GetEmails(context.Background(), tm.mb, tm.mb.config)
+	if len(emails) != 1 || emails[0].ID != "1:401" {
+		t.Fatalf("expected only alice's email, got %+v", emails)
+	}
+	if datum, ok := emailcache.IsCached("1:403"); !ok || datum.Action != emailcache.IGNORE {
+		t.Errorf("expected the no-reply email cached as ignored, got %+v", datum)
+	}
+	for _, msg := range tm.inbox(t).Messages {
+		if msg.Uid == 403 && !hasFlag(msg.Flags, "Valet/Ignored") {
+			t.Errorf("expected the no-reply email labeled ignored, got %v", msg.Flags)
+		}
+	}
+}
+
+func TestGetNewEmails(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{LookbackDays: 7, EmailBatchLimit: 10})
+	addMessage(tm.inbox(t), 701, time.Now().Add(-time.Hour), simpleEmail)
+	ctx := context.Background()
+	if emails := GetEmails(ctx, tm.mb, tm.mb.config); len(emails) != 1 || emails[0].ID != "1:701" {
+		t.Fatalf("expected alice's email, got %+v", emails)
+	}
+
+	// only the email that arrived since the last list is looked at, even though the first one isn't cached
+	addMessage(tm.inbox(t), 702, time.Now(), `From: Bob <bob@example.com>
+To: me@example.com
+Subject: Lunch
+
+Lunch on Friday?
+`)
+	emails := GetNewEmails(ctx, tm.mb, tm.mb.config)
+	if len(emails) != 1 || emails[0].ID != "1:702" {
+		t.Fatalf("expected only bob's new email, got %+v", emails)
+	}
+	if emails := GetNewEmails(ctx, tm.mb, tm.mb.config); len(emails) != 0 {
+		t.Errorf("expected no new emails, got %+v", emails)
+	}
+}
+
+func TestIMAPInboxReset(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{Labels: config.Labels{Enabled: true}, LookbackDays: 7, EmailBatchLimit: 10})
+	addMessage(tm.inbox(t), 501, time.Now().Add(-time.Hour), simpleEmail)
+	ctx := context.Background()
+	emails := GetEmails(ctx, tm.mb, tm.mb.config)
+	if len(emails) != 1 || emails[0].ID != "1:501" {
+		t.Fatalf("expected alice's email, got %+v", emails)
+	}
+	emailcache.AddToCache(emails[0], emailcache.REPLY)
+
+	// the new inbox reuses the UID, for a different email
+	tm.resetInbox(t)
+	addMessage(tm.inbox(t), 501, time.Now(), `From: Bob <bob@example.com>
+To: me@example.com
+Subject: Lunch
+
+Lunch on Friday?
+`)
+	emails = GetEmails(ctx, tm.mb, tm.mb.config)
+	if len(emails) != 1 || emails[0].ID != "2:501" || emails[0].From != "bob@example.com" {
+		t.Fatalf("expected bob's new email, got %+v", emails)
+	}
+	if _, err := tm.mb.GetEmail(ctx, "1:501"); err == nil {
+		t.Error("expected an error getting an email from before the reset")
+	}
+	if err := tm.mb.MarkHandled(ctx, "1:501", types.REPLIED); err == nil {
+		t.Error("expected an error marking an email from before the reset")
+	}
+	if flags := tm.inbox(t).Messages[0].Flags; len(flags) != 0 {
+		t.Errorf("the new email shouldn't be labeled, got %v", flags)
+	}
+}
+
+func TestIMAPConnectionReuse(t *testing.T) {
+	tm := newTestMailbox(t, config.Config{Labels: config.Labels{Enabled: true}, LookbackDays: 7, EmailBatchLimit: 10})
+	for uid := uint32(601); uid <= 603; uid++ {
+		addMessage(tm.inbox(t), uid, time.Now(), simpleEmail)
+	}
+	ctx := context.Background()
+	if emails := GetEmails(ctx, tm.mb, tm.mb.config); len(emails) != 3 {
+		t.Fatalf("expected 3 emails, got %+v", emails)
+	}
+	if err := tm.mb.MarkHandled(ctx, "1:601", types.REPLIED); err != nil {
+		t.Fatal("failed to mark replied:", err)
+	}
+	if logins := tm.logins.Load(); logins != 1 {
+		t.Errorf("expected one login, got %v", logins)
+	}
+
+	// a call that's cancelled closes the connection, and the next call logs in again
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := tm.mb.GetEmail(cancelled, "1:602"); err == nil {
+		t.Error("expected an error with a cancelled context")
+	}
+	if _, err := tm.mb.GetEmail(ctx, "1:602"); err != nil {
+		t.Fatal("failed to get email after a cancelled call:", err)
+	}
+	if logins := tm.logins.Load(); logins != 2 {
+		t.Errorf("expected a second login after the connection was closed, got %v logins", logins)
+	}
+
+	// the same after the server drops the connection
+	tm.mb.conn.Terminate()
+	if _, err := tm.mb.GetEmail(ctx, "1:603"); err != nil {
+		t.Fatal("failed to get email after the connection was lost:", err)
+	}
+	if logins := tm.logins.Load(); logins != 3 {
+		t.Errorf("expected a third login after the connection was lost, got %v logins", logins)
+	}
+}
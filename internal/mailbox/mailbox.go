@@ -0,0 +1,150 @@
+package mailbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/webbben/mail-assistant/internal/auth"
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/message"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+// kinds of mailbox
+const (
+	GMAIL = "gmail"
+	IMAP  = "imap"
+)
+
+// Mailbox is the mail account the valet reads and sends mail through.
+// All of the assistant's mail access goes through this, so the mail provider can be swapped out in the config without code changes.
+//
+// Message IDs only mean something to the mailbox they came from: they're gmail message IDs, or UIDs in the imap inbox.
+// Each call is aborted if ctx is cancelled.
+type Mailbox interface {
+	// Lists the IDs of the messages in the inbox to look at, newest first.
+	List(ctx context.Context) ([]string, error)
+	// Lists the IDs of the messages that arrived in the inbox since the last List or ListNew call, newest first.
+	// The first call lists the whole inbox.
+	ListNew(ctx context.Context) ([]string, error)
+	// Gets the email with the given ID.
+	GetEmail(ctx context.Context, id string) (t.Email, error)
+	// Gets the raw RFC 5322 message with the given ID.
+	GetRaw(ctx context.Context, id string) (string, error)
+	// Downloads the content of one of the email's attachments.
+	GetAttachment(ctx context.Context, email t.Email, attachment t.Attachment) ([]byte, error)
+	// Gets the messages in the email's conversation, oldest first. Drafts aren't included, since they weren't sent.
+	Thread(ctx context.Context, email t.Email) ([]t.ThreadMessage, error)
+	// Sends the reply to the email.
+	SendReply(ctx context.Context, email t.Email, reply t.Reply) error
+	// Saves the reply to the email as a draft, instead of sending it. Returns the ID of the draft.
+	CreateDraft(ctx context.Context, email t.Email, reply t.Reply) (string, error)
+	// Sends a new email, which isn't a reply to another one.
+	SendEmail(ctx context.Context, email t.NewEmail) error
+	// Saves a new email as a draft, instead of sending it. Returns the ID of the draft.
+	CreateEmailDraft(ctx context.Context, email t.NewEmail) (string, error)
+	// Forwards the email.
+	Forward(ctx context.Context, email t.Email, fwd t.Forward) error
+	// Saves a forward of the email as a draft, instead of sending it. Returns the ID of the draft.
+	CreateForwardDraft(ctx context.Context, email t.Email, fwd t.Forward) (string, error)
+	// Shows how the valet handled the email (e.g. t.REPLIED) with the configured label, and marks it as read and/or
+	// archives it if that's enabled in the config. Does nothing if labels aren't enabled.
+	MarkHandled(ctx context.Context, id string, action string) error
+	// Adds the emails MarkHandled has labeled to the email cache, e.g. when the cache file was lost. Returns how many were added.
+	RebuildCache(ctx context.Context) (int, error)
+}
+
+// creates the mailbox selected in the app config. If no provider is set, gmail is used.
+func New(c config.Config) (Mailbox, error) {
+	switch c.Mailbox.Provider {
+	case "", GMAIL:
+		return NewGmail(auth.GetGmailService(), c), nil
+	case IMAP:
+		return NewIMAP(c)
+	}
+	return nil, fmt.Errorf("unknown mailbox provider: %q", c.Mailbox.Provider)
+}
+
+// Gets the emails in the inbox that need looking at, up to the batch limit. Stops early if the context is cancelled.
+// Each call to the mailbox is limited to the configured timeout.
+//
+// Emails that are already in the cache, sent by the user, or from before the lookback period are skipped.
+// Junk emails (spam, bulk mail, etc) are cached as ignored and labeled, without the user seeing them.
+func GetEmails(ctx context.Context, mb Mailbox, config config.Config) []t.Email {
+	debug.Println("getting emails...")
+	emails := []t.Email{}
+	listCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+	list, err := mb.List(listCtx)
+	cancel()
+	if err != nil {
+		log.Println("failed to list inbox:", err)
+		return emails
+	}
+	return filterEmails(ctx, mb, config, list)
+}
+
+// Same as GetEmails, but only looks at the emails that arrived since the inbox was last listed.
+// e.g. to check for new mail without fetching and checking the whole inbox again.
+func GetNewEmails(ctx context.Context, mb Mailbox, config config.Config) []t.Email {
+	listCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+	list, err := mb.ListNew(listCtx)
+	cancel()
+	if err != nil {
+		log.Println("failed to list new mail:", err)
+		return []t.Email{}
+	}
+	return filterEmails(ctx, mb, config, list)
+}
+
+// gets the emails with the given IDs that need looking at, leaving out cached, own, old and junk emails as described in GetEmails
+func filterEmails(ctx context.Context, mb Mailbox, config config.Config, list []string) []t.Email {
+	emails := []t.Email{}
+	if len(list) == 0 {
+		debug.Println("No emails found.")
+		return emails
+	}
+	for _, msgID := range list {
+		if len(emails) >= config.EmailBatchLimit {
+			break
+		}
+		if ctx.Err() != nil {
+			debug.Println("stopped getting emails:", ctx.Err())
+			break
+		}
+		if _, isCached := emailcache.IsCached(msgID); isCached {
+			continue
+		}
+		msgCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+		email, err := mb.GetEmail(msgCtx, msgID)
+		cancel()
+		if err != nil {
+			debug.Println("failed to process email:", err)
+			continue
+		}
+		// ignore messages that are from ourself, from any of our addresses
+		if message.IsOwnAddress(email.From, config.OwnAddresses()) {
+			continue
+		}
+		if message.IsEmailTooOld(email, config) {
+			debug.Println("email too old:", email.Date, email.From)
+			emailcache.AddToCache(email, emailcache.IGNORE, message.OLD)
+			break
+		}
+		if junk, reasons := message.IsJunk(email, config.SpamThreshold); junk {
+			emailcache.AddToCache(email, emailcache.IGNORE, reasons...)
+			labelCtx, cancel := util.WithTimeout(ctx, config.MailTimeout())
+			if err := mb.MarkHandled(labelCtx, email.ID, t.FILTERED); err != nil {
+				debug.Println("failed to label email:", err)
+			}
+			cancel()
+			continue
+		}
+		emails = append(emails, email)
+	}
+	debug.Println("... done!")
+	return emails
+}
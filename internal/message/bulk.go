@@ -0,0 +1,112 @@
+package message
+
+import (
+	"strings"
+
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// emails scoring at least this much on the bulk mail signals are treated as bulk mail
+const BulkThreshold = 5
+
+// a bulk mail signal found in an email's headers or labels, and how much it counts towards the bulk score
+type bulkSignal struct {
+	reason string
+	score  int
+}
+
+// headers that bulk email services (ESPs) add to the mail they send.
+// value is a lowercase substring the header must contain, or empty if the header being present is enough.
+var espFingerprints = []struct {
+	name   string
+	header string
+	value  string
+}{
+	{"mailchimp", "X-MC-User", ""},
+	{"mailchimp", "X-Mailer", "mailchimp"},
+	{"mandrill", "X-Mandrill-User", ""},
+	{"sendgrid", "X-SG-EID", ""},
+	{"mailgun", "X-Mailgun-Sid", ""},
+	{"amazonses", "X-SES-Outgoing", ""},
+	{"sparkpost", "X-MSFBL", ""},
+	{"postmark", "X-PM-Message-Id", ""},
+	{"salesforce", "X-SFMC-Stack", ""},
+	{"constantcontact", "X-Roving-Id", ""},
+	{"campaignmonitor", "X-Mailer", "campaign monitor"},
+	{"feedback-id", "Feedback-ID", ""},
+}
+
+// the result of checking an email for bulk mail signals
+type BulkVerdict struct {
+	Score   int
+	Reasons []string // the signals that were found. these have no spaces, so they can be saved as email cache categories.
+}
+
+// returns true if the email scored high enough to be treated as bulk mail
+func (v BulkVerdict) IsBulk() bool {
+	return v.Score >= BulkThreshold
+}
+
+// Checks the email's headers and gmail labels for signs of bulk mail (newsletters, promotions, automated notifications, etc).
+// This is deterministic and cheap, so it runs before any model is asked if an email is spam.
+func DetectBulk(email t.Email) BulkVerdict {
+	verdict := BulkVerdict{}
+	for _, signal := range bulkSignals(email) {
+		verdict.Score += signal.score
+		verdict.Reasons = append(verdict.Reasons, signal.reason)
+	}
+	return verdict
+}
+
+func bulkSignals(email t.Email) []bulkSignal {
+	signals := []bulkSignal{}
+	if _, ok := getHeader(email, "List-Unsubscribe"); ok {
+		signals = append(signals, bulkSignal{"list-unsubscribe", 3})
+	}
+	if _, ok := getHeader(email, "List-Id"); ok {
+		signals = append(signals, bulkSignal{"list-id", 3})
+	}
+	if precedence, ok := getHeader(email, "Precedence"); ok {
+		precedence = strings.ToLower(strings.TrimSpace(precedence))
+		if precedence == "bulk" || precedence == "list" || precedence == "junk" {
+			signals = append(signals, bulkSignal{"precedence=" + precedence, 4})
+		}
+	}
+	// "no" means the email was written by a person; anything else (auto-generated, auto-replied) is automated
+	if autoSubmitted, ok := getHeader(email, "Auto-Submitted"); ok && strings.ToLower(strings.TrimSpace(autoSubmitted)) != "no" {
+		signals = append(signals, bulkSignal{"auto-submitted", 4})
+	}
+	if _, ok := getHeader(email, "X-Auto-Response-Suppress"); ok {
+		signals = append(signals, bulkSignal{"auto-response-suppress", 2})
+	}
+	for _, esp := range espFingerprints {
+		value, ok := getHeader(email, esp.header)
+		if ok && strings.Contains(strings.ToLower(value), esp.value) {
+			// one ESP is enough; more than one doesn't make it any more likely
+			signals = append(signals, bulkSignal{"esp=" + esp.name, 2})
+			break
+		}
+	}
+	for _, label := range email.LabelIDs {
+		switch label {
+		case "CATEGORY_PROMOTIONS":
+			signals = append(signals, bulkSignal{"label=promotions", 5})
+		case "CATEGORY_SOCIAL":
+			signals = append(signals, bulkSignal{"label=social", 3})
+		}
+	}
+	return signals
+}
+
+// gets the first value of the given header. header names are case-insensitive.
+func getHeader(email t.Email, name string) (string, bool) {
+	if values, ok := email.Headers[name]; ok && len(values) > 0 {
+		return values[0], true
+	}
+	for k, values := range email.Headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,78 @@
+package message
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/webbben/mail-assistant/internal/types"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+)
+
+// loads a raw email from tests/bulk and parses it like ParseRaw does
+func loadBulkTestEmail(t *testing.T, filename string, labels ...string) types.Email {
+	bytes, err := os.ReadFile("tests/bulk/" + filename)
+	if err != nil {
+		t.Fatal("failed to load test email:", err)
+	}
+	body, headers, err := emailparse.ParseEmail(string(bytes))
+	if err != nil {
+		t.Fatal("failed to parse test email:", err)
+	}
+	from, sender := ExtractEmailAndName(headers["From"][0])
+	return types.Email{From: from, SenderName: sender, Body: body, Headers: headers, LabelIDs: labels}
+}
+
+func TestDetectBulk(t *testing.T) {
+	tests := []struct {
+		email      types.Email
+		expBulk    bool
+		expReasons []string
+	}{
+		{loadBulkTestEmail(t, "newsletter.txt"), true, []string{"list-unsubscribe", "precedence=bulk", "esp=mailchimp"}},
+		{loadBulkTestEmail(t, "personal.txt"), false, nil},
+		{loadBulkTestEmail(t, "personal.txt", "INBOX", "CATEGORY_PERSONAL"), false, nil},
+		{loadBulkTestEmail(t, "autoreply.txt"), true, []string{"auto-submitted", "auto-response-suppress"}},
+		{loadBulkTestEmail(t, "personal.txt", "INBOX", "CATEGORY_PROMOTIONS"), true, []string{"label=promotions"}},
+		{loadBulkTestEmail(t, "personal.txt", "CATEGORY_SOCIAL"), false, []string{"label=social"}},
+		{types.Email{Headers: map[string][]string{"List-Id": {"<tofu.lists.example.com>"}, "Precedence": {"list"}}}, true, []string{"list-id", "precedence=list"}},
+		{types.Email{Headers: map[string][]string{"Auto-Submitted": {"no"}}}, false, nil},
+		{types.Email{Headers: map[string][]string{"x-mailer": {"Campaign Monitor 2.0"}}}, false, []string{"esp=campaignmonitor"}},
+		{types.Email{Headers: map[string][]string{"X-Mailer": {"Apple Mail (2.3731)"}}}, false, nil},
+	}
+
+	for i, test := range tests {
+		verdict := DetectBulk(test.email)
+		if verdict.IsBulk() != test.expBulk {
+			t.Errorf("case %v, expected bulk: %v, got: %v (score %v, reasons %v)", i, test.expBulk, verdict.IsBulk(), verdict.Score, verdict.Reasons)
+		}
+		for _, reason := range test.expReasons {
+			if !slices.Contains(verdict.Reasons, reason) {
+				t.Errorf("case %v, missing reason %q in %v", i, reason, verdict.Reasons)
+			}
+		}
+		if test.expReasons == nil && len(verdict.Reasons) > 0 {
+			t.Errorf("case %v, expected no reasons, but got %v", i, verdict.Reasons)
+		}
+	}
+}
+
+func TestIsJunk(t *testing.T) {
+	tests := []struct {
+		email         types.Email
+		expJunk       bool
+		expCategories []string
+	}{
+		{types.Email{From: "tom.squeaks@gmail.com"}, true, []string{BAD_FORM}},
+		{types.Email{From: "no-reply@bank.com", Body: "Your statement is ready."}, true, []string{NOREPLY}},
+		{loadBulkTestEmail(t, "newsletter.txt"), true, []string{BULK, "list-unsubscribe", "precedence=bulk", "esp=mailchimp"}},
+		{loadBulkTestEmail(t, "personal.txt"), false, nil},
+	}
+
+	for i, test := range tests {
+		junk, categories := IsJunk(test.email, 0)
+		if junk != test.expJunk || !slices.Equal(categories, test.expCategories) {
+			t.Errorf("case %v, expected: %v %v, got: %v %v", i, test.expJunk, test.expCategories, junk, categories)
+		}
+	}
+}
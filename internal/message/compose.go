@@ -0,0 +1,30 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// Builds the raw message for a new email sent now from the given address, like RawReply.
+func RawEmail(from string, email t.NewEmail) ([]byte, error) {
+	return buildEmail(from, email, time.Now(), newMessageID(from))
+}
+
+// Builds the raw RFC 5322 message for a new email. It's written the same way as replies, just without the threading headers or a quote.
+func buildEmail(from string, email t.NewEmail, date time.Time, messageID string) ([]byte, error) {
+	if len(email.To) == 0 || from == "" {
+		return nil, errors.New("failed to create email; missing required email properties")
+	}
+	headers := messageHeaders(from, email.To, email.Cc, email.Subject, date, messageID)
+	headers = append(headers, header{"MIME-Version", "1.0"})
+
+	var buf bytes.Buffer
+	body := t.Reply{Body: email.Body, Style: email.Style}
+	if err := writeReplyBody(&buf, headers, t.Email{}, body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,163 @@
+package message
+
+import (
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	t "github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/util"
+)
+
+const defaultAttribution = "On <<DATE>>, <<SENDER>> wrote:"
+
+// format of the date in the quote attribution, e.g. "Mon, Jul 1, 2024 at 9:30 AM"
+const attributionDateFormat = "Mon, Jan 2, 2006 at 3:04 PM"
+
+// styles for the quote block in the HTML version, like most mail clients use
+const quoteStyle = "margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex"
+
+// gets the line introducing the quote of the original message, e.g. "On Mon, Jul 1, 2024 at 9:30 AM, Bob <bob@example.com> wrote:"
+func attribution(original t.Email, style t.ReplyStyle) string {
+	format := style.Attribution
+	if format == "" {
+		format = defaultAttribution
+	}
+	sender := original.From
+	if original.SenderName != "" {
+		sender = original.SenderName + " <" + original.From + ">"
+	}
+	date := ""
+	if !original.Date.IsZero() {
+		date = original.Date.Local().Format(attributionDateFormat)
+	}
+	return util.InsertMappedValues(format, map[string]string{"date": date, "sender": sender})
+}
+
+// returns true if the reply should quote the original message
+func hasQuote(original t.Email, style t.ReplyStyle) bool {
+	return !style.NoQuote && strings.TrimSpace(original.Body) != ""
+}
+
+// renders the plain text version of the reply: the body, then the original message quoted with "> "
+func plainTextReply(original t.Email, reply t.Reply) string {
+	text := strings.ReplaceAll(reply.Body, "\r\n", "\n")
+	if !hasQuote(original, reply.Style) {
+		return text
+	}
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(original.Body, "\r\n", "\n")), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else if line == "" {
+			lines[i] = ">"
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.TrimRight(text, "\n") + "\n\n" + attribution(original, reply.Style) + "\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// renders the HTML version of the reply: the body in paragraphs, then the original message in a quote block
+func htmlReply(original t.Email, reply t.Reply) string {
+	var b strings.Builder
+	b.WriteString("<html>\n<body>\n")
+	b.WriteString(textToHTML(reply.Body))
+	if hasQuote(original, reply.Style) {
+		b.WriteString("<div class=\"quote\">\n<div>" + html.EscapeString(attribution(original, reply.Style)) + "</div>\n")
+		b.WriteString("<blockquote style=\"" + quoteStyle + "\">\n")
+		b.WriteString(textToHTML(original.Body))
+		b.WriteString("</blockquote>\n</div>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+// converts plain text to simple HTML. blank lines separate paragraphs, and other line breaks are kept with <br>.
+func textToHTML(text string) string {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	var b strings.Builder
+	for _, para := range strings.Split(text, "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		lines := strings.Split(para, "\n")
+		for i, line := range lines {
+			lines[i] = html.EscapeString(line)
+		}
+		b.WriteString("<p>" + strings.Join(lines, "<br>\n") + "</p>\n")
+	}
+	return b.String()
+}
+
+// writes the headers in order, then the blank line that ends them
+func writeHeaders(w io.Writer, headers []header) error {
+	for _, h := range headers {
+		if _, err := io.WriteString(w, h.key+": "+h.value+"\r\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// gets the Content-Type of a multipart body. it's folded, so the long boundary doesn't make an overly long line.
+func multipartType(mediaType string, boundary string) string {
+	return strings.Replace(mime.FormatMediaType(mediaType, map[string]string{"boundary": boundary}), "; ", ";\r\n ", 1)
+}
+
+// writes the text with quoted-printable encoding
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Writes the body of the reply, after the given headers. With an HTML version, the body is multipart/alternative,
+// with the plain text and HTML versions as its parts; otherwise it's just the plain text.
+// Both are encoded as UTF-8 quoted-printable.
+func writeReplyBody(w io.Writer, headers []header, original t.Email, reply t.Reply) error {
+	plain := plainTextReply(original, reply)
+	if reply.Style.PlainOnly {
+		headers = append(headers,
+			header{"Content-Type", `text/plain; charset="utf-8"`},
+			header{"Content-Transfer-Encoding", "quoted-printable"},
+		)
+		if err := writeHeaders(w, headers); err != nil {
+			return err
+		}
+		return writeQuotedPrintable(w, plain)
+	}
+
+	mw := textproto.NewMultipartWriter(w)
+	contentType := multipartType("multipart/alternative", mw.Boundary())
+	if err := writeHeaders(w, append(headers, header{"Content-Type", contentType})); err != nil {
+		return err
+	}
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{`text/plain; charset="utf-8"`, plain},
+		{`text/html; charset="utf-8"`, htmlReply(original, reply)},
+	}
+	for _, part := range parts {
+		var h textproto.Header
+		h.Set("Content-Type", part.contentType)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if err := writeQuotedPrintable(pw, part.content); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,111 @@
+package message
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+var quotedOriginal = types.Email{
+	From:       "bob@example.com",
+	SenderName: "Bob",
+	Subject:    "Lunch",
+	Body:       "Are you free for lunch?\n\n> earlier: maybe Friday\nThanks & see you",
+	Date:       time.Date(2024, 7, 1, 9, 30, 0, 0, time.Local),
+}
+
+func TestAttribution(t *testing.T) {
+	tests := []struct {
+		original types.Email
+		style    types.ReplyStyle
+		want     string
+	}{
+		{quotedOriginal, types.ReplyStyle{}, "On Mon, Jul 1, 2024 at 9:30 AM, Bob <bob@example.com> wrote:"},
+		{types.Email{From: "carol@example.com"}, types.ReplyStyle{}, "On , carol@example.com wrote:"},
+		{quotedOriginal, types.ReplyStyle{Attribution: "<<SENDER>> penned on <<DATE>>:"}, "Bob <bob@example.com> penned on Mon, Jul 1, 2024 at 9:30 AM:"},
+	}
+	for _, test := range tests {
+		if got := attribution(test.original, test.style); got != test.want {
+			t.Errorf("expected %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestPlainTextReply(t *testing.T) {
+	reply := types.Reply{Body: "Yes, noon works.\n"}
+	want := "Yes, noon works.\n\n" +
+		"On Mon, Jul 1, 2024 at 9:30 AM, Bob <bob@example.com> wrote:\n" +
+		"> Are you free for lunch?\n" +
+		">\n" +
+		">> earlier: maybe Friday\n" +
+		"> Thanks & see you\n"
+	if got := plainTextReply(quotedOriginal, reply); got != want {
+		t.Errorf("unexpected plain text reply.\nexpected: %q\ngot: %q", want, got)
+	}
+	reply.Style.NoQuote = true
+	if got := plainTextReply(quotedOriginal, reply); got != reply.Body {
+		t.Errorf("expected just the body without a quote, got %q", got)
+	}
+}
+
+func TestTextToHTML(t *testing.T) {
+	got := textToHTML("Dear Bob,\n\nNoon works <for me> & Alice.\nSee you then.\n")
+	want := "<p>Dear Bob,</p>\n<p>Noon works &lt;for me&gt; &amp; Alice.<br>\nSee you then.</p>\n"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestBuildReplyAlternative(t *testing.T) {
+	reply := NewReply(quotedOriginal, "Yes, noon works. À bientôt!", false, nil)
+	raw, err := buildReply(quotedOriginal, "me@example.com", reply, time.Now(), "<reply@example.com>")
+	if err != nil {
+		t.Fatal("failed to build reply:", err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line too long (%v chars): %q", len(line), line)
+		}
+	}
+	entity, err := message.Read(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal("failed to read reply:", err)
+	}
+	mediaType, _, _ := entity.Header.ContentType()
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %s", mediaType)
+	}
+	parts := map[string]string{}
+	mr := entity.MultipartReader()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("failed to read part:", err)
+		}
+		partType, _, _ := part.Header.ContentType()
+		body, _ := io.ReadAll(part.Body)
+		// quoted-printable text has CRLF line breaks
+		parts[partType] = strings.ReplaceAll(string(body), "\r\n", "\n")
+	}
+	if parts["text/plain"] != plainTextReply(quotedOriginal, reply) {
+		t.Errorf("unexpected plain text part: %q", parts["text/plain"])
+	}
+	html := parts["text/html"]
+	for _, want := range []string{
+		"<p>Yes, noon works. À bientôt!</p>",
+		"On Mon, Jul 1, 2024 at 9:30 AM, Bob &lt;bob@example.com&gt; wrote:",
+		"<blockquote",
+		"<p>&gt; earlier: maybe Friday<br>\nThanks &amp; see you</p>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected the html part to contain %q, got:\n%s", want, html)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// matches the forward prefixes at the start of a subject, like "Fwd: ", "FW: " or "WG: " (German mail clients)
+var forwardPrefixPattern = regexp.MustCompile(`^(?i)\s*((fwd?|wg)\s*:\s*)+`)
+
+// line introducing the original message in an inline forward, the same as gmail uses
+const forwardedSeparator = "---------- Forwarded message ---------"
+
+// Builds the raw message for a forward sent now from the given address, like RawReply.
+// rawOriginal is the original message to attach; it's not needed for an inline forward.
+func RawForward(original t.Email, rawOriginal string, from string, fwd t.Forward) ([]byte, error) {
+	return buildForward(original, rawOriginal, from, fwd, time.Now(), newMessageID(from))
+}
+
+// gets the subject for a forward, without stacking up prefixes like "Fwd: Fwd: "
+func forwardSubject(subject string) string {
+	return "Fwd: " + forwardPrefixPattern.ReplaceAllString(subject, "")
+}
+
+// Builds the raw RFC 5322 message forwarding the email. It refers to the original with In-Reply-To and References, like a reply,
+// so mail clients keep it in the same conversation.
+//
+// The cover note is written the same way as a reply's body. An inline forward adds the original's headers and text below the note;
+// otherwise the whole original message (rawOriginal) is attached as message/rfc822, which keeps its attachments and formatting.
+func buildForward(original t.Email, rawOriginal string, from string, fwd t.Forward, date time.Time, messageID string) ([]byte, error) {
+	if len(fwd.To) == 0 || from == "" {
+		return nil, errors.New("failed to create forward; missing required email properties")
+	}
+	if !fwd.Inline && rawOriginal == "" {
+		return nil, errors.New("failed to create forward; the original message is missing")
+	}
+	headers := messageHeaders(from, fwd.To, nil, forwardSubject(original.Subject), date, messageID)
+	if original.MessageID != "" {
+		headers = append(headers, header{"In-Reply-To", original.MessageID})
+	}
+	if refs := replyReferences(original); len(refs) > 0 {
+		headers = append(headers, header{"References", strings.Join(refs, "\r\n ")})
+	}
+	headers = append(headers, header{"MIME-Version", "1.0"})
+
+	var buf bytes.Buffer
+	if fwd.Inline {
+		body := strings.TrimRight(fwd.Note, "\n") + "\n\n" + forwardedText(original)
+		if err := writeReplyBody(&buf, headers, t.Email{}, t.Reply{Body: body, Style: fwd.Style}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := textproto.NewMultipartWriter(&buf)
+	if err := writeHeaders(&buf, append(headers, header{"Content-Type", multipartType("multipart/mixed", mw.Boundary())})); err != nil {
+		return nil, err
+	}
+	// the note is written like a reply's body, then its headers are read back for the part
+	var note bytes.Buffer
+	if err := writeReplyBody(&note, nil, t.Email{}, t.Reply{Body: fwd.Note, Style: fwd.Style}); err != nil {
+		return nil, err
+	}
+	noteReader := bufio.NewReader(&note)
+	noteHeader, err := textproto.ReadHeader(noteReader)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := mw.CreatePart(noteHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(pw, noteReader); err != nil {
+		return nil, err
+	}
+
+	var h textproto.Header
+	h.Set("Content-Type", "message/rfc822")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": forwardFilename(original.Subject)}))
+	pw, err = mw.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	rawOriginal = strings.ReplaceAll(strings.ReplaceAll(rawOriginal, "\r\n", "\n"), "\n", "\r\n")
+	if _, err := io.WriteString(pw, rawOriginal); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renders the original message for an inline forward: its headers, like gmail shows them, then its text
+func forwardedText(original t.Email) string {
+	sender := original.From
+	if original.SenderName != "" {
+		sender = original.SenderName + " <" + original.From + ">"
+	}
+	lines := []string{forwardedSeparator, "From: " + sender}
+	if !original.Date.IsZero() {
+		lines = append(lines, "Date: "+original.Date.Local().Format(attributionDateFormat))
+	}
+	lines = append(lines, "Subject: "+original.Subject)
+	if len(original.To) > 0 {
+		lines = append(lines, "To: "+strings.Join(original.To, ", "))
+	}
+	if len(original.Cc) > 0 {
+		lines = append(lines, "Cc: "+strings.Join(original.Cc, ", "))
+	}
+	return strings.Join(lines, "\n") + "\n\n" + strings.TrimSpace(strings.ReplaceAll(original.Body, "\r\n", "\n")) + "\n"
+}
+
+// gets the filename of the attached original message, from its subject
+func forwardFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if name == "" {
+		return "forwarded-email.eml"
+	}
+	return name + ".eml"
+}
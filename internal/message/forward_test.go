@@ -0,0 +1,48 @@
+package message
+
+import "testing"
+
+func TestForwardSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Hamu project", "Fwd: Hamu project"},
+		{"Fwd: Hamu project", "Fwd: Hamu project"},
+		{"FW: fwd:Hamu project", "Fwd: Hamu project"},
+		{"Re: Hamu project", "Fwd: Re: Hamu project"},
+		{"", "Fwd: "},
+	}
+	for _, test := range tests {
+		if got := forwardSubject(test.subject); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.subject, test.want, got)
+		}
+	}
+}
+
+func TestForwardedText(t *testing.T) {
+	original := quotedOriginal
+	original.To = []string{"me@example.com"}
+	want := "---------- Forwarded message ---------\n" +
+		"From: Bob <bob@example.com>\n" +
+		"Date: Mon, Jul 1, 2024 at 9:30 AM\n" +
+		"Subject: Lunch\n" +
+		"To: me@example.com\n\n" +
+		"Are you free for lunch?\n\n> earlier: maybe Friday\nThanks & see you\n"
+	if got := forwardedText(original); got != want {
+		t.Errorf("unexpected forwarded text.\nexpected: %q\ngot: %q", want, got)
+	}
+}
+
+func TestForwardFilename(t *testing.T) {
+	tests := map[string]string{
+		"Hamu project": "Hamu project.eml",
+		"Re: a/b":      "Re_ a_b.eml",
+		"  ":           "forwarded-email.eml",
+	}
+	for subject, want := range tests {
+		if got := forwardFilename(subject); got != want {
+			t.Errorf("%q: expected %q, got %q", subject, want, got)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+	"github.com/webbben/mail-assistant/internal/spamfilter"
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// reasons an email is ignored without asking the user, which are saved as its email cache categories
+const (
+	SPAM     = "SPAM"
+	BAD_FORM = "BAD_FORM"
+	NOREPLY  = "NOREPLY"
+	OLD      = "OLD"
+	BULK     = "BULK"
+)
+
+// Determines if the given email is junk or unwanted, and if so, gives categories for why it is unwanted.
+// emails the spam filter gives at least spamThreshold probability of being spam are junk; 0 turns the spam filter off.
+func IsJunk(email t.Email, spamThreshold float64) (bool, []string) {
+	if len(email.Body) == 0 {
+		debug.Println("empty email:", email.From)
+		return true, []string{BAD_FORM}
+	}
+	if isEmailNoReply(email) {
+		debug.Println("no reply email:", email.From)
+		return true, []string{NOREPLY}
+	}
+	if verdict := DetectBulk(email); verdict.IsBulk() {
+		debug.Println("bulk email:", email.From, verdict.Score, verdict.Reasons)
+		return true, append([]string{BULK}, verdict.Reasons...)
+	}
+	if spamThreshold > 0 {
+		if p, ok := spamfilter.SpamProbability(email); ok && p >= spamThreshold {
+			debug.Printf("spam email (p=%.2f): %s %s\n", p, email.From, email.Snippet)
+			return true, []string{SPAM, fmt.Sprintf("p=%.2f", p)}
+		}
+	}
+	return false, nil
+}
+
+// returns true if the email is from before the configured lookback period
+func IsEmailTooOld(email t.Email, config config.Config) bool {
+	if config.LookbackDays == 0 {
+		return false
+	}
+	// email date is unset or at the "zero" value, so invalid to compare
+	if email.Date.Equal(time.Time{}) {
+		return false
+	}
+	return email.Date.Before(time.Now().Add((-24 * time.Hour) * time.Duration(config.LookbackDays)))
+}
+
+func isEmailNoReply(email t.Email) bool {
+	sender := strings.ToLower(email.From)
+	return strings.Contains(sender, "noreply") || strings.Contains(sender, "no-reply") || strings.Contains(sender, "donotreply") || strings.Contains(sender, "do-not-reply")
+}
@@ -0,0 +1,64 @@
+package message
+
+import (
+	"github.com/webbben/mail-assistant/internal/config"
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// default names of the labels (or imap keywords) for each way of handling an email
+const (
+	DefaultRepliedLabel     = "Valet/Replied"
+	DefaultIgnoredLabel     = "Valet/Ignored"
+	DefaultAutoRepliedLabel = "Valet/AutoReplied"
+	DefaultDraftedLabel     = "Valet/Drafted"
+	DefaultForwardedLabel   = "Valet/Forwarded"
+)
+
+// the actions whose labels the cache can be rebuilt from. filtered emails share the ignored label.
+var RestorableActions = []string{t.REPLIED, t.AUTO_REPLIED, t.IGNORED, t.DRAFTED, t.FORWARDED}
+
+// Gets the name of the label for the given way of handling an email. Returns an empty string for an unknown action.
+func LabelName(c config.Labels, action string) string {
+	switch action {
+	case t.REPLIED:
+		if c.Replied != "" {
+			return c.Replied
+		}
+		return DefaultRepliedLabel
+	case t.AUTO_REPLIED:
+		if c.AutoReplied != "" {
+			return c.AutoReplied
+		}
+		return DefaultAutoRepliedLabel
+	case t.IGNORED, t.FILTERED:
+		if c.Ignored != "" {
+			return c.Ignored
+		}
+		return DefaultIgnoredLabel
+	case t.DRAFTED:
+		if c.Drafted != "" {
+			return c.Drafted
+		}
+		return DefaultDraftedLabel
+	case t.FORWARDED:
+		if c.Forwarded != "" {
+			return c.Forwarded
+		}
+		return DefaultForwardedLabel
+	}
+	return ""
+}
+
+// gets the cache action and categories an email labeled for the action is restored to the cache with
+func RestoredCacheAction(action string) (string, []string) {
+	switch action {
+	case t.IGNORED:
+		return emailcache.IGNORE, []string{"RESTORED"}
+	case t.DRAFTED:
+		return emailcache.DRAFT, []string{"RESTORED"}
+	case t.FORWARDED:
+		return emailcache.FORWARD, []string{"RESTORED"}
+	}
+	return emailcache.REPLY, []string{"RESTORED", action}
+}
@@ -0,0 +1,54 @@
+package message
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	t "github.com/webbben/mail-assistant/internal/types"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+)
+
+// Parses the raw RFC 5322 message into an email: its sender, subject, text, headers, reply info and attachments.
+// The mailbox specific fields (ID, thread, labels, etc) are left for the caller to fill in.
+func ParseRaw(raw string) (t.Email, error) {
+	body, headers, err := emailparse.ParseEmail(raw)
+	if err != nil {
+		return t.Email{}, err
+	}
+	email := t.Email{Body: body, Headers: headers}
+	email.From, email.SenderName = ExtractEmailAndName(headerValue(email, "From"))
+	email.Subject = headerValue(email, "Subject")
+	setReplyInfo(&email)
+	attachments, err := emailparse.ParseAttachments(raw)
+	if err != nil {
+		// the email can still be read without them
+		log.Println("failed to parse attachments:", err)
+	}
+	email.Attachments = attachments
+	return email, nil
+}
+
+// To and From headers may be formatted as "First Last <email.addr@gmail.com>". This extracts the email address and name.
+//
+// Returns: (emailAddress, Name)
+func ExtractEmailAndName(emailAddrHeader string) (string, string) {
+	if emailAddrHeader == "" {
+		return "", ""
+	}
+	// see if there's a name
+	name := ""
+	pieces := strings.Split(emailAddrHeader, "<")
+	if len(pieces) > 1 {
+		name = strings.TrimSpace(pieces[0])
+	}
+	// regex pattern for email addresses
+	pattern := `(?i)([a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,})`
+	re := regexp.MustCompile(pattern)
+	matches := re.FindStringSubmatch(emailAddrHeader)
+	if len(matches) > 0 {
+		return matches[0], name
+	}
+	// ... no email address found?
+	return "", ""
+}
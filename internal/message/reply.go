@@ -0,0 +1,203 @@
+package message
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// matches the reply prefixes at the start of a subject, like "Re: ", "RE: Re: " or "Aw: " (German mail clients)
+var replyPrefixPattern = regexp.MustCompile(`^(?i)\s*((re|aw|sv)(\[\d+\])?\s*:\s*)+`)
+
+// matches each message ID in a Message-ID, In-Reply-To or References header
+var msgIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// a header of an outgoing email. headers are kept in a list, so they're always written in the same order.
+type header struct {
+	key   string
+	value string
+}
+
+// Fills in the email's reply info from its headers: its Message-ID, the References chain of the conversation, and the Reply-To address.
+func setReplyInfo(email *t.Email) {
+	if ids := parseMsgIDs(headerValue(*email, "Message-ID")); len(ids) > 0 {
+		email.MessageID = ids[0]
+	}
+	// RFC 5322 3.6.4: if there are no References, the parent's In-Reply-To (a single message ID) starts the chain instead
+	email.References = parseMsgIDs(headerValue(*email, "References"))
+	if len(email.References) == 0 {
+		if ids := parseMsgIDs(headerValue(*email, "In-Reply-To")); len(ids) == 1 {
+			email.References = ids
+		}
+	}
+	if replyTo := headerValue(*email, "Reply-To"); replyTo != "" {
+		email.ReplyTo, _ = ExtractEmailAndName(replyTo)
+	}
+	email.To = parseAddressList(headerValue(*email, "To"))
+	email.Cc = parseAddressList(headerValue(*email, "Cc"))
+}
+
+var addressPattern = regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}`)
+
+// gets the addresses in an address list header, like To or Cc. If the list isn't valid, any addresses found in it are used.
+func parseAddressList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	addrs := []string{}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return addressPattern.FindAllString(value, -1)
+	}
+	for _, addr := range list {
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs
+}
+
+// gets the header's value, or an empty string if it's not set
+func headerValue(email t.Email, name string) string {
+	value, _ := getHeader(email, name)
+	return value
+}
+
+// gets the message IDs in a header, with their angle brackets
+func parseMsgIDs(value string) []string {
+	return msgIDPattern.FindAllString(value, -1)
+}
+
+// gets the subject for a reply, without stacking up prefixes like "Re: Re: "
+func replySubject(subject string) string {
+	return "Re: " + replyPrefixPattern.ReplaceAllString(subject, "")
+}
+
+// Gets who a reply should go to: the Reply-To address if there is one, otherwise the sender.
+// The sender's name is only used when replying to the sender's own address.
+func replyRecipient(email t.Email) *mail.Address {
+	if email.ReplyTo != "" && !strings.EqualFold(email.ReplyTo, email.From) {
+		return &mail.Address{Address: email.ReplyTo}
+	}
+	return &mail.Address{Name: email.SenderName, Address: email.From}
+}
+
+// Addresses a reply to the email. It goes to the sender (or their Reply-To address), and if replyAll is set,
+// everyone else the email was sent to as well. The user's own addresses are never included, so they don't get a copy of their own reply.
+func NewReply(original t.Email, body string, replyAll bool, ownAddrs []string) t.Reply {
+	seen := make(map[string]bool)
+	for _, addr := range ownAddrs {
+		seen[strings.ToLower(addr)] = true
+	}
+	add := func(list []*mail.Address, addr *mail.Address) []*mail.Address {
+		key := strings.ToLower(addr.Address)
+		if key == "" || seen[key] {
+			return list
+		}
+		seen[key] = true
+		return append(list, addr)
+	}
+	reply := t.Reply{Body: body}
+	reply.To = add(reply.To, replyRecipient(original))
+	if replyAll {
+		for _, addr := range original.To {
+			reply.To = add(reply.To, &mail.Address{Address: addr})
+		}
+		for _, addr := range original.Cc {
+			reply.Cc = add(reply.Cc, &mail.Address{Address: addr})
+		}
+	}
+	// e.g. replying to an email the user sent themselves; it goes to whoever else was on it
+	if len(reply.To) == 0 {
+		reply.To, reply.Cc = reply.Cc, nil
+	}
+	return reply
+}
+
+// returns true if the email was sent to anyone other than the user, who could be included with reply-all
+func HasOtherRecipients(original t.Email, ownAddrs []string) bool {
+	everyone := NewReply(original, "", true, ownAddrs)
+	single := NewReply(original, "", false, ownAddrs)
+	return len(everyone.To)+len(everyone.Cc) > len(single.To)+len(single.Cc)
+}
+
+// formats a list of addresses for a header
+func formatAddressList(addrs []*mail.Address) string {
+	formatted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		formatted = append(formatted, addr.String())
+	}
+	return strings.Join(formatted, ",\r\n ")
+}
+
+// gets the References for a reply: the original's chain, followed by the original itself
+func replyReferences(email t.Email) []string {
+	refs := append([]string{}, email.References...)
+	if email.MessageID != "" {
+		refs = append(refs, email.MessageID)
+	}
+	return refs
+}
+
+// Builds the raw RFC 5322 message for a reply to the given email. Headers are always written in the same order,
+// the subject and names are encoded with RFC 2047 if they aren't plain ASCII, and the body is sent as UTF-8 quoted-printable.
+// Depending on the reply's style, an HTML version is included, and the original message is quoted below the reply.
+func buildReply(original t.Email, from string, reply t.Reply, date time.Time, messageID string) ([]byte, error) {
+	if len(reply.To) == 0 || from == "" {
+		return nil, errors.New("failed to create reply; missing required email properties")
+	}
+	headers := messageHeaders(from, reply.To, reply.Cc, replySubject(original.Subject), date, messageID)
+	if original.MessageID != "" {
+		headers = append(headers, header{"In-Reply-To", original.MessageID})
+	}
+	if refs := replyReferences(original); len(refs) > 0 {
+		// each ID on its own folded line, so a long chain doesn't make an overly long line
+		headers = append(headers, header{"References", strings.Join(refs, "\r\n ")})
+	}
+	headers = append(headers, header{"MIME-Version", "1.0"})
+
+	var buf bytes.Buffer
+	if err := writeReplyBody(&buf, headers, original, reply); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Builds the raw message for a reply sent now from the given address, ready to send through any mail server.
+func RawReply(original t.Email, from string, reply t.Reply) ([]byte, error) {
+	return buildReply(original, from, reply, time.Now(), newMessageID(from))
+}
+
+// gets the headers every outgoing email starts with, in order
+func messageHeaders(from string, to []*mail.Address, cc []*mail.Address, subject string, date time.Time, messageID string) []header {
+	headers := []header{
+		{"From", from},
+		{"To", formatAddressList(to)},
+	}
+	if len(cc) > 0 {
+		headers = append(headers, header{"Cc", formatAddressList(cc)})
+	}
+	return append(headers,
+		header{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		header{"Date", date.Format(time.RFC1123Z)},
+		header{"Message-ID", messageID},
+	)
+}
+
+// makes a new unique Message-ID for an email sent from the given address
+func newMessageID(from string) string {
+	domain := "localhost"
+	if _, d, found := strings.Cut(from, "@"); found && d != "" {
+		domain = d
+	}
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(nonce), domain)
+}
@@ -0,0 +1,308 @@
+package message
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/types"
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
+)
+
+func TestReplySubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Lunch tomorrow?", "Re: Lunch tomorrow?"},
+		{"Re: Lunch tomorrow?", "Re: Lunch tomorrow?"},
+		{"RE: re: Lunch tomorrow?", "Re: Lunch tomorrow?"},
+		{"Re[2]: Lunch", "Re: Lunch"},
+		{"AW: Termin", "Re: Termin"},
+		{"Regarding the project", "Re: Regarding the project"},
+		{"", "Re: "},
+	}
+	for _, test := range tests {
+		if got := replySubject(test.subject); got != test.want {
+			t.Errorf("subject %q: expected %q, got %q", test.subject, test.want, got)
+		}
+	}
+}
+
+func TestSetReplyInfo(t *testing.T) {
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"Reply-To: Team <team@example.com>\r\n" +
+		"To: Me <me@example.com>, \"Smith, Bob\" <bob@example.com>\r\n" +
+		"Cc: carol@example.com\r\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_plans?=\r\n" +
+		"Message-ID: <three@example.com>\r\n" +
+		"In-Reply-To: <two@example.com>\r\n" +
+		"References: <one@example.com>\r\n <two@example.com>\r\n" +
+		"\r\n" +
+		"See you there.\r\n"
+	_, headers, err := emailparse.ParseEmail(raw)
+	if err != nil {
+		t.Fatal("failed to parse email:", err)
+	}
+	email := types.Email{Headers: headers}
+	setReplyInfo(&email)
+	if email.MessageID != "<three@example.com>" {
+		t.Errorf("unexpected message ID %q", email.MessageID)
+	}
+	if want := []string{"<one@example.com>", "<two@example.com>"}; !reflect.DeepEqual(email.References, want) {
+		t.Errorf("expected references %v, got %v", want, email.References)
+	}
+	if email.ReplyTo != "team@example.com" {
+		t.Errorf("unexpected reply-to %q", email.ReplyTo)
+	}
+	if want := []string{"me@example.com", "bob@example.com"}; !reflect.DeepEqual(email.To, want) {
+		t.Errorf("expected to %v, got %v", want, email.To)
+	}
+	if want := []string{"carol@example.com"}; !reflect.DeepEqual(email.Cc, want) {
+		t.Errorf("expected cc %v, got %v", want, email.Cc)
+	}
+
+	// without References, In-Reply-To starts the chain
+	email = types.Email{Headers: map[string][]string{"In-Reply-To": {"<two@example.com>"}}}
+	setReplyInfo(&email)
+	if want := []string{"<two@example.com>"}; !reflect.DeepEqual(email.References, want) {
+		t.Errorf("expected references %v from In-Reply-To, got %v", want, email.References)
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"alice@example.com", []string{"alice@example.com"}},
+		{`Alice <alice@example.com>, "Smith, Bob" <bob@example.com>`, []string{"alice@example.com", "bob@example.com"}},
+		{"undisclosed-recipients:;", []string{}},
+		// not a valid list, but the addresses are still found
+		{"Alice <alice@example.com>; bob@example.com", []string{"alice@example.com", "bob@example.com"}},
+	}
+	for _, test := range tests {
+		if got := parseAddressList(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.value, test.want, got)
+		}
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	own := []string{"me@example.com", "Me.Alias@Example.com"}
+	tests := []struct {
+		name     string
+		original types.Email
+		replyAll bool
+		to       []string
+		cc       []string
+		others   bool
+	}{
+		{
+			name:     "just the sender",
+			original: types.Email{From: "bob@example.com", To: []string{"me@example.com", "carol@example.com"}},
+			to:       []string{"bob@example.com"},
+			others:   true,
+		},
+		{
+			name:     "everyone, without own addresses",
+			original: types.Email{From: "bob@example.com", To: []string{"me@example.com", "carol@example.com"}, Cc: []string{"me.alias@example.com", "dan@example.com"}},
+			replyAll: true,
+			to:       []string{"bob@example.com", "carol@example.com"},
+			cc:       []string{"dan@example.com"},
+			others:   true,
+		},
+		{
+			name:     "duplicates",
+			original: types.Email{From: "bob@example.com", To: []string{"BOB@example.com", "carol@example.com"}, Cc: []string{"carol@example.com"}},
+			replyAll: true,
+			to:       []string{"bob@example.com", "carol@example.com"},
+			others:   true,
+		},
+		{
+			name:     "reply-to replaces the sender",
+			original: types.Email{From: "bob@example.com", ReplyTo: "list@example.com", To: []string{"me@example.com"}},
+			replyAll: true,
+			to:       []string{"list@example.com"},
+		},
+		{
+			name:     "sent by the user",
+			original: types.Email{From: "me@example.com", To: []string{"me.alias@example.com"}, Cc: []string{"carol@example.com"}},
+			replyAll: true,
+			to:       []string{"carol@example.com"},
+			others:   true,
+		},
+		{
+			name:     "only to the user",
+			original: types.Email{From: "bob@example.com", To: []string{"me@example.com"}},
+			replyAll: true,
+			to:       []string{"bob@example.com"},
+		},
+	}
+	addresses := func(list []*mail.Address) []string {
+		addrs := []string{}
+		for _, addr := range list {
+			addrs = append(addrs, addr.Address)
+		}
+		return addrs
+	}
+	for _, test := range tests {
+		reply := NewReply(test.original, "body", test.replyAll, own)
+		if got := addresses(reply.To); !reflect.DeepEqual(got, test.to) {
+			t.Errorf("%s: expected to %v, got %v", test.name, test.to, got)
+		}
+		if test.cc == nil {
+			test.cc = []string{}
+		}
+		if got := addresses(reply.Cc); !reflect.DeepEqual(got, test.cc) {
+			t.Errorf("%s: expected cc %v, got %v", test.name, test.cc, got)
+		}
+		if got := HasOtherRecipients(test.original, own); got != test.others {
+			t.Errorf("%s: expected other recipients to be %v", test.name, test.others)
+		}
+	}
+}
+
+func TestBuildReply(t *testing.T) {
+	date := time.Date(2024, 7, 1, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		original   types.Email
+		body       string
+		replyAll   bool
+		to         string
+		cc         string
+		subject    string
+		references string
+	}{
+		{
+			name:       "plain",
+			original:   types.Email{From: "bob@example.com", SenderName: "Bob", Subject: "Lunch", MessageID: "<1@example.com>"},
+			body:       "Sounds good.\nSee you at noon.",
+			to:         `"Bob" <bob@example.com>`,
+			subject:    "Re: Lunch",
+			references: "<1@example.com>",
+		},
+		{
+			name: "accents and reply-to",
+			original: types.Email{
+				From:       "zoe@example.com",
+				SenderName: "Zoë Ångström",
+				ReplyTo:    "list@example.com",
+				Subject:    "Re: Café crème",
+				MessageID:  "<3@example.com>",
+				References: []string{"<1@example.com>", "<2@example.com>"},
+			},
+			body:       "Très bien, merci ! Ça marche pour jeudi.\n\n— Valet",
+			to:         "<list@example.com>",
+			subject:    "Re: Café crème",
+			references: "<1@example.com> <2@example.com> <3@example.com>",
+		},
+		{
+			name:     "no message id",
+			original: types.Email{From: "carol@example.com", Subject: "Hello"},
+			body:     "A very long line that goes on and on, well past the seventy-six characters quoted-printable allows on one line, so it has to be wrapped.",
+			to:       "<carol@example.com>",
+			subject:  "Re: Hello",
+		},
+		{
+			name: "reply all",
+			original: types.Email{
+				From:      "dave@example.com",
+				Subject:   "Offsite",
+				MessageID: "<4@example.com>",
+				To:        []string{"me@example.com", "erin@example.com", "frank@example.com"},
+				Cc:        []string{"grace@example.com", "heidi@example.com"},
+			},
+			body:       "Count me in.",
+			replyAll:   true,
+			to:         "<dave@example.com>, <erin@example.com>, <frank@example.com>",
+			cc:         "<grace@example.com>, <heidi@example.com>",
+			subject:    "Re: Offsite",
+			references: "<4@example.com>",
+		},
+	}
+	for _, test := range tests {
+		reply := NewReply(test.original, test.body, test.replyAll, []string{"me@example.com"})
+		raw, err := buildReply(test.original, "me@example.com", reply, date, "<reply@example.com>")
+		if err != nil {
+			t.Fatalf("%s: failed to build reply: %v", test.name, err)
+		}
+		for _, line := range strings.Split(string(raw), "\r\n") {
+			if len(line) > 78 {
+				t.Errorf("%s: line too long (%v chars): %q", test.name, len(line), line)
+			}
+			for _, r := range line {
+				if r > 127 {
+					t.Errorf("%s: raw message should be plain ASCII: %q", test.name, line)
+					break
+				}
+			}
+		}
+
+		body, headers, err := emailparse.ParseEmail(string(raw))
+		if err != nil {
+			t.Fatalf("%s: failed to parse reply: %v", test.name, err)
+		}
+		if body != test.body {
+			t.Errorf("%s: body didn't round trip.\nexpected: %q\ngot: %q", test.name, test.body, body)
+		}
+		expectHeader := func(key string, want string) {
+			got := ""
+			if values := headers[key]; len(values) > 0 {
+				got = values[0]
+			}
+			if got != want {
+				t.Errorf("%s: expected %s %q, got %q", test.name, key, want, got)
+			}
+		}
+		expectHeader("Subject", test.subject)
+		expectHeader("To", test.to)
+		expectHeader("Cc", test.cc)
+		expectHeader("From", "me@example.com")
+		expectHeader("Message-ID", "<reply@example.com>")
+		expectHeader("In-Reply-To", test.original.MessageID)
+		expectHeader("References", test.references)
+		expectHeader("Mime-Version", "1.0")
+		if contentType := headers["Content-Type"][0]; !strings.HasPrefix(contentType, "multipart/alternative; boundary=") {
+			t.Errorf("%s: expected a multipart/alternative reply, got %q", test.name, contentType)
+		}
+		expectHeader("Date", "Mon, 01 Jul 2024 09:30:00 +0000")
+	}
+}
+
+func TestBuildReplyHeaderOrder(t *testing.T) {
+	original := types.Email{From: "bob@example.com", Subject: "Lunch", MessageID: "<1@example.com>"}
+	want := []string{"From", "To", "Subject", "Date", "Message-ID", "In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+	for i := 0; i < 5; i++ {
+		reply := NewReply(original, "ok", false, nil)
+		reply.Style.PlainOnly = true
+		raw, err := buildReply(original, "me@example.com", reply, time.Now(), newMessageID("me@example.com"))
+		if err != nil {
+			t.Fatal("failed to build reply:", err)
+		}
+		head, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+		keys := []string{}
+		for _, line := range strings.Split(head, "\r\n") {
+			if key, _, found := strings.Cut(line, ":"); found && !strings.HasPrefix(line, " ") {
+				keys = append(keys, key)
+			}
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Fatalf("unexpected header order: %v", keys)
+		}
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	a, b := newMessageID("me@example.com"), newMessageID("me@example.com")
+	if a == b {
+		t.Error("message IDs should be unique")
+	}
+	if ids := parseMsgIDs(a); len(ids) != 1 || !strings.HasSuffix(a, "@example.com>") {
+		t.Errorf("invalid message ID %q", a)
+	}
+}
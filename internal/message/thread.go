@@ -0,0 +1,154 @@
+package message
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// matches the line introducing a quote of an earlier message, like "On Mon, Jul 1, 2024 at 9:30 AM, Bob <bob@example.com> wrote:"
+var quoteAttributionPattern = regexp.MustCompile(`(?i)^on\s.*\swrote:\s*$`)
+
+// matches the line outlook and the like put above the earlier message in a reply
+var originalMessagePattern = regexp.MustCompile(`(?i)^\s*-{2,}\s*original message\s*-{2,}\s*$`)
+
+// Parses a raw RFC 5322 message into a message of a thread.
+// The date is taken from the Date header, and messages sent from one of ownAddrs are marked as the user's own.
+func ParseThreadMessage(id string, raw string, ownAddrs []string) (t.ThreadMessage, error) {
+	email, err := ParseRaw(raw)
+	if err != nil {
+		return t.ThreadMessage{}, err
+	}
+	m := t.ThreadMessage{
+		ID:         id,
+		From:       email.From,
+		SenderName: strings.Trim(email.SenderName, `"`),
+		Text:       StripQuoted(email.Body),
+		Mine:       IsOwnAddress(email.From, ownAddrs),
+	}
+	if date, err := mail.ParseDate(headerValue(email, "Date")); err == nil {
+		m.Date = date
+	}
+	return m, nil
+}
+
+// returns true if the address is one of the user's own (case doesn't matter)
+func IsOwnAddress(addr string, ownAddrs []string) bool {
+	for _, own := range ownAddrs {
+		if own != "" && strings.EqualFold(own, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the earlier messages a reply quoted, so each message is only in the transcript once: lines quoted with ">",
+// the line introducing them (like "On ..., Bob wrote:"), and anything below an "Original Message" line or an outlook style header block.
+func StripQuoted(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	kept := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if originalMessagePattern.MatchString(line) || isOutlookHeader(lines[i:]) {
+			break
+		}
+		if strings.HasPrefix(line, ">") || quoteAttributionPattern.MatchString(line) {
+			continue
+		}
+		// an attribution wrapped onto a second line
+		if strings.HasPrefix(strings.ToLower(line), "on ") && i+1 < len(lines) && strings.HasSuffix(strings.ToLower(strings.TrimSpace(lines[i+1])), "wrote:") {
+			i++
+			continue
+		}
+		// one blank line at most between paragraphs
+		if line == "" && (len(kept) == 0 || kept[len(kept)-1] == "") {
+			continue
+		}
+		kept = append(kept, strings.TrimRight(lines[i], " \t"))
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// returns true if the lines start with the header outlook puts above the earlier message, like "From: Bob" followed by "Sent: ..."
+func isOutlookHeader(lines []string) bool {
+	if !strings.HasPrefix(strings.TrimSpace(lines[0]), "From:") {
+		return false
+	}
+	for i := 1; i < len(lines) && i <= 3; i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "Sent:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats the messages as a transcript of the conversation, oldest first, with the user's own messages marked "(sent by me)".
+// If the transcript would be longer than maxChars, the oldest messages are left out; if even the newest message is too long,
+// only the end of its text is kept.
+func Transcript(messages []t.ThreadMessage, maxChars int) string {
+	entries := make([]string, 0, len(messages))
+	for _, m := range messages {
+		entries = append(entries, formatThreadMessage(m))
+	}
+	// the newest messages are kept first, since they matter most for a reply
+	start, total := len(entries), 0
+	for start > 0 && total+len(entries[start-1]) <= maxChars {
+		start--
+		total += len(entries[start]) + 1
+	}
+	if start == len(entries) && start > 0 && maxChars > 0 {
+		start--
+		newest := messages[start]
+		room := maxChars - len(threadMessageHeader(newest)) - len(":\n...\n")
+		newest.Text = "..." + truncateStart(newest.Text, room)
+		entries[start] = formatThreadMessage(newest)
+	}
+	transcript := strings.Join(entries[start:], "\n")
+	if start > 0 {
+		transcript = fmt.Sprintf("(%v earlier message(s) left out)\n\n%s", start, transcript)
+	}
+	return transcript
+}
+
+// formats one message for the transcript, e.g. "Bob <bob@example.com>, Mon, Jul 1, 2024 at 9:30 AM:" followed by its text
+func formatThreadMessage(m t.ThreadMessage) string {
+	text := m.Text
+	if text == "" {
+		text = "(no text)"
+	}
+	return threadMessageHeader(m) + ":\n" + text + "\n"
+}
+
+// gets who sent the message and when, e.g. "Bob <bob@example.com>, Mon, Jul 1, 2024 at 9:30 AM"
+func threadMessageHeader(m t.ThreadMessage) string {
+	sender := m.From
+	if m.SenderName != "" {
+		sender = m.SenderName + " <" + m.From + ">"
+	}
+	if m.Mine {
+		sender += " (sent by me)"
+	}
+	if !m.Date.IsZero() {
+		sender += ", " + m.Date.Local().Format(attributionDateFormat)
+	}
+	return sender
+}
+
+// keeps the last n bytes of the text, without cutting a character in half
+func truncateStart(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	i := len(s) - n
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+	return s[i:]
+}
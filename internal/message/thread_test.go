@@ -0,0 +1,78 @@
+package message
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+func TestStripQuoted(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Sounds good, what time?", "Sounds good, what time?"},
+		{
+			"Sounds good, what time?\n\nOn Mon, Jul 1, 2024 at 9:30 AM, Bob <bob@example.com> wrote:\n> Lunch on Friday?\n>\n>> earlier\n",
+			"Sounds good, what time?",
+		},
+		{
+			"Noon works.\r\n\r\nOn Mon, Jul 1, 2024 at 9:30 AM, Bob Smith <bob.smith@example.com>\r\nwrote:\r\n> Lunch?\r\n",
+			"Noon works.",
+		},
+		{
+			"> Lunch on Friday?\nYes!\n> What time?\nNoon.",
+			"Yes!\nNoon.",
+		},
+		{
+			"Will do.\n\n-----Original Message-----\nFrom: Bob\nSent: Monday\nLunch?",
+			"Will do.",
+		},
+		{
+			"Will do.\n\nFrom: Bob Smith <bob@example.com>\nSent: Monday, July 1, 2024 9:30 AM\nTo: me\nSubject: Lunch\n\nLunch?",
+			"Will do.",
+		},
+		{
+			"First paragraph.\n\n\n\nSecond paragraph.   \n",
+			"First paragraph.\n\nSecond paragraph.",
+		},
+	}
+	for _, test := range tests {
+		if got := StripQuoted(test.text); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.text, test.want, got)
+		}
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	date := time.Date(2024, 7, 1, 9, 30, 0, 0, time.Local)
+	messages := []types.ThreadMessage{
+		{From: "bob@example.com", SenderName: "Bob", Date: date, Text: "Lunch on Friday?"},
+		{From: "me@example.com", Date: date.Add(time.Hour), Text: "Sounds good, where?", Mine: true},
+		{From: "bob@example.com", SenderName: "Bob", Date: date.Add(2 * time.Hour), Text: "The usual place."},
+	}
+	full := "Bob <bob@example.com>, Mon, Jul 1, 2024 at 9:30 AM:\nLunch on Friday?\n\n" +
+		"me@example.com (sent by me), Mon, Jul 1, 2024 at 10:30 AM:\nSounds good, where?\n\n" +
+		"Bob <bob@example.com>, Mon, Jul 1, 2024 at 11:30 AM:\nThe usual place.\n"
+	if got := Transcript(messages, 1000); got != full {
+		t.Errorf("unexpected transcript.\nexpected: %q\ngot: %q", full, got)
+	}
+
+	// only room for the last two messages
+	got := Transcript(messages, len(full)-20)
+	if !strings.HasPrefix(got, "(1 earlier message(s) left out)\n\nme@example.com (sent by me)") || !strings.HasSuffix(got, "The usual place.\n") {
+		t.Errorf("expected the oldest message to be left out, got %q", got)
+	}
+
+	// not even room for the newest message; the end of it is kept
+	got = Transcript(messages, 66)
+	if !strings.HasPrefix(got, "(2 earlier message(s) left out)\n\nBob <bob@example.com>, Mon, Jul 1, 2024 at 11:30 AM:\n...") || !strings.HasSuffix(got, "place.\n") {
+		t.Errorf("expected the end of the newest message, got %q", got)
+	}
+
+	if got := Transcript(nil, 1000); got != "" {
+		t.Errorf("expected an empty transcript for no messages, got %q", got)
+	}
+}
@@ -2,27 +2,53 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/debug"
 )
 
 const (
 	gpt3 string = "gpt-3.5-turbo"
 	gpt4 string = "gpt-4o"
+
+	DefaultModel = gpt3
+
+	DefaultBaseURL    = "https://api.openai.com/v1"
+	DefaultAPIKeyFile = "cred/openai.txt"
 )
 
-func LoadAPIKey() string {
-	path := "cred/openai.txt"
+// Loads the API key from the given environment variable, or if it's not set, from the given file.
+// Either can be empty to skip it. Returns an empty string if no key is found; a missing file isn't an error, since local servers don't need a key.
+func LoadAPIKeyFrom(envVar string, path string) (string, error) {
+	if envVar != "" {
+		if key := strings.TrimSpace(os.Getenv(envVar)); key != "" {
+			return key, nil
+		}
+	}
+	if path == "" {
+		return "", nil
+	}
 	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
 	if err != nil {
-		fmt.Println("error reading openai secret key file:", err)
-		return ""
+		return "", err
 	}
-	return strings.TrimSpace(string(bytes))
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+// loads the API key from cred/openai.txt
+func LoadAPIKey() (string, error) {
+	return LoadAPIKeyFrom("", DefaultAPIKeyFile)
 }
 
 func LoadPrompt(id string, aiName string, name string, message string) string {
@@ -66,10 +92,105 @@ type Usage struct {
 }
 
 type Request struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	FreqPenalty float64   `json:"frequency_penalty"` // penalize repeated tokens by giving a higher value. -2.0 to 2.0. defaults to 0.
-	Temperature float64   `json:"temperature"`       // 0 - 2; higher values like 0.8 make the output more random, while lower values like 0.2 make it more focused and deterministic. defaults to 1.
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	FreqPenalty    float64         `json:"frequency_penalty"`         // penalize repeated tokens by giving a higher value. -2.0 to 2.0. defaults to 0.
+	Temperature    float64         `json:"temperature"`               // 0 - 2; higher values like 0.8 make the output more random, while lower values like 0.2 make it more focused and deterministic. defaults to 1.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"` // set to {"type": "json_object"} to force the output to be valid JSON
+}
+
+type ResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// Client for the OpenAI chat completions API, or any server that is compatible with it (llama.cpp, vLLM, LM Studio, etc).
+type Client struct {
+	BaseURL    string        // base URL of the API, e.g. "https://api.openai.com/v1" or "http://localhost:8080/v1"
+	APIKey     string        // may be empty for local servers that don't need one
+	HTTPClient *http.Client  // client used to make the requests (default: http.DefaultClient)
+	MaxRetries int           // how many times a rate limited (429) or failed (5xx) call is retried
+	Backoff    time.Duration // how long to wait before the first retry. doubles after each retry, unless the server says how long to wait.
+}
+
+// an error response from the API
+type APIError struct {
+	StatusCode int
+	Message    string
+	Type       string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("openai api error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("openai api error: %d %s", e.StatusCode, e.Message)
+}
+
+// returns true if the call may succeed if tried again later
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// creates a client for the API at the given base URL. if baseURL is empty, the OpenAI API is used.
+func NewClient(baseURL string, apiKey string) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		MaxRetries: 3,
+		Backoff:    time.Second,
+	}
+}
+
+// Calls the chat completions API. Rate limited (429) and server error (5xx) responses are retried with backoff.
+// The call is aborted if the context is cancelled or times out, including while waiting to retry.
+//
+// The response has at least one choice, and its Usage says how many tokens the call used.
+func (c *Client) CreateChatCompletion(ctx context.Context, requestData Request) (*APIResponse, error) {
+	body, err := json.Marshal(requestData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request data: %w", err)
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, retryAfter, err := c.post(ctx, "/chat/completions", body)
+		var apiErr *APIError
+		if err == nil || !errors.As(err, &apiErr) || !apiErr.Retryable() || attempt >= c.MaxRetries {
+			return resp, err
+		}
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		debug.Printf("openai call failed (%s); retrying in %v\n", err, wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// Calls the chat completions API with the given model (DefaultModel if empty), and returns the given messages with the reply appended,
+// along with how many tokens the call used.
+func MakeAPICall(ctx context.Context, client *Client, model string, requestMessages []Message) ([]Message, Usage, error) {
+	if model == "" {
+		model = DefaultModel
+	}
+	requestData := Request{
+		Model:       model,
+		Temperature: 0.2,
+		FreqPenalty: 1,
+		Messages:    requestMessages,
+	}
+	resp, err := client.CreateChatCompletion(ctx, requestData)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	return append(requestMessages, resp.Choices[0].Message), resp.Usage, nil
 }
 
 // Call the API to obtain a specific phrase from the AI, based on the given desired output prompt, and using the given personality prompt.
@@ -77,7 +198,7 @@ type Request struct {
 // Example:
 // Desired Output Prompt: "Dismiss yourself from the conversation in a formal way"
 // Personality Prompt: "You are a Butler from Victorian era England"
-func GetCustomPromptOutput(apiKey string, desiredOutputPrompt, personalityPrompt string) string {
+func GetCustomPromptOutput(ctx context.Context, client *Client, model string, desiredOutputPrompt, personalityPrompt string) (string, Usage, error) {
 	messages := []Message{
 		{
 			Role:    "system",
@@ -88,57 +209,74 @@ func GetCustomPromptOutput(apiKey string, desiredOutputPrompt, personalityPrompt
 			Content: desiredOutputPrompt,
 		},
 	}
-	output := MakeAPICall(apiKey, messages)
-	return output[len(output)-1].Content
+	output, usage, err := MakeAPICall(ctx, client, model, messages)
+	if err != nil {
+		return "", usage, err
+	}
+	return output[len(output)-1].Content, usage, nil
 }
 
-func IsEmailSpam(apiKey string, email string) bool {
+func IsEmailSpam(ctx context.Context, client *Client, model string, email string) (bool, error) {
 	outputPrompt := fmt.Sprintf("Email:\n\n%s", email)
 	personalityPrompt := "You are an assistant that judges if emails are from real people, or if they are spam, automated, newsletters, etc. Given an email, say \"<<<SPAM>>>\" if you think its spam, automated, a newsletter etc, or \"<<<PASS>>>\" if it looks like a normal email from a real person."
-	out := GetCustomPromptOutput(apiKey, outputPrompt, personalityPrompt)
-	return strings.TrimSpace(out) == "<<<SPAM>>>" || strings.Contains(out, "<<<SPAM>>>")
-}
-
-func MakeAPICall(apiKey string, requestMessages []Message) []Message {
-	endpoint := "https://api.openai.com/v1/chat/completions"
-	requestData := Request{
-		Model:       gpt3,
-		Temperature: 0.2,
-		FreqPenalty: 1,
-		Messages:    requestMessages,
-	}
-
-	requestDataBytes, err := json.Marshal(requestData)
+	out, _, err := GetCustomPromptOutput(ctx, client, model, outputPrompt, personalityPrompt)
 	if err != nil {
-		log.Fatalf("Failed to marshal request data: %v", err)
+		return false, err
 	}
+	return strings.Contains(out, "<<<SPAM>>>"), nil
+}
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(requestDataBytes))
+// makes a single API call. for error responses, also returns how long the server asked us to wait before retrying, if it did.
+func (c *Client) post(ctx context.Context, path string, body []byte) (*APIResponse, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+path, bytes.NewReader(body))
 	if err != nil {
-		log.Fatalf("Failed to create HTTP request: %v", err)
+		return nil, 0, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
 	}
-
-	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := http.Client{}
-	resp, err := client.Do(req)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatalf("Failed to send HTTP request: %v", err)
+		return nil, 0, fmt.Errorf("failed to send HTTP request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	var response APIResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		log.Fatalf("Failed to decode response body: %v", err)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var errResp struct {
+			Error struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil {
+			apiErr.Message = errResp.Error.Message
+			apiErr.Type = errResp.Error.Type
+		}
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), apiErr
 	}
 
+	var response APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode response body: %w", err)
+	}
 	if len(response.Choices) == 0 {
-		fmt.Println(response)
-		return []Message{}
+		return nil, 0, errors.New("no choices in openai response")
 	}
+	return &response, 0, nil
+}
 
-	outputMessages := append(requestMessages, response.Choices[0].Message)
-	return outputMessages
+// parses a Retry-After header given in seconds. other formats are ignored.
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
 }
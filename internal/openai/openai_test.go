@@ -0,0 +1,176 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a stand-in for the chat completions API, which answers with the given status codes in order, then succeeds
+func newTestServer(t *testing.T, statuses ...int) (*httptest.Server, *int) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if calls <= len(statuses) {
+			w.WriteHeader(statuses[calls-1])
+			w.Write([]byte(`{"error": {"message": "slow down", "type": "rate_limit"}}`))
+			return
+		}
+		var req Request
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(APIResponse{
+			Model:   req.Model,
+			Choices: []Choice{{Message: Message{Role: "assistant", Content: "Bonjour, " + r.Header.Get("Authorization")}}},
+			Usage:   Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func testRequest() Request {
+	return Request{Model: "local-model", Messages: []Message{{Role: "user", Content: "hello"}}}
+}
+
+func TestCreateChatCompletion(t *testing.T) {
+	srv, calls := newTestServer(t)
+	client := NewClient(srv.URL+"/v1/", "secret")
+	resp, err := client.CreateChatCompletion(context.Background(), testRequest())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if *calls != 1 || resp.Choices[0].Message.Content != "Bonjour, Bearer secret" {
+		t.Errorf("unexpected response after %v calls: %+v", *calls, resp)
+	}
+	if resp.Usage.TotalTokens != 15 {
+		t.Errorf("usage not returned: %+v", resp.Usage)
+	}
+
+	// local servers don't need a key
+	resp, err = NewClient(srv.URL+"/v1", "").CreateChatCompletion(context.Background(), testRequest())
+	if err != nil || resp.Choices[0].Message.Content != "Bonjour, " {
+		t.Errorf("expected no authorization header without a key. error: %v, response: %+v", err, resp)
+	}
+}
+
+func TestMakeAPICall(t *testing.T) {
+	srv, _ := newTestServer(t)
+	client := NewClient(srv.URL+"/v1", "secret")
+	messages := []Message{{Role: "user", Content: "hello"}}
+	out, usage, err := MakeAPICall(context.Background(), client, "", messages)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(out) != 2 || out[1].Content != "Bonjour, Bearer secret" {
+		t.Errorf("expected the reply to be appended to the messages: %+v", out)
+	}
+	if usage.TotalTokens != 15 {
+		t.Errorf("usage not returned: %+v", usage)
+	}
+
+	// errors are returned, instead of ending the program
+	srv, _ = newTestServer(t, 400)
+	if _, _, err := MakeAPICall(context.Background(), NewClient(srv.URL+"/v1", ""), "", messages); err == nil {
+		t.Error("expected an error for a bad request")
+	}
+}
+
+func TestCreateChatCompletionRetry(t *testing.T) {
+	tests := []struct {
+		statuses   []int
+		maxRetries int
+		expCalls   int
+		expStatus  int // status of the returned error, or 0 if it should succeed
+	}{
+		{[]int{429, 503}, 3, 3, 0},
+		{[]int{500, 500, 500, 500}, 3, 4, 500},
+		{[]int{400}, 3, 1, 400},
+		{[]int{401}, 3, 1, 401},
+		{[]int{429}, 0, 1, 429},
+	}
+
+	for i, test := range tests {
+		srv, calls := newTestServer(t, test.statuses...)
+		client := NewClient(srv.URL+"/v1", "secret")
+		client.MaxRetries = test.maxRetries
+		client.Backoff = time.Millisecond
+		_, err := client.CreateChatCompletion(context.Background(), testRequest())
+		if *calls != test.expCalls {
+			t.Errorf("case %v, expected %v calls, got %v", i, test.expCalls, *calls)
+		}
+		var apiErr *APIError
+		if test.expStatus == 0 && err != nil {
+			t.Errorf("case %v, unexpected error: %v", i, err)
+		}
+		if test.expStatus != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != test.expStatus || apiErr.Message != "slow down") {
+			t.Errorf("case %v, expected api error with status %v, got: %v", i, test.expStatus, err)
+		}
+	}
+}
+
+func TestCreateChatCompletionCancel(t *testing.T) {
+	srv, _ := newTestServer(t, 429, 429, 429)
+	client := NewClient(srv.URL+"/v1", "secret")
+	client.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.CreateChatCompletion(ctx, testRequest()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("cancelling didn't stop the retry wait")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		input string
+		exp   time.Duration
+	}{
+		{"2", 2 * time.Second},
+		{"", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+
+	for i, test := range tests {
+		if out := parseRetryAfter(test.input); out != test.exp {
+			t.Errorf("case %v, expected: %v, output: %v", i, test.exp, out)
+		}
+	}
+}
+
+func TestLoadAPIKeyFrom(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "openai.txt")
+	os.WriteFile(keyFile, []byte("sk-file\n"), 0644)
+	t.Setenv("MAIL_ASSISTANT_TEST_KEY", "sk-env")
+
+	tests := []struct {
+		env     string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"MAIL_ASSISTANT_TEST_KEY", keyFile, "sk-env", false},
+		{"MAIL_ASSISTANT_TEST_NO_KEY", keyFile, "sk-file", false},
+		{"", filepath.Join(dir, "missing.txt"), "", false},
+		{"", dir, "", true},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		key, err := LoadAPIKeyFrom(test.env, test.path)
+		if key != test.want || (err != nil) != test.wantErr {
+			t.Errorf("%q, %q: expected %q (error: %v), got %q, %v", test.env, test.path, test.want, test.wantErr, key, err)
+		}
+	}
+}
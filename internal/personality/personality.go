@@ -1,15 +1,15 @@
 package personality
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 
-	"github.com/ollama/ollama/api"
-	"github.com/webbben/mail-assistant/internal/llama"
-	"github.com/webbben/mail-assistant/internal/openai"
+	"github.com/webbben/mail-assistant/internal/llm"
 	t "github.com/webbben/mail-assistant/internal/types"
 	"github.com/webbben/mail-assistant/internal/util"
 )
@@ -21,14 +21,31 @@ type Personality struct {
 	PhrasePrompts   map[string]string `json:"phrase_prompts"`   // Prompts used for generating phrases
 	Prompts         Prompts           `json:"prompts"`          // Prompts for main workflows (e.g. handling incoming emails)
 	InsertDict      map[string]string `json:"insert_dict"`      // dictionary of terms to insert into the prompts
+	ReplyStyle      t.ReplyStyle      `json:"reply_style"`      // how the emails this personality writes are formatted
 }
 
 type Prompts struct {
 	EmailWorkflow string `json:"email_workflow"` // prompt for how the email handling workflow and interaction should work.
 	AutoReply     string `json:"autoreply"`      // prompt for handling autoreply messages
+	Compose       string `json:"compose"`        // prompt for writing new emails
 }
 
-func (p Personality) GenPhrase(client *api.Client, phraseKey string) string {
+func (p Personality) GenPhrase(ctx context.Context, provider llm.Provider, phraseKey string) string {
+	return p.genPhrase(ctx, provider, phraseKey, nil)
+}
+
+// generates a phrase and prints it as the AI speaking, streaming it to the terminal as it is generated. returns the full phrase.
+//
+// Ctrl-C while the phrase is generating cancels it, rather than killing the process.
+func (p Personality) SayPhrase(ctx context.Context, provider llm.Provider, phraseKey string) string {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	talk := util.NewTalkStream(p.Name, util.Hi_blue)
+	defer talk.End()
+	return p.genPhrase(ctx, provider, phraseKey, unquoteStream(talk.Write))
+}
+
+func (p Personality) genPhrase(ctx context.Context, provider llm.Provider, phraseKey string, onToken func(string)) string {
 	if p.PhrasePrompts == nil {
 		log.Println("failed to generate phrase: no phrase prompts defined")
 		return ""
@@ -39,7 +56,7 @@ func (p Personality) GenPhrase(client *api.Client, phraseKey string) string {
 		return ""
 	}
 	system := p.BasePersonality + ". Return a phrase for the following prompt, but keep it brief - no longer than one or two sentences."
-	out, err := llama.GenerateCompletion(client, system, prompt)
+	out, err := provider.ForTask(llm.PHRASE).GenerateStream(ctx, system, prompt, onToken)
 	if err != nil {
 		log.Println("failed to generate completion:", err)
 		return ""
@@ -47,6 +64,28 @@ func (p Personality) GenPhrase(client *api.Client, phraseKey string) string {
 	return strings.Trim(out, "\"")
 }
 
+// wraps a stream callback so the quotes the model likes to put around phrases are dropped, like GenPhrase does.
+// a trailing quote is held back until more text comes, since we can't know if it's the last one until then.
+func unquoteStream(onToken func(string)) func(string) {
+	started := false
+	held := ""
+	return func(token string) {
+		if !started {
+			token = strings.TrimLeft(token, "\"")
+			if token == "" {
+				return
+			}
+			started = true
+		}
+		token = held + token
+		trimmed := strings.TrimRight(token, "\"")
+		held = token[len(trimmed):]
+		if trimmed != "" {
+			onToken(trimmed)
+		}
+	}
+}
+
 func (p *Personality) SaveToDisk() error {
 	bytes, err := json.MarshalIndent(p, "", "  ")
 	if err != nil {
@@ -77,27 +116,36 @@ func Load(id string) (*Personality, error) {
 }
 
 // generates a list of phrases based on the given phrase prompt. meant for building the AI personality's phrase set, which are used outside of the dynamic conversation time.
-func buildPhrases(phrasePrompt string, basePersonality string, count int, apiKey string) []string {
+func buildPhrases(ctx context.Context, provider llm.Provider, phrasePrompt string, basePersonality string, count int) []string {
 	phrases := make([]string, 0)
 	instructions := "\nUsing this personality, generate a phrase based on the following prompt and context, and return just the phrase, without quotes or anything else.\n"
 	prompt := basePersonality + instructions + phrasePrompt
 
-	input := []openai.Message{
+	provider = provider.ForTask(llm.PHRASE)
+	messages := []llm.Message{
 		{
 			Role:    "system",
 			Content: prompt,
 		},
 	}
-	messages := openai.MakeAPICall(apiKey, input)
-	phrases = append(phrases, messages[len(messages)-1].Content)
+	messages, err := provider.Chat(ctx, messages)
+	if err != nil {
+		log.Println("failed to generate phrase:", err)
+		return phrases
+	}
+	phrases = append(phrases, llm.LastContent(messages))
 
 	for i := 1; i < count; i++ {
-		messages = append(messages, openai.Message{
+		messages = append(messages, llm.Message{
 			Role:    "user",
 			Content: "Generate another phrase, please",
 		})
-		messages = openai.MakeAPICall(apiKey, messages)
-		phrase := messages[len(messages)-1].Content
+		messages, err = provider.Chat(ctx, messages)
+		if err != nil {
+			log.Println("failed to generate phrase:", err)
+			return phrases
+		}
+		phrase := llm.LastContent(messages)
 		util.PrintlnColor(util.Gray, phrase)
 		phrases = append(phrases, phrase)
 	}
@@ -196,7 +244,12 @@ func NewPersonalitySetup() {
 	fmt.Println("Next steps: find your personality JSON and set the paths to the prompt text file you want to use. Then, to use this personality, set it in your config.json.")
 }
 
-func (p Personality) FormatPrompt(Username, prompt string, email t.Email) string {
+// placeholder in a prompt for the transcript of the earlier messages in the email's conversation
+const ThreadPlaceholder = "<<THREAD>>"
+
+// Fills in the prompt's placeholders: the names, the email's sender and subject, the insert-dict terms, and the thread transcript.
+// The email's body goes where the prompt has "%s".
+func (p Personality) FormatPrompt(Username, prompt string, email t.Email, thread string) string {
 	if p.InsertDict == nil {
 		p.InsertDict = make(map[string]string)
 	}
@@ -212,5 +265,6 @@ func (p Personality) FormatPrompt(Username, prompt string, email t.Email) string
 	if email.Body != "" {
 		output = fmt.Sprintf(output, email.Body)
 	}
-	return output
+	// filled in last, since the transcript could have a "%" in it
+	return strings.ReplaceAll(output, ThreadPlaceholder, thread)
 }
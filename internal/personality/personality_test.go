@@ -12,6 +12,7 @@ func TestFormatPrompt(t *testing.T) {
 		prompt   string
 		username string
 		email    types.Email
+		thread   string
 		expOut   string
 	}{
 		{
@@ -23,6 +24,7 @@ func TestFormatPrompt(t *testing.T) {
 			types.Email{
 				Body: "Here's a message for you to read.",
 			},
+			"",
 			"Your name is AI and you are the assistant of Userdude. Here's a message for you to read.",
 		},
 		{
@@ -34,14 +36,51 @@ func TestFormatPrompt(t *testing.T) {
 			types.Email{
 				Body: "Hi,\nmy name is Dave and I like pickles.\nRegards,\nDave!",
 			},
+			"",
 			"Hello! My name is James Jameson and you are Jimmy John, an assistant who reads me emails.\nHere's an email for you to read:\nHi,\nmy name is Dave and I like pickles.\nRegards,\nDave!",
 		},
+		{
+			Personality{
+				Name: "AI",
+			},
+			"Earlier messages:\n<<THREAD>>\nThe new message, from <<FROM>>:\n%s",
+			"Userdude",
+			types.Email{
+				From: "dave@example.com",
+				Body: "Sounds good, what time?",
+			},
+			"dave@example.com:\nI'm 100% in for pickles on Friday.\n",
+			"Earlier messages:\ndave@example.com:\nI'm 100% in for pickles on Friday.\n\nThe new message, from dave@example.com:\nSounds good, what time?",
+		},
 	}
 
 	for _, test := range tests {
-		out := test.p.FormatPrompt(test.username, test.prompt, test.email)
+		out := test.p.FormatPrompt(test.username, test.prompt, test.email, test.thread)
 		if out != test.expOut {
 			t.Errorf("wrong output. expected: %q\noutput: %q", test.expOut, out)
 		}
 	}
 }
+
+func TestUnquoteStream(t *testing.T) {
+	tests := []struct {
+		tokens []string
+		expOut string
+	}{
+		{[]string{"\"Good ", "day, ", "Monsieur.\""}, "Good day, Monsieur."},
+		{[]string{"\"", "Adieu", "!", "\""}, "Adieu!"},
+		{[]string{"He said \"", "hello\" ", "to you"}, "He said \"hello\" to you"},
+		{[]string{"No quotes here."}, "No quotes here."},
+	}
+
+	for i, test := range tests {
+		out := ""
+		onToken := unquoteStream(func(s string) { out += s })
+		for _, token := range test.tokens {
+			onToken(token)
+		}
+		if out != test.expOut {
+			t.Errorf("case %v, wrong output. expected: %q\noutput: %q", i, test.expOut, out)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package spamfilter
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	t "github.com/webbben/mail-assistant/internal/types"
+)
+
+// file the spam model is saved to
+const modelPath = "spammodel.json"
+
+// the model won't give a probability until it has been trained on at least this many spam and ham (not spam) emails each
+const minDocs = 3
+
+// limit on how many tokens are used to judge an email. only the tokens that say the most about it (spam or ham) are used.
+const maxTokens = 150
+
+// tokens whose spam probability is closer than this to 0.5 say too little to be worth using
+const minDeviation = 0.1
+
+// Model is a naive Bayes spam classifier, trained on the tokens of emails that are known to be spam or ham (not spam).
+//
+// Token probabilities are combined with Fisher's method (as in SpamBayes), which gives probabilities that stay
+// close to 0.5 when the evidence is weak or mixed, rather than jumping to 0 or 1 like a plain naive Bayes product does.
+type Model struct {
+	SpamDocs int             `json:"spam_docs"` // number of spam emails trained on
+	HamDocs  int             `json:"ham_docs"`  // number of ham emails trained on
+	Spam     map[string]int  `json:"spam"`      // number of spam emails each token appeared in
+	Ham      map[string]int  `json:"ham"`       // number of ham emails each token appeared in
+	Trained  map[string]bool `json:"trained"`   // message IDs already trained on, so an email isn't counted twice
+
+	mu sync.Mutex
+}
+
+func NewModel() *Model {
+	return &Model{
+		Spam:    make(map[string]int),
+		Ham:     make(map[string]int),
+		Trained: make(map[string]bool),
+	}
+}
+
+// Trains the model on the given tokens. If id isn't empty and the model was already trained on that id, nothing is done.
+// Returns true if the model was trained.
+func (m *Model) Train(id string, tokens []string, spam bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id != "" {
+		if m.Trained[id] {
+			return false
+		}
+		m.Trained[id] = true
+	}
+	counts := m.Ham
+	if spam {
+		counts = m.Spam
+		m.SpamDocs++
+	} else {
+		m.HamDocs++
+	}
+	for _, token := range unique(tokens) {
+		counts[token]++
+	}
+	return true
+}
+
+// Gives the probability (0 to 1) that an email with the given tokens is spam.
+// If the model hasn't been trained on enough emails to judge yet, false is returned.
+func (m *Model) Probability(tokens []string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.SpamDocs < minDocs || m.HamDocs < minDocs {
+		return 0.5, false
+	}
+	probs := []float64{}
+	for _, token := range unique(tokens) {
+		p := m.tokenProbability(token)
+		if math.Abs(p-0.5) >= minDeviation {
+			probs = append(probs, p)
+		}
+	}
+	if len(probs) == 0 {
+		return 0.5, true
+	}
+	// use the most telling tokens
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > maxTokens {
+		probs = probs[:maxTokens]
+	}
+	// Fisher's method: how unlikely the token probabilities are if they were random, in the spam and ham directions
+	spamLog, hamLog := 0.0, 0.0
+	for _, p := range probs {
+		spamLog += math.Log(1 - p)
+		hamLog += math.Log(p)
+	}
+	n := len(probs)
+	spamness := 1 - chi2Q(-2*spamLog, 2*n)
+	hamness := 1 - chi2Q(-2*hamLog, 2*n)
+	return (spamness - hamness + 1) / 2, true
+}
+
+// gives the probability that an email containing the token is spam, smoothed towards 0.5 for tokens that haven't been seen much
+func (m *Model) tokenProbability(token string) float64 {
+	const strength = 1.0 // how much weight the 0.5 prior has, in number of emails
+	spamCount, hamCount := m.Spam[token], m.Ham[token]
+	if spamCount+hamCount == 0 {
+		return 0.5
+	}
+	spamFreq := float64(spamCount) / float64(m.SpamDocs)
+	hamFreq := float64(hamCount) / float64(m.HamDocs)
+	p := spamFreq / (spamFreq + hamFreq)
+	n := float64(spamCount + hamCount)
+	return (strength*0.5 + n*p) / (strength + n)
+}
+
+// survival function of the chi-squared distribution, for an even number of degrees of freedom
+func chi2Q(x2 float64, dof int) float64 {
+	m := x2 / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < dof/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
+
+func (m *Model) Save(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, bytes, 0644)
+}
+
+// loads the model saved at the given path. If there is no saved model yet, an untrained model is returned.
+func LoadModel(path string) (*Model, error) {
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewModel(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := NewModel()
+	if err := json.Unmarshal(bytes, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var tokenPattern = regexp.MustCompile(`[\p{L}\p{N}$'-]+`)
+
+// splits text into lowercase word tokens. very short and very long words (like links and encoded data) are left out.
+func Tokenize(text string) []string {
+	tokens := []string{}
+	for _, word := range tokenPattern.FindAllString(strings.ToLower(text), -1) {
+		word = strings.Trim(word, "'-")
+		if len(word) < 2 || len(word) > 25 {
+			continue
+		}
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+// gets the tokens the model judges an email by: the words of its body and subject, and its sender
+func EmailTokens(email t.Email) []string {
+	tokens := senderTokens(email.From)
+	for _, word := range Tokenize(email.Subject) {
+		tokens = append(tokens, "subject:"+word)
+	}
+	return append(tokens, Tokenize(email.Body)...)
+}
+
+func senderTokens(from string) []string {
+	from = strings.ToLower(strings.TrimSpace(from))
+	if from == "" {
+		return []string{}
+	}
+	tokens := []string{"from:" + from}
+	if _, domain, ok := strings.Cut(from, "@"); ok {
+		tokens = append(tokens, "domain:"+domain)
+	}
+	return tokens
+}
+
+func unique(tokens []string) []string {
+	seen := make(map[string]bool)
+	out := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if !seen[token] {
+			seen[token] = true
+			out = append(out, token)
+		}
+	}
+	return out
+}
+
+// the model used by the app, and whether it has changes that haven't been saved to disk
+var model = NewModel()
+var unsavedChanges int
+
+// loads the app's spam model from disk
+func LoadModelFromDisk() error {
+	m, err := LoadModel(modelPath)
+	if err != nil {
+		return err
+	}
+	model = m
+	unsavedChanges = 0
+	return nil
+}
+
+// saves the app's spam model to disk, if it has changed
+func WriteModelToDisk() error {
+	if unsavedChanges == 0 {
+		return nil
+	}
+	if err := model.Save(modelPath); err != nil {
+		return err
+	}
+	unsavedChanges = 0
+	return nil
+}
+
+// trains the app's spam model on an email the user has made a decision on
+func Learn(email t.Email, spam bool) {
+	if model.Train(email.ID, EmailTokens(email), spam) {
+		unsavedChanges++
+	}
+}
+
+// gives the probability that the email is spam, according to the app's spam model. returns false if the model isn't trained enough yet.
+func SpamProbability(email t.Email) (float64, bool) {
+	return model.Probability(EmailTokens(email))
+}
+
+// returns true if the app's spam model hasn't been trained on anything yet
+func IsEmpty() bool {
+	return model.SpamDocs == 0 && model.HamDocs == 0
+}
+
+// Trains the app's spam model on the decisions saved in the email cache that it hasn't seen yet.
+// The cache doesn't keep email content, so only the sender is learned from these.
+// Returns how many emails were learned from.
+func LearnFromCache(entries []emailcache.EmailCacheDatum) int {
+	count := 0
+	for _, datum := range entries {
+		spam, ok := cacheLabel(datum)
+		if !ok {
+			continue
+		}
+		if model.Train(datum.MessageID, senderTokens(datum.From), spam) {
+			count++
+		}
+	}
+	unsavedChanges += count
+	return count
+}
+
+// Gets the spam label for a decision in the email cache. Replies and forwards are ham, and emails the user ignored are spam.
+// Emails ignored automatically (for being old, bulk mail, caught by the spam filter itself, restored from labels, etc)
+// aren't learned from, since the user never decided on them.
+func cacheLabel(datum emailcache.EmailCacheDatum) (bool, bool) {
+	switch datum.Action {
+	case emailcache.REPLY, emailcache.FORWARD:
+		return false, true
+	case emailcache.IGNORE:
+		if slices.Contains(strings.Split(datum.Categories, ";"), emailcache.USER) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// labeled emails the spam model starts out trained on, so it works before the user has made many decisions
+//
+//go:embed seed/*.txt
+var seedCorpus embed.FS
+
+// Trains the app's spam model on the seed corpus built into the app. Returns how many emails were learned from.
+func LearnFromSeedCorpus() (int, error) {
+	return LearnFromCorpus(seedCorpus, "seed")
+}
+
+// Trains the app's spam model on a corpus of labeled emails: the .txt files in dir of the given file system.
+// Each file starts with TRUE (spam) or FALSE (ham), followed by "<<TESTCASE>>" and the email body.
+func LearnFromCorpus(fsys fs.FS, dir string) (int, error) {
+	paths, err := fs.Glob(fsys, path.Join(dir, "*.txt"))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, p := range paths {
+		bytes, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return count, err
+		}
+		label, body, found := strings.Cut(string(bytes), "<<TESTCASE>>")
+		if !found {
+			continue
+		}
+		if model.Train("corpus:"+path.Base(p), Tokenize(body), strings.TrimSpace(label) == "TRUE") {
+			count++
+		}
+	}
+	unsavedChanges += count
+	return count, nil
+}
@@ -0,0 +1,177 @@
+package spamfilter
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
+	"github.com/webbben/mail-assistant/internal/types"
+)
+
+var spamTexts = []string{
+	"Limited time offer! Save 50% on all tofu presses. Unsubscribe from this newsletter anytime.",
+	"Our monthly newsletter: new features, webinars and a special offer for subscribers. Unsubscribe here.",
+	"You have 1 new message on LinkedIn. View message. Unsubscribe from these notifications.",
+	"Exclusive deal just for you! Click now to claim your discount before the offer ends. Unsubscribe.",
+}
+
+var hamTexts = []string{
+	"Hey Ben, want to grab lunch on Tuesday? I was thinking the dumpling place near the office.",
+	"Ben, can you review the Hamu project design before our meeting tomorrow? Thanks, Tom",
+	"Hi Ben, thanks for helping me move last weekend. Dinner is on me next time.",
+	"Ben - the team is meeting Thursday to discuss the project schedule. Can you make it?",
+}
+
+func trainedModel() *Model {
+	m := NewModel()
+	for i, text := range spamTexts {
+		m.Train(fmt.Sprint("spam", i), Tokenize(text), true)
+	}
+	for i, text := range hamTexts {
+		m.Train(fmt.Sprint("ham", i), Tokenize(text), false)
+	}
+	return m
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		exp   []string
+	}{
+		{"Save 50% on Tofu!", []string{"save", "50", "on", "tofu"}},
+		{"Don't miss it - a $5 deal", []string{"don't", "miss", "it", "$5", "deal"}},
+		{"x https://example.com/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", []string{"https", "example", "com"}},
+	}
+
+	for i, test := range tests {
+		if out := Tokenize(test.input); !slices.Equal(out, test.exp) {
+			t.Errorf("case %v, expected: %q, output: %q", i, test.exp, out)
+		}
+	}
+}
+
+func TestProbability(t *testing.T) {
+	if _, ok := NewModel().Probability(Tokenize(spamTexts[0])); ok {
+		t.Error("untrained model gave a probability")
+	}
+
+	m := trainedModel()
+	tests := []struct {
+		text string
+		min  float64
+		max  float64
+	}{
+		{"Special offer for subscribers! Click to claim your discount. Unsubscribe.", 0.9, 1},
+		{"Ben, are you free for lunch Thursday to talk about the project?", 0, 0.1},
+		{"zebra quantum marmalade", 0.4, 0.6}, // nothing known about these words
+	}
+
+	for i, test := range tests {
+		p, ok := m.Probability(Tokenize(test.text))
+		if !ok {
+			t.Fatalf("case %v, trained model gave no probability", i)
+		}
+		if p < test.min || p > test.max {
+			t.Errorf("case %v, expected probability between %v and %v, got %v", i, test.min, test.max, p)
+		}
+	}
+}
+
+func TestTrainIncremental(t *testing.T) {
+	m := trainedModel()
+	text := "Ben, the quarterly budget spreadsheet is ready for your review"
+	before, _ := m.Probability(Tokenize(text))
+
+	if !m.Train("msg-1", Tokenize(text), true) {
+		t.Fatal("model wasn't trained on a new message")
+	}
+	if m.Train("msg-1", Tokenize(text), true) {
+		t.Error("model was trained twice on the same message")
+	}
+	after, _ := m.Probability(Tokenize(text))
+	if after <= before {
+		t.Errorf("marking the email as spam didn't raise its probability: %v -> %v", before, after)
+	}
+	if m.SpamDocs != len(spamTexts)+1 {
+		t.Errorf("expected %v spam docs, got %v", len(spamTexts)+1, m.SpamDocs)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.json")
+	m := trainedModel()
+	if err := m.Save(path); err != nil {
+		t.Fatal("failed to save:", err)
+	}
+	loaded, err := LoadModel(path)
+	if err != nil {
+		t.Fatal("failed to load:", err)
+	}
+	text := Tokenize(spamTexts[0])
+	p1, _ := m.Probability(text)
+	p2, _ := loaded.Probability(text)
+	if math.Abs(p1-p2) > 1e-9 || !loaded.Trained["ham0"] {
+		t.Errorf("loaded model differs from saved model: %v vs %v", p1, p2)
+	}
+
+	missing, err := LoadModel(filepath.Join(t.TempDir(), "none.json"))
+	if err != nil || missing.SpamDocs != 0 {
+		t.Error("expected an untrained model when there is no saved model, got error:", err)
+	}
+}
+
+func TestCacheLabel(t *testing.T) {
+	tests := []struct {
+		datum    emailcache.EmailCacheDatum
+		expSpam  bool
+		expLabel bool
+	}{
+		{emailcache.EmailCacheDatum{Action: emailcache.REPLY}, false, true},
+		{emailcache.EmailCacheDatum{Action: emailcache.FORWARD}, false, true},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE, Categories: emailcache.USER}, true, true},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE}, false, false},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE, Categories: "BULK;list-unsubscribe"}, false, false},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE, Categories: "NOREPLY"}, false, false},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE, Categories: "RESTORED"}, false, false},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE, Categories: "OLD"}, false, false},
+		{emailcache.EmailCacheDatum{Action: emailcache.IGNORE, Categories: "SPAM;p=0.95"}, false, false},
+	}
+
+	for i, test := range tests {
+		spam, ok := cacheLabel(test.datum)
+		if spam != test.expSpam || ok != test.expLabel {
+			t.Errorf("case %v, expected: %v %v, got: %v %v", i, test.expSpam, test.expLabel, spam, ok)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	model = NewModel()
+	n, err := LearnFromSeedCorpus()
+	if err != nil || n != 9 {
+		t.Fatalf("expected to learn from 9 corpus emails, got %v (error: %v)", n, err)
+	}
+	if n, _ := LearnFromSeedCorpus(); n != 0 {
+		t.Error("learned from the corpus twice")
+	}
+
+	entries := []emailcache.EmailCacheDatum{
+		{MessageID: "a", From: "news@deals.com", Action: emailcache.IGNORE, Categories: emailcache.USER},
+		{MessageID: "b", From: "tom@gmail.com", Action: emailcache.REPLY},
+		{MessageID: "c", From: "old@gmail.com", Action: emailcache.IGNORE, Categories: "OLD"},
+	}
+	if n := LearnFromCache(entries); n != 2 {
+		t.Errorf("expected to learn from 2 cached decisions, got %v", n)
+	}
+
+	Learn(types.Email{ID: "d", From: "tom@gmail.com", Subject: "Lunch", Body: "Lunch on Tuesday?"}, false)
+	if n := LearnFromCache([]emailcache.EmailCacheDatum{{MessageID: "d", From: "tom@gmail.com", Action: emailcache.REPLY}}); n != 0 {
+		t.Error("learned from a cached decision that was already learned")
+	}
+	if model.SpamDocs != 7 || model.HamDocs != 5 {
+		t.Errorf("expected 7 spam and 5 ham docs, got %v and %v", model.SpamDocs, model.HamDocs)
+	}
+}
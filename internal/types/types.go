@@ -2,19 +2,50 @@ package types
 
 import (
 	"fmt"
+	"net/mail"
 	"time"
+
+	emailparse "github.com/webbben/mail-assistant/pkg/email_parse"
 )
 
 // a processed email
 type Email struct {
-	ID         string
-	ThreadID   string
-	From       string
-	SenderName string
-	Subject    string
-	Body       string
-	Snippet    string
-	Date       time.Time
+	ID          string
+	ThreadID    string
+	From        string
+	SenderName  string
+	Subject     string
+	Body        string
+	Snippet     string
+	Date        time.Time
+	Headers     map[string][]string // all headers of the email, as parsed from the raw message
+	LabelIDs    []string            // gmail label IDs on the message (e.g. "INBOX", "CATEGORY_PROMOTIONS")
+	MessageID   string              // the RFC 5322 Message-ID header, with its angle brackets (e.g. "<abc@mail.gmail.com>"). not the same as the gmail ID
+	References  []string            // message IDs of the earlier emails in the conversation, oldest first, from the References header
+	ReplyTo     string              // address replies should be sent to, from the Reply-To header, if it's set
+	To          []string            // addresses the email was sent to
+	Cc          []string            // addresses the email was copied to
+	Attachments []Attachment        // files attached to the email, including inline ones like images in the HTML
+}
+
+// a file attached to an email. the content isn't kept, and is downloaded when it's needed.
+type Attachment = emailparse.Attachment
+
+// ways the valet can handle an email, which are shown in the mailbox with labels (or imap keywords)
+const (
+	REPLIED      = "REPLIED"      // the user replied, through the valet
+	AUTO_REPLIED = "AUTO_REPLIED" // the valet sent an auto-reply
+	IGNORED      = "IGNORED"      // the user chose to ignore it
+	FILTERED     = "FILTERED"     // ignored without asking the user, e.g. spam or bulk mail. these get the ignored label, but are left unread and in the inbox.
+	DRAFTED      = "DRAFTED"      // a reply was saved as a draft. these are also left unread and in the inbox, since the user still has to send the reply.
+	FORWARDED    = "FORWARDED"    // forwarded to a delegate, by the user or by auto-reply
+)
+
+// how replies are formatted. the zero value sends an HTML version along with the plain text, and quotes the original message below the reply.
+type ReplyStyle struct {
+	PlainOnly   bool   `json:"plain_only"`  // only send plain text, without an HTML version
+	NoQuote     bool   `json:"no_quote"`    // don't quote the original message below the reply
+	Attribution string `json:"attribution"` // line introducing the quote, with <<DATE>> and <<SENDER>> placeholders (default: "On <<DATE>>, <<SENDER>> wrote:")
 }
 
 func (e Email) String() string {
@@ -24,3 +55,38 @@ func (e Email) String() string {
 	}
 	return fmt.Sprintf("From: %s\nSubject: %s\n\n%s", from, e.Subject, e.Body)
 }
+
+// a reply to send, who it's going to, and how it's formatted
+type Reply struct {
+	To    []*mail.Address
+	Cc    []*mail.Address
+	Body  string
+	Style ReplyStyle
+}
+
+// a new email, which isn't a reply to another one
+type NewEmail struct {
+	To      []*mail.Address
+	Cc      []*mail.Address
+	Subject string
+	Body    string
+	Style   ReplyStyle // how the email is formatted. there's nothing to quote, so only the HTML setting applies
+}
+
+// an email to forward, who it's going to, and the note introducing it
+type Forward struct {
+	To     []*mail.Address
+	Note   string     // cover note written above the forwarded email
+	Inline bool       // put the original's text in the body, instead of attaching the whole original message (message/rfc822)
+	Style  ReplyStyle // how the note is formatted. nothing is quoted, so only the HTML setting applies
+}
+
+// one message in a thread, as it's shown in the transcript
+type ThreadMessage struct {
+	ID         string
+	From       string
+	SenderName string
+	Date       time.Time
+	Text       string // the text of the message, without the earlier messages it quoted
+	Mine       bool   // sent by the user
+}
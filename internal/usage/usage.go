@@ -0,0 +1,233 @@
+package usage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+	"github.com/webbben/mail-assistant/internal/debug"
+)
+
+// file the app's usage ledger is saved to
+const ledgerPath = "usage.jsonl"
+
+// a single model call, as recorded in the usage ledger
+type Record struct {
+	Time             time.Time `json:"time"`
+	Task             string    `json:"task"` // task the call was made for (draft, categorize, spam, phrase, summarize), or empty for general calls
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	EmailID          string    `json:"email_id,omitempty"` // the email being handled when the call was made, if any
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Cost             float64   `json:"cost"` // estimated cost in USD
+}
+
+// Ledger is a log of model calls, saved to disk as one JSON record per line.
+type Ledger struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewLedger(path string) *Ledger {
+	return &Ledger{path: path}
+}
+
+// appends the record to the ledger file
+func (l *Ledger) Add(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(bytes, '\n'))
+	return err
+}
+
+// reads the records made at or after the given time. If the ledger doesn't exist yet, there are no records.
+func (l *Ledger) Records(since time.Time) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := []Record{}
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("usage ledger corrupted: %w", err)
+		}
+		if !r.Time.Before(since) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// totals of a set of model calls
+type Totals struct {
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+	Latency          time.Duration
+	Cost             float64
+}
+
+func (t *Totals) Add(r Record) {
+	t.Calls++
+	t.PromptTokens += r.PromptTokens
+	t.CompletionTokens += r.CompletionTokens
+	t.Latency += time.Duration(r.LatencyMs) * time.Millisecond
+	t.Cost += r.Cost
+}
+
+// adds another set of totals into these
+func (t *Totals) Merge(o Totals) {
+	t.Calls += o.Calls
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.Latency += o.Latency
+	t.Cost += o.Cost
+}
+
+func (t Totals) Tokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+// a group of records in a report, e.g. all the calls made on one day
+type Group struct {
+	Key string
+	Totals
+}
+
+// Adds up the records into groups by the given key. Records with an empty key are left out.
+// Groups are sorted by key.
+func GroupBy(records []Record, key func(Record) string) []Group {
+	totals := make(map[string]*Totals)
+	for _, r := range records {
+		k := key(r)
+		if k == "" {
+			continue
+		}
+		if totals[k] == nil {
+			totals[k] = &Totals{}
+		}
+		totals[k].Add(r)
+	}
+	groups := make([]Group, 0, len(totals))
+	for k, t := range totals {
+		groups = append(groups, Group{Key: k, Totals: *t})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// groups records by the local date they were made on
+func ByDay(r Record) string {
+	return r.Time.Local().Format("2006-01-02")
+}
+
+func ByTask(r Record) string {
+	if r.Task == "" {
+		return "general"
+	}
+	return r.Task
+}
+
+func ByEmail(r Record) string {
+	return r.EmailID
+}
+
+// returns the start of the current day, in local time
+func StartOfToday() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// Checks today's usage in the ledger against the daily budget. If a limit has been reached, returns true and says which one.
+func (l *Ledger) OverBudget(b config.Budget) (bool, string, error) {
+	if b.DailyTokens <= 0 && b.DailyCost <= 0 {
+		return false, "", nil
+	}
+	records, err := l.Records(StartOfToday())
+	if err != nil {
+		return false, "", err
+	}
+	today := Totals{}
+	for _, r := range records {
+		today.Add(r)
+	}
+	if b.DailyTokens > 0 && today.Tokens() >= b.DailyTokens {
+		return true, fmt.Sprintf("%v of %v daily tokens used", today.Tokens(), b.DailyTokens), nil
+	}
+	if b.DailyCost > 0 && today.Cost >= b.DailyCost {
+		return true, fmt.Sprintf("$%.4f of $%.2f daily budget spent", today.Cost, b.DailyCost), nil
+	}
+	return false, "", nil
+}
+
+type emailKey struct{}
+
+// returns a context that marks the model calls made with it as being for the given email
+func WithEmail(ctx context.Context, emailID string) context.Context {
+	return context.WithValue(ctx, emailKey{}, emailID)
+}
+
+// gets the email the context's model calls are for, if any
+func EmailFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(emailKey{}).(string)
+	return id
+}
+
+// the ledger used by the app. calls aren't recorded until it's enabled.
+var ledger *Ledger
+
+// starts recording the app's model calls to the usage ledger on disk
+func Enable() {
+	SetLedger(NewLedger(ledgerPath))
+}
+
+// sets the ledger the app's model calls are recorded to. nil stops recording.
+func SetLedger(l *Ledger) {
+	ledger = l
+}
+
+// gets the app's usage ledger, for reporting. This works even if recording isn't enabled.
+func AppLedger() *Ledger {
+	if ledger != nil {
+		return ledger
+	}
+	return NewLedger(ledgerPath)
+}
+
+// records a model call to the app's ledger, if recording is enabled
+func Add(r Record) {
+	if ledger == nil {
+		return
+	}
+	if err := ledger.Add(r); err != nil {
+		debug.Println("failed to record usage:", err)
+	}
+}
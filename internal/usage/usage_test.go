@@ -0,0 +1,95 @@
+package usage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/webbben/mail-assistant/internal/config"
+)
+
+func TestLedger(t *testing.T) {
+	l := NewLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+
+	records, err := l.Records(time.Time{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("a new ledger should be empty, got %v records, error: %v", len(records), err)
+	}
+
+	today := StartOfToday().Add(time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	add := []Record{
+		{Time: yesterday, Task: "draft", EmailID: "a", PromptTokens: 100, CompletionTokens: 50, LatencyMs: 1000, Cost: 0.01},
+		{Time: today, Task: "categorize", EmailID: "a", PromptTokens: 200, CompletionTokens: 10, LatencyMs: 500},
+		{Time: today, Task: "", PromptTokens: 20, CompletionTokens: 30, LatencyMs: 250, Cost: 0.002},
+	}
+	for _, r := range add {
+		if err := l.Add(r); err != nil {
+			t.Fatal("failed to add record:", err)
+		}
+	}
+
+	records, err = l.Records(StartOfToday())
+	if err != nil {
+		t.Fatal("failed to read records:", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records from today, got %v", len(records))
+	}
+
+	records, _ = l.Records(time.Time{})
+	days := GroupBy(records, ByDay)
+	if len(days) != 2 || days[0].Key != ByDay(add[0]) || days[1].Calls != 2 || days[1].Tokens() != 260 {
+		t.Errorf("unexpected totals per day: %+v", days)
+	}
+	emails := GroupBy(records, ByEmail)
+	if len(emails) != 1 || emails[0].Key != "a" || emails[0].Calls != 2 || emails[0].Latency != 1500*time.Millisecond {
+		t.Errorf("unexpected totals per email (records without an email should be left out): %+v", emails)
+	}
+	tasks := GroupBy(records, ByTask)
+	if len(tasks) != 3 || tasks[2].Key != "general" {
+		t.Errorf("unexpected totals per task: %+v", tasks)
+	}
+}
+
+func TestOverBudget(t *testing.T) {
+	l := NewLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+	// usage from yesterday doesn't count towards today's budget
+	l.Add(Record{Time: StartOfToday().Add(-time.Hour), PromptTokens: 10000, Cost: 10})
+	l.Add(Record{Time: time.Now(), PromptTokens: 800, CompletionTokens: 200, Cost: 0.05})
+
+	tests := []struct {
+		budget config.Budget
+		over   bool
+	}{
+		{config.Budget{}, false},
+		{config.Budget{DailyTokens: 2000}, false},
+		{config.Budget{DailyTokens: 1000}, true},
+		{config.Budget{DailyCost: 0.1}, false},
+		{config.Budget{DailyCost: 0.05}, true},
+		{config.Budget{DailyTokens: 2000, DailyCost: 0.01}, true},
+	}
+	for _, test := range tests {
+		over, reason, err := l.OverBudget(test.budget)
+		if err != nil {
+			t.Fatal("failed to check budget:", err)
+		}
+		if over != test.over {
+			t.Errorf("budget %+v: expected over = %v, got %v (%s)", test.budget, test.over, over, reason)
+		}
+		if over && reason == "" {
+			t.Errorf("budget %+v: no reason given", test.budget)
+		}
+	}
+}
+
+func TestEmailFromContext(t *testing.T) {
+	ctx := context.Background()
+	if id := EmailFromContext(ctx); id != "" {
+		t.Errorf("expected no email, got %q", id)
+	}
+	if id := EmailFromContext(WithEmail(ctx, "abc")); id != "abc" {
+		t.Errorf("expected email abc, got %q", id)
+	}
+}
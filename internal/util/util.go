@@ -2,7 +2,9 @@ package util
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -83,6 +85,75 @@ func SomeoneTalks(name string, statement string, c *color.Color) {
 	fmt.Printf(sf("\n%s: %s\n"), name, statement)
 }
 
+// TalkStream prints a statement from someone as it streams in piece by piece, highlighting "~~~" draft blocks the same way SomeoneTalks does.
+//
+// Call Write with each piece of the statement, and End once the statement is done.
+type TalkStream struct {
+	name    string
+	c       *color.Color
+	out     io.Writer
+	started bool
+	inDraft bool   // if we are currently inside a "~~~" block
+	pending string // trailing tildes held back, since they may be the start of a "~~~" split across pieces
+}
+
+func NewTalkStream(name string, c *color.Color) *TalkStream {
+	if c == nil {
+		c = color.New(color.Reset)
+	}
+	return &TalkStream{name: name, c: c, out: color.Output}
+}
+
+func (ts *TalkStream) Write(piece string) {
+	ts.start()
+	s := ts.pending + piece
+	ts.pending = ""
+	for {
+		i := strings.Index(s, "~~~")
+		if i == -1 {
+			break
+		}
+		ts.print(s[:i])
+		fmt.Fprint(ts.out, Magenta.Sprint("~~~"))
+		ts.inDraft = !ts.inDraft
+		s = s[i+3:]
+	}
+	held := len(s) - len(strings.TrimRight(s, "~"))
+	held = min(held, 2)
+	ts.print(s[:len(s)-held])
+	ts.pending = s[len(s)-held:]
+}
+
+// finishes the statement, printing anything still held back. If nothing was written, e.g. because generation failed
+// before the first token, nothing is printed, so there's no empty speaker line.
+func (ts *TalkStream) End() {
+	if !ts.started {
+		return
+	}
+	ts.print(ts.pending)
+	ts.pending = ""
+	fmt.Fprintln(ts.out)
+}
+
+func (ts *TalkStream) start() {
+	if ts.started {
+		return
+	}
+	ts.started = true
+	fmt.Fprint(ts.out, ts.c.Sprintf("\n%s: ", ts.name))
+}
+
+func (ts *TalkStream) print(s string) {
+	if s == "" {
+		return
+	}
+	if ts.inDraft {
+		fmt.Fprint(ts.out, Magenta.Sprint(s))
+	} else {
+		fmt.Fprint(ts.out, ts.c.Sprint(s))
+	}
+}
+
 func PrintlnColor(c *color.Color, a ...any) {
 	pf := c.PrintlnFunc()
 	pf(a...)
@@ -116,6 +187,14 @@ func InsertMappedValues(s string, dict map[string]string) string {
 	return s
 }
 
+// returns a context that times out after the given number of seconds. If seconds is 0 or less, the context only ends when it is cancelled.
+func WithTimeout(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
 func CurrentTime() string {
 	return time.Now().Local().Format(time.Kitchen)
 }
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestTalkStream(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	tests := []struct {
+		pieces []string
+		expOut string
+	}{
+		{
+			[]string{"Hello ", "there."},
+			Hi_blue.Sprint("\nBot: ") + Hi_blue.Sprint("Hello ") + Hi_blue.Sprint("there.") + "\n",
+		},
+		{
+			[]string{"Here: ~~~Dear", " Sir~~~", " done"},
+			Hi_blue.Sprint("\nBot: ") + Hi_blue.Sprint("Here: ") + Magenta.Sprint("~~~") + Magenta.Sprint("Dear") + Magenta.Sprint(" Sir") + Magenta.Sprint("~~~") + Hi_blue.Sprint(" done") + "\n",
+		},
+		{
+			// draft markers split across pieces
+			[]string{"A ~", "~~B~~", "~ C~"},
+			Hi_blue.Sprint("\nBot: ") + Hi_blue.Sprint("A ") + Magenta.Sprint("~~~") + Magenta.Sprint("B") + Magenta.Sprint("~~~") + Hi_blue.Sprint(" C") + Hi_blue.Sprint("~") + "\n",
+		},
+		{
+			// nothing streamed, e.g. the model call failed
+			[]string{},
+			"",
+		},
+	}
+
+	for i, test := range tests {
+		buf := new(bytes.Buffer)
+		ts := NewTalkStream("Bot", Hi_blue)
+		ts.out = buf
+		for _, piece := range test.pieces {
+			ts.Write(piece)
+		}
+		ts.End()
+		if buf.String() != test.expOut {
+			t.Errorf("case %v, wrong output. expected: %q\noutput: %q", i, test.expOut, buf.String())
+		}
+	}
+}
@@ -1,20 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 
 	"github.com/webbben/mail-assistant/internal/assistant"
-	auth "github.com/webbben/mail-assistant/internal/auth"
 	"github.com/webbben/mail-assistant/internal/config"
 	"github.com/webbben/mail-assistant/internal/debug"
 	emailcache "github.com/webbben/mail-assistant/internal/email_cache"
-	"github.com/webbben/mail-assistant/internal/gmail"
-	"github.com/webbben/mail-assistant/internal/llama"
+	"github.com/webbben/mail-assistant/internal/llm"
+	"github.com/webbben/mail-assistant/internal/mailbox"
+	"github.com/webbben/mail-assistant/internal/message"
 	"github.com/webbben/mail-assistant/internal/personality"
+	"github.com/webbben/mail-assistant/internal/spamfilter"
+	"github.com/webbben/mail-assistant/internal/types"
+	"github.com/webbben/mail-assistant/internal/usage"
 	"github.com/webbben/mail-assistant/internal/util"
 )
 
@@ -41,27 +47,68 @@ func loadPrompt(id string) string {
 	return strings.TrimSpace(string(bytes))
 }
 
-func main() {
-	// ollama
-	cmd, err := llama.StartServer()
+// saves the user's reply to the email as a draft, and records it in the cache
+func saveDraft(ctx context.Context, mb mailbox.Mailbox, appConfig config.Config, email types.Email, reply types.Reply) {
+	draftCtx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+	draftID, err := mb.CreateDraft(draftCtx, email, reply)
+	cancel()
 	if err != nil {
-		log.Fatal("failed to start ollama server:", err)
+		log.Println("failed to save draft:", err)
+		return
 	}
-	defer llama.StopServer(cmd)
-	ollamaClient, err := llama.GetClient()
-	if err != nil {
-		log.Fatal("failed to get ollama client:", err)
+	emailcache.AddDraftToCache(email, draftID)
+	spamfilter.Learn(email, false)
+	markHandled(ctx, mb, appConfig, email, types.DRAFTED)
+	util.SomeoneTalks("SYS", "reply to "+email.From+" saved as a draft", util.Gray)
+}
+
+// applies the label for how the email was handled. failing to label isn't worth stopping for, so errors are just logged.
+func markHandled(ctx context.Context, mb mailbox.Mailbox, appConfig config.Config, email types.Email, action string) {
+	ctx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+	defer cancel()
+	if err := mb.MarkHandled(ctx, email.ID, action); err != nil {
+		log.Println("failed to label email:", err)
 	}
+}
+
+func main() {
+	noCache := flag.Bool("no-llm-cache", false, "don't use cached model outputs for this run (new outputs are still cached)")
+	rebuildCache := flag.Bool("rebuild-cache", false, "add the emails labeled as replied or ignored to the email cache (done automatically if the cache file is missing and labels are enabled)")
+	flag.Parse()
 
 	// app config
 	appConfig, err := loadConfig()
 	if err != nil {
 		log.Fatal("failed to load config json:", err)
 	}
+	if *noCache {
+		appConfig.LLM.Cache.Bypass = true
+	}
 	debug.SetDebugMode(appConfig.Debug)
 
-	// Oauth + Gmail setup
-	srv := auth.GetGmailService()
+	// record model usage, for the usage report and daily budget
+	usage.Enable()
+
+	ctx := context.Background()
+
+	// LLM provider
+	if appConfig.LLM.Provider == "" || appConfig.LLM.Provider == llm.OLLAMA {
+		server, err := llm.StartOllama(ctx, appConfig.LLM)
+		if err != nil {
+			log.Fatal("failed to start ollama server:", err)
+		}
+		defer server.Stop()
+	}
+	provider, err := llm.NewProvider(appConfig)
+	if err != nil {
+		log.Fatal("failed to get llm provider:", err)
+	}
+
+	// mailbox: gmail (oauth setup, and the inbox sync picking up where the last run left off) or imap
+	mb, err := mailbox.New(appConfig)
+	if err != nil {
+		log.Fatal("failed to set up mailbox:", err)
+	}
 
 	// load personality file
 	p, err := personality.Load(appConfig.PersonalityID)
@@ -70,17 +117,39 @@ func main() {
 		// TODO use default personality
 	}
 	emailReplyPrompt := loadPrompt(p.Prompts.EmailWorkflow)
+	composePrompt := loadPrompt(p.Prompts.Compose)
 
-	// Load email cache
+	// Load email cache. If it's lost, it can be rebuilt from the labels on the emails in the mailbox.
 	if err := emailcache.LoadCacheFromDisk(); err != nil {
 		log.Println("failed to load cache:", err)
+		if errors.Is(err, os.ErrNotExist) && appConfig.Labels.Enabled {
+			*rebuildCache = true
+		}
+	}
+	if *rebuildCache {
+		count, err := mb.RebuildCache(ctx)
+		if err != nil {
+			log.Println("failed to rebuild cache from labels:", err)
+		}
+		debug.Println("restored", count, "emails to the cache from labels")
+	}
+
+	// Load spam filter, and catch it up on decisions made since it was last saved
+	if err := spamfilter.LoadModelFromDisk(); err != nil {
+		log.Println("failed to load spam model:", err)
+	}
+	if spamfilter.IsEmpty() {
+		if _, err := spamfilter.LearnFromSeedCorpus(); err != nil {
+			log.Println("failed to train spam model on corpus:", err)
+		}
 	}
+	debug.Println("spam filter learned from", spamfilter.LearnFromCache(emailcache.Entries()), "new cached decisions")
 
 	for {
-		// check gmail inbox
+		// check inbox
 		util.ClearScreen()
 		util.SomeoneTalks("SYS", "Loading your emails from your inbox. This may take a minute...", util.Gray)
-		emails := gmail.GetEmails(srv, ollamaClient, appConfig)
+		emails := mailbox.GetEmails(ctx, mb, appConfig)
 		if len(emails) > 0 {
 			util.SomeoneTalks("SYS", "Emails found:", util.Gray)
 			for _, email := range emails {
@@ -97,12 +166,14 @@ func main() {
 		if len(emails) > 0 && util.PromptYN("Go through these emails now?") {
 			util.ClearScreen()
 			fmt.Printf("%s enters the room, approaching to convey a message for you.\n", p.Name)
-			util.SomeoneTalks(p.Name, p.GenPhrase(ollamaClient, "greeting"), util.Hi_blue)
+			p.SayPhrase(ctx, provider, "greeting")
 			fmt.Printf("(To dismiss %s at any time, enter 'q' in the prompt)\n\n", p.Name)
 			for _, email := range emails {
-				emailReply := assistant.GetResponseInteractive(email, emailReplyPrompt, ollamaClient, appConfig, p)
+				emailReply, draft, replyAll := assistant.GetResponseInteractive(ctx, mb, email, emailReplyPrompt, provider, appConfig, p)
 				if emailReply == "<<SKIP>>" {
-					emailcache.AddToCache(email, emailcache.IGNORE)
+					emailcache.AddToCache(email, emailcache.IGNORE, emailcache.USER)
+					spamfilter.Learn(email, true)
+					markHandled(ctx, mb, appConfig, email, types.IGNORED)
 					continue
 				}
 				if emailReply == "" {
@@ -112,21 +183,45 @@ func main() {
 				if emailReply == "<<QUIT>>" {
 					break
 				}
-				if err := gmail.SendReply(srv, appConfig.GmailAddr, email, emailReply); err != nil {
+				if emailReply == "<<FORWARDED>>" {
+					util.ClearScreen()
+					continue
+				}
+				reply := message.NewReply(email, emailReply, replyAll, appConfig.OwnAddresses())
+				reply.Style = p.ReplyStyle
+				if draft {
+					saveDraft(ctx, mb, appConfig, email, reply)
+					util.ClearScreen()
+					continue
+				}
+				sendCtx, cancel := util.WithTimeout(ctx, appConfig.MailTimeout())
+				err := mb.SendReply(sendCtx, email, reply)
+				cancel()
+				if err != nil {
 					log.Println("failed to send reply:", err)
 				} else {
 					emailcache.AddToCache(email, emailcache.REPLY)
+					spamfilter.Learn(email, false)
+					markHandled(ctx, mb, appConfig, email, types.REPLIED)
 					util.SomeoneTalks("SYS", "email successfully sent to "+email.From, util.Gray)
 				}
 				util.ClearScreen()
 			}
-			util.SomeoneTalks(p.Name, p.GenPhrase(ollamaClient, "dismiss"), util.Hi_blue)
+			p.SayPhrase(ctx, provider, "dismiss")
 		}
 
 		emailcache.RemoveOldEntries(appConfig.LookbackDays)
 		if err := emailcache.WriteCacheToDisk(); err != nil {
 			log.Println("failed to write cache:", err)
 		}
-		assistant.WaitForNextSummon(srv, ollamaClient, appConfig, *p)
+		if err := spamfilter.WriteModelToDisk(); err != nil {
+			log.Println("failed to write spam model:", err)
+		}
+		for assistant.WaitForNextSummon(ctx, mb, provider, appConfig, *p) == assistant.COMPOSE {
+			util.ClearScreen()
+			if err := assistant.Compose(ctx, mb, provider, appConfig, p, composePrompt, ""); err != nil {
+				log.Println("failed to compose email:", err)
+			}
+		}
 	}
 }
@@ -0,0 +1,141 @@
+package emailparse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// a file attached to an email
+type Attachment struct {
+	PartID    string // ID of the MIME part holding the attachment, numbered the way gmail numbers them (e.g. "1", or "1.0" for the first part inside the second)
+	Filename  string
+	MimeType  string
+	Size      int    // size of the decoded content, in bytes
+	ContentID string // Content-ID of the part, without angle brackets. set for inline parts the HTML refers to, like images
+	Inline    bool   // shown inside the email, rather than attached to it
+}
+
+// Finds the attachments in the raw email. The text and HTML bodies of the email aren't attachments, unless they're given a filename.
+// Attached emails (message/rfc822) are listed as attachments, without looking inside them.
+func ParseAttachments(rawEmail string) ([]Attachment, error) {
+	entity, err := message.Read(strings.NewReader(rawEmail))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, errors.Join(errors.New("failed to read message"), err)
+	}
+	attachments := make([]Attachment, 0)
+	err = walkParts(entity, "", &attachments)
+	return attachments, err
+}
+
+// looks through the entity and any parts inside it for attachments
+func walkParts(entity *message.Entity, partID string, attachments *[]Attachment) error {
+	if mr := entity.MultipartReader(); mr != nil {
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+				return errors.Join(errors.New("failed to read part"), err)
+			}
+			childID := fmt.Sprint(i)
+			if partID != "" {
+				childID = partID + "." + childID
+			}
+			if err := walkParts(part, childID, attachments); err != nil {
+				return err
+			}
+		}
+	}
+	attachment, ok := asAttachment(entity.Header)
+	if !ok {
+		return nil
+	}
+	size, err := io.Copy(io.Discard, entity.Body)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to read attachment %s", attachment.Filename), err)
+	}
+	attachment.PartID = partID
+	attachment.Size = int(size)
+	*attachments = append(*attachments, attachment)
+	return nil
+}
+
+// Gets the decoded content of the part with the given part ID, numbered the same way as in ParseAttachments.
+func ReadAttachment(rawEmail string, partID string) ([]byte, error) {
+	entity, err := message.Read(strings.NewReader(rawEmail))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, errors.Join(errors.New("failed to read message"), err)
+	}
+	for _, index := range strings.Split(partID, ".") {
+		mr := entity.MultipartReader()
+		if mr == nil {
+			return nil, fmt.Errorf("part %s not found", partID)
+		}
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, fmt.Errorf("part %s not found", partID)
+			}
+			if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+				return nil, errors.Join(errors.New("failed to read part"), err)
+			}
+			if fmt.Sprint(i) == index {
+				entity = part
+				break
+			}
+		}
+	}
+	return io.ReadAll(entity.Body)
+}
+
+// gets the attachment info from a part's header, if the part is an attachment
+func asAttachment(header message.Header) (Attachment, bool) {
+	mediaType, typeParams, _ := header.ContentType()
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	disposition, dispParams, _ := header.ContentDisposition()
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = typeParams["name"]
+	}
+	contentID := strings.Trim(header.Get("Content-Id"), "<> ")
+
+	isBody := strings.HasPrefix(mediaType, "text/") && filename == "" && disposition != "attachment"
+	if isBody {
+		return Attachment{}, false
+	}
+	// e.g. a calendar invite's alternative part, without a name or disposition
+	if filename == "" && disposition == "" && contentID == "" && mediaType != "message/rfc822" && !strings.HasPrefix(mediaType, "application/") {
+		return Attachment{}, false
+	}
+	if filename == "" {
+		filename = defaultFilename(mediaType)
+	} else if decoded, err := decodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	return Attachment{
+		Filename:  filename,
+		MimeType:  mediaType,
+		ContentID: contentID,
+		Inline:    disposition == "inline" || (disposition == "" && contentID != ""),
+	}, true
+}
+
+// makes up a filename for an attachment that wasn't given one
+func defaultFilename(mediaType string) string {
+	if mediaType == "message/rfc822" {
+		return "attached-email.eml"
+	}
+	ext := ""
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	return "attachment" + ext
+}
@@ -138,6 +138,19 @@ func extractPlainText(body io.Reader, contentType string, encoding string) (stri
 	return "", fmt.Errorf("no plain text content found: " + mediaType)
 }
 
+// Gets the text of a part that's already been decoded from its transfer encoding (like the parts gmail gives in the full format),
+// converting it to UTF-8. HTML is turned into plain text.
+func DecodeText(data []byte, contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to parse media type"), err)
+	}
+	if mediaType == "text/html" {
+		return parseHTML(bytes.NewReader(data)), nil
+	}
+	return parsePlainText(bytes.NewReader(data), "", params["charset"])
+}
+
 func parsePlainText(body io.Reader, encoding string, charset string) (string, error) {
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(body)
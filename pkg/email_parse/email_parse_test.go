@@ -69,3 +69,77 @@ func TestParseEmail(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAttachments(t *testing.T) {
+	raw, err := os.ReadFile("tests/attachments.txt")
+	if err != nil {
+		t.Fatal("failed to load test email:", err)
+	}
+	// the test file has plain line breaks, but emails have CRLF
+	attachments, err := ParseAttachments(strings.ReplaceAll(string(raw), "\n", "\r\n"))
+	if err != nil {
+		t.Fatal("failed to parse attachments:", err)
+	}
+	want := []Attachment{
+		{PartID: "0.1", Filename: "attachment.png", MimeType: "image/png", Size: 8, ContentID: "logo@example.com", Inline: true},
+		{PartID: "1", Filename: "invoice-june.pdf", MimeType: "application/pdf", Size: 52},
+		{PartID: "2", Filename: "détails.csv", MimeType: "text/csv", Size: 41},
+		{PartID: "3", Filename: "attached-email.eml", MimeType: "message/rfc822", Size: 84},
+	}
+	if len(attachments) != len(want) {
+		t.Fatalf("expected %v attachments, got %+v", len(want), attachments)
+	}
+	for i := range want {
+		if attachments[i] != want[i] {
+			t.Errorf("attachment %v: expected %+v, got %+v", i, want[i], attachments[i])
+		}
+	}
+
+	for _, part := range []struct {
+		id   string
+		want string
+	}{
+		{"1", "%PDF-1.4"},
+		{"0.1", "\x89PNG"},
+		{"3", "From: Bob <bob@example.com>"},
+	} {
+		content, err := ReadAttachment(strings.ReplaceAll(string(raw), "\n", "\r\n"), part.id)
+		if err != nil {
+			t.Errorf("failed to read part %s: %v", part.id, err)
+		} else if !strings.HasPrefix(string(content), part.want) {
+			t.Errorf("part %s: expected content starting with %q, got %q", part.id, part.want, content)
+		}
+	}
+	if _, err := ReadAttachment(string(raw), "9"); err == nil {
+		t.Error("expected an error for a missing part")
+	}
+
+	// emails without attachments
+	for i, test := range loadTestCases() {
+		if _, err := ParseAttachments(test.raw); err != nil {
+			t.Errorf("case %v: failed to parse attachments: %v", i, err)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		data        string
+		contentType string
+		want        string
+	}{
+		{"See you at noon.\r\n", `text/plain; charset="utf-8"`, "See you at noon."},
+		{"caf\xe9 at noon", "text/plain; charset=iso-8859-1", "café at noon"},
+		{"<p>See you at <b>noon</b> &amp; bring snacks</p>", "text/html", "See you at noon & bring snacks"},
+	}
+	for _, test := range tests {
+		got, err := DecodeText([]byte(test.data), test.contentType)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.data, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.data, test.want, got)
+		}
+	}
+}